@@ -3,13 +3,13 @@ module github.com/jimsnab/go-treestore-client
 go 1.21
 
 require (
+	github.com/Knetic/govaluate v3.0.0+incompatible
 	github.com/jimsnab/go-lane v1.18.1
 	github.com/jimsnab/go-treestore v0.0.0-20240321183110-a5b905356f5b
 	github.com/jimsnab/go-treestore-cmdline v0.0.0-20240321185226-1abb8f5e5b74
 )
 
 require (
-	github.com/Knetic/govaluate v3.0.0+incompatible // indirect
 	github.com/djherbis/atime v1.1.0 // indirect
 	github.com/google/uuid v1.6.0 // indirect
 	github.com/jimsnab/go-cmdline v1.6.0 // indirect
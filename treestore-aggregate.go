@@ -0,0 +1,80 @@
+package treestore_client
+
+import (
+	"fmt"
+	"math"
+)
+
+type (
+	// The operation of AggregateKeyValues.
+	AggregateOp int
+)
+
+const (
+	AggregateSum AggregateOp = iota
+	AggregateMin
+	AggregateMax
+	AggregateAvg
+	AggregateCount
+)
+
+func (op AggregateOp) String() string {
+	switch op {
+	case AggregateSum:
+		return "sum"
+	case AggregateMin:
+		return "min"
+	case AggregateMax:
+		return "max"
+	case AggregateAvg:
+		return "avg"
+	case AggregateCount:
+		return "count"
+	}
+	return "unknown"
+}
+
+// Computes `op` over the numeric values of the keys matching `skPattern`, and
+// returns the result along with the number of values it covers. Values that
+// aren't numbers are skipped; when there are no numeric values, the result
+// is 0 (and count is 0). The computation is in float64, so large integers
+// may lose precision.
+//
+// The server has no aggregation, so the values are streamed a page at a time
+// and combined by the client, which keeps only the running result.
+func (tsc *tsClient) AggregateKeyValues(skPattern StoreKey, op AggregateOp) (result float64, count int, err error) {
+	if op < AggregateSum || op > AggregateCount {
+		err = fmt.Errorf("unknown aggregate operation %d", op)
+		return
+	}
+
+	var sum float64
+	low, high := math.Inf(1), math.Inf(-1)
+	err = tsc.GetMatchingKeyValuesStream(skPattern, func(kvm *KeyValueMatch) bool {
+		number, isNumber := numericValue(kvm.CurrentValue)
+		if isNumber {
+			count++
+			sum += number
+			low = math.Min(low, number)
+			high = math.Max(high, number)
+		}
+		return true
+	})
+	if err != nil || count == 0 {
+		return
+	}
+
+	switch op {
+	case AggregateSum:
+		result = sum
+	case AggregateMin:
+		result = low
+	case AggregateMax:
+		result = high
+	case AggregateAvg:
+		result = sum / float64(count)
+	case AggregateCount:
+		result = float64(count)
+	}
+	return
+}
@@ -1,6 +1,10 @@
 package treestore_client
 
 import (
+	"context"
+	"errors"
+	"io"
+	"math/big"
 	"time"
 
 	"github.com/jimsnab/go-treestore"
@@ -23,7 +27,34 @@ type (
 	JsonOptions        = treestore.JsonOptions
 	AutoLinkDefinition = treestore.AutoLinkDefinition
 
-	TSClient interface {
+	KeyValuePair struct {
+		Sk    StoreKey
+		Value any
+	}
+
+	SetKeyValueResult struct {
+		Address    StoreAddress
+		FirstValue bool
+	}
+
+	GetKeyValueResult struct {
+		Value       any
+		KeyExists   bool
+		ValueExists bool
+		ValueIsNil  bool // the key has a null value (see SetKeyValueNil)
+	}
+
+	// The key (and value) found at an address by KeysFromAddresses or
+	// KeyValuesFromAddresses.
+	AddressResult struct {
+		Sk          StoreKey
+		KeyExists   bool
+		ValueExists bool // always false for KeysFromAddresses
+		Value       any
+	}
+
+	// Manages the client's connection to the server and the options of the client.
+	Connection interface {
 		// Closes the connection to the TreeStore server, if one is open.
 		Close() error
 
@@ -31,6 +62,231 @@ type (
 		// next API call.
 		SetServer(host string, port int)
 
+		// Replaces the function used to connect to the server, for example with
+		// one made by NewFaultInjectingDialer. The current connection is closed.
+		// Specify nil to restore the default TCP dialer.
+		SetDialer(dial Dialer)
+
+		// Configures the server the client switches to when its current server
+		// drains. After a switch, the drained server becomes the standby, so the
+		// client can switch back when the other server restarts. Specify an empty
+		// host to remove the standby.
+		//
+		// The server doesn't announce that it is shutting down, so the client
+		// only switches when Drain is called; server errors never cause a
+		// switch.
+		SetStandbyServer(host string, port int)
+
+		// Switches the client to the standby server: new commands wait, commands
+		// in flight finish, the connection to the current server is closed, and
+		// then the waiting commands are sent to the standby server. Returns
+		// ErrNoStandby if SetStandbyServer wasn't called.
+		Drain() (err error)
+
+		// Returns a client that shares this client's connection, but with its
+		// behavior adjusted by `opts`: see ClientTimeout, ClientLane,
+		// ClientReadOnly, ClientKeyPrefix, ClientRetries, ClientLockWarning,
+		// ClientBase64Threshold, ClientMaxRequestSize, ClientTouchOnRead and
+		// ClientInterceptors.
+		// Settings not overridden are inherited from this client. Closing either
+		// client closes the shared connection, which is re-established by the
+		// next command.
+		With(opts ...ClientOption) TSClient
+
+		// Establishes the connection to the server ahead of the first command, so
+		// that the first request doesn't pay the dial latency. The client uses a
+		// single connection; if it is already connected, Connect returns
+		// immediately. The dial is canceled if ctx is done.
+		Connect(ctx context.Context) (err error)
+
+		// Limits the number of commands that can wait for the connection while
+		// another command is in flight. Commands beyond the limit fail immediately
+		// with ErrBusy. Specify 0 for no limit (the default).
+		SetRequestQueueLimit(maxQueued int)
+
+		// Limits the number of async commands waiting to be sent. Async
+		// commands beyond the limit resolve immediately with ErrQueueFull.
+		// Specify 0 for no limit (the default).
+		SetAsyncQueueLimit(maxQueued int)
+
+		// Installs a circuit breaker that opens after `threshold` consecutive
+		// commands fail to reach the server or get a response. While open,
+		// commands fail with ErrCircuitOpen; after `cooldown`, one command tests
+		// the server and closes the circuit if it gets a response. `onChange` is
+		// invoked on each change of state. Specify a `threshold` of 0 to remove
+		// the breaker.
+		SetCircuitBreaker(threshold int, cooldown time.Duration, onChange CircuitStateHandler)
+
+		// Returns the state of the circuit breaker; CircuitClosed when there is
+		// no breaker.
+		GetCircuitState() CircuitState
+
+		// Limits the rate of commands and of request bytes sent by the client,
+		// allowing bursts of up to one second of each rate. Commands over the
+		// limit wait, or with `failFast` fail with ErrRateLimited. Specify 0
+		// for a rate to leave it unlimited.
+		SetRateLimit(commandsPerSec, bytesPerSec float64, failFast bool)
+
+		// Sends a read command again on a second connection if it hasn't been
+		// answered after `after`, and uses the first response, to cut the
+		// latency of reads held up by a slow command or connection. Specify 0
+		// to stop hedging.
+		SetHedgedReads(after time.Duration)
+
+		// Registers a profile of behavior for the keys under `prefixSk`, such as a
+		// response timeout or a value codec, or removes the profile when `profile`
+		// is nil. The profile with the longest matching prefix applies. Profiles
+		// are shared with clients derived by With().
+		SetProfile(prefixSk StoreKey, profile *ClientProfile)
+
+		// Starts or stops collecting the sizes of values written and read under
+		// `prefixSk`, to find the prefixes holding large values.
+		TrackValueSizes(prefixSk StoreKey, track bool)
+
+		// Returns the count, median, 95th percentile and maximum size of the
+		// values written and read under each prefix tracked by TrackValueSizes.
+		// Percentiles are estimated from a random sample of the values.
+		GetValueSizeStats() (stats []ValueSizeStats)
+
+		// Clears the statistics collected by TrackValueSizes.
+		ResetValueSizeStats()
+
+		// Installs a cache for the json projections returned by GetKeyAsJson,
+		// GetKeyAsJsonBytes and GetKeyAsJsonBase64 (see NewJsonCache), or
+		// removes it when `cache` is nil. Writes made through this client
+		// invalidate the projections of the keys they name; writes by other
+		// clients do not, and neither do the auto-link index keys the server
+		// updates as a side effect of a write.
+		SetJsonCache(cache JsonCache)
+
+		// Discards the cached json projections affected by a change to `sk`,
+		// for use when another client is known to have changed it, or when the
+		// server changed it as a side effect, such as an auto-link index.
+		InvalidateJsonCache(sk StoreKey)
+
+		// Calls the treestore sending in value-escaped arguments, and receiving back a map parsed
+		// from the json response. Errors are wrapped with the command name, its key and the
+		// server address, such as "getv /the/key on localhost:6770: ...".
+		RawCommand(valueEscapedArgs ...string) (response map[string]any, err error)
+
+		// Queues a raw command and returns immediately with a future for the
+		// response. See SetKeyValueAsync.
+		RawCommandAsync(valueEscapedArgs ...string) *Future[map[string]any]
+	}
+
+	// Reads keys and their values.
+	KeyReader interface {
+		// Looks up the key in the index and returns true if it exists and has value history.
+		IsKeyIndexed(sk StoreKey) (address StoreAddress, exists bool, err error)
+
+		// Walks the tree level by level and returns the current address, whether or not
+		// the key path is indexed. This avoids putting a lock on the index, but will lock
+		// tree levels while walking the tree.
+		LocateKey(sk StoreKey) (address StoreAddress, exists bool, err error)
+
+		// Returns true if the key exists, for existence checks that don't need the
+		// address. Like LocateKey, it walks the tree rather than locking the index.
+		KeyExists(sk StoreKey) (exists bool, err error)
+
+		// Navigates to the valueInstance key node and returns the expiration time in Unix nanoseconds, or
+		// -1 if the key path does not exist.
+		GetKeyTtl(sk StoreKey) (ttl *time.Time, err error)
+
+		// Looks up the key in the index and returns the current value and flags
+		// that indicate if the key was set, and if so, if it has a value.
+		//
+		// A key with a null value (see SetKeyValueNil) returns a nil value with
+		// `valueExists` true, while a key without a value returns `valueExists`
+		// false.
+		GetKeyValue(sk StoreKey) (value any, keyExists, valueExists bool, err error)
+
+		// Looks up the key and returns the bytes of its current value as base64
+		// text, whatever the value type, without converting them to a Go value.
+		// This is a convenience wrapper; the value still travels with value
+		// escaping, and is encoded as base64 by the client.
+		GetKeyValueBase64(sk StoreKey) (b64 string, keyExists, valueExists bool, err error)
+
+		// Returns the value of `sk` as a big integer, converting integer values
+		// and decimal text. Big integers are stored with SetKeyValue, as decimal
+		// text. `exists` is false if the key has no value.
+		GetKeyValueBigInt(sk StoreKey) (value *big.Int, exists bool, err error)
+
+		// Returns the value of `sk` as a big float, converting numeric values and
+		// decimal text. Big floats are stored with SetKeyValue, as the shortest
+		// decimal text that identifies the value at its precision. `exists` is
+		// false if the key has no value.
+		GetKeyValueBigFloat(sk StoreKey) (value *big.Float, exists bool, err error)
+
+		// Queues a GetKeyValue and returns immediately with a future for the
+		// result. See SetKeyValueAsync.
+		GetKeyValueAsync(sk StoreKey) *Future[GetKeyValueResult]
+
+		// Looks up many keys, returning the value and existence flags for each
+		// key in the order of `sks`. The lookups are sent back to back on the
+		// connection, as the server does not have a multi-get command.
+		GetKeyValues(sks []StoreKey) (results []GetKeyValueResult, err error)
+
+		// Looks up the key and returns the expiration time in Unix nanoseconds, or
+		// -1 if the key value does not exist.
+		GetKeyValueTtl(sk StoreKey) (ttl *time.Time, err error)
+
+		// Looks up the key in the index and scans history for the specified Unix ns tick,
+		// returning the value at that moment in time, if one exists.
+		//
+		// To specify a relative time, specify `tickNs` as the negative ns from the current
+		// time, e.g., -1000000000 is one second ago.
+		GetKeyValueAtTime(sk StoreKey, when *time.Time) (value any, exists bool, err error)
+
+		// Returns the values of `sk` set from `from` through `to`, inclusive,
+		// oldest first. A zero `from` or `to` leaves that end of the range open.
+		// The key is exported to find the value history, so this is best used on
+		// leaf keys.
+		GetKeyValuesInRange(sk StoreKey, from, to time.Time) (values []TimedValue, err error)
+
+		// Converts an address to a store key
+		KeyFromAddress(addr StoreAddress) (sk StoreKey, exists bool, err error)
+
+		// Fetches the current value by address
+		KeyValueFromAddress(addr StoreAddress) (keyExists, valueExists bool, sk StoreKey, value any, err error)
+
+		// Converts many addresses to store keys, in the order of `addrs`. The
+		// lookups are sent back to back on the connection, as the server does
+		// not have a multi-address command; repeated addresses are looked up
+		// once, and zero addresses not at all.
+		KeysFromAddresses(addrs []StoreAddress) (results []AddressResult, err error)
+
+		// Fetches the keys and current values of many addresses, in the order
+		// of `addrs`, as KeysFromAddresses does for keys.
+		KeyValuesFromAddresses(addrs []StoreAddress) (results []AddressResult, err error)
+
+		// Retreives a value by following a relationship link. The target value is
+		// returned in `rv`, and will be nil if the target doesn't exist. The
+		// `hasLink` flag indicates true when a relationship is stored at the
+		// specified `relationshipIndex`.
+		GetRelationshipValue(sk StoreKey, relationshipIndex int) (hasLink bool, rv *RelationshipValue, err error)
+
+		// Returns all of the relationships of `sk` and the keys and values they
+		// link to, without probing GetRelationshipValue index by index.
+		// `values` parallels `addresses`; an entry is nil if the slot is empty
+		// or the target doesn't exist. Both are nil if `sk` doesn't exist.
+		GetRelationships(sk StoreKey) (addresses []StoreAddress, values []*RelationshipValue, err error)
+
+		// Follows the relationship of `sk` named with SetRelationshipByName.
+		// `hasLink` is false if the name isn't defined or its slot is empty.
+		GetRelationshipValueByName(sk StoreKey, name string) (hasLink bool, rv *RelationshipValue, err error)
+
+		// Returns the index of the relationship slot of `sk` named `name`.
+		GetRelationshipIndex(sk StoreKey, name string) (index int, named bool, err error)
+
+		// Begins a consistent, point-in-time view of the subtree at `sk`, for
+		// reports that make several reads. The subtree is copied with a single
+		// export, which the server makes under an exclusive lock. Close the
+		// snapshot to release the copy.
+		BeginSnapshot(sk StoreKey) (snap *Snapshot, err error)
+	}
+
+	// Creates, modifies and deletes keys and their values.
+	KeyWriter interface {
 		// Set a key without a value and without an expiration, doing nothing if the
 		// key already exists. The key index is not altered.
 		SetKey(sk StoreKey) (address StoreAddress, exists bool, err error)
@@ -45,8 +301,38 @@ type (
 
 		// Set a key with a value, without an expiration, adding to value history if the
 		// key already exists.
+		//
+		// Float values are sent with full precision, including NaN and the
+		// infinities. (This version of the server parses float64 values with
+		// single precision; json numbers, such as those set by SetKeyJson, keep
+		// full precision.)
 		SetKeyValue(sk StoreKey, value any) (address StoreAddress, firstValue bool, err error)
 
+		// Sets the value of a key to null, which GetKeyValue distinguishes from a
+		// key without a value. The key is created if necessary, and its children
+		// are kept. The value history is replaced and the expiration is removed.
+		SetKeyValueNil(sk StoreKey) (address StoreAddress, err error)
+
+		// Set a key with a value given as base64 text, without an expiration,
+		// adding to value history if the key already exists. The value is stored
+		// as bytes. This is a convenience wrapper; the client decodes the base64
+		// and the bytes still travel with value escaping.
+		SetKeyValueBase64(sk StoreKey, b64 string) (address StoreAddress, firstValue bool, err error)
+
+		// Queues a SetKeyValue and returns immediately with a future for the
+		// result. Queued commands are sent in order by a single worker per
+		// connection, so many commands can be outstanding without a goroutine
+		// per call.
+		SetKeyValueAsync(sk StoreKey, value any) *Future[SetKeyValueResult]
+
+		// Sets the values of many keys in the order of `pairs`, returning the
+		// address and first value flag for each, as a best-effort batch. The
+		// server does not have a multi-set command, so the values are set one
+		// at a time, and the operation is not atomic. The first error stops the
+		// operation partway, and `results` holds the outcome of the values
+		// already set, which are not rolled back.
+		SetKeyValuesBestEffort(pairs []KeyValuePair) (results []SetKeyValueResult, err error)
+
 		// Ensures a key exists, optionally sets a value, optionally sets or removes key expiration, and
 		// optionally replaces the relationships array.
 		//
@@ -69,40 +355,67 @@ type (
 		// removes all relationships. Specify nil to retain the current key relationships.
 		SetKeyValueEx(sk StoreKey, value any, flags SetExFlags, expire *time.Time, relationships []StoreAddress) (address StoreAddress, exists bool, originalValue any, err error)
 
-		// Looks up the key in the index and returns true if it exists and has value history.
-		IsKeyIndexed(sk StoreKey) (address StoreAddress, exists bool, err error)
+		// Stores `addr` in a new relationship slot of `sk`, after the last slot
+		// in use, and returns its index. The relationship array is read and
+		// written back under a lock on the key, which serializes the
+		// relationship helpers but not direct writes of the array, such as by
+		// SetKeyValueEx.
+		AddRelationship(sk StoreKey, addr StoreAddress) (index int, exists bool, err error)
 
-		// Walks the tree level by level and returns the current address, whether or not
-		// the key path is indexed. This avoids putting a lock on the index, but will lock
-		// tree levels while walking the tree.
-		LocateKey(sk StoreKey) (address StoreAddress, exists bool, err error)
+		// Empties the first relationship slot of `sk` that holds `addr`,
+		// leaving the indexes of the other relationships unchanged.
+		RemoveRelationship(sk StoreKey, addr StoreAddress) (removed bool, err error)
 
-		// Navigates to the valueInstance key node and returns the expiration time in Unix nanoseconds, or
-		// -1 if the key path does not exist.
-		GetKeyTtl(sk StoreKey) (ttl *time.Time, err error)
+		// Empties relationship slot `index` of `sk`, returning the address it
+		// held, leaving the indexes of the other relationships unchanged.
+		RemoveRelationshipAt(sk StoreKey, index int) (addr StoreAddress, err error)
+
+		// Stores `addr` in the relationship slot of `sk` named `name`, so that
+		// code doesn't hardcode slot indexes. A new name is given the next
+		// free slot, recorded in the metadata attribute
+		// RelationshipNamePrefix + `name` of `sk`.
+		SetRelationshipByName(sk StoreKey, name string, addr StoreAddress) (index int, exists bool, err error)
+
+		// Atomically replaces the value of `sk` and returns the value it replaced,
+		// or nil if the key had no value. The key's expiration is removed.
+		GetSetKeyValue(sk StoreKey, newValue any) (address StoreAddress, originalValue any, err error)
+
+		// Sets a key's value only if its current value matches `expectedValue`. Specify
+		// nil for `expectedValue` to require that the key has no value.
+		//
+		// When the current value doesn't match, no change is made, `swapped` is false
+		// and `actualValue` holds the current value. When it matches, `actualValue`
+		// holds the value that was replaced. The key's expiration is kept.
+		//
+		// The comparison is made by the client while it holds a lock on the key, so
+		// the swap is atomic with respect to other SetKeyValueCAS calls, but not to
+		// plain writes such as SetKeyValue.
+		SetKeyValueCAS(sk StoreKey, expectedValue, newValue any) (swapped bool, actualValue any, err error)
 
 		// Navigates to the valueInstance key node and sets the expiration time in Unix nanoseconds.
 		// Specify nil for no expiration.
 		SetKeyTtl(sk StoreKey, expiration *time.Time) (exists bool, err error)
 
-		// Looks up the key in the index and returns the current value and flags
-		// that indicate if the key was set, and if so, if it has a value.
-		GetKeyValue(sk StoreKey) (value any, keyExists, valueExists bool, err error)
+		// Sets the expiration of the key node to `extendBy` from now, as with a
+		// sliding expiration, returning whether the key exists. See also
+		// ClientTouchOnRead.
+		TouchKey(sk StoreKey, extendBy time.Duration) (exists bool, err error)
 
-		// Looks up the key and returns the expiration time in Unix nanoseconds, or
-		// -1 if the key value does not exist.
-		GetKeyValueTtl(sk StoreKey) (ttl *time.Time, err error)
+		// Removes the expiration of the key node, returning whether it had one.
+		PersistKey(sk StoreKey) (hadTtl bool, err error)
+
+		// Sets the expiration of every key matching `skPattern`, or clears it when
+		// `expiration` is nil, returning the number of keys updated. The matches
+		// are collected first, then updated one at a time; the operation is not
+		// atomic.
+		SetTtlMatching(skPattern StoreKey, expiration *time.Time) (updated int, err error)
 
 		// Looks up the key and sets the expiration time in Unix nanoseconds. Specify
 		// 0 to clear the expiration.
 		SetKeyValueTtl(sk StoreKey, expiration *time.Time) (exists bool, err error)
 
-		// Looks up the key in the index and scans history for the specified Unix ns tick,
-		// returning the value at that moment in time, if one exists.
-		//
-		// To specify a relative time, specify `tickNs` as the negative ns from the current
-		// time, e.g., -1000000000 is one second ago.
-		GetKeyValueAtTime(sk StoreKey, when *time.Time) (value any, exists bool, err error)
+		// Removes the expiration of the key's value, returning whether it had one.
+		PersistKeyValue(sk StoreKey) (hadTtl bool, err error)
 
 		// Deletes an indexed key that has a value, including its value history, and its metadata.
 		// Specify `clean` as `true` to delete parent key nodes that become empty, or `false` to only
@@ -135,6 +448,121 @@ type (
 		// The sentinal (root) key node cannot be deleted; only its value can be cleared.
 		DeleteKeyTree(sk StoreKey) (removed bool, err error)
 
+		// Deletes a key and all of its child data, and empties or removes the
+		// relationship slots of other keys that link into the deleted subtree,
+		// returning the keys that were changed. The server doesn't keep a
+		// reverse index of relationships, so the referrers are found by
+		// scanning opts.ReferrersPattern, or the whole store.
+		DeleteKeyTreeCascade(sk StoreKey, opts CascadeOptions) (removed bool, referrers []StoreKey, err error)
+
+		// Deletes up to `limit` keys matching `skPattern`, along with their child
+		// data, returning the number of matching keys deleted. Matches are fetched
+		// and deleted a page at a time; the operation is not atomic.
+		DeleteMatchingKeys(skPattern StoreKey, limit int) (removed int, err error)
+	}
+
+	// Guards writes against a key being deleted or recreated by another client.
+	Fencer interface {
+		// Captures the current address of `sk` as a write fence. Mutations made with
+		// the fence are rejected with ErrFenceViolated if the key was deleted or
+		// recreated (at a different address) since the fence was captured.
+		FenceKey(sk StoreKey) (fence KeyFence, exists bool, err error)
+
+		// Reads the current value of `sk` along with a write fence for a later
+		// fenced mutation.
+		GetKeyValueFenced(sk StoreKey) (value any, valueExists bool, fence KeyFence, err error)
+
+		// Sets the value of the fenced key, if it still exists at the fenced address.
+		// The key's expiration is kept.
+		SetKeyValueFenced(fence KeyFence, value any) (originalValue any, err error)
+
+		// Replaces the json subtree of the fenced key, if it still exists at the
+		// fenced address.
+		ReplaceKeyJsonFenced(fence KeyFence, jsonData any, opt JsonOptions) (err error)
+
+		// Deletes the fenced key, if it still exists at the fenced address. The
+		// fence is only checked before the delete, so a key recreated in between
+		// is deleted without an error.
+		DeleteKeyFenced(fence KeyFence) (keyRemoved, valueRemoved bool, originalValue any, err error)
+	}
+
+	// Computes key values on the server.
+	Calculator interface {
+		// Evaluate a math expression and store the result.
+		//
+		// The expression operators include + - / * & | ^ ** % >> <<,
+		// comparators >, <=, etc., and logical || &&.
+		//
+		// Constants are 64-bit floating point, string constants, dates or true/false.
+		//
+		// Parenthesis specify order of evaluation.
+		//
+		// Unary operators ! - ~ are supported.
+		//
+		// Ternary conditionals are supported with <expr> ? <on-true> : <on-false>
+		//
+		// Null coalescence is supported with ??
+		//
+		// Basic type conversion is supported - int(value), uint(value) and float(value)
+		//
+		// The target's store key original value is accessed with variable 'self'.
+		//
+		// The 'self' can also be referred to as 'i' for int, 'u' for uint or 'f' for float,
+		// for which if there are no other types specified, the result will be stored as
+		// the type specified. This is useful for compact, simple expressions such as:
+		//
+		//	"i+1"        increments existing int (or zero), stores result as int
+		//
+		// The operation is computed in 64-bit floating point before it is stored in its
+		// final type.
+		//
+		// String values can be converted in casts, e.g., int("-35")
+		//
+		// Other input keys can be accessed using the lookup(sk) function, where sk is the
+		// key path containing a value.
+		//
+		//	`lookup("/my/store/key")+25`
+		//
+		// If the initial slash is not specified, the store key path is a child of the
+		// target sk.
+		//
+		// For ternary conditionals, an operation can be skipped by using fail().
+		//
+		//	"i>100?i+1:fail()"        no modifications if the sk value is < 100
+		CalculateKeyValue(sk StoreKey, expression string) (address StoreAddress, newValue any, err error)
+
+		// Makes a lookup() call for a CalculateKeyValue expression that reads the
+		// value of `sk`. The key path is escaped, so any key can be referenced
+		// safely, and it includes the client's key prefix.
+		//
+		//	tsc.Lookup(priceSk) + " * " + tsc.Lookup(quantitySk)
+		Lookup(sk StoreKey) (expression string)
+
+		// Like CalculateKeyValue, but first verifies that each of `sourceSks` has
+		// a value, failing with ErrLookupKeyMissing if one does not. The
+		// expression is expected to refer to the sources with Lookup.
+		CalculateKeyValueFrom(sk StoreKey, expression string, sourceSks ...StoreKey) (address StoreAddress, newValue any, err error)
+
+		// Like CalculateKeyValue, but the expression is built from a template with
+		// bound parameters, and its syntax is validated before it is sent.
+		//
+		//	tsc.CalculateKeyValueExpr(sk, Expr("i + {delta}").Bind("delta", 5))
+		CalculateKeyValueExpr(sk StoreKey, ce *CalcExpression) (address StoreAddress, newValue any, err error)
+
+		// Atomically adds `delta` to the int value of `sk` (zero if it has no
+		// value), and returns the new value. Use a negative `delta` to
+		// decrement. The server sends int values as 32 bits, so an increment
+		// whose result is outside of the int32 range isn't made, and returns
+		// ErrIncrementNotApplied, as does a value that isn't a number.
+		IncrementKeyValue(sk StoreKey, delta int64) (newValue int64, err error)
+
+		// Atomically adds `delta` to the float64 value of `sk` (zero if it has no
+		// value), and returns the new value.
+		IncrementKeyValueFloat(sk StoreKey, delta float64) (newValue float64, err error)
+	}
+
+	// Reads and writes key metadata attributes.
+	MetadataStore interface {
 		// Sets a metadata attribute on a key, returning the original value (if any)
 		SetMetadataAttribute(sk StoreKey, attribute, value string) (keyExists bool, priorValue string, err error)
 
@@ -150,18 +578,27 @@ type (
 		// Returns an array of attribute names of metadata stored for the specified key
 		GetMetadataAttributes(sk StoreKey) (attributes []string, err error)
 
-		// Converts an address to a store key
-		KeyFromAddress(addr StoreAddress) (sk StoreKey, exists bool, err error)
+		// Sets a metadata attribute on a key to a typed value (a string, bool,
+		// integer, float or time.Time), returning the original value (if any) as
+		// text. Read the value with the typed getters.
+		SetMetadataAttributeTyped(sk StoreKey, attribute string, value any) (keyExists bool, priorValue string, err error)
 
-		// Fetches the current value by address
-		KeyValueFromAddress(addr StoreAddress) (keyExists, valueExists bool, sk StoreKey, value any, err error)
+		// Fetches a key's metadata attribute as an integer.
+		GetMetadataAttributeInt(sk StoreKey, attribute string) (attributeExists bool, value int64, err error)
 
-		// Retreives a value by following a relationship link. The target value is
-		// returned in `rv`, and will be nil if the target doesn't exist. The
-		// `hasLink` flag indicates true when a relationship is stored at the
-		// specified `relationshipIndex`.
-		GetRelationshipValue(sk StoreKey, relationshipIndex int) (hasLink bool, rv *RelationshipValue, err error)
+		// Fetches a key's metadata attribute as a float.
+		GetMetadataAttributeFloat(sk StoreKey, attribute string) (attributeExists bool, value float64, err error)
 
+		// Fetches a key's metadata attribute as a bool, such as the "array"
+		// attribute of json arrays.
+		GetMetadataAttributeBool(sk StoreKey, attribute string) (attributeExists bool, value bool, err error)
+
+		// Fetches a key's metadata attribute as a time.
+		GetMetadataAttributeTime(sk StoreKey, attribute string) (attributeExists bool, value time.Time, err error)
+	}
+
+	// Lists and counts keys by level or by pattern.
+	KeyIterator interface {
 		// Navigates to the specified store key and returns all of the key segments
 		// matching the simple wildcard `pattern`. If the store key does not exist,
 		// the return `keys` will be nil.
@@ -170,34 +607,131 @@ type (
 		// a reasonable limit.
 		GetLevelKeys(sk StoreKey, pattern string, startAt, limit int) (keys []LevelKey, err error)
 
+		// Lists the children of `sk` with a resumable cursor, as
+		// GetMatchingKeysCursor does for key matches. Specify an empty cursor
+		// to start, then pass the returned `nextCursor` to continue. The
+		// listing is complete when `nextCursor` is empty. Children are not
+		// skipped or duplicated when other children are added or removed.
+		GetLevelKeysCursor(sk StoreKey, pattern string, cursor string, limit int) (keys []LevelKey, nextCursor string, err error)
+
+		// Returns the children of `sk` with segments matching `pattern`, as
+		// GetLevelKeys does, with options such as descending order, which
+		// lists the last children first.
+		GetLevelKeysEx(sk StoreKey, pattern string, startAt, limit int, opts LevelKeyOptions) (keys []LevelKey, err error)
+
+		// Lists the children of `sk` with segments matching `pattern` along
+		// with their current values, in one request. When `withTtl` is true,
+		// each child's ttl is also read, with a request per child.
+		GetLevelKeyValues(sk StoreKey, pattern string, startAt, limit int, withTtl bool) (keys []LevelKeyValue, err error)
+
+		// Invokes `fn` for each child of `sk` with a segment matching `pattern`,
+		// fetching the children from the server a page at a time, so a key with a
+		// huge number of children can be iterated without guessing a limit.
+		// Iteration stops early when `fn` returns false.
+		GetLevelKeysStream(sk StoreKey, pattern string, fn func(lk LevelKey) bool) (err error)
+
+		// Returns the children of `sk` with segments in the range
+		// [`fromSegment`, `toSegment`), in byte order, up to `limit` children
+		// (0 for no limit). An empty bound leaves that end of the range open.
+		GetLevelKeysRange(sk StoreKey, fromSegment, toSegment TokenSegment, limit int) (keys []LevelKey, err error)
+
+		// Returns the number of immediate children of `sk`, and whether `sk` has a
+		// value, without fetching the child segments or the value.
+		GetKeyChildrenCount(sk StoreKey) (children int, hasValue bool, err error)
+
 		// Full iteration function walks each tree store level according to skPattern and returns every
 		// detail of matching keys.
 		GetMatchingKeys(skPattern StoreKey, startAt, limit int) (keys []*KeyMatch, err error)
 
+		// Finds the keys matching `skPattern`, as GetMatchingKeys does, with
+		// options such as ordering by value or ttl, filtering by metadata, or
+		// matching `*` literally (see EscapePattern and MatchOptions.Literal).
+		// Orders other than key order, filters and literal `*` are applied by
+		// the client, which fetches every match to do so.
+		GetMatchingKeysEx(skPattern StoreKey, startAt, limit int, opts MatchOptions) (keys []*KeyMatch, err error)
+
+		// Iterates the keys matching `skPattern` with a resumable cursor. Specify an
+		// empty cursor to start, then pass the returned `nextCursor` to continue. The
+		// iteration is complete when `nextCursor` is empty.
+		//
+		// Unlike integer offsets, the cursor resumes after the last key returned, so
+		// keys are not skipped or duplicated when other keys are added or removed
+		// during the iteration.
+		GetMatchingKeysCursor(skPattern StoreKey, cursor string, limit int) (keys []*KeyMatch, nextCursor string, err error)
+
+		// Invokes `fn` for each key matching `skPattern`, fetching matches from the
+		// server a page at a time, so large key spaces can be iterated without
+		// holding every match in memory. Iteration stops early when `fn` returns
+		// false.
+		GetMatchingKeysStream(skPattern StoreKey, fn func(km *KeyMatch) bool) (err error)
+
+		// Invokes `fn` for each key matching `skPattern` whose path also
+		// matches the regular expression `expr`. The server only matches
+		// wildcards, so the expression is applied by the client to the
+		// streamed matches of `skPattern`, which should be kept narrow.
+		GetMatchingKeysRegexStream(skPattern StoreKey, expr string, fn func(km *KeyMatch) bool) (err error)
+
+		// Invokes `fn` for each key matching `skPattern`, partitioning the keys
+		// by the segments at the pattern's first wildcard and scanning the
+		// partitions with `workers` connections of their own. `fn` is invoked
+		// concurrently and keys are not delivered in order.
+		ScanParallel(skPattern StoreKey, workers int, fn func(km *KeyMatch) bool) (err error)
+
+		// Walks the subtree under `sk` level by level, invoking `fn` for each key
+		// down to `maxDepth` levels below `sk` (0 for no limit). All keys at one
+		// depth are visited before any deeper key. The walk stops early when `fn`
+		// returns false.
+		WalkTree(sk StoreKey, maxDepth int, fn func(km *KeyMatch) bool) (err error)
+
+		// Visits `startSk` and the keys reachable from it by following
+		// relationships, breadth or depth first, down to `maxDepth` links (0
+		// for no limit). Each key is visited once, so cycles are not followed
+		// around. Relationship targets are resolved in batches. The traversal
+		// stops early when `visitor` returns false.
+		TraverseGraph(startSk StoreKey, maxDepth int, order GraphOrder, visitor func(node *GraphNode) bool) (err error)
+
 		// Full iteration function walks each tree store level according to skPattern and returns every
 		// detail of matching keys that have values.
 		GetMatchingKeyValues(skPattern StoreKey, startAt, limit int) (values []*KeyValueMatch, err error)
 
-		// Serialize the tree store into a single JSON doc.
-		//
-		// N.B., The document is constructed entirely in memory and will hold an
-		// exclusive lock during the operation.
-		Export(sk StoreKey) (jsonData any, err error)
+		// Finds the keys with values matching `skPattern`, as
+		// GetMatchingKeyValues does, with the options of GetMatchingKeysEx.
+		GetMatchingKeyValuesEx(skPattern StoreKey, startAt, limit int, opts MatchOptions) (values []*KeyValueMatch, err error)
 
-		// Serialize the tree store into a single JSON doc.
-		//
-		// N.B., The document is constructed entirely in memory and will hold an
-		// exclusive lock during the operation.
-		ExportBase64(sk StoreKey) (b64 string, err error)
+		// Finds the keys matching `skPattern` that expire within `within` from
+		// now, soonest first. The expirations are read by the client, one key
+		// at a time.
+		GetExpiringKeys(skPattern StoreKey, within time.Duration) (keys []ExpiringKey, err error)
 
-		// Creates a key from an export format json doc and adds it to the tree store
-		// at the specified sk. If the key exists, it and its children will be replaced.
-		Import(sk StoreKey, jsonData any) (err error)
+		// Counts the keys matching `skPattern` without transferring the details of
+		// each match. When `countValues` is true, the matching keys that have
+		// values are counted as well, which requires transferring the values.
+		CountMatchingKeys(skPattern StoreKey, countValues bool) (keys, withValues int, err error)
 
-		// Creates a key from an export format json doc and adds it to the tree store
-		// at the specified sk. If the key exists, it and its children will be replaced.
-		ImportBase64(sk StoreKey, b64 string) (err error)
+		// Measures the subtree at `sk`: key and value counts, total value
+		// bytes, depth and the number of keys at each level. The keys are
+		// listed a page at a time and measured by the client.
+		GetTreeStats(sk StoreKey) (stats TreeStats, err error)
+
+		// Invokes `fn` for each key with a value matching `skPattern`, fetching
+		// matches from the server a page at a time. Iteration stops early when `fn`
+		// returns false.
+		GetMatchingKeyValuesStream(skPattern StoreKey, fn func(kvm *KeyValueMatch) bool) (err error)
+
+		// Computes a sum, min, max, average or count over the numeric values of
+		// the keys matching `skPattern`. The values are streamed a page at a
+		// time and combined by the client.
+		AggregateKeyValues(skPattern StoreKey, op AggregateOp) (result float64, count int, err error)
+
+		// Returns the keys in the subtree at `rootSk` whose current value equals
+		// `value` (in type as well as content), up to `limit` keys (0 for no
+		// limit). The values are fetched a page at a time and compared by the
+		// client, so this is meant for debugging and ad-hoc queries.
+		FindKeysByValue(rootSk StoreKey, value any, limit int) (keys []StoreKey, err error)
+	}
 
+	// Stores and retrieves key trees as json.
+	JsonStore interface {
 		// Retrieves the child key tree and leaf values in the form of json. If
 		// metadata "array" is "true" then the child key nodes are treated as
 		// array indicies. (They must be big endian uint32.)
@@ -224,7 +758,10 @@ type (
 
 		// Takes the generalized json data and stores it at the specified key path.
 		// If the sk exists, its value, children and history are deleted, and the new
-		// json data takes its place.
+		// json data takes its place. A struct can be passed directly; it is
+		// marshalled with encoding/json, so its json field tags are honored.
+		//
+		// Large payloads are sent base64 encoded (see ClientBase64Threshold).
 		SetKeyJson(sk StoreKey, jsonData any, opt JsonOptions) (replaced bool, address StoreAddress, err error)
 
 		// Takes the generalized json data and stores it at the specified key path.
@@ -232,23 +769,9 @@ type (
 		// json data takes its place.
 		SetKeyJsonBase64(sk StoreKey, b64 string, opt JsonOptions) (replaced bool, address StoreAddress, err error)
 
-		// Saves a json object under a temporary name. A one minute expiration is set.
-		// This is used in the case where the caller has multiple operations to perform
-		// to stage data, and then atomically commits it with MoveKey or MoveReferencedKey.
-		// If the caller happens to abort, the staged data expires.
-		//
-		// The caller provides a staging key, and the json data is stored under a subkey
-		// with a unique identifier.
-		StageKeyJson(stagingSk StoreKey, jsonData any, opts JsonOptions) (tempSk StoreKey, address StoreAddress, err error)
-
-		// Saves a json object under a temporary name. A one minute expiration is set.
-		// This is used in the case where the caller has multiple operations to perform
-		// to stage data, and then atomically commits it with MoveKey or MoveReferencedKey.
-		// If the caller happens to abort, the staged data expires.
-		//
-		// The caller provides a staging key, and the json data is stored under a subkey
-		// with a unique identifier.
-		StageKeyJsonBase64(stagingSk StoreKey, b64 string, opts JsonOptions) (tempSk StoreKey, address StoreAddress, err error)
+		// Like SetKeyJson, but accepts json data that is already marshalled, and
+		// sends it without encoding it again.
+		SetKeyJsonBytes(sk StoreKey, marshalled []byte, opt JsonOptions) (replaced bool, address StoreAddress, err error)
 
 		// Takes the generalized json data and stores it at the specified key path.
 		// If the sk exists, no changes are made. Otherwise a new key node is created
@@ -260,6 +783,10 @@ type (
 		// with its child data set according to the json structure.
 		CreateKeyJsonBase64(sk StoreKey, b64 string, opt JsonOptions) (created bool, address StoreAddress, err error)
 
+		// Like CreateKeyJson, but accepts json data that is already marshalled, and
+		// sends it without encoding it again.
+		CreateKeyJsonBytes(sk StoreKey, marshalled []byte, opt JsonOptions) (created bool, address StoreAddress, err error)
+
 		// Takes the generalized json data and stores it at the specified key path.
 		// If the sk doesn't exists, no changes are made. Otherwise the key node's
 		// value and children are deleted, and the new json data takes its place.
@@ -270,9 +797,17 @@ type (
 		// value and children are deleted, and the new json data takes its place.
 		ReplaceKeyJsonBase64(sk StoreKey, b64 string, opt JsonOptions) (replaced bool, address StoreAddress, err error)
 
+		// Like ReplaceKeyJson, but accepts json data that is already marshalled, and
+		// sends it without encoding it again.
+		ReplaceKeyJsonBytes(sk StoreKey, marshalled []byte, opt JsonOptions) (replaced bool, address StoreAddress, err error)
+
 		// Overlays json data on top of existing data. This is one of the slower APIs
 		// because each part of json is independently written to the store, and a
 		// write lock is required across the whole operation.
+		//
+		// Arrays are appended to existing arrays, unless JsonMergeArraysReplace
+		// or JsonMergeArraysByIndex is specified; those merges are made of one
+		// command per array branch, and so are not atomic.
 		MergeKeyJson(sk StoreKey, jsonData any, opt JsonOptions) (address StoreAddress, err error)
 
 		// Overlays json data on top of existing data. This is one of the slower APIs
@@ -280,49 +815,166 @@ type (
 		// write lock is required across the whole operation.
 		MergeKeyJsonBase64(sk StoreKey, b64 string, opt JsonOptions) (address StoreAddress, err error)
 
-		// Evaluate a math expression and store the result.
-		//
-		// The expression operators include + - / * & | ^ ** % >> <<,
-		// comparators >, <=, etc., and logical || &&.
-		//
-		// Constants are 64-bit floating point, string constants, dates or true/false.
-		//
-		// Parenthesis specify order of evaluation.
-		//
-		// Unary operators ! - ~ are supported.
-		//
-		// Ternary conditionals are supported with <expr> ? <on-true> : <on-false>
-		//
-		// Null coalescence is supported with ??
-		//
-		// Basic type conversion is supported - int(value), uint(value) and float(value)
-		//
-		// The target's store key original value is accessed with variable 'self'.
-		//
-		// The 'self' can also be referred to as 'i' for int, 'u' for uint or 'f' for float,
-		// for which if there are no other types specified, the result will be stored as
-		// the type specified. This is useful for compact, simple expressions such as:
-		//
-		//	"i+1"        increments existing int (or zero), stores result as int
-		//
-		// The operation is computed in 64-bit floating point before it is stored in its
-		// final type.
-		//
-		// String values can be converted in casts, e.g., int("-35")
-		//
-		// Other input keys can be accessed using the lookup(sk) function, where sk is the
-		// key path containing a value.
-		//
-		//	`lookup("/my/store/key")+25`
+		// Like MergeKeyJson, but accepts json data that is already marshalled, and
+		// sends it without encoding it again.
+		MergeKeyJsonBytes(sk StoreKey, marshalled []byte, opt JsonOptions) (address StoreAddress, err error)
+
+		// Creates the key with the json data if it doesn't exist, or overlays the
+		// json data on the existing key, in a single server-side operation.
+		UpsertKeyJson(sk StoreKey, jsonData any, opt JsonOptions) (address StoreAddress, err error)
+
+		// Deletes a nested part of the json document at `sk`, such as
+		// `animals[2].name`, along with its value, children and history. See
+		// JsonPathToSubPath for the path syntax.
+		DeleteKeyJsonPath(sk StoreKey, relativePath string) (removed bool, err error)
+
+		// Sets the "array" metadata attribute on the keys matching `skPattern`,
+		// so that GetKeyAsJson returns their children (which must have four byte
+		// index segments) as arrays, or clears it when `isArray` is false.
+		// See also JsonNumericSegmentsAsArrays.
+		SetJsonArrayMetadata(skPattern StoreKey, isArray bool) (updated int, err error)
+
+		// Replaces only the nested part of the json document at `sk` found at
+		// `subPath`, as SetKeyJson would, without overlaying the whole document.
+		// See JsonPathToSubPath to make the subpath from a json path.
+		SetKeyJsonAtPath(sk StoreKey, subPath SubPath, jsonData any, opt JsonOptions) (replaced bool, address StoreAddress, err error)
+
+		// Evaluates a json path query, such as `$.animals[?(@.sound=='bark')]`,
+		// against the json document at `sk` and returns only the matching part.
+		// The leading fields and indexes are resolved by the server, so only
+		// that branch is transferred. Queries with wildcards, recursive descent
+		// or filters return a list of matches.
+		GetKeyJsonPath(sk StoreKey, expr string) (jsonData any, err error)
+
+		// Compares the json document at `sk` with `jsonData`, returning the paths
+		// that `jsonData` adds, removes or changes, for detecting drift before a
+		// merge.
+		DiffKeyJson(sk StoreKey, jsonData any) (diffs []JsonDiff, err error)
+
+		// Stores a struct at `sk`, mapping its fields to child keys according to
+		// `treestore` field tags, which work like `json` tags. The `metadata` tag
+		// option stores a string field as a metadata attribute of the struct's
+		// key instead. Existing children of `sk` are replaced.
+		SetKeyStruct(sk StoreKey, v any) (replaced bool, address StoreAddress, err error)
+
+		// Loads a struct stored by SetKeyStruct into `out`, which must be a
+		// pointer. `exists` is false if `sk` does not exist.
+		GetKeyStruct(sk StoreKey, out any) (exists bool, err error)
+	}
+
+	// Models ordered lists as json arrays.
+	ListStore interface {
+		// Appends `values` to the list at `sk`, creating the list if necessary.
+		// The list is a json array, with four byte index segments for the
+		// elements, and the values are stored as json. The values are appended
+		// atomically, under the lock on the list that ListPop takes.
+		ListPush(sk StoreKey, values ...any) (err error)
+
+		// Removes the last element of the list at `sk` and returns it. `exists`
+		// is false if the list is empty or doesn't exist. Pops and pushes are
+		// serialized by a lock on the list, so each element is returned by only
+		// one pop, provided the list isn't also changed by other means.
+		ListPop(sk StoreKey) (value any, exists bool, err error)
+
+		// Returns the elements of the list at `sk` from index `start` through
+		// `stop`, inclusive. Negative indexes count from the end of the list.
+		ListRange(sk StoreKey, start, stop int) (values []any, err error)
+
+		// Returns the number of elements in the list at `sk`.
+		ListLength(sk StoreKey) (length int, err error)
+	}
+
+	// Models sorted sets, such as leaderboards, with keys ordered by score.
+	SortedSetStore interface {
+		// Adds `member` to the sorted set at `sk` with `score`, or updates the
+		// score of an existing member. `added` is true if the member is new.
+		// Updates of a member are serialized by a lock on the member, and keep
+		// the expiration of the member's key.
+		ZAdd(sk StoreKey, member string, score float64) (added bool, err error)
+
+		// Adds `delta` to the score of `member` in the sorted set at `sk`, adding
+		// the member if necessary, and returns the new score. The score is read
+		// and written under the member's lock, so concurrent increments add up.
+		ZIncrBy(sk StoreKey, member string, delta float64) (score float64, err error)
+
+		// Returns the score of `member` in the sorted set at `sk`.
+		ZScore(sk StoreKey, member string) (score float64, exists bool, err error)
+
+		// Removes `member` from the sorted set at `sk`.
+		ZRem(sk StoreKey, member string) (removed bool, err error)
+
+		// Returns the number of members in the sorted set at `sk`.
+		ZCard(sk StoreKey) (count int, err error)
+
+		// Returns the members of the sorted set at `sk` ranked `start` through
+		// `stop`, inclusive, lowest score first. Negative ranks count from the
+		// highest score.
+		ZRange(sk StoreKey, start, stop int) (members []ZMember, err error)
+
+		// Returns up to `n` members of the sorted set at `sk` with the highest
+		// scores, highest first.
+		ZTop(sk StoreKey, n int) (members []ZMember, err error)
+	}
+
+	// Stages json data under temporary keys, to be committed by a move.
+	JsonStager interface {
+		// Saves a json object under a temporary name. A one minute expiration is set.
+		// This is used in the case where the caller has multiple operations to perform
+		// to stage data, and then atomically commits it with MoveKey or MoveReferencedKey.
+		// If the caller happens to abort, the staged data expires.
 		//
-		// If the initial slash is not specified, the store key path is a child of the
-		// target sk.
+		// The caller provides a staging key, and the json data is stored under a subkey
+		// with a unique identifier.
 		//
-		// For ternary conditionals, an operation can be skipped by using fail().
+		// Specify JsonStageCleanupOnClose to have the temporary key deleted when the
+		// client is closed, if it still exists.
+		StageKeyJson(stagingSk StoreKey, jsonData any, opts JsonOptions) (tempSk StoreKey, address StoreAddress, err error)
+
+		// Saves a json object under a temporary name. A one minute expiration is set.
+		// This is used in the case where the caller has multiple operations to perform
+		// to stage data, and then atomically commits it with MoveKey or MoveReferencedKey.
+		// If the caller happens to abort, the staged data expires.
 		//
-		//	"i>100?i+1:fail()"        no modifications if the sk value is < 100
-		CalculateKeyValue(sk StoreKey, expression string) (address StoreAddress, newValue any, err error)
+		// The caller provides a staging key, and the json data is stored under a subkey
+		// with a unique identifier.
+		StageKeyJsonBase64(stagingSk StoreKey, b64 string, opts JsonOptions) (tempSk StoreKey, address StoreAddress, err error)
+
+		// Removes staged subtrees under `stagingSk` that were staged longer than
+		// `olderThan` ago, or that no longer have an expiration. This is a janitor
+		// for leftovers of StageKeyJson, such as staged keys that had their
+		// expiration removed but were never moved to their permanent location.
+		CleanupStaging(stagingSk StoreKey, olderThan time.Duration) (removed int, err error)
+
+		// Refreshes the expiration of a staged key every `interval` on a background
+		// goroutine, preventing it from expiring while a long-running job fills the
+		// staged subtree. The refresh stops when `stop` is called, or when the staged
+		// key no longer exists (e.g., it was moved to its permanent location).
+		KeepStagedAlive(tempSk StoreKey, interval time.Duration) (stop func())
+
+		// Stages `jsonData` under `stagingSk` and returns a builder that performs
+		// incremental child writes and metadata updates on the staged record, and
+		// finally commits it with MoveReferencedKey (or aborts it). This encodes the
+		// recommended indexing workflow described in MoveReferencedKey.
+		StageRecord(stagingSk StoreKey, jsonData any, opts JsonOptions) (b *StagedRecordBuilder)
 
+		// Commits a key staged by StageKeyJson: moves `tempSk` to `destSk` with
+		// MoveReferencedKey, maintaining the index keys `refs` and `unrefs`.
+		// Unlike MoveReferencedKey, a nil `ttl` clears the staging expiration, so
+		// the committed key is permanent.
+		CommitStagedKey(tempSk, destSk StoreKey, overwrite bool, ttl *time.Time, refs, unrefs []StoreKey) (exists, moved bool, err error)
+
+		// Deletes a key staged by StageKeyJson immediately, rather than waiting
+		// for it to expire.
+		AbortStagedKey(tempSk StoreKey) (removed bool, err error)
+
+		// Stages `jsonData`, calls `verify` to check the staged key, and then
+		// commits it to `destSk` (replacing an existing key) in a single move, or
+		// deletes it and returns the error from `verify`.
+		StageKeyJsonVerified(stagingSk, destSk StoreKey, jsonData any, opts JsonOptions, verify func(tempSk StoreKey) error) (moved bool, err error)
+	}
+
+	// Moves key trees.
+	Mover interface {
 		// Move a key atomically, optionally overwriting the destionation
 		MoveKey(srcSk StoreKey, destSk StoreKey, overwrite bool) (exists, moved bool, err error)
 
@@ -361,13 +1013,16 @@ type (
 		// expired ttl.
 		MoveReferencedKey(srcSk StoreKey, destSk StoreKey, overwrite bool, ttl *time.Time, refs []StoreKey, unrefs []StoreKey) (exists, moved bool, err error)
 
-		// Calls the treestore sending in value-escaped arguments, and receiving back a map parsed
-		// from the json response.
-		RawCommand(valueEscapedArgs ...string) (response map[string]any, err error)
-
-		// Discards all data, completely resetting the treestore instance.
-		Purge() (err error)
+		// Moves several staged records and maintains their index keys, as with
+		// MoveReferencedKey. The server moves one key per command, so the batch
+		// isn't atomic. The moves are checked first, and if one fails, the
+		// records already moved are moved back, except those that overwrote a
+		// key; the index keys removed through Unrefs are not restored.
+		MoveReferencedKeys(moves []MoveSpec) (moved int, err error)
+	}
 
+	// Maintains auto-link indexes.
+	AutoLinker interface {
 		// Makes an auto-link definition.
 		//
 		// To use auto-linking, target data must be stored in a specific way:
@@ -419,8 +1074,143 @@ type (
 		// number of links are high, the operation may take some time to delete.
 		RemoveAutoLinkKey(dataParentSk, autoLinkSk StoreKey) (recordKeyExists, autoLinkRemoved bool, err error)
 
+		// Makes an auto-link definition that only links the records passing
+		// `filter`, a calc-style expression over the record's fields, such as
+		// `status == "active"`. The server links every record, so the filter
+		// is kept in the metadata of `autoLinkSk` and applied by the client:
+		// lookups skip records that don't pass, and PruneAutoLinks deletes
+		// their links.
+		DefineAutoLinkKeyFiltered(dataParentSk, autoLinkSk StoreKey, fields []SubPath, filter string) (recordKeyExists, autoLinkCreated bool, err error)
+
+		// Deletes the links of records that don't pass the filter of the
+		// auto-link key `autoLinkSk`, returning the number deleted.
+		PruneAutoLinks(autoLinkSk StoreKey) (removed int, err error)
+
 		// Returns all auto-link definitions defined for the specified data key, or nil if none.
 		GetAutoLinkDefinition(dataParentSk StoreKey) (id []AutoLinkDefinition, err error)
+
+		// Returns every data parent key that has auto-link definitions, with
+		// its definitions, for auditing the auto-link configuration. The whole
+		// store is exported to find them.
+		GetAllAutoLinkDefinitions() (parents []DataParentAutoLinks, err error)
+
+		// Finds the record linked by the auto-link key made of `fieldValues`
+		// under `autoLinkSk`, following relationship 0 of the link, and returns
+		// the record key and its value.
+		LookupAutoLinked(autoLinkSk StoreKey, fieldValues ...string) (recordSk StoreKey, value any, found bool, err error)
+
+		// Finds all of the records linked under `autoLinkSk` by auto-link keys
+		// that start with `fieldValues`, a partial list of field value patterns.
+		LookupAutoLinkedPrefix(autoLinkSk StoreKey, fieldValues ...string) (matches []AutoLinkMatch, err error)
+
+		// Checks the auto-link keys under `autoLinkSk` against the records
+		// under `dataParentSk`, and reports missing links and stale links,
+		// such as links to expired records.
+		VerifyAutoLinks(dataParentSk, autoLinkSk StoreKey) (problems []AutoLinkProblem, err error)
+
+		// Re-creates the auto-link keys under `autoLinkSk` by redefining the
+		// auto-link definition, to recover from partial failures.
+		RebuildAutoLinks(dataParentSk, autoLinkSk StoreKey) (err error)
+	}
+
+	// Watches keys for changes.
+	Subscriber interface {
+		// Watches keys matching `skPattern` and delivers change events (created,
+		// value set, deleted, expired) on the subscription's Events channel.
+		//
+		// The subscription uses a dedicated connection to the server and detects
+		// changes by scanning periodically. Call Close on the subscription to stop it.
+		Subscribe(skPattern StoreKey) (sub *Subscription, err error)
+
+		// Watches keys matching `skPattern` as Subscribe does, scanning at
+		// opts.PollInterval rather than DefaultSubscribePollInterval.
+		SubscribeEx(skPattern StoreKey, opts SubscribeOptions) (sub *Subscription, err error)
+	}
+
+	// Exports, imports and maintains the whole store or a subtree.
+	Maintainer interface {
+		// Serialize the tree store into a single JSON doc.
+		//
+		// N.B., The document is constructed entirely in memory and will hold an
+		// exclusive lock during the operation.
+		Export(sk StoreKey) (jsonData any, err error)
+
+		// Serialize the tree store into a single JSON doc.
+		//
+		// N.B., The document is constructed entirely in memory and will hold an
+		// exclusive lock during the operation.
+		ExportBase64(sk StoreKey) (b64 string, err error)
+
+		// Serializes the subtree at `sk` in the export format, with each key
+		// holding only the value it had at `when`, for audit snapshots. Keys
+		// whose values were all set after `when` are omitted, unless they have
+		// children in the snapshot. Numbers are decoded as json.Number.
+		ExportAtTime(sk StoreKey, when time.Time) (jsonData any, err error)
+
+		// Creates a key from an export format json doc and adds it to the tree store
+		// at the specified sk. If the key exists, it and its children will be replaced.
+		//
+		// Large payloads are sent base64 encoded (see ClientBase64Threshold).
+		Import(sk StoreKey, jsonData any) (err error)
+
+		// Creates a key from an export format json doc and adds it to the tree store
+		// at the specified sk. If the key exists, it and its children will be replaced.
+		ImportBase64(sk StoreKey, b64 string) (err error)
+
+		// Stores the newline-delimited json records read from `r` as children of
+		// `parentSk`, each at the key returned by `keyFunc` (relative to
+		// `parentSk`), or under its line number when `keyFunc` is nil. Records
+		// are decoded and written concurrently, so they aren't written in order.
+		ImportJsonLines(parentSk StoreKey, r io.Reader, keyFunc func(doc any) StoreKey) (imported int, err error)
+
+		// Stores the CSV rows read from `r` as record keys under `parentSk`, with
+		// a child key for each column holding the cell. The record key is the row
+		// id from opts.KeyColumn, or the row number. Rows are written
+		// concurrently, so they aren't written in order.
+		ImportCsv(parentSk StoreKey, r io.Reader, opts CsvImportOptions) (imported int, err error)
+
+		// Compares the subtrees at `skA` and `skB` - their keys, values and
+		// metadata - and returns what `skB` adds, removes or changes, for
+		// verifying migrations and replication. The subtrees and the reported
+		// values are read by separate commands, so the diff is only coherent
+		// when the subtrees aren't being written.
+		DiffKeys(skA, skB StoreKey) (diffs []KeyDiff, err error)
+
+		// Records a value history retention policy for keys matching `skPattern`
+		// in the metadata of HistoryPolicySk. Keys keep at most `maxEntries`
+		// history entries, and entries no older than `maxAge`; 0 means no limit.
+		// The current value is always kept. Specify 0 for both to remove the
+		// policy. The policy is enforced by Compact.
+		ConfigureHistoryPolicy(skPattern StoreKey, maxEntries int, maxAge time.Duration) (err error)
+
+		// Trims the value history of keys according to the policies recorded by
+		// ConfigureHistoryPolicy, returning the number of keys trimmed. Keys with
+		// children are skipped. A value written to a key while it is being
+		// compacted can be lost.
+		Compact() (compacted int, err error)
+
+		// Discards all data, completely resetting the treestore instance.
+		Purge() (err error)
+	}
+
+	// The full client API, made of the sub-interfaces above. Code that uses only
+	// part of the API can depend on the relevant sub-interface instead.
+	TSClient interface {
+		Connection
+		KeyReader
+		KeyWriter
+		Fencer
+		Calculator
+		MetadataStore
+		KeyIterator
+		JsonStore
+		ListStore
+		SortedSetStore
+		JsonStager
+		Mover
+		AutoLinker
+		Subscriber
+		Maintainer
 	}
 )
 
@@ -432,4 +1222,42 @@ const (
 
 const (
 	JsonStringValuesAsKeys JsonOptions = 1 << iota
+	JsonStageCleanupOnClose
+
+	// MergeKeyJson replaces the existing arrays with the arrays of the merged
+	// data, rather than appending to them.
+	JsonMergeArraysReplace
+
+	// MergeKeyJson overlays each element of the merged arrays on the existing
+	// element at the same index, rather than appending to the arrays.
+	JsonMergeArraysByIndex
+
+	// GetKeyAsJson and GetKeyAsJsonBytes return objects whose fields are all
+	// array indexes ("0", "1", ...) as arrays, and SetKeyJson, CreateKeyJson,
+	// ReplaceKeyJson and MergeKeyJson store arrays as objects with index fields,
+	// so that arrays need neither the "array" metadata attribute nor four byte
+	// index segments.
+	JsonNumericSegmentsAsArrays
+
+	// GetKeyAsJson and GetKeyAsJsonBytes leave out the keys that have neither
+	// a value nor children, the keys with null values, and the objects left
+	// empty by their removal, for compact documents. Array elements are kept
+	// so that their indexes don't change.
+	JsonOmitEmpty
+)
+
+var (
+	ErrStagedRecordFinished = errors.New("staged record already committed or aborted")
+	ErrFenceViolated        = errors.New("key was deleted or recreated since it was fenced")
+	ErrBusy                 = errors.New("too many requests are waiting for the connection")
+	ErrReadOnly             = errors.New("client is read-only")
+	ErrLookupKeyMissing     = errors.New("lookup key does not have a value")
+	ErrRequestTooLarge      = errors.New("request too large")
+	ErrNoStandby            = errors.New("no standby server is configured")
+	ErrMoveFailed           = errors.New("key was not moved")
+	ErrCircuitOpen          = errors.New("circuit breaker is open")
+	ErrResponseLost         = errors.New("connection failed during the response")
+	ErrRateLimited          = errors.New("client rate limit exceeded")
+	ErrQueueFull            = errors.New("too many async commands are queued")
+	ErrIncrementNotApplied  = errors.New("increment result is outside of the int32 range, or the value is not a number")
 )
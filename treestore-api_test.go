@@ -5,9 +5,19 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"net"
+	"os"
+	"reflect"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -226,6 +236,168 @@ func TestSetEx(t *testing.T) {
 	}
 }
 
+func TestSetKeyValueCAS(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	sk := MakeStoreKey("client", "test", "key")
+
+	swapped, actual, err := tsc.SetKeyValueCAS(sk, 5, 10)
+	if swapped || actual != nil || err != nil {
+		t.Error("cas on missing value")
+	}
+
+	swapped, actual, err = tsc.SetKeyValueCAS(sk, nil, 10)
+	if !swapped || actual != nil || err != nil {
+		t.Error("cas create")
+	}
+
+	swapped, actual, err = tsc.SetKeyValueCAS(sk, 5, 20)
+	if swapped || actual != 10 || err != nil {
+		t.Error("cas mismatch")
+	}
+
+	swapped, actual, err = tsc.SetKeyValueCAS(sk, 10, 20)
+	if !swapped || actual != 10 || err != nil {
+		t.Error("cas match")
+	}
+
+	swapped, actual, err = tsc.SetKeyValueCAS(sk, nil, 30)
+	if swapped || actual != 20 || err != nil {
+		t.Error("cas expected no value")
+	}
+
+	value, _, _, err := tsc.GetKeyValue(sk)
+	if value != 20 || err != nil {
+		t.Error("verify value")
+	}
+
+	swapped, _, err = tsc.SetKeyValueCAS(sk, int64(20), 30)
+	if swapped || err != nil {
+		t.Error("cas type mismatch")
+	}
+}
+
+func TestSetKeyValueCASConcurrent(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	sk := MakeStoreKey("client", "test", "counter")
+	expire := time.Now().Add(time.Hour)
+	if _, _, _, err := tsc.SetKeyValueEx(sk, 0, 0, &expire, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// writers on separate connections increment the counter with CAS, so a
+	// lost update would leave it short
+	const writers = 4
+	const increments = 25
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		writer := tsc.(*tsClient).dedicated()
+		defer writer.Close()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < increments; {
+				value, _, _, err := writer.GetKeyValue(sk)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				swapped, _, err := writer.SetKeyValueCAS(sk, value, value.(int)+1)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if swapped {
+					n++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	value, _, _, err := tsc.GetKeyValue(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != writers*increments {
+		t.Errorf("expected %d increments, got %v", writers*increments, value)
+	}
+
+	ttl, err := tsc.GetKeyTtl(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl == nil || !ttl.Equal(expire) {
+		t.Error("cas kept the expiration")
+	}
+}
+
+func TestKeyFence(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	sk := MakeStoreKey("client", "test", "key")
+
+	_, exists, err := tsc.FenceKey(sk)
+	if exists || err != nil {
+		t.Error("fence missing key")
+	}
+
+	expire := time.Now().Add(time.Hour)
+	if _, _, _, err = tsc.SetKeyValueEx(sk, 1, 0, &expire, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	value, valueExists, fence, err := tsc.GetKeyValueFenced(sk)
+	if value != 1 || !valueExists || fence.Address == 0 || err != nil {
+		t.Fatal("fenced read")
+	}
+
+	orgVal, err := tsc.SetKeyValueFenced(fence, 2)
+	if orgVal != 1 || err != nil {
+		t.Error("fenced write")
+	}
+	if ttl, err := tsc.GetKeyTtl(sk); err != nil || ttl == nil || !ttl.Equal(expire) {
+		t.Error("fenced write kept the expiration")
+	}
+
+	// recreate the key at a new address
+	if _, _, _, err = tsc.DeleteKey(sk); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = tsc.SetKeyValue(sk, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = tsc.SetKeyValueFenced(fence, 4); err != ErrFenceViolated {
+		t.Error("stale fenced write")
+	}
+	if err = tsc.ReplaceKeyJsonFenced(fence, map[string]any{"a": 1}, 0); err != ErrFenceViolated {
+		t.Error("stale fenced replace")
+	}
+	if _, _, _, err = tsc.DeleteKeyFenced(fence); err != ErrFenceViolated {
+		t.Error("stale fenced delete")
+	}
+
+	value, _, _, _ = tsc.GetKeyValue(sk)
+	if value != 3 {
+		t.Error("stale fence modified key")
+	}
+
+	fence, exists, err = tsc.FenceKey(sk)
+	if !exists || err != nil {
+		t.Fatal("refence")
+	}
+	if err = tsc.ReplaceKeyJsonFenced(fence, map[string]any{"a": 1}, 0); err != nil {
+		t.Error("fenced replace")
+	}
+	keyRemoved, _, _, err := tsc.DeleteKeyFenced(fence)
+	if keyRemoved || err != nil {
+		t.Error("fenced delete")
+	}
+}
+
 func TestSetKeyNoValueRelationship(t *testing.T) {
 	_, tsc := testSetup(t)
 
@@ -838,6 +1010,92 @@ func TestMatchingKeys(t *testing.T) {
 	}
 }
 
+func TestMatchingKeysCursor(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	for i := 0; i < 40; i++ {
+		if _, _, err := tsc.SetKeyValue(MakeStoreKey("cursor", fmt.Sprintf("%02d", i)), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pattern := MakeStoreKey("cursor", "*")
+	seen := map[string]int{}
+	cursor := ""
+	pages := 0
+	for {
+		keys, nextCursor, err := tsc.GetMatchingKeysCursor(pattern, cursor, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, km := range keys {
+			seen[string(km.Key)]++
+		}
+		if nextCursor == "" {
+			break
+		}
+		cursor = nextCursor
+		pages++
+
+		if pages == 4 {
+			// remove keys that were already returned, shifting offsets
+			for i := 0; i < 20; i++ {
+				if _, err = tsc.DeleteKeyTree(MakeStoreKey("cursor", fmt.Sprintf("%02d", i))); err != nil {
+					t.Fatal(err)
+				}
+			}
+		} else if pages == 5 {
+			// add keys behind the cursor position
+			for i := 0; i < 3; i++ {
+				if _, _, err = tsc.SetKeyValue(MakeStoreKey("cursor", fmt.Sprintf("%02d", i)), i); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+
+	for i := 0; i < 40; i++ {
+		key := string(MakeStoreKey("cursor", fmt.Sprintf("%02d", i)).Path)
+		if seen[key] != 1 {
+			t.Errorf("key %s seen %d times", key, seen[key])
+		}
+	}
+
+	// remove every key behind the cursor, leaving fewer keys than the cursor
+	// offset less the slack, so the page at the offset is empty
+	for i := 0; i < 60; i++ {
+		if _, _, err := tsc.SetKeyValue(MakeStoreKey("cursor2", fmt.Sprintf("%02d", i)), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pattern = MakeStoreKey("cursor2", "*")
+	keys, cursor, err := tsc.GetMatchingKeysCursor(pattern, "", 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 40 || cursor == "" {
+		t.Fatal("first page")
+	}
+	for i := 0; i < 40; i++ {
+		if _, err = tsc.DeleteKeyTree(MakeStoreKey("cursor2", fmt.Sprintf("%02d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keys, cursor, err = tsc.GetMatchingKeysCursor(pattern, cursor, 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 20 || cursor != "" || keys[0].Key != MakeStoreKey("cursor2", "40").Path {
+		t.Error("keys after the cursor")
+	}
+
+	_, _, err = tsc.GetMatchingKeysCursor(pattern, "not a cursor", 5)
+	if err == nil {
+		t.Error("invalid cursor accepted")
+	}
+}
+
 func TestMatchingValues(t *testing.T) {
 	_, tsc := testSetup(t)
 
@@ -1209,6 +1467,190 @@ func TestJsonStageBytesStrAsKey(t *testing.T) {
 	doesJsonMatch(t, "staging", jsonData, m)
 }
 
+func TestCleanupStaging(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	stagingSk := MakeStoreKey("staging")
+
+	tempSk1, _, err := tsc.StageKeyJson(stagingSk, map[string]any{"a": 1}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempSk2, _, err := tsc.StageKeyJson(stagingSk, map[string]any{"b": 2}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a staged key that lost its expiration is always a leftover
+	exists, err := tsc.SetKeyTtl(tempSk1, nil)
+	if !exists || err != nil {
+		t.Fatal("clear ttl")
+	}
+
+	removed, err := tsc.CleanupStaging(stagingSk, time.Hour)
+	if removed != 1 || err != nil {
+		t.Error("cleanup leftover")
+	}
+
+	_, exists, _ = tsc.LocateKey(tempSk1)
+	if exists {
+		t.Error("leftover still exists")
+	}
+	_, exists, _ = tsc.LocateKey(tempSk2)
+	if !exists {
+		t.Error("young staged key removed")
+	}
+
+	removed, err = tsc.CleanupStaging(stagingSk, 0)
+	if removed != 1 || err != nil {
+		t.Error("cleanup all")
+	}
+
+	_, exists, _ = tsc.LocateKey(tempSk2)
+	if exists {
+		t.Error("staged key still exists")
+	}
+}
+
+func TestStageCleanupOnClose(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	stagingSk := MakeStoreKey("staging")
+
+	tempSk, _, err := tsc.StageKeyJson(stagingSk, map[string]any{"a": 1}, JsonStageCleanupOnClose)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keptSk, _, err := tsc.StageKeyJson(stagingSk, map[string]any{"b": 2}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = tsc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, exists, err := tsc.LocateKey(tempSk)
+	if exists || err != nil {
+		t.Error("registered staged key not cleaned up")
+	}
+	_, exists, err = tsc.LocateKey(keptSk)
+	if !exists || err != nil {
+		t.Error("unregistered staged key removed")
+	}
+}
+
+func TestKeepStagedAlive(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	stagingSk := MakeStoreKey("staging")
+	tempSk, _, err := tsc.StageKeyJson(stagingSk, map[string]any{"a": 1}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ttl1, err := tsc.GetKeyTtl(tempSk)
+	if err != nil || ttl1 == nil {
+		t.Fatal("initial ttl")
+	}
+
+	stop := tsc.KeepStagedAlive(tempSk, 50*time.Millisecond)
+	time.Sleep(200 * time.Millisecond)
+	stop()
+	stop()
+
+	ttl2, err := tsc.GetKeyTtl(tempSk)
+	if err != nil || ttl2 == nil {
+		t.Fatal("refreshed ttl")
+	}
+	if !ttl2.After(*ttl1) {
+		t.Error("ttl not extended")
+	}
+
+	// refresh ends on its own once the staged key is committed
+	stop = tsc.KeepStagedAlive(tempSk, 10*time.Millisecond)
+	defer stop()
+
+	destSk := MakeStoreKey("committed")
+	_, moved, err := tsc.MoveReferencedKey(tempSk, destSk, false, &ZeroTime, nil, nil)
+	if !moved || err != nil {
+		t.Fatal("commit")
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	_, exists, _ := tsc.LocateKey(tempSk)
+	if exists {
+		t.Error("temp key recreated")
+	}
+}
+
+func TestStageRecord(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	stagingSk := MakeStoreKey("staging")
+	destSk := MakeStoreKey("records", "1")
+	indexSk := MakeStoreKey("index", "cat")
+
+	b := tsc.StageRecord(stagingSk, map[string]any{"name": "cat"}, 0).
+		SetValue(MakeSubPath("sound"), "meow").
+		MergeJson(MakeSubPath("traits"), map[string]any{"legs": 4}, 0).
+		SetMetadata(nil, "kind", "animal").
+		Reference(indexSk).
+		KeepAlive(time.Second)
+	if b.Err() != nil {
+		t.Fatal(b.Err())
+	}
+	tempSk := b.TempKey()
+
+	exists, moved, err := b.Commit(destSk)
+	if !exists || !moved || err != nil {
+		t.Fatal("commit")
+	}
+
+	data, err := tsc.GetKeyAsJson(destSk, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doesJsonMatch(t, "record", map[string]any{"name": "cat", "sound": "meow", "traits": map[string]any{"legs": 4}}, data)
+
+	ttl, err := tsc.GetKeyTtl(destSk)
+	if err != nil || ttl == nil || ttl.UnixNano() != 0 {
+		t.Error("staging expiration not cleared")
+	}
+
+	exists, value, err := tsc.GetMetadataAttribute(destSk, "kind")
+	if !exists || value != "animal" || err != nil {
+		t.Error("metadata")
+	}
+
+	hasLink, rv, err := tsc.GetRelationshipValue(indexSk, 0)
+	if !hasLink || rv == nil || rv.Sk.Path != destSk.Path || err != nil {
+		t.Error("index reference")
+	}
+
+	_, exists, _ = tsc.LocateKey(tempSk)
+	if exists {
+		t.Error("temp key still exists")
+	}
+
+	if b.SetValue(nil, 1).Err() != ErrStagedRecordFinished {
+		t.Error("use after commit")
+	}
+
+	b = tsc.StageRecord(stagingSk, map[string]any{"name": "dog"}, 0)
+	tempSk = b.TempKey()
+	if err = b.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	_, exists, _ = tsc.LocateKey(tempSk)
+	if exists {
+		t.Error("aborted temp key still exists")
+	}
+	if _, _, err = b.Commit(destSk); err != ErrStagedRecordFinished {
+		t.Error("commit after abort")
+	}
+}
+
 func TestJsonGetMissing(t *testing.T) {
 	_, tsc := testSetup(t)
 
@@ -1757,6 +2199,79 @@ func TestJsonMergeBase64StrAsKey(t *testing.T) {
 	}
 }
 
+type testAnimal struct {
+	Sound  string `json:"sound"`
+	Breeds int    `json:"breeds,omitempty"`
+}
+
+type testAnimals struct {
+	Animals map[string]testAnimal `json:"animals"`
+}
+
+func TestJsonStruct(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	sk := MakeStoreKey("test")
+
+	v := testAnimals{
+		Animals: map[string]testAnimal{
+			"cat": {Sound: "meow"},
+			"dog": {Sound: "bark", Breeds: 360},
+		},
+	}
+
+	created, addr, err := tsc.CreateKeyJson(sk, v, 0)
+	if !created || addr == 0 || err != nil {
+		t.Error("create json")
+	}
+
+	created, _, err = tsc.CreateKeyJson(sk, v, 0)
+	if created || err != nil {
+		t.Error("create json 2")
+	}
+
+	by, err := tsc.GetKeyAsJsonBytes(sk, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out testAnimals
+	if err = json.Unmarshal(by, &out); err != nil {
+		t.Fatal(err)
+	}
+	doesJsonMatch(t, "create", v, out)
+
+	v.Animals["fox"] = testAnimal{Sound: "howl"}
+	delete(v.Animals, "cat")
+
+	replaced, addr, err := tsc.ReplaceKeyJson(sk, v, 0)
+	if !replaced || addr == 0 || err != nil {
+		t.Error("replace json")
+	}
+
+	replaced, _, err = tsc.SetKeyJson(sk, v, 0)
+	if !replaced || err != nil {
+		t.Error("set json")
+	}
+
+	addr, err = tsc.MergeKeyJson(sk, testAnimals{Animals: map[string]testAnimal{"cat": {Sound: "purr"}}}, 0)
+	if addr == 0 || err != nil {
+		t.Error("merge json")
+	}
+
+	by, err = tsc.GetKeyAsJsonBytes(sk, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out = testAnimals{}
+	if err = json.Unmarshal(by, &out); err != nil {
+		t.Fatal(err)
+	}
+	v.Animals["cat"] = testAnimal{Sound: "purr"}
+	doesJsonMatch(t, "merge", v, out)
+}
+
 func TestCalculateKeyValue(t *testing.T) {
 	_, tsc := testSetup(t)
 
@@ -2288,3 +2803,5338 @@ func TestGetAutoLinkDefinition(t *testing.T) {
 		t.Error("autolink field def wrong")
 	}
 }
+
+func nextKeyEvent(t *testing.T, sub *Subscription) KeyEvent {
+	select {
+	case event := <-sub.Events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event")
+	}
+	return KeyEvent{}
+}
+
+func TestSubscribe(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	sk := MakeStoreKey("sub", "a")
+	if _, _, err := tsc.SetKeyValue(MakeStoreKey("sub", "existing"), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	sub, err := tsc.SubscribeEx(MakeStoreKey("sub", "*"), SubscribeOptions{PollInterval: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	if sub.interval != 20*time.Millisecond {
+		t.Error("poll interval")
+	}
+
+	if _, _, err = tsc.SetKey(sk); err != nil {
+		t.Fatal(err)
+	}
+	event := nextKeyEvent(t, sub)
+	if event.Type != KeyEventCreated || event.Key.Path != sk.Path {
+		t.Errorf("created event: %v", event)
+	}
+
+	if _, _, err = tsc.SetKeyValue(sk, "v1"); err != nil {
+		t.Fatal(err)
+	}
+	event = nextKeyEvent(t, sub)
+	if event.Type != KeyEventValueSet || event.Key.Path != sk.Path || event.Value != "v1" {
+		t.Errorf("value set event: %v", event)
+	}
+
+	if _, _, _, err = tsc.DeleteKey(sk); err != nil {
+		t.Fatal(err)
+	}
+	event = nextKeyEvent(t, sub)
+	if event.Type != KeyEventDeleted || event.Key.Path != sk.Path {
+		t.Errorf("deleted event: %v", event)
+	}
+
+	expire := time.Now().Add(300 * time.Millisecond)
+	if _, _, _, err = tsc.SetKeyValueEx(sk, "v2", 0, &expire, nil); err != nil {
+		t.Fatal(err)
+	}
+	event = nextKeyEvent(t, sub)
+	if event.Type != KeyEventCreated || event.Value != "v2" {
+		t.Errorf("created event 2: %v", event)
+	}
+	event = nextKeyEvent(t, sub)
+	if event.Type != KeyEventExpired || event.Key.Path != sk.Path {
+		t.Errorf("expired event: %v", event)
+	}
+
+	if err = sub.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, open := <-sub.Events; open {
+		t.Error("events channel not closed")
+	}
+}
+
+func TestRequestQueueLimit(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	tsc.SetRequestQueueLimit(2)
+
+	// stall the connection so that commands pile up
+	impl := tsc.(*tsClient)
+	impl.Lock()
+
+	var wg sync.WaitGroup
+	errs := make([]error, 3)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, _, errs[i] = tsc.SetKey(MakeStoreKey("key", strconv.Itoa(i)))
+		}(i)
+	}
+
+	for impl.invoked.Load() < 3 {
+		time.Sleep(time.Millisecond)
+	}
+
+	_, _, err := tsc.SetKey(MakeStoreKey("busy"))
+	if !errors.Is(err, ErrBusy) {
+		t.Error("queue limit not enforced")
+	}
+
+	impl.Unlock()
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tsc.SetRequestQueueLimit(0)
+	if _, _, err = tsc.SetKey(MakeStoreKey("busy")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMatchingKeysStream(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	saved := streamPageSize
+	streamPageSize = 7
+	defer func() { streamPageSize = saved }()
+
+	for i := 0; i < 30; i++ {
+		sk := MakeStoreKey("stream", fmt.Sprintf("%02d", i))
+		if i%2 == 0 {
+			if _, _, err := tsc.SetKeyValue(sk, i); err != nil {
+				t.Fatal(err)
+			}
+		} else if _, _, err := tsc.SetKey(sk); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var keys []TokenPath
+	err := tsc.GetMatchingKeysStream(MakeStoreKey("stream", "*"), func(km *KeyMatch) bool {
+		keys = append(keys, km.Key)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 30 {
+		t.Fatal("key count")
+	}
+	for i, key := range keys {
+		if key != TokenPath(fmt.Sprintf("/stream/%02d", i)) {
+			t.Error("key order")
+		}
+	}
+
+	count := 0
+	err = tsc.GetMatchingKeysStream(MakeStoreKey("stream", "*"), func(km *KeyMatch) bool {
+		count++
+		return count < 10
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 10 {
+		t.Error("early stop")
+	}
+
+	var values []any
+	err = tsc.GetMatchingKeyValuesStream(MakeStoreKey("stream", "*"), func(kvm *KeyValueMatch) bool {
+		values = append(values, kvm.CurrentValue)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 15 {
+		t.Fatal("value count")
+	}
+	for i, value := range values {
+		if value != i*2 {
+			t.Error("value order")
+		}
+	}
+}
+
+func TestConnect(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	if err := tsc.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	impl := tsc.(*tsClient)
+	cxn := impl.cxn
+	if cxn == nil {
+		t.Fatal("not connected")
+	}
+
+	if _, _, err := tsc.SetKey(MakeStoreKey("warm")); err != nil {
+		t.Fatal(err)
+	}
+	if impl.cxn != cxn {
+		t.Error("connection not reused")
+	}
+
+	other := NewTSClient(lane.NewTestingLane(context.Background()))
+	other.SetServer("localhost", 6771)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := other.Connect(ctx); err == nil {
+		t.Error("canceled dial")
+	}
+}
+
+func TestClientWith(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	scoped := tsc.With(ClientKeyPrefix(MakeStoreKey("tenant", "a")))
+	if _, _, err := scoped.SetKeyValue(MakeStoreKey("color"), "red"); err != nil {
+		t.Fatal(err)
+	}
+
+	value, _, exists, err := tsc.GetKeyValue(MakeStoreKey("tenant", "a", "color"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists || value != "red" {
+		t.Error("prefixed write")
+	}
+
+	keys, err := scoped.GetMatchingKeys(MakeStoreKey("*"), 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Key != "/color" {
+		t.Error("prefix not removed from matches")
+	}
+
+	addr, _, err := scoped.LocateKey(MakeStoreKey("color"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sk, _, err := scoped.KeyFromAddress(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sk.Path != "/color" {
+		t.Error("prefix not removed from key")
+	}
+
+	nested := scoped.With(ClientKeyPrefix(MakeStoreKey("sub")), ClientReadOnly())
+	if _, _, err = nested.SetKey(MakeStoreKey("x")); !errors.Is(err, ErrReadOnly) {
+		t.Error("read-only write")
+	}
+	if _, _, err = tsc.SetKeyValue(MakeStoreKey("tenant", "a", "sub", "x"), 1); err != nil {
+		t.Fatal(err)
+	}
+	value, _, exists, err = nested.GetKeyValue(MakeStoreKey("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists || value != 1 {
+		t.Error("nested prefix read")
+	}
+
+	if tsc.(*tsClient).tsConnection != nested.(*tsClient).tsConnection {
+		t.Error("connection not shared")
+	}
+
+	impatient := tsc.With(ClientTimeout(time.Nanosecond))
+	if _, _, _, err = impatient.GetKeyValue(MakeStoreKey("tenant", "a", "color")); err == nil {
+		t.Error("timeout not applied")
+	}
+
+	if _, _, _, err = tsc.GetKeyValue(MakeStoreKey("tenant", "a", "color")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAsync(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	sets := make([]*Future[SetKeyValueResult], 0, 100)
+	for i := 0; i < 100; i++ {
+		sets = append(sets, tsc.SetKeyValueAsync(MakeStoreKey("async", fmt.Sprintf("%03d", i)), i))
+	}
+
+	// queued in order, so the last get observes every set
+	get := tsc.GetKeyValueAsync(MakeStoreKey("async", "099"))
+	raw := tsc.RawCommandAsync("getv", "/async/050")
+
+	for _, f := range sets {
+		result, err := f.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !result.FirstValue || result.Address == 0 {
+			t.Error("set result")
+		}
+	}
+
+	<-get.Done()
+	result, err := get.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.KeyExists || !result.ValueExists || result.Value != 99 {
+		t.Error("get result")
+	}
+
+	response, err := raw.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !responseBool(response["key_exists"]) {
+		t.Error("raw result")
+	}
+}
+
+func TestFaultInjection(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	sk := MakeStoreKey("fault")
+
+	tsc.SetDialer(NewFaultInjectingDialer(FaultPolicy{Latency: time.Millisecond, SlowReadDelay: time.Millisecond, MaxReadSize: 3}, nil))
+	if _, _, err := tsc.SetKeyValue(sk, "fragmented response"); err != nil {
+		t.Fatal(err)
+	}
+	value, _, _, err := tsc.GetKeyValue(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "fragmented response" {
+		t.Error("fragmented read")
+	}
+
+	tsc.SetDialer(NewFaultInjectingDialer(FaultPolicy{DropRate: 1}, nil))
+	if _, _, err = tsc.SetKey(sk); err == nil {
+		t.Error("dropped connection")
+	}
+
+	tsc.SetDialer(NewFaultInjectingDialer(FaultPolicy{TruncateRate: 1}, nil))
+	if _, _, err = tsc.SetKey(sk); err == nil {
+		t.Error("truncated frame")
+	}
+
+	tsc.SetDialer(NewFaultInjectingDialer(FaultPolicy{DialFailRate: 1}, nil))
+	if _, _, err = tsc.SetKey(sk); err == nil {
+		t.Error("failed dial")
+	}
+
+	tsc.SetDialer(nil)
+	if _, _, _, err = tsc.GetKeyValue(sk); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetKeyValues(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	if _, _, err := tsc.SetKeyValue(MakeStoreKey("multi", "a"), "one"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tsc.SetKey(MakeStoreKey("multi", "b")); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := tsc.GetKeyValues([]StoreKey{
+		MakeStoreKey("multi", "a"),
+		MakeStoreKey("multi", "b"),
+		MakeStoreKey("multi", "c"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatal("result count")
+	}
+	if !results[0].KeyExists || !results[0].ValueExists || results[0].Value != "one" {
+		t.Error("value")
+	}
+	if results[1].ValueExists {
+		t.Error("key without value")
+	}
+	if results[2].KeyExists {
+		t.Error("missing key")
+	}
+}
+
+type lostResponseConn struct {
+	net.Conn
+	lose *atomic.Int32
+}
+
+func (c *lostResponseConn) Read(b []byte) (int, error) {
+	if c.lose.Add(-1) >= 0 {
+		c.Conn.Close()
+		return 0, io.ErrUnexpectedEOF
+	}
+	return c.Conn.Read(b)
+}
+
+func TestRetries(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	var dialFailures atomic.Int32
+	var lostResponses atomic.Int32
+	tsc.SetDialer(func(ctx context.Context, network, address string) (net.Conn, error) {
+		if dialFailures.Add(-1) >= 0 {
+			return nil, errors.New("dial failure")
+		}
+		cxn, err := (&net.Dialer{}).DialContext(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		return &lostResponseConn{Conn: cxn, lose: &lostResponses}, nil
+	})
+
+	sk := MakeStoreKey("retry")
+	retrying := tsc.With(ClientRetries(2, time.Millisecond))
+
+	// a mutation that was never sent is retried
+	dialFailures.Store(2)
+	if _, _, err := retrying.SetKeyValue(sk, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// a mutation whose response was lost is not retried
+	lostResponses.Store(1)
+	if _, _, err := retrying.SetKeyValue(sk, 2); err == nil {
+		t.Error("ambiguous mutation retried")
+	}
+
+	// reads are retried
+	lostResponses.Store(2)
+	value, _, _, err := retrying.GetKeyValue(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != 2 {
+		t.Error("mutation applied once")
+	}
+
+	// retries are exhausted
+	lostResponses.Store(3)
+	if _, _, _, err = retrying.GetKeyValue(sk); err == nil {
+		t.Error("retry limit")
+	}
+}
+
+func TestSetKeyValuesBestEffort(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	if _, _, err := tsc.SetKeyValue(MakeStoreKey("multi", "b"), "old"); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := tsc.SetKeyValuesBestEffort([]KeyValuePair{
+		{Sk: MakeStoreKey("multi", "a"), Value: 1},
+		{Sk: MakeStoreKey("multi", "b"), Value: "new"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatal("result count")
+	}
+	if !results[0].FirstValue || results[1].FirstValue {
+		t.Error("first value flags")
+	}
+
+	addr, _, err := tsc.LocateKey(MakeStoreKey("multi", "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[1].Address != addr {
+		t.Error("address")
+	}
+
+	value, _, _, err := tsc.GetKeyValue(MakeStoreKey("multi", "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "new" {
+		t.Error("value")
+	}
+}
+
+func TestDeleteMatchingKeys(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	for i := 0; i < 10; i++ {
+		if _, _, err := tsc.SetKeyValue(MakeStoreKey("bulk", fmt.Sprintf("%d", i), "child"), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := tsc.SetKey(MakeStoreKey("keep")); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := tsc.DeleteMatchingKeys(MakeStoreKey("bulk", "*"), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 4 {
+		t.Error("limited delete")
+	}
+
+	// children are deleted with their parents and not counted
+	removed, err = tsc.DeleteMatchingKeys(MakeStoreKey("bulk", "**"), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 6 {
+		t.Error("remaining delete")
+	}
+
+	keys, err := tsc.GetMatchingKeys(MakeStoreKey("**"), 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0].Key != "/bulk" || keys[1].Key != "/keep" {
+		t.Error("unmatched keys")
+	}
+}
+
+func testHistoryLength(t *testing.T, tsc TSClient, sk StoreKey) int {
+	b64, err := tsc.ExportBase64(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	by, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var node struct {
+		History []any `json:"history"`
+	}
+	if err = json.Unmarshal(by, &node); err != nil {
+		t.Fatal(err)
+	}
+	return len(node.History)
+}
+
+func TestCompactHistory(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	counter := MakeStoreKey("counters", "a")
+	aged := MakeStoreKey("aged", "a")
+	parent := MakeStoreKey("counters", "b")
+	for i := 0; i < 5; i++ {
+		for _, sk := range []StoreKey{counter, aged, parent} {
+			if _, _, err := tsc.SetKeyValue(sk, i); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if _, _, err := tsc.SetKey(AppendStoreKeySegmentStrings(parent, "child")); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if _, _, err := tsc.SetKeyValue(aged, 5); err != nil {
+		t.Fatal(err)
+	}
+
+	addr, _, err := tsc.LocateKey(counter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = tsc.ConfigureHistoryPolicy(MakeStoreKey("counters", "*"), 2, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = tsc.ConfigureHistoryPolicy(MakeStoreKey("aged", "*"), 0, 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	compacted, err := tsc.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compacted != 2 {
+		t.Error("compacted count")
+	}
+
+	if testHistoryLength(t, tsc, counter) != 2 {
+		t.Error("max entries")
+	}
+	if testHistoryLength(t, tsc, aged) != 1 {
+		t.Error("max age")
+	}
+	if testHistoryLength(t, tsc, parent) != 5 {
+		t.Error("key with children")
+	}
+
+	value, _, _, err := tsc.GetKeyValue(counter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != 4 {
+		t.Error("current value")
+	}
+
+	verifyAddr, _, err := tsc.LocateKey(counter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verifyAddr != addr {
+		t.Error("address changed")
+	}
+
+	// compacting again has nothing to do
+	if compacted, err = tsc.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if compacted != 0 {
+		t.Error("repeated compaction")
+	}
+
+	if err = tsc.ConfigureHistoryPolicy(MakeStoreKey("counters", "*"), 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	attributes, err := tsc.GetMetadataAttributes(HistoryPolicySk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attributes) != 1 {
+		t.Error("policy removal")
+	}
+}
+
+func TestCountMatchingKeys(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	saved := streamPageSize
+	streamPageSize = 1
+	defer func() { streamPageSize = saved }()
+
+	for i := 0; i < 25; i++ {
+		sk := MakeStoreKey("count", fmt.Sprintf("%02d", i))
+		if i%5 == 0 {
+			if _, _, err := tsc.SetKeyValue(sk, i); err != nil {
+				t.Fatal(err)
+			}
+		} else if _, _, err := tsc.SetKey(sk); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys, withValues, err := tsc.CountMatchingKeys(MakeStoreKey("count", "*"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys != 25 || withValues != 0 {
+		t.Error("key count")
+	}
+
+	keys, withValues, err = tsc.CountMatchingKeys(MakeStoreKey("count", "*"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys != 25 || withValues != 5 {
+		t.Error("value count")
+	}
+
+	keys, _, err = tsc.CountMatchingKeys(MakeStoreKey("missing", "*"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys != 0 {
+		t.Error("no matches")
+	}
+}
+
+func TestCalculateKeyValueFrom(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	priceSk := MakeStoreKey("src", `price "a\b"`, "x/y")
+	quantitySk := MakeStoreKey("src", "it's")
+	if _, _, err := tsc.SetKeyValue(priceSk, 3); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tsc.SetKeyValue(quantitySk, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	totalSk := MakeStoreKey("total")
+	expression := "int(" + tsc.Lookup(priceSk) + " * " + tsc.Lookup(quantitySk) + ")"
+	_, newValue, err := tsc.CalculateKeyValueFrom(totalSk, expression, priceSk, quantitySk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newValue != 12 {
+		t.Error("escaped lookups")
+	}
+
+	scoped := tsc.With(ClientKeyPrefix(MakeStoreKey("src")))
+	_, newValue, err = scoped.CalculateKeyValueFrom(MakeStoreKey("double"), "int("+scoped.Lookup(MakeStoreKey("it's"))+" * 2)", MakeStoreKey("it's"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newValue != 8 {
+		t.Error("prefixed lookup")
+	}
+
+	missingSk := MakeStoreKey("missing")
+	_, _, err = tsc.CalculateKeyValueFrom(totalSk, tsc.Lookup(missingSk)+" + 1", missingSk)
+	if !errors.Is(err, ErrLookupKeyMissing) {
+		t.Error("missing source")
+	}
+}
+
+func TestCalcExpression(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	sk := MakeStoreKey("counter")
+	if _, _, err := tsc.SetKeyValue(sk, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	_, newValue, err := tsc.CalculateKeyValueExpr(sk, Expr("i + {delta}").Bind("delta", 5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newValue != 15 {
+		t.Error("bound int")
+	}
+
+	_, newValue, err = tsc.CalculateKeyValueExpr(sk, Expr("i-{delta}").Bind("delta", -5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newValue != 20 {
+		t.Error("bound negative int")
+	}
+
+	otherSk := MakeStoreKey("other")
+	if _, _, err = tsc.SetKeyValue(otherSk, 2); err != nil {
+		t.Fatal(err)
+	}
+	_, newValue, err = tsc.CalculateKeyValueExpr(sk, Expr("int(i * {factor})").Bind("factor", otherSk))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newValue != 40 {
+		t.Error("bound key")
+	}
+
+	// a string can't break out of its literal
+	_, newValue, err = tsc.CalculateKeyValueExpr(MakeStoreKey("label"), Expr("{name}").Bind("name", `x" + "y`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newValue != `x" + "y` {
+		t.Error("bound string")
+	}
+
+	if _, _, err = tsc.CalculateKeyValueExpr(sk, Expr("i + {delta}")); err == nil {
+		t.Error("unbound parameter")
+	}
+	if _, _, err = tsc.CalculateKeyValueExpr(sk, Expr("i + {delta").Bind("delta", 1)); err == nil {
+		t.Error("unterminated parameter")
+	}
+	if _, _, err = tsc.CalculateKeyValueExpr(sk, Expr("i + ({delta}").Bind("delta", 1)); err == nil {
+		t.Error("syntax error")
+	}
+	if _, _, err = tsc.CalculateKeyValueExpr(sk, Expr("i + x")); err == nil {
+		t.Error("unknown variable")
+	}
+	if _, _, err = tsc.CalculateKeyValueExpr(sk, Expr("i + {delta}").Bind("delta", math.NaN())); err == nil {
+		t.Error("non-finite number")
+	}
+	if _, _, err = tsc.CalculateKeyValueExpr(sk, Expr("i + {delta}").Bind("delta", []int{1})); err == nil {
+		t.Error("unsupported type")
+	}
+
+	value, _, _, err := tsc.GetKeyValue(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != 40 {
+		t.Error("invalid expressions were sent")
+	}
+}
+
+func TestKeyExists(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	sk := MakeStoreKey("parent", "child")
+	if _, _, err := tsc.SetKey(sk); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		sk     StoreKey
+		exists bool
+	}{
+		{sk, true},
+		{MakeStoreKey("parent"), true},
+		{MakeStoreKey("parent", "other"), false},
+		{MakeStoreKey("missing"), false},
+	} {
+		exists, err := tsc.KeyExists(test.sk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists != test.exists {
+			t.Errorf("exists %s", test.sk.Path)
+		}
+	}
+}
+
+func TestLevelKeysStream(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	saved := streamPageSize
+	streamPageSize = 4
+	defer func() { streamPageSize = saved }()
+
+	parentSk := MakeStoreKey("fanout")
+	for i := 0; i < 30; i++ {
+		if _, _, err := tsc.SetKey(AppendStoreKeySegmentStrings(parentSk, fmt.Sprintf("%02d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var segments []string
+	err := tsc.GetLevelKeysStream(parentSk, "*", func(lk LevelKey) bool {
+		segments = append(segments, string(lk.Segment))
+		if len(segments) == 10 {
+			// removing keys already visited doesn't disturb the iteration
+			for i := 0; i < 5; i++ {
+				if _, err := tsc.DeleteKeyTree(AppendStoreKeySegmentStrings(parentSk, fmt.Sprintf("%02d", i))); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 30 {
+		t.Fatal("segment count")
+	}
+	for i, segment := range segments {
+		if segment != fmt.Sprintf("%02d", i) {
+			t.Error("segment order")
+		}
+	}
+
+	count := 0
+	err = tsc.GetLevelKeysStream(parentSk, "1*", func(lk LevelKey) bool {
+		count++
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 10 {
+		t.Error("pattern")
+	}
+}
+
+func TestWalkTree(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	for _, path := range []string{"/org/a/x/1", "/org/a/y", "/org/b", "/other"} {
+		if _, _, err := tsc.SetKey(MakeStoreKeyFromPath(TokenPath(path))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var visited []TokenPath
+	walk := func(km *KeyMatch) bool {
+		visited = append(visited, km.Key)
+		return true
+	}
+
+	if err := tsc.WalkTree(MakeStoreKey("org"), 0, walk); err != nil {
+		t.Fatal(err)
+	}
+	expected := []TokenPath{"/org/a", "/org/b", "/org/a/x", "/org/a/y", "/org/a/x/1"}
+	if len(visited) != len(expected) {
+		t.Fatal("walk count")
+	}
+	for i, key := range expected {
+		if visited[i] != key {
+			t.Error("walk order")
+		}
+	}
+
+	visited = nil
+	if err := tsc.WalkTree(MakeStoreKey("org"), 2, walk); err != nil {
+		t.Fatal(err)
+	}
+	if len(visited) != 4 {
+		t.Error("depth limit")
+	}
+
+	visited = nil
+	err := tsc.WalkTree(MakeStoreKey("org"), 0, func(km *KeyMatch) bool {
+		visited = append(visited, km.Key)
+		return len(visited) < 3
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(visited) != 3 {
+		t.Error("early stop")
+	}
+}
+
+func TestSetTtlMatching(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	for i := 0; i < 5; i++ {
+		if _, _, err := tsc.SetKey(MakeStoreKey("sessions", fmt.Sprintf("%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := tsc.SetKey(MakeStoreKey("users", "1")); err != nil {
+		t.Fatal(err)
+	}
+
+	expiration := time.Now().Add(time.Hour)
+	updated, err := tsc.SetTtlMatching(MakeStoreKey("sessions", "*"), &expiration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated != 5 {
+		t.Error("updated count")
+	}
+
+	ttl, err := tsc.GetKeyTtl(MakeStoreKey("sessions", "3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl == nil || ttl.UnixNano() != expiration.UnixNano() {
+		t.Error("expiration set")
+	}
+	if ttl, err = tsc.GetKeyTtl(MakeStoreKey("users", "1")); err != nil {
+		t.Fatal(err)
+	}
+	if ttl == nil || ttl.UnixNano() != 0 {
+		t.Error("unmatched key")
+	}
+
+	if updated, err = tsc.SetTtlMatching(MakeStoreKey("sessions", "*"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if updated != 5 {
+		t.Error("cleared count")
+	}
+	if ttl, err = tsc.GetKeyTtl(MakeStoreKey("sessions", "3")); err != nil {
+		t.Fatal(err)
+	}
+	if ttl == nil || ttl.UnixNano() != 0 {
+		t.Error("expiration cleared")
+	}
+
+	// an expiration in the past removes the keys, across several pages
+	saved := streamPageSize
+	streamPageSize = 4
+	defer func() { streamPageSize = saved }()
+
+	for i := 5; i < 15; i++ {
+		if _, _, err := tsc.SetKey(MakeStoreKey("sessions", fmt.Sprintf("%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expiration = time.Now().Add(-time.Hour)
+	if updated, err = tsc.SetTtlMatching(MakeStoreKey("sessions", "*"), &expiration); err != nil {
+		t.Fatal(err)
+	}
+	if updated != 15 {
+		t.Errorf("expired count %d", updated)
+	}
+	keys, err := tsc.GetMatchingKeys(MakeStoreKey("sessions", "*"), 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Errorf("%d keys left", len(keys))
+	}
+}
+
+type testTagCodec struct {
+	tag string
+}
+
+func (c testTagCodec) EncodeValue(tokenPath TokenPath, value any) (any, error) {
+	return c.tag + value.(string), nil
+}
+
+func (c testTagCodec) DecodeValue(tokenPath TokenPath, encoded any) (any, error) {
+	text, _ := encoded.(string)
+	if !strings.HasPrefix(text, c.tag) {
+		return nil, errors.New("not encoded")
+	}
+	return strings.TrimPrefix(text, c.tag), nil
+}
+
+func TestProfiles(t *testing.T) {
+	l, tsc := testSetup(t)
+
+	tsc.SetProfile(MakeStoreKey("secret"), &ClientProfile{Codec: testTagCodec{"enc:"}})
+	tsc.SetProfile(MakeStoreKey("secret", "inner"), &ClientProfile{Codec: testTagCodec{"inner:"}})
+	tsc.SetProfile(MakeStoreKey("slow"), &ClientProfile{Timeout: time.Nanosecond})
+
+	if _, _, err := tsc.SetKeyValue(MakeStoreKey("secret", "a"), "hidden"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tsc.SetKeyValue(MakeStoreKey("secret", "inner", "b"), "nested"); err != nil {
+		t.Fatal(err)
+	}
+
+	raw := NewTSClient(l)
+	raw.SetServer("localhost", 6771)
+	defer raw.Close()
+
+	value, _, _, err := raw.GetKeyValue(MakeStoreKey("secret", "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "enc:hidden" {
+		t.Error("encoded value")
+	}
+	if value, _, _, err = raw.GetKeyValue(MakeStoreKey("secret", "inner", "b")); err != nil {
+		t.Fatal(err)
+	}
+	if value != "inner:nested" {
+		t.Error("longest prefix")
+	}
+
+	// derived clients share the profiles
+	scoped := tsc.With(ClientKeyPrefix(MakeStoreKey("secret")))
+	if value, _, _, err = scoped.GetKeyValue(MakeStoreKey("a")); err != nil {
+		t.Fatal(err)
+	}
+	if value != "hidden" {
+		t.Error("decoded value")
+	}
+
+	values, err := tsc.GetMatchingKeyValues(MakeStoreKey("secret", "**"), 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 2 || values[0].CurrentValue != "hidden" || values[1].CurrentValue != "nested" {
+		t.Error("decoded matches")
+	}
+
+	if _, _, _, err = tsc.GetKeyValue(MakeStoreKey("slow", "x")); err == nil {
+		t.Error("profile timeout")
+	}
+	if _, _, _, err = tsc.GetKeyValue(MakeStoreKey("fast", "x")); err != nil {
+		t.Fatal(err)
+	}
+
+	tsc.SetProfile(MakeStoreKey("secret"), nil)
+	if value, _, _, err = tsc.GetKeyValue(MakeStoreKey("secret", "a")); err != nil {
+		t.Fatal(err)
+	}
+	if value != "enc:hidden" {
+		t.Error("profile removal")
+	}
+}
+
+func TestGetKeyChildrenCount(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	saved := streamPageSize
+	streamPageSize = 1
+	defer func() { streamPageSize = saved }()
+
+	parentSk := MakeStoreKey("tree", "a*")
+	if _, _, err := tsc.SetKeyValue(parentSk, "parent"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tsc.SetKey(MakeStoreKey("tree", "ab")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 15; i++ {
+		if _, _, err := tsc.SetKey(AppendStoreKeySegmentStrings(parentSk, fmt.Sprintf("%02d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	children, hasValue, err := tsc.GetKeyChildrenCount(parentSk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if children != 15 || !hasValue {
+		t.Error("parent count")
+	}
+
+	children, hasValue, err = tsc.GetKeyChildrenCount(MakeStoreKey("tree", "ab"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if children != 0 || hasValue {
+		t.Error("sibling count")
+	}
+
+	children, hasValue, err = tsc.GetKeyChildrenCount(MakeStoreKey("tree"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if children != 2 || hasValue {
+		t.Error("tree count")
+	}
+
+	children, hasValue, err = tsc.GetKeyChildrenCount(MakeStoreKey("missing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if children != 0 || hasValue {
+		t.Error("missing count")
+	}
+}
+
+func TestGetSetKeyValue(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	sk := MakeStoreKey("counter")
+	addr, original, err := tsc.GetSetKeyValue(sk, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr == 0 || original != nil {
+		t.Error("first swap")
+	}
+
+	addr2, original, err := tsc.GetSetKeyValue(sk, "two")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr2 != addr || original != 1 {
+		t.Error("second swap")
+	}
+
+	value, _, _, err := tsc.GetKeyValue(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "two" {
+		t.Error("current value")
+	}
+}
+
+func TestIncrementKeyValue(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	sk := MakeStoreKey("hits")
+	n, err := tsc.IncrementKeyValue(sk, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 5 {
+		t.Error("first increment")
+	}
+
+	if n, err = tsc.IncrementKeyValue(sk, -7); err != nil {
+		t.Fatal(err)
+	}
+	if n != -2 {
+		t.Error("decrement")
+	}
+
+	value, _, _, err := tsc.GetKeyValue(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != -2 {
+		t.Error("stored value")
+	}
+
+	if _, err = tsc.IncrementKeyValue(sk, math.MaxInt32); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tsc.IncrementKeyValue(sk, 3); err != ErrIncrementNotApplied {
+		t.Error("overflow accepted")
+	}
+	if value, _, _, err = tsc.GetKeyValue(sk); err != nil {
+		t.Fatal(err)
+	}
+	if value != math.MaxInt32-2 {
+		t.Error("value changed by overflow")
+	}
+	if _, err = tsc.IncrementKeyValue(sk, math.MinInt64); err != ErrIncrementNotApplied {
+		t.Error("underflow accepted")
+	}
+
+	fsk := MakeStoreKey("ratio")
+	f, err := tsc.IncrementKeyValueFloat(fsk, 1.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f != 1.5 {
+		t.Error("first float increment")
+	}
+
+	if f, err = tsc.IncrementKeyValueFloat(fsk, -0.25); err != nil {
+		t.Fatal(err)
+	}
+	if f != 1.25 {
+		t.Error("float decrement")
+	}
+}
+
+func TestUpsertKeyJson(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	sk := MakeStoreKey("doc")
+	addr, err := tsc.UpsertKeyJson(sk, map[string]any{"a": "one", "b": "two"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr == 0 {
+		t.Error("create address")
+	}
+
+	addr2, err := tsc.UpsertKeyJson(sk, map[string]any{"b": "three", "c": "four"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr2 != addr {
+		t.Error("merge address")
+	}
+
+	jsonData, err := tsc.GetKeyAsJson(sk, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doesJsonMatch(t, "upsert", map[string]any{"a": "one", "b": "three", "c": "four"}, jsonData)
+}
+
+func TestSubInterfaces(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	var writer KeyWriter = tsc
+	var reader KeyReader = tsc.With(ClientReadOnly())
+
+	sk := MakeStoreKey("split")
+	if _, _, err := writer.SetKeyValue(sk, "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	value, _, _, err := reader.GetKeyValue(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "value" {
+		t.Error("read through sub-interface")
+	}
+}
+
+func TestDeleteKeyJsonPath(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	sk := MakeStoreKey("zoo")
+	doc := map[string]any{
+		"animals": []any{
+			map[string]any{"name": "dog", "sound": "bark"},
+			map[string]any{"name": "cat", "sound": "meow"},
+		},
+		"config": map[string]any{"log.level": "debug", "owner": "sam"},
+	}
+	if _, _, err := tsc.SetKeyJson(sk, doc, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := tsc.DeleteKeyJsonPath(sk, `$.animals[1].sound`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !removed {
+		t.Error("delete array element field")
+	}
+
+	if removed, err = tsc.DeleteKeyJsonPath(sk, `config["log.level"]`); err != nil {
+		t.Fatal(err)
+	}
+	if !removed {
+		t.Error("delete quoted field")
+	}
+
+	if removed, err = tsc.DeleteKeyJsonPath(sk, `config.missing`); err != nil {
+		t.Fatal(err)
+	}
+	if removed {
+		t.Error("delete missing field")
+	}
+
+	jsonData, err := tsc.GetKeyAsJson(sk, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doesJsonMatch(t, "delete path", map[string]any{
+		"animals": []any{
+			map[string]any{"name": "dog", "sound": "bark"},
+			map[string]any{"name": "cat"},
+		},
+		"config": map[string]any{"owner": "sam"},
+	}, jsonData)
+
+	for _, invalid := range []string{"", "$", "a..b", "a[x]", "a[1", `a["b]`, "a]"} {
+		if _, err = tsc.DeleteKeyJsonPath(sk, invalid); err == nil {
+			t.Errorf("invalid path %s", invalid)
+		}
+	}
+}
+
+func TestValueSizeStats(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	tsc.TrackValueSizes(MakeStoreKey("small"), true)
+	tsc.TrackValueSizes(MakeStoreKey("big"), true)
+
+	for i := 1; i <= 100; i++ {
+		sk := MakeStoreKey("small", fmt.Sprintf("%d", i))
+		if _, _, err := tsc.SetKeyValue(sk, strings.Repeat("x", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bigSk := MakeStoreKey("big", "blob")
+	if _, _, err := tsc.SetKeyValue(bigSk, bytes.Repeat([]byte{0, 0x5c, 0xff}, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := tsc.GetKeyValue(bigSk); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tsc.SetKeyValue(MakeStoreKey("untracked"), "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := tsc.GetValueSizeStats()
+	if len(stats) != 2 {
+		t.Fatal("tracked prefixes")
+	}
+
+	big := stats[0]
+	if big.Prefix.Path != "/big" || big.Written.Count != 1 || big.Written.Max != 3000 || big.Read.Count != 1 || big.Read.P50 != 3000 {
+		t.Error("big stats")
+	}
+
+	small := stats[1]
+	if small.Prefix.Path != "/small" || small.Written.Count != 100 || small.Written.P50 != 50 || small.Written.P95 != 95 || small.Written.Max != 100 || small.Read.Count != 0 {
+		t.Error("small stats")
+	}
+
+	tsc.ResetValueSizeStats()
+	tsc.TrackValueSizes(MakeStoreKey("big"), false)
+	stats = tsc.GetValueSizeStats()
+	if len(stats) != 1 || stats[0].Written.Count != 0 {
+		t.Error("reset stats")
+	}
+}
+
+type (
+	testStructBase struct {
+		Id    int    `treestore:"id"`
+		Owner string `treestore:"owner,metadata"`
+	}
+
+	testStructToy struct {
+		Name  string `treestore:"name"`
+		Color string `treestore:"color,metadata"`
+	}
+
+	testStructPet struct {
+		testStructBase
+		Name     string            `treestore:"name"`
+		Age      float64           `treestore:"age,omitempty"`
+		Toys     []testStructToy   `treestore:"toys"`
+		Best     *testStructToy    `treestore:"best"`
+		Labels   map[string]string `treestore:"labels"`
+		Born     time.Time         `treestore:"born"`
+		Untagged bool
+		Skipped  string `treestore:"-"`
+	}
+)
+
+func TestKeyStruct(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	sk := MakeStoreKey("pets", "rex")
+	pet := testStructPet{
+		testStructBase: testStructBase{Id: 7, Owner: "sam"},
+		Name:           "rex",
+		Toys:           []testStructToy{{Name: "ball", Color: "red"}, {Name: "rope"}},
+		Best:           &testStructToy{Name: "bone", Color: "white"},
+		Labels:         map[string]string{"breed": "mutt"},
+		Born:           time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		Untagged:       true,
+		Skipped:        "skipped",
+	}
+	if _, _, err := tsc.SetKeyStruct(sk, &pet); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, _, err := tsc.GetKeyValue(AppendStoreKeySegmentStrings(sk, "Untagged")); err != nil {
+		t.Fatal(err)
+	}
+	exists, _, err := tsc.GetMetadataAttribute(AppendStoreKeySegmentStrings(sk, "toys"), "color")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Error("metadata on array key")
+	}
+
+	var loaded testStructPet
+	exists, err = tsc.GetKeyStruct(sk, &loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists {
+		t.Fatal("struct exists")
+	}
+
+	pet.Skipped = ""
+	if loaded.Id != 7 || loaded.Owner != "sam" || loaded.Name != "rex" || loaded.Age != 0 || !loaded.Untagged || loaded.Skipped != "" {
+		t.Error("struct fields")
+	}
+	if len(loaded.Toys) != 2 || loaded.Toys[0] != pet.Toys[0] || loaded.Toys[1] != pet.Toys[1] {
+		t.Error("struct slice")
+	}
+	if loaded.Best == nil || *loaded.Best != *pet.Best {
+		t.Error("struct pointer")
+	}
+	if loaded.Labels["breed"] != "mutt" || !loaded.Born.Equal(pet.Born) {
+		t.Error("struct map and time")
+	}
+
+	if exists, err = tsc.GetKeyStruct(MakeStoreKey("pets", "missing"), &loaded); err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Error("missing struct")
+	}
+
+	if _, err = tsc.GetKeyStruct(sk, loaded); err == nil {
+		t.Error("non-pointer")
+	}
+}
+
+func TestLockWarning(t *testing.T) {
+	l, tsc := testSetup(t)
+	tl := l.(lane.TestingLane)
+
+	tsc.SetDialer(NewFaultInjectingDialer(FaultPolicy{SlowReadDelay: 20 * time.Millisecond}, nil))
+	warned := tsc.With(ClientLockWarning(10 * time.Millisecond))
+
+	if _, _, err := warned.SetKeyValue(MakeStoreKey("plain"), 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tsc.MergeKeyJson(MakeStoreKey("quiet"), map[string]any{"a": 1}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(tl.EventsToString(), "long lock") {
+		t.Error("unexpected warning")
+	}
+
+	if _, err := warned.MergeKeyJson(MakeStoreKey("doc"), map[string]any{"a": 1}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(tl.EventsToString(), "WARN\tlong lock: command=mergejson key=/doc elapsed=") {
+		t.Error("long lock warning")
+	}
+}
+
+func TestJsonCache(t *testing.T) {
+	l, tsc := testSetup(t)
+
+	other := NewTSClient(l)
+	other.SetServer("localhost", 6771)
+	defer other.Close()
+
+	tsc.SetJsonCache(NewJsonCache(10, 0))
+
+	sk := MakeStoreKey("cached", "doc")
+	if _, _, err := tsc.SetKeyJson(sk, map[string]any{"a": "one"}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	jsonData, err := tsc.GetKeyAsJson(sk, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doesJsonMatch(t, "first read", map[string]any{"a": "one"}, jsonData)
+
+	// a change by another client isn't seen until invalidated
+	if _, _, err = other.SetKeyValue(AppendStoreKeySegmentStrings(sk, "a"), "two"); err != nil {
+		t.Fatal(err)
+	}
+	jsonData, err = tsc.GetKeyAsJson(sk, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doesJsonMatch(t, "cached read", map[string]any{"a": "one"}, jsonData)
+
+	b64, err := tsc.GetKeyAsJsonBase64(sk, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b64 != base64.StdEncoding.EncodeToString([]byte(`{"a":"one"}`)) {
+		t.Error("cached base64")
+	}
+
+	tsc.InvalidateJsonCache(sk)
+	jsonBytes, err := tsc.GetKeyAsJsonBytes(sk, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(jsonBytes) != `{"a":"two"}` {
+		t.Error("invalidated read")
+	}
+
+	// a write through this client, even to a child, invalidates
+	if _, _, err = tsc.SetKeyValue(AppendStoreKeySegmentStrings(sk, "b"), "three"); err != nil {
+		t.Fatal(err)
+	}
+	jsonData, err = tsc.GetKeyAsJson(MakeStoreKey("cached"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doesJsonMatch(t, "write invalidated", map[string]any{"doc": map[string]any{"a": "two", "b": "three"}}, jsonData)
+
+	// entries expire
+	tsc.SetJsonCache(NewJsonCache(10, 10*time.Millisecond))
+	if _, err = tsc.GetKeyAsJson(sk, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = other.DeleteKeyTree(AppendStoreKeySegmentStrings(sk, "b")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	jsonData, err = tsc.GetKeyAsJson(sk, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doesJsonMatch(t, "expired", map[string]any{"a": "two"}, jsonData)
+}
+
+func TestJsonCacheEviction(t *testing.T) {
+	cache := NewJsonCache(2, 0)
+	cache.Put(JsonCacheKey{Key: "/a"}, []byte("1"))
+	cache.Put(JsonCacheKey{Key: "/b"}, []byte("2"))
+	cache.Get(JsonCacheKey{Key: "/a"})
+	cache.Put(JsonCacheKey{Key: "/c"}, []byte("3"))
+
+	if _, found := cache.Get(JsonCacheKey{Key: "/b"}); found {
+		t.Error("least recently used kept")
+	}
+	if _, found := cache.Get(JsonCacheKey{Key: "/a"}); !found {
+		t.Error("recently used evicted")
+	}
+
+	cache.Invalidate("/c/d")
+	if _, found := cache.Get(JsonCacheKey{Key: "/c"}); found {
+		t.Error("ancestor not invalidated")
+	}
+	if _, found := cache.Get(JsonCacheKey{Key: "/a"}); !found {
+		t.Error("unrelated invalidated")
+	}
+}
+
+type testJsonValue struct {
+	Name  string
+	Count int
+}
+
+func TestJsonValueTypes(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	// the server stores json values from clients as bytes
+	sk := MakeStoreKey("generic")
+	if _, _, err := tsc.SetKeyValue(sk, map[string]any{"a": 1}); err != nil {
+		t.Fatal(err)
+	}
+	value, _, _, err := tsc.GetKeyValue(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(value.([]byte), []byte(`{"a":1}`)) {
+		t.Error("client json value")
+	}
+
+	val, valType, err := nativeValueToCmdline(map[string]any{"a": []any{1, "two"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err = cmdlineToNativeValue(val, valType); err != nil {
+		t.Fatal(err)
+	}
+	doesJsonMatch(t, "generic", map[string]any{"a": []any{float64(1), "two"}}, value)
+
+	RegisterJsonValueType(testJsonValue{})
+	RegisterJsonValueType(&testJsonValue{})
+
+	if val, valType, err = nativeValueToCmdline(testJsonValue{Name: "x", Count: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if value, err = cmdlineToNativeValue(val, valType); err != nil {
+		t.Fatal(err)
+	}
+	if value != (testJsonValue{Name: "x", Count: 3}) {
+		t.Error("registered type")
+	}
+
+	if val, valType, err = nativeValueToCmdline(&testJsonValue{Name: "y", Count: 4}); err != nil {
+		t.Fatal(err)
+	}
+	if value, err = cmdlineToNativeValue(val, valType); err != nil {
+		t.Fatal(err)
+	}
+	ptr, isPtr := value.(*testJsonValue)
+	if !isPtr || *ptr != (testJsonValue{Name: "y", Count: 4}) {
+		t.Error("registered pointer type")
+	}
+
+	if _, err = cmdlineToNativeValue("{", valType); err == nil {
+		t.Error("invalid json")
+	}
+}
+
+func TestJsonAutoBase64(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	big := map[string]any{}
+	for i := 0; i < 2000; i++ {
+		big[fmt.Sprintf("field%d", i)] = strings.Repeat("x", 20)
+	}
+	escaped := map[string]any{"path": `c:\temp\n`, "quote": `say "hi"`}
+
+	sk := MakeStoreKey("big")
+	if _, _, err := tsc.SetKeyJson(sk, big, 0); err != nil {
+		t.Fatal(err)
+	}
+	jsonData, err := tsc.GetKeyAsJson(sk, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doesJsonMatch(t, "big", big, jsonData)
+
+	sk = MakeStoreKey("escaped")
+	if _, _, err = tsc.SetKeyJson(sk, escaped, 0); err != nil {
+		t.Fatal(err)
+	}
+	if jsonData, err = tsc.GetKeyAsJson(sk, 0); err != nil {
+		t.Fatal(err)
+	}
+	doesJsonMatch(t, "escaped", escaped, jsonData)
+
+	exported, err := tsc.Export(MakeStoreKey("big"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tsc2 := tsc.With(ClientBase64Threshold(0))
+	sk = MakeStoreKey("imported")
+	if err = tsc2.Import(sk, exported); err != nil {
+		t.Fatal(err)
+	}
+	if jsonData, err = tsc.GetKeyAsJson(sk, 0); err != nil {
+		t.Fatal(err)
+	}
+	doesJsonMatch(t, "imported", big, jsonData)
+
+	if _, err = tsc2.MergeKeyJson(MakeStoreKey("escaped"), map[string]any{"more": 1}, 0); err != nil {
+		t.Fatal(err)
+	}
+	escaped["more"] = float64(1)
+	if jsonData, err = tsc.GetKeyAsJson(MakeStoreKey("escaped"), 0); err != nil {
+		t.Fatal(err)
+	}
+	doesJsonMatch(t, "merged", escaped, jsonData)
+}
+
+func TestFloatValuePrecision(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	values := []float64{
+		0.1,
+		math.Pi,
+		1.0 / 3.0,
+		math.MaxFloat64,
+		math.SmallestNonzeroFloat64,
+		-123456789.123456789,
+		math.Copysign(0, -1),
+		math.Inf(1),
+		math.Inf(-1),
+	}
+
+	for _, f := range values {
+		val, valType, err := nativeValueToCmdline(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, err := cmdlineToNativeValue(val, valType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f2, isFloat := value.(float64)
+		if !isFloat || math.Float64bits(f2) != math.Float64bits(f) {
+			t.Errorf("float64 %v round trip: %v", f, value)
+		}
+	}
+
+	val, valType, err := nativeValueToCmdline(math.NaN())
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := cmdlineToNativeValue(val, valType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f, isFloat := value.(float64); !isFloat || !math.IsNaN(f) {
+		t.Error("NaN round trip")
+	}
+
+	// the server keeps full precision of json numbers
+	sk := MakeStoreKey("doc")
+	if _, _, err = tsc.SetKeyJson(sk, map[string]any{"pi": math.Pi}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if value, _, _, err = tsc.GetKeyValue(MakeStoreKey("doc", "pi")); err != nil {
+		t.Fatal(err)
+	}
+	if value != math.Pi {
+		t.Errorf("json number precision: %v", value)
+	}
+
+	for i, f := range []float64{math.Inf(1), math.Inf(-1), math.NaN(), -2.5} {
+		sk = MakeStoreKey("special", strconv.Itoa(i))
+		if _, _, err = tsc.SetKeyValue(sk, f); err != nil {
+			t.Fatal(err)
+		}
+		if value, _, _, err = tsc.GetKeyValue(sk); err != nil {
+			t.Fatal(err)
+		}
+		f2, isFloat := value.(float64)
+		if !isFloat || (math.IsNaN(f) != math.IsNaN(f2)) || (!math.IsNaN(f) && f2 != f) {
+			t.Errorf("special value %v: %v", f, value)
+		}
+	}
+
+	f32 := float32(math.Pi)
+	sk = MakeStoreKey("float32")
+	if _, _, err = tsc.SetKeyValue(sk, f32); err != nil {
+		t.Fatal(err)
+	}
+	if value, _, _, err = tsc.GetKeyValue(sk); err != nil {
+		t.Fatal(err)
+	}
+	if value != f32 {
+		t.Error("float32 round trip")
+	}
+}
+
+func TestRequestTooLarge(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	limited := tsc.With(ClientMaxRequestSize(1024))
+
+	_, _, err := limited.SetKeyValue(MakeStoreKey("small"), "value")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = limited.SetKeyValue(MakeStoreKey("large"), strings.Repeat("x", 2000))
+	if !errors.Is(err, ErrRequestTooLarge) {
+		t.Fatal("expected ErrRequestTooLarge")
+	}
+	if !strings.Contains(err.Error(), "argument 2 is 2000 bytes") {
+		t.Error(err.Error())
+	}
+
+	_, _, err = limited.SetKeyJson(MakeStoreKey("doc"), map[string]any{"text": strings.Repeat("y", 2000)}, 0)
+	if !errors.Is(err, ErrRequestTooLarge) {
+		t.Error("json too large")
+	}
+
+	// the default limit allows the value
+	if _, _, err = tsc.SetKeyValue(MakeStoreKey("large"), strings.Repeat("x", 2000)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBigNumberValues(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	bi, _ := new(big.Int).SetString("-123456789012345678901234567890", 10)
+	sk := MakeStoreKey("bigint")
+	if _, _, err := tsc.SetKeyValue(sk, bi); err != nil {
+		t.Fatal(err)
+	}
+	bi2, exists, err := tsc.GetKeyValueBigInt(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists || bi2.Cmp(bi) != 0 {
+		t.Errorf("big int: %v", bi2)
+	}
+
+	bf, _, _ := big.ParseFloat("12345678901234567890.0987654321", 10, 200, big.ToNearestEven)
+	sk = MakeStoreKey("bigfloat")
+	if _, _, err = tsc.SetKeyValue(sk, bf); err != nil {
+		t.Fatal(err)
+	}
+	bf2, exists, err := tsc.GetKeyValueBigFloat(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists || bf2.Text('g', -1) != bf.Text('g', -1) {
+		t.Errorf("big float: %v", bf2)
+	}
+
+	sk = MakeStoreKey("int")
+	if _, _, err = tsc.SetKeyValue(sk, int64(-42)); err != nil {
+		t.Fatal(err)
+	}
+	if bi2, _, err = tsc.GetKeyValueBigInt(sk); err != nil {
+		t.Fatal(err)
+	}
+	if bi2.Int64() != -42 {
+		t.Error("int conversion")
+	}
+	if bf2, _, err = tsc.GetKeyValueBigFloat(sk); err != nil {
+		t.Fatal(err)
+	}
+	if f, _ := bf2.Float64(); f != -42 {
+		t.Error("float conversion")
+	}
+
+	sk = MakeStoreKey("text")
+	if _, _, err = tsc.SetKeyValue(sk, "not a number"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = tsc.GetKeyValueBigInt(sk); err == nil {
+		t.Error("invalid text")
+	}
+
+	if _, exists, err = tsc.GetKeyValueBigInt(MakeStoreKey("missing")); err != nil || exists {
+		t.Error("missing key")
+	}
+
+	// values decoded with their value type
+	val, valType, err := nativeValueToCmdline(bf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := cmdlineToNativeValue(val, valType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded, isBig := value.(*big.Float); !isBig || decoded.Text('g', -1) != bf.Text('g', -1) {
+		t.Errorf("decoded big float: %v", value)
+	}
+
+	if _, _, err = tsc.SetKeyValue(sk, (*big.Int)(nil)); err == nil {
+		t.Error("nil big int")
+	}
+}
+
+func TestDrainToStandby(t *testing.T) {
+	l, tsc := testSetup(t)
+
+	standby := tscmdsrv.NewTreeStoreCmdLineServer(l)
+	standby.StartServer("localhost", 6772, "", 100, nil)
+	t.Cleanup(func() {
+		standby.StopServer()
+		standby.WaitForTermination()
+	})
+
+	if err := tsc.Drain(); !errors.Is(err, ErrNoStandby) {
+		t.Error("drain without standby")
+	}
+
+	sk := MakeStoreKey("server")
+	if _, _, err := tsc.SetKeyValue(sk, "primary"); err != nil {
+		t.Fatal(err)
+	}
+
+	tsc.SetStandbyServer("localhost", 6772)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, _, err := tsc.GetKeyValue(sk); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	if err := tsc.Drain(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	value, keyExists, _, err := tsc.GetKeyValue(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyExists {
+		t.Errorf("expected the standby server, got %v", value)
+	}
+
+	// the drained server becomes the standby
+	if err = tsc.Drain(); err != nil {
+		t.Fatal(err)
+	}
+	if value, _, _, err = tsc.GetKeyValue(sk); err != nil {
+		t.Fatal(err)
+	}
+	if value != "primary" {
+		t.Error("switch back")
+	}
+}
+
+func TestValueEncodeErr(t *testing.T) {
+	by, err := ValueEncodeErr(map[string]int{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := ValueDecodeErr[map[string]int](by)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m["a"] != 1 {
+		t.Error("round trip")
+	}
+
+	if _, err = ValueEncodeErr(func() {}); err == nil {
+		t.Error("unencodable value")
+	}
+
+	if _, err = ValueDecodeErr[int]([]byte("not gob")); err == nil {
+		t.Error("invalid data")
+	}
+
+	if n, err := ValueDecodeErr[int](nil); err != nil || n != 0 {
+		t.Error("nil data")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("ValueDecode should panic")
+		}
+	}()
+	ValueDecode[int]([]byte("not gob"))
+}
+
+func TestKeyValueNil(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	sk := MakeStoreKey("parent")
+	child := MakeStoreKey("parent", "child")
+	if _, _, err := tsc.SetKeyValue(child, "x"); err != nil {
+		t.Fatal(err)
+	}
+
+	value, keyExists, valueExists, err := tsc.GetKeyValue(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if valueExists || value != nil {
+		t.Error("no value")
+	}
+
+	addr, err := tsc.SetKeyValueNil(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr == 0 {
+		t.Error("address")
+	}
+
+	value, keyExists, valueExists, err = tsc.GetKeyValue(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keyExists || !valueExists || value != nil {
+		t.Error("nil value")
+	}
+
+	if value, _, _, err = tsc.GetKeyValue(child); err != nil || value != "x" {
+		t.Error("child kept")
+	}
+
+	results, err := tsc.GetKeyValues([]StoreKey{sk, child, MakeStoreKey("missing")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !results[0].ValueIsNil || results[1].ValueIsNil || results[2].ValueIsNil {
+		t.Error("ValueIsNil")
+	}
+
+	result, err := tsc.GetKeyValueAsync(sk).Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.ValueIsNil {
+		t.Error("async ValueIsNil")
+	}
+
+	if _, err = tsc.SetKeyValueNil(MakeStoreKey("new")); err != nil {
+		t.Fatal(err)
+	}
+	if _, keyExists, valueExists, err = tsc.GetKeyValue(MakeStoreKey("new")); err != nil || !keyExists || !valueExists {
+		t.Error("new nil key")
+	}
+}
+
+func TestKeyValueBase64(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	blob := make([]byte, 4096)
+	for i := range blob {
+		blob[i] = byte(i * 7)
+	}
+	blob[0] = '-'
+
+	sk := MakeStoreKey("blob")
+	_, firstValue, err := tsc.SetKeyValueBase64(sk, base64.StdEncoding.EncodeToString(blob))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !firstValue {
+		t.Error("first value")
+	}
+
+	value, _, _, err := tsc.GetKeyValue(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(value.([]byte), blob) {
+		t.Error("stored bytes")
+	}
+
+	b64, keyExists, valueExists, err := tsc.GetKeyValueBase64(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keyExists || !valueExists || b64 != base64.StdEncoding.EncodeToString(blob) {
+		t.Error("base64 value")
+	}
+
+	if _, _, err = tsc.SetKeyValue(sk, 1234); err != nil {
+		t.Fatal(err)
+	}
+	if b64, _, _, err = tsc.GetKeyValueBase64(sk); err != nil {
+		t.Fatal(err)
+	}
+	if b64 != base64.StdEncoding.EncodeToString([]byte{0, 0, 4, 0xD2}) {
+		t.Error("int bytes")
+	}
+
+	if _, _, err = tsc.SetKeyValueBase64(sk, "not base64!"); err == nil {
+		t.Error("invalid base64")
+	}
+
+	if _, keyExists, valueExists, err = tsc.GetKeyValueBase64(MakeStoreKey("missing")); err != nil || keyExists || valueExists {
+		t.Error("missing key")
+	}
+
+	if string(valueUnescape(`a\zzb\41`)) != `a\zzbA` {
+		t.Error("invalid escape")
+	}
+}
+
+func TestTypedMetadata(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	sk := MakeStoreKey("key")
+	if _, _, err := tsc.SetKey(sk); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	if _, _, err := tsc.SetMetadataAttributeTyped(sk, "count", -42); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tsc.SetMetadataAttributeTyped(sk, "ratio", 0.25); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tsc.SetMetadataAttributeTyped(sk, "enabled", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tsc.SetMetadataAttributeTyped(sk, "updated", now); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tsc.SetMetadataAttributeTyped(sk, "bad", struct{}{}); err == nil {
+		t.Error("unsupported type")
+	}
+
+	exists, n, err := tsc.GetMetadataAttributeInt(sk, "count")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists || n != -42 {
+		t.Error("int")
+	}
+
+	exists, f, err := tsc.GetMetadataAttributeFloat(sk, "ratio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists || f != 0.25 {
+		t.Error("float")
+	}
+
+	exists, b, err := tsc.GetMetadataAttributeBool(sk, "enabled")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists || !b {
+		t.Error("bool")
+	}
+
+	exists, tm, err := tsc.GetMetadataAttributeTime(sk, "updated")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists || !tm.Equal(now) {
+		t.Error("time")
+	}
+
+	// the stored text is the number itself, for the untyped readers too
+	exists, text, err := tsc.GetMetadataAttribute(sk, "count")
+	if err != nil || !exists || text != "-42" {
+		t.Errorf("raw text %q", text)
+	}
+	keys, err := tsc.GetMatchingKeysEx(sk, 0, 10, MatchOptions{MetadataAttribute: "count", MetadataValue: &text})
+	if err != nil || len(keys) != 1 || keys[0].Metadata["count"] != "-42" {
+		t.Error("match on negative metadata")
+	}
+
+	// only the leading dash is escaped in the stored text
+	stored := func(attribute string) string {
+		response, err := tsc.RawCommand("getmeta", tsc.(*tsClient).keyArg(sk), attribute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, _ := response["value"].(string)
+		return value
+	}
+	if text = stored("count"); text != `\2D42` {
+		t.Errorf("stored negative %q", text)
+	}
+	for _, value := range []string{`-c:\41\tmp`, `C:\temp`, `\2D`, `\5Cx`} {
+		if _, _, err = tsc.SetMetadataAttribute(sk, "path", value); err != nil {
+			t.Fatal(err)
+		}
+		if _, text, err = tsc.GetMetadataAttribute(sk, "path"); err != nil || text != value {
+			t.Errorf("round trip %q as %q", value, text)
+		}
+	}
+	if _, _, err = tsc.SetMetadataAttribute(sk, "path", `C:\temp`); err != nil {
+		t.Fatal(err)
+	}
+	if text = stored("path"); text != `C:\temp` {
+		t.Errorf("stored path %q", text)
+	}
+
+	// metadata written by other clients reads back as stored
+	if _, err = tsc.RawCommand("setmeta", tsc.(*tsClient).keyArg(sk), "foreign", `C:\Data`); err != nil {
+		t.Fatal(err)
+	}
+	if _, text, err = tsc.GetMetadataAttribute(sk, "foreign"); err != nil || text != `C:\Data` {
+		t.Errorf("foreign text %q", text)
+	}
+
+	if _, _, err = tsc.GetMetadataAttributeInt(sk, "enabled"); err == nil {
+		t.Error("not an int")
+	}
+
+	if exists, _, err = tsc.GetMetadataAttributeBool(sk, "missing"); err != nil || exists {
+		t.Error("missing attribute")
+	}
+
+	// json arrays are flagged with a bool attribute
+	if _, _, err = tsc.SetKeyJson(MakeStoreKey("doc"), map[string]any{"list": []any{1, 2}}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if exists, b, err = tsc.GetMetadataAttributeBool(MakeStoreKey("doc", "list"), "array"); err != nil || !exists || !b {
+		t.Error("array attribute")
+	}
+}
+
+func TestListOps(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	sk := MakeStoreKey("queue")
+	if err := tsc.ListPush(sk, "a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tsc.ListPush(sk, map[string]any{"n": 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	length, err := tsc.ListLength(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if length != 3 {
+		t.Errorf("length %d", length)
+	}
+
+	values, err := tsc.ListRange(sk, 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doesJsonMatch(t, "all", []any{"a", "b", map[string]any{"n": float64(3)}}, values)
+
+	if values, err = tsc.ListRange(sk, -2, 100); err != nil {
+		t.Fatal(err)
+	}
+	doesJsonMatch(t, "tail", []any{"b", map[string]any{"n": float64(3)}}, values)
+
+	if values, err = tsc.ListRange(sk, 2, 1); err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 0 {
+		t.Error("empty range")
+	}
+
+	value, exists, err := tsc.ListPop(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists {
+		t.Fatal("pop")
+	}
+	doesJsonMatch(t, "popped", map[string]any{"n": float64(3)}, value)
+
+	if value, _, err = tsc.ListPop(sk); err != nil || value != "b" {
+		t.Errorf("pop b: %v", value)
+	}
+
+	// a push after a pop continues from the end
+	if err = tsc.ListPush(sk, "c"); err != nil {
+		t.Fatal(err)
+	}
+	if values, err = tsc.ListRange(sk, 0, -1); err != nil {
+		t.Fatal(err)
+	}
+	doesJsonMatch(t, "after pop", []any{"a", "c"}, values)
+
+	exists, isArray, err := tsc.GetMetadataAttributeBool(sk, "array")
+	if err != nil || !exists || !isArray {
+		t.Error("array metadata")
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, exists, err = tsc.ListPop(sk); err != nil || !exists {
+			t.Fatal("drain")
+		}
+	}
+	if _, exists, err = tsc.ListPop(sk); err != nil || exists {
+		t.Error("empty pop")
+	}
+
+	if values, err = tsc.ListRange(MakeStoreKey("missing"), 0, -1); err != nil || values != nil {
+		t.Error("missing list")
+	}
+}
+
+func TestSortedSet(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	sk := MakeStoreKey("leaderboard")
+	scores := map[string]float64{"ann": 10.5, "bob": -3, "cy": 42, "di": 0, "ed": 1e9}
+	for member, score := range scores {
+		added, err := tsc.ZAdd(sk, member, score)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !added {
+			t.Errorf("added %s", member)
+		}
+	}
+
+	count, err := tsc.ZCard(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 5 {
+		t.Errorf("count %d", count)
+	}
+
+	members, err := tsc.ZRange(sk, 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ZMember{{"bob", -3}, {"di", 0}, {"ann", 10.5}, {"cy", 42}, {"ed", 1e9}}
+	if fmt.Sprint(members) != fmt.Sprint(expected) {
+		t.Errorf("range %v", members)
+	}
+
+	top, err := tsc.ZTop(sk, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(top) != fmt.Sprint([]ZMember{{"ed", 1e9}, {"cy", 42}}) {
+		t.Errorf("top %v", top)
+	}
+
+	added, err := tsc.ZAdd(sk, "bob", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added {
+		t.Error("score update")
+	}
+
+	score, err := tsc.ZIncrBy(sk, "di", 0.1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if score != 0.1 {
+		t.Errorf("incr %v", score)
+	}
+	if score, exists, err := tsc.ZScore(sk, "di"); err != nil || !exists || score != 0.1 {
+		t.Error("exact score")
+	}
+
+	if top, err = tsc.ZTop(sk, 3); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(top) != fmt.Sprint([]ZMember{{"ed", 1e9}, {"bob", 100}, {"cy", 42}}) {
+		t.Errorf("top after update %v", top)
+	}
+
+	removed, err := tsc.ZRem(sk, "cy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !removed {
+		t.Error("removed")
+	}
+	if removed, err = tsc.ZRem(sk, "cy"); err != nil || removed {
+		t.Error("removed twice")
+	}
+
+	if members, err = tsc.ZRange(sk, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(members) != fmt.Sprint([]ZMember{{"ann", 10.5}, {"bob", 100}}) {
+		t.Errorf("range after remove %v", members)
+	}
+
+	if _, exists, err := tsc.ZScore(sk, "nobody"); err != nil || exists {
+		t.Error("missing member")
+	}
+
+	// a member's expiration is kept when its score changes
+	memberSk := MakeStoreKey("leaderboard", "members", "ann")
+	expiration := time.Now().Add(time.Hour)
+	if _, err = tsc.SetKeyTtl(memberSk, &expiration); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tsc.ZAdd(sk, "ann", 11); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tsc.ZIncrBy(sk, "ann", 1); err != nil {
+		t.Fatal(err)
+	}
+	ttl, err := tsc.GetKeyTtl(memberSk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl == nil || ttl.UnixNano() != expiration.UnixNano() {
+		t.Error("member expiration kept")
+	}
+	if ttl, err = tsc.GetKeyTtl(JoinSubPath(MakeStoreKey("leaderboard", "ranks"), SubPath{zsetRankSegment(12, "ann")})); err != nil {
+		t.Fatal(err)
+	}
+	if ttl == nil || ttl.UnixNano() != expiration.UnixNano() {
+		t.Error("ranks expiration")
+	}
+}
+
+func TestGetKeyValuesInRange(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	sk := MakeStoreKey("sensor")
+	var times []time.Time
+	for i := 1; i <= 4; i++ {
+		if _, _, err := tsc.SetKeyValue(sk, i*10); err != nil {
+			t.Fatal(err)
+		}
+		times = append(times, time.Now())
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	values, err := tsc.GetKeyValuesInRange(sk, time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 4 {
+		t.Fatalf("all values: %v", values)
+	}
+	for i, tv := range values {
+		if tv.Value != (i+1)*10 {
+			t.Errorf("value %d: %v", i, tv.Value)
+		}
+		if i > 0 && !tv.Timestamp.After(values[i-1].Timestamp) {
+			t.Error("order")
+		}
+	}
+
+	if values, err = tsc.GetKeyValuesInRange(sk, times[0], times[2]); err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 2 || values[0].Value != 20 || values[1].Value != 30 {
+		t.Errorf("range: %v", values)
+	}
+
+	if values, err = tsc.GetKeyValuesInRange(sk, times[3], time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 0 {
+		t.Error("after the last value")
+	}
+
+	if values, err = tsc.GetKeyValuesInRange(MakeStoreKey("missing"), time.Time{}, time.Time{}); err != nil || len(values) != 0 {
+		t.Error("missing key")
+	}
+}
+
+func TestPersistKey(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	sk := MakeStoreKey("session")
+	expire := time.Now().Add(time.Hour)
+	if _, _, _, err := tsc.SetKeyValueEx(sk, "data", 0, &expire, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	hadTtl, err := tsc.PersistKeyValue(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hadTtl {
+		t.Error("value ttl")
+	}
+	ttl, err := tsc.GetKeyValueTtl(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttlIsSet(ttl) {
+		t.Error("value ttl cleared")
+	}
+	if hadTtl, err = tsc.PersistKeyValue(sk); err != nil || hadTtl {
+		t.Error("value ttl already cleared")
+	}
+
+	if _, err = tsc.SetKeyTtl(sk, &expire); err != nil {
+		t.Fatal(err)
+	}
+	if hadTtl, err = tsc.PersistKey(sk); err != nil || !hadTtl {
+		t.Error("key ttl")
+	}
+	if ttl, err = tsc.GetKeyTtl(sk); err != nil || ttlIsSet(ttl) {
+		t.Error("key ttl cleared")
+	}
+	if hadTtl, err = tsc.PersistKey(sk); err != nil || hadTtl {
+		t.Error("key ttl already cleared")
+	}
+
+	if hadTtl, err = tsc.PersistKey(MakeStoreKey("missing")); err != nil || hadTtl {
+		t.Error("missing key")
+	}
+}
+
+func TestTouchKey(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	sk := MakeStoreKey("cached")
+	expire := time.Now().Add(50 * time.Millisecond)
+	if _, _, _, err := tsc.SetKeyValueEx(sk, "data", 0, &expire, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	exists, err := tsc.TouchKey(sk, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists {
+		t.Error("touch")
+	}
+	ttl, err := tsc.GetKeyTtl(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ttlIsSet(ttl) || time.Until(*ttl) < 50*time.Minute {
+		t.Error("extended ttl")
+	}
+
+	if exists, err = tsc.TouchKey(MakeStoreKey("missing"), time.Hour); err != nil || exists {
+		t.Error("missing key")
+	}
+
+	// reads through a sliding client push the expiration out
+	expire = time.Now().Add(time.Second)
+	if _, err = tsc.SetKeyTtl(sk, &expire); err != nil {
+		t.Fatal(err)
+	}
+	sliding := tsc.With(ClientTouchOnRead(time.Hour))
+	value, _, _, err := sliding.GetKeyValue(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "data" {
+		t.Error("read")
+	}
+	if ttl, err = tsc.GetKeyTtl(sk); err != nil {
+		t.Fatal(err)
+	}
+	if !ttlIsSet(ttl) || time.Until(*ttl) < 50*time.Minute {
+		t.Error("touched on read")
+	}
+
+	// a read-only client reads without touching
+	readOnly := sliding.With(ClientReadOnly())
+	if value, _, _, err = readOnly.GetKeyValue(sk); err != nil {
+		t.Fatal(err)
+	}
+	if value != "data" {
+		t.Error("read-only read")
+	}
+}
+
+func TestCommitStagedKey(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	stagingSk := MakeStoreKey("staging")
+	tempSk, _, err := tsc.StageKeyJson(stagingSk, map[string]any{"name": "rex"}, JsonStageCleanupOnClose)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	destSk := MakeStoreKey("pets", "1")
+	indexSk := MakeStoreKey("index", "rex")
+	exists, moved, err := tsc.CommitStagedKey(tempSk, destSk, false, nil, []StoreKey{indexSk}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists || !moved {
+		t.Fatal("commit")
+	}
+
+	ttl, err := tsc.GetKeyTtl(destSk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttlIsSet(ttl) {
+		t.Error("staging ttl cleared")
+	}
+
+	hasLink, rv, err := tsc.GetRelationshipValue(indexSk, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasLink || rv == nil || rv.Sk.Path != destSk.Path {
+		t.Error("index reference")
+	}
+
+	tempSk, _, err = tsc.StageKeyJson(stagingSk, map[string]any{"name": "tom"}, JsonStageCleanupOnClose)
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed, err := tsc.AbortStagedKey(tempSk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !removed {
+		t.Error("abort")
+	}
+	if jsonData, err := tsc.GetKeyAsJson(tempSk, 0); err != nil || jsonData != nil {
+		t.Error("aborted key")
+	}
+
+	impl := tsc.(*tsClient)
+	impl.stagedMu.Lock()
+	remaining := len(impl.staged)
+	impl.stagedMu.Unlock()
+	if remaining != 0 {
+		t.Error("cleanup registrations")
+	}
+}
+
+func TestExportAtTime(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	sk := MakeStoreKey("audit")
+	if _, _, err := tsc.SetKeyValue(AppendStoreKeySegmentStrings(sk, "a"), "first"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tsc.SetKey(AppendStoreKeySegmentStrings(sk, "empty")); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond)
+	when := time.Now()
+	time.Sleep(time.Millisecond)
+
+	if _, _, err := tsc.SetKeyValue(AppendStoreKeySegmentStrings(sk, "a"), "second"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tsc.SetKeyValue(AppendStoreKeySegmentStrings(sk, "b"), "later"); err != nil {
+		t.Fatal(err)
+	}
+
+	jsonData, err := tsc.ExportAtTime(sk, when)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	children := jsonData.(map[string]any)["children"].(map[string]any)
+	if len(children) != 2 || children["empty"] == nil {
+		t.Error("snapshot keys")
+	}
+	history := children["a"].(map[string]any)["history"].([]any)
+	if len(history) != 1 || history[0].(map[string]any)["value"] != "first" {
+		t.Error("snapshot value")
+	}
+
+	restoreSk := MakeStoreKey("restored")
+	if err = tsc.Import(restoreSk, jsonData); err != nil {
+		t.Fatal(err)
+	}
+	value, _, exists, err := tsc.GetKeyValue(AppendStoreKeySegmentStrings(restoreSk, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists || value != "first" {
+		t.Error("restored value")
+	}
+
+	jsonData, err = tsc.ExportAtTime(MakeStoreKey("missing"), when)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jsonData != nil {
+		t.Error("missing key")
+	}
+}
+
+func TestBeginSnapshot(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	sk := MakeStoreKey("report")
+	if _, _, err := tsc.SetKeyJson(sk, map[string]any{"a": 1, "b": "x"}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	snap, err := tsc.BeginSnapshot(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err = tsc.SetKeyValue(AppendStoreKeySegmentStrings(sk, "a"), 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = tsc.SetKeyValue(AppendStoreKeySegmentStrings(sk, "c"), "y"); err != nil {
+		t.Fatal(err)
+	}
+
+	value, _, valueExists, err := snap.GetKeyValue(AppendStoreKeySegmentStrings(sk, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !valueExists || value != float64(1) {
+		t.Error("snapshot value")
+	}
+
+	jsonData, err := snap.GetKeyAsJson(sk, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doesJsonMatch(t, "snapshot", jsonData, map[string]any{"a": 1, "b": "x"})
+
+	keys, err := snap.GetMatchingKeys(AppendStoreKeySegmentStrings(sk, "*"), 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0].Key != "/report/a" || keys[1].Key != "/report/b" {
+		t.Error("snapshot keys")
+	}
+
+	if err = snap.Close(); err != nil {
+		t.Fatal(err)
+	}
+	exists, err := tsc.KeyExists(SnapshotsSk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		keys, _ = tsc.GetMatchingKeys(AppendStoreKeySegmentStrings(SnapshotsSk, "*"), 0, 10)
+		if len(keys) != 0 {
+			t.Error("snapshot copy")
+		}
+	}
+}
+
+func TestSetKeyJsonAtPath(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	sk := MakeStoreKey("zoo")
+	doc := map[string]any{
+		"animals": []any{
+			map[string]any{"name": "dog", "sound": "bark"},
+			map[string]any{"name": "cat", "sound": "meow"},
+		},
+		"config": map[string]any{"owner": "sam"},
+	}
+	if _, _, err := tsc.SetKeyJson(sk, doc, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	subPath, err := JsonPathToSubPath("animals[1]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	replaced, _, err := tsc.SetKeyJsonAtPath(sk, subPath, map[string]any{"name": "cow"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !replaced {
+		t.Error("replaced branch")
+	}
+
+	jsonData, err := tsc.GetKeyAsJson(sk, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doesJsonMatch(t, "set at path", jsonData, map[string]any{
+		"animals": []any{
+			map[string]any{"name": "dog", "sound": "bark"},
+			map[string]any{"name": "cow"},
+		},
+		"config": map[string]any{"owner": "sam"},
+	})
+
+	if _, _, err = tsc.SetKeyJsonAtPath(sk, SubPath{}, doc, 0); err == nil {
+		t.Error("empty subpath")
+	}
+}
+
+func TestGetKeyJsonPath(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	sk := MakeStoreKey("zoo")
+	doc := map[string]any{
+		"animals": []any{
+			map[string]any{"name": "dog", "sound": "bark", "legs": 4},
+			map[string]any{"name": "bird", "sound": "tweet", "legs": 2},
+			map[string]any{"name": "seal", "sound": "bark", "legs": 0},
+		},
+		"keeper": map[string]any{"name": "sam"},
+	}
+	if _, _, err := tsc.SetKeyJson(sk, doc, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	jsonData, err := tsc.GetKeyJsonPath(sk, "$.animals[?(@.sound=='bark')].name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	doesJsonMatch(t, "filter", jsonData, []any{"dog", "seal"})
+
+	if jsonData, err = tsc.GetKeyJsonPath(sk, "animals[?(@.legs >= 2)]"); err != nil {
+		t.Fatal(err)
+	}
+	doesJsonMatch(t, "numeric filter", jsonData, []any{
+		map[string]any{"name": "dog", "sound": "bark", "legs": 4},
+		map[string]any{"name": "bird", "sound": "tweet", "legs": 2},
+	})
+
+	if jsonData, err = tsc.GetKeyJsonPath(sk, "$.animals[1].name"); err != nil {
+		t.Fatal(err)
+	}
+	if jsonData != "bird" {
+		t.Error("definite path")
+	}
+
+	if jsonData, err = tsc.GetKeyJsonPath(sk, "$.animals[-1].sound"); err != nil {
+		t.Fatal(err)
+	}
+	if jsonData != "bark" {
+		t.Error("negative index")
+	}
+
+	if jsonData, err = tsc.GetKeyJsonPath(sk, "$..name"); err != nil {
+		t.Fatal(err)
+	}
+	doesJsonMatch(t, "descend", jsonData, []any{"dog", "bird", "seal", "sam"})
+
+	if jsonData, err = tsc.GetKeyJsonPath(sk, "$.keeper.missing"); err != nil {
+		t.Fatal(err)
+	}
+	if jsonData != nil {
+		t.Error("missing path")
+	}
+
+	if _, err = tsc.GetKeyJsonPath(sk, "$.animals[?(@.sound ~ 'x')]"); err == nil {
+		t.Error("invalid filter")
+	}
+}
+
+func TestKeyJsonBytes(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	sk := MakeStoreKey("doc")
+	created, _, err := tsc.CreateKeyJsonBytes(sk, []byte(`{"a":1}`), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created {
+		t.Error("create")
+	}
+
+	if _, err = tsc.MergeKeyJsonBytes(sk, []byte(`{"b":"two"}`), 0); err != nil {
+		t.Fatal(err)
+	}
+	jsonData, err := tsc.GetKeyAsJson(sk, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doesJsonMatch(t, "merge", jsonData, map[string]any{"a": 1, "b": "two"})
+
+	replaced, _, err := tsc.ReplaceKeyJsonBytes(sk, []byte(`{"c":[1,2]}`), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !replaced {
+		t.Error("replace")
+	}
+
+	if _, _, err = tsc.SetKeyJsonBytes(sk, []byte(`{"path":"a\\b"}`), 0); err != nil {
+		t.Fatal(err)
+	}
+	if jsonData, err = tsc.GetKeyAsJson(sk, 0); err != nil {
+		t.Fatal(err)
+	}
+	doesJsonMatch(t, "set", jsonData, map[string]any{"path": `a\b`})
+
+	if _, _, err = tsc.SetKeyJsonBytes(sk, []byte(`{"a":`), 0); err == nil {
+		t.Error("invalid json")
+	}
+}
+
+func TestGetKeyJsonAs(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	type animal struct {
+		Name string   `json:"name"`
+		Legs int      `json:"legs"`
+		Tags []string `json:"tags"`
+	}
+
+	sk := MakeStoreKey("animals", "dog")
+	if _, _, err := tsc.SetKeyJson(sk, animal{Name: "dog", Legs: 4, Tags: []string{"pet"}}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	dog, exists, err := GetKeyJsonAs[animal](tsc, sk, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists || dog.Name != "dog" || dog.Legs != 4 || len(dog.Tags) != 1 || dog.Tags[0] != "pet" {
+		t.Error("decoded struct")
+	}
+
+	if _, exists, err = GetKeyJsonAs[animal](tsc, MakeStoreKey("animals", "cat"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Error("missing key")
+	}
+
+	tempSk, _, err := StageKeyJsonAs(tsc, MakeStoreKey("staging"), animal{Name: "bird", Legs: 2}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bird, exists, err := GetKeyJsonAs[animal](tsc, tempSk, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists || bird.Name != "bird" || bird.Legs != 2 {
+		t.Error("staged struct")
+	}
+}
+
+func TestMergeKeyJsonArrayStrategies(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	doc := map[string]any{
+		"name": "zoo",
+		"animals": []any{
+			map[string]any{"name": "dog", "sound": "bark"},
+			map[string]any{"name": "cat", "sound": "meow"},
+		},
+		"tags": []any{"a", "b"},
+	}
+	overlay := map[string]any{
+		"animals": []any{
+			map[string]any{"sound": "woof"},
+		},
+		"tags": []any{"c"},
+	}
+
+	appendSk := MakeStoreKey("append")
+	replaceSk := MakeStoreKey("replace")
+	indexSk := MakeStoreKey("index")
+	for _, sk := range []StoreKey{appendSk, replaceSk, indexSk} {
+		if _, _, err := tsc.SetKeyJson(sk, doc, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := tsc.MergeKeyJson(appendSk, overlay, 0); err != nil {
+		t.Fatal(err)
+	}
+	jsonData, err := tsc.GetKeyAsJson(appendSk, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doesJsonMatch(t, "append", jsonData, map[string]any{
+		"name": "zoo",
+		"animals": []any{
+			map[string]any{"name": "dog", "sound": "bark"},
+			map[string]any{"name": "cat", "sound": "meow"},
+			map[string]any{"sound": "woof"},
+		},
+		"tags": []any{"a", "b", "c"},
+	})
+
+	if _, err = tsc.MergeKeyJson(replaceSk, overlay, JsonMergeArraysReplace); err != nil {
+		t.Fatal(err)
+	}
+	if jsonData, err = tsc.GetKeyAsJson(replaceSk, 0); err != nil {
+		t.Fatal(err)
+	}
+	doesJsonMatch(t, "replace", jsonData, map[string]any{
+		"name": "zoo",
+		"animals": []any{
+			map[string]any{"sound": "woof"},
+		},
+		"tags": []any{"c"},
+	})
+
+	addr, err := tsc.MergeKeyJson(indexSk, overlay, JsonMergeArraysByIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jsonData, err = tsc.GetKeyAsJson(indexSk, 0); err != nil {
+		t.Fatal(err)
+	}
+	doesJsonMatch(t, "by index", jsonData, map[string]any{
+		"name": "zoo",
+		"animals": []any{
+			map[string]any{"name": "dog", "sound": "woof"},
+			map[string]any{"name": "cat", "sound": "meow"},
+		},
+		"tags": []any{"c", "b"},
+	})
+
+	expected, _, err := tsc.LocateKey(indexSk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != expected {
+		t.Error("merge address")
+	}
+
+	newSk := MakeStoreKey("new")
+	if _, err = tsc.MergeKeyJson(newSk, map[string]any{"list": []any{1, 2}}, JsonMergeArraysByIndex); err != nil {
+		t.Fatal(err)
+	}
+	if jsonData, err = tsc.GetKeyAsJson(newSk, 0); err != nil {
+		t.Fatal(err)
+	}
+	doesJsonMatch(t, "new key", jsonData, map[string]any{"list": []any{1, 2}})
+}
+
+func TestImportJsonLines(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	var sb strings.Builder
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&sb, "{\"id\":\"r%d\",\"n\":%d}\n", i, i)
+		if i%50 == 0 {
+			sb.WriteString("\n")
+		}
+	}
+
+	parentSk := MakeStoreKey("records")
+	imported, err := tsc.ImportJsonLines(parentSk, strings.NewReader(sb.String()), func(doc any) StoreKey {
+		return MakeStoreKey(doc.(map[string]any)["id"].(string))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported != 200 {
+		t.Errorf("imported %d", imported)
+	}
+
+	jsonData, err := tsc.GetKeyAsJson(AppendStoreKeySegmentStrings(parentSk, "r123"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doesJsonMatch(t, "record", jsonData, map[string]any{"id": "r123", "n": 123})
+
+	linesSk := MakeStoreKey("lines")
+	if imported, err = tsc.ImportJsonLines(linesSk, strings.NewReader("[1,2]\n\n\"x\""), nil); err != nil {
+		t.Fatal(err)
+	}
+	if imported != 2 {
+		t.Error("line keys")
+	}
+	value, _, _, err := tsc.GetKeyValue(AppendStoreKeySegmentStrings(linesSk, "3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "x" {
+		t.Error("line number key")
+	}
+
+	if _, err = tsc.ImportJsonLines(linesSk, strings.NewReader("{}\n{bad\n"), nil); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Error("invalid line")
+	}
+}
+
+func TestImportCsv(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	csvData := "id,name,legs,pet,note\n" +
+		"d1,dog,4,true,\n" +
+		"c1,cat,4,true,\"likes \"\"fish\"\"\"\n" +
+		"b1,bird,2,false,Inf\n"
+
+	parentSk := MakeStoreKey("animals")
+	imported, err := tsc.ImportCsv(parentSk, strings.NewReader(csvData), CsvImportOptions{KeyColumn: "id", InferTypes: true, SkipEmpty: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported != 3 {
+		t.Errorf("imported %d", imported)
+	}
+
+	jsonData, err := tsc.GetKeyAsJson(parentSk, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doesJsonMatch(t, "rows", jsonData, map[string]any{
+		"d1": map[string]any{"id": "d1", "name": "dog", "legs": 4, "pet": true},
+		"c1": map[string]any{"id": "c1", "name": "cat", "legs": 4, "pet": true, "note": `likes "fish"`},
+		"b1": map[string]any{"id": "b1", "name": "bird", "legs": 2, "pet": false, "note": "Inf"},
+	})
+
+	rowsSk := MakeStoreKey("rows")
+	if imported, err = tsc.ImportCsv(rowsSk, strings.NewReader("a;1\nb;2\n"), CsvImportOptions{Comma: ';', NoHeader: true}); err != nil {
+		t.Fatal(err)
+	}
+	if imported != 2 {
+		t.Error("no header rows")
+	}
+	if jsonData, err = tsc.GetKeyAsJson(rowsSk, 0); err != nil {
+		t.Fatal(err)
+	}
+	doesJsonMatch(t, "no header", jsonData, map[string]any{
+		"1": map[string]any{"0": "a", "1": "1"},
+		"2": map[string]any{"0": "b", "1": "2"},
+	})
+
+	if _, err = tsc.ImportCsv(rowsSk, strings.NewReader("x,y\n1,2\n"), CsvImportOptions{KeyColumn: "id"}); err == nil {
+		t.Error("missing key column")
+	}
+}
+
+func TestDiffKeyJson(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	sk := MakeStoreKey("config")
+	stored := map[string]any{
+		"name":      "svc",
+		"replicas":  3,
+		"ports":     []any{80, 443},
+		"log.level": "debug",
+		"limits":    map[string]any{"cpu": 2},
+	}
+	if _, _, err := tsc.SetKeyJson(sk, stored, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	diffs, err := tsc.DiffKeyJson(sk, stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 0 {
+		t.Error("identical")
+	}
+
+	diffs, err = tsc.DiffKeyJson(sk, map[string]any{
+		"name":      "svc",
+		"replicas":  5,
+		"ports":     []any{80},
+		"log.level": "debug",
+		"limits":    "none",
+		"owner":     "ops",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []JsonDiff{
+		{Path: "$.limits", Kind: DiffChanged, Old: map[string]any{"cpu": float64(2)}, New: "none"},
+		{Path: "$.owner", Kind: DiffAdded, New: "ops"},
+		{Path: "$.ports[1]", Kind: DiffRemoved, Old: float64(443)},
+		{Path: "$.replicas", Kind: DiffChanged, Old: float64(3), New: float64(5)},
+	}
+	if !reflect.DeepEqual(diffs, expected) {
+		t.Errorf("diffs %v", diffs)
+	}
+
+	diffs, err = tsc.DiffKeyJson(sk, map[string]any{"log.level": "info"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 5 || diffs[1].Path != "$['log.level']" || diffs[1].Kind != DiffChanged {
+		t.Error("quoted path")
+	}
+	if _, err = JsonPathToSubPath(diffs[1].Path); err != nil {
+		t.Error(err)
+	}
+
+	if diffs, err = tsc.DiffKeyJson(MakeStoreKey("missing"), 1); err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 1 || diffs[0].Kind != DiffAdded || diffs[0].Path != "$" {
+		t.Error("missing key")
+	}
+}
+
+func TestDiffKeys(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	skA := MakeStoreKey("primary")
+	skB := MakeStoreKey("replica")
+	for _, sk := range []StoreKey{skA, skB} {
+		if _, _, err := tsc.SetKeyValue(AppendStoreKeySegmentStrings(sk, "same"), "v"); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := tsc.SetKeyValue(AppendStoreKeySegmentStrings(sk, "tree", "leaf"), 1); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := tsc.SetMetadataAttribute(AppendStoreKeySegmentStrings(sk, "same"), "owner", "sam"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	diffs, err := tsc.DiffKeys(skA, skB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 0 {
+		t.Errorf("identical %v", diffs)
+	}
+
+	if _, _, err = tsc.SetKeyValue(AppendStoreKeySegmentStrings(skB, "tree", "leaf"), 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = tsc.SetMetadataAttribute(AppendStoreKeySegmentStrings(skB, "same"), "owner", "kim"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = tsc.SetKeyValue(AppendStoreKeySegmentStrings(skB, "extra", "child"), "x"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = tsc.SetKeyValue(AppendStoreKeySegmentStrings(skA, "gone"), "y"); err != nil {
+		t.Fatal(err)
+	}
+
+	if diffs, err = tsc.DiffKeys(skA, skB); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []KeyDiff{
+		{Sk: MakeStoreKey("extra"), Kind: DiffAdded},
+		{Sk: MakeStoreKey("gone"), Kind: DiffRemoved, Old: "y"},
+		{Sk: MakeStoreKey("same"), Kind: DiffChanged, Attribute: "owner", Old: "sam", New: "kim"},
+		{Sk: MakeStoreKey("tree", "leaf"), Kind: DiffChanged, Old: 1, New: 2},
+	}
+	if !reflect.DeepEqual(diffs, expected) {
+		t.Errorf("diffs %v", diffs)
+	}
+}
+
+func TestJsonNumericSegmentsAsArrays(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	sk := MakeStoreKey("doc")
+	doc := map[string]any{"list": []any{"a", map[string]any{"b": []any{1}}}}
+	if _, _, err := tsc.SetKeyJson(sk, doc, JsonNumericSegmentsAsArrays); err != nil {
+		t.Fatal(err)
+	}
+
+	value, _, _, err := tsc.GetKeyValue(MakeStoreKey("doc", "list", "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "a" {
+		t.Error("numeric segment")
+	}
+
+	jsonData, err := tsc.GetKeyAsJson(sk, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doesJsonMatch(t, "stored", jsonData, map[string]any{"list": map[string]any{"0": "a", "1": map[string]any{"b": map[string]any{"0": 1}}}})
+
+	if jsonData, err = tsc.GetKeyAsJson(sk, JsonNumericSegmentsAsArrays); err != nil {
+		t.Fatal(err)
+	}
+	doesJsonMatch(t, "arrays", jsonData, doc)
+
+	marshalled, err := tsc.GetKeyAsJsonBytes(sk, JsonNumericSegmentsAsArrays)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(marshalled) != `{"list":["a",{"b":[1]}]}` {
+		t.Error("array bytes")
+	}
+
+	if _, _, err = tsc.SetKeyValue(MakeStoreKey("doc", "list", "9"), "f"); err != nil {
+		t.Fatal(err)
+	}
+	if jsonData, err = tsc.GetKeyAsJson(sk, JsonNumericSegmentsAsArrays); err != nil {
+		t.Fatal(err)
+	}
+	doesJsonMatch(t, "sparse", jsonData, map[string]any{"list": map[string]any{"0": "a", "1": map[string]any{"b": []any{1}}, "9": "f"}})
+
+	arraySk := MakeStoreKey("native")
+	if _, _, err = tsc.SetKeyJson(arraySk, map[string]any{"list": []any{1, 2}}, 0); err != nil {
+		t.Fatal(err)
+	}
+	updated, err := tsc.SetJsonArrayMetadata(MakeStoreKey("native", "list"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated != 1 {
+		t.Error("cleared")
+	}
+	if jsonData, err = tsc.GetKeyAsJson(arraySk, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, isArray := jsonData.(map[string]any)["list"].([]any); isArray {
+		t.Error("not an array")
+	}
+
+	if updated, err = tsc.SetJsonArrayMetadata(MakeStoreKey("native", "list"), true); err != nil {
+		t.Fatal(err)
+	}
+	if updated != 1 {
+		t.Error("set")
+	}
+	if jsonData, err = tsc.GetKeyAsJson(arraySk, 0); err != nil {
+		t.Fatal(err)
+	}
+	doesJsonMatch(t, "array again", jsonData, map[string]any{"list": []any{1, 2}})
+}
+
+func TestJsonOmitEmpty(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	sk := MakeStoreKey("doc")
+	if _, _, err := tsc.SetKeyJson(sk, map[string]any{"v": 1, "n": nil, "list": []any{nil, 2}}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tsc.SetKey(MakeStoreKey("doc", "empty")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tsc.SetKey(MakeStoreKey("doc", "nested", "empty")); err != nil {
+		t.Fatal(err)
+	}
+
+	jsonData, err := tsc.GetKeyAsJson(sk, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doesJsonMatch(t, "full", jsonData, map[string]any{"v": 1, "n": nil, "list": []any{nil, 2}, "empty": nil, "nested": map[string]any{"empty": nil}})
+
+	if jsonData, err = tsc.GetKeyAsJson(sk, JsonOmitEmpty); err != nil {
+		t.Fatal(err)
+	}
+	doesJsonMatch(t, "compact", jsonData, map[string]any{"v": 1, "list": []any{nil, 2}})
+
+	marshalled, err := tsc.GetKeyAsJsonBytes(sk, JsonOmitEmpty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(marshalled) != `{"list":[null,2],"v":1}` {
+		t.Error("compact bytes")
+	}
+}
+
+func TestStageKeyJsonVerified(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	stagingSk := MakeStoreKey("staging")
+	destSk := MakeStoreKey("config")
+	if _, _, err := tsc.SetKeyJson(destSk, map[string]any{"port": 80}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	requirePort := func(tempSk StoreKey) error {
+		_, _, exists, err := tsc.GetKeyValue(AppendStoreKeySegmentStrings(tempSk, "port"))
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return errors.New("port is required")
+		}
+		return nil
+	}
+
+	var stagedSk StoreKey
+	moved, err := tsc.StageKeyJsonVerified(stagingSk, destSk, map[string]any{"host": "x"}, 0, func(tempSk StoreKey) error {
+		stagedSk = tempSk
+		return requirePort(tempSk)
+	})
+	if err == nil || err.Error() != "port is required" || moved {
+		t.Error("rejected")
+	}
+	if exists, err := tsc.KeyExists(stagedSk); err != nil || exists {
+		t.Error("rejected key deleted")
+	}
+
+	if moved, err = tsc.StageKeyJsonVerified(stagingSk, destSk, map[string]any{"port": 443}, 0, requirePort); err != nil {
+		t.Fatal(err)
+	}
+	if !moved {
+		t.Error("committed")
+	}
+
+	jsonData, err := tsc.GetKeyAsJson(destSk, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doesJsonMatch(t, "committed", jsonData, map[string]any{"port": 443})
+
+	ttl, err := tsc.GetKeyTtl(destSk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl == nil || ttlIsSet(ttl) {
+		t.Error("committed key is permanent")
+	}
+}
+
+func TestLookupAutoLinked(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	dsk := MakeStoreKey("people")
+	isk := MakeStoreKey("people-by-city")
+	if _, _, err := tsc.DefineAutoLinkKey(dsk, isk, []SubPath{{SubPathSegment("city")}, {}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for id, city := range map[string]string{"1": "nyc", "2": "nyc", "3": "sf"} {
+		if _, _, err := tsc.SetKeyJson(AppendStoreKeySegmentStrings(dsk, id), map[string]any{"city": city}, JsonStringValuesAsKeys); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	recordSk, _, found, err := tsc.LookupAutoLinked(isk, "sf", "3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || recordSk.Path != "/people/3" {
+		t.Error("lookup")
+	}
+
+	if _, _, found, err = tsc.LookupAutoLinked(isk, "sf", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Error("missing link")
+	}
+
+	matches, err := tsc.LookupAutoLinkedPrefix(isk, "nyc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 2 || matches[0].RecordSk.Path != "/people/1" || matches[1].RecordSk.Path != "/people/2" || matches[1].LinkSk.Path != "/people-by-city/nyc/2" {
+		t.Error("prefix lookup")
+	}
+
+	if matches, err = tsc.LookupAutoLinkedPrefix(isk); err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 3 {
+		t.Error("all links")
+	}
+}
+
+func TestVerifyAutoLinks(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	dsk := MakeStoreKey("people")
+	isk := MakeStoreKey("people-by-city")
+	if _, _, err := tsc.DefineAutoLinkKey(dsk, isk, []SubPath{{SubPathSegment("city")}, {}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for id, city := range map[string]string{"1": "nyc", "2": "nyc", "3": "sf"} {
+		if _, _, err := tsc.SetKeyJson(AppendStoreKeySegmentStrings(dsk, id), map[string]any{"city": city}, JsonStringValuesAsKeys); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	problems, err := tsc.VerifyAutoLinks(dsk, isk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Error("intact")
+	}
+
+	if _, _, _, err = tsc.DeleteKey(MakeStoreKey("people-by-city", "sf", "3")); err != nil {
+		t.Fatal(err)
+	}
+	expired := time.Now().Add(-time.Second)
+	if _, err = tsc.SetKeyTtl(MakeStoreKey("people", "2"), &expired); err != nil {
+		t.Fatal(err)
+	}
+
+	if problems, err = tsc.VerifyAutoLinks(dsk, isk); err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 2 ||
+		problems[0].LinkSk.Path != "/people-by-city/nyc/2" || problems[0].Problem != AutoLinkStale ||
+		problems[1].LinkSk.Path != "/people-by-city/sf/3" || problems[1].RecordSk.Path != "/people/3" || problems[1].Problem != AutoLinkMissing {
+		t.Error("problems")
+	}
+
+	if err = tsc.RebuildAutoLinks(dsk, isk); err != nil {
+		t.Fatal(err)
+	}
+
+	if problems, err = tsc.VerifyAutoLinks(dsk, isk); err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Error("rebuilt")
+	}
+
+	if _, err = tsc.VerifyAutoLinks(dsk, MakeStoreKey("nope")); err == nil {
+		t.Error("no definition")
+	}
+}
+
+func TestGetRelationships(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	addrA, _, err := tsc.SetKeyValue(MakeStoreKey("a"), "apple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrB, _, err := tsc.SetKey(MakeStoreKey("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrC, _, err := tsc.SetKey(MakeStoreKey("c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sk := MakeStoreKey("links")
+	if _, _, _, err = tsc.SetKeyValueEx(sk, nil, SetExNoValueUpdate, nil, []StoreAddress{addrA, 0, addrB, addrC}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err = tsc.DeleteKey(MakeStoreKey("c")); err != nil {
+		t.Fatal(err)
+	}
+
+	addresses, values, err := tsc.GetRelationships(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(addresses, []StoreAddress{addrA, 0, addrB, addrC}) || len(values) != 4 {
+		t.Fatal("addresses")
+	}
+	if values[0] == nil || values[0].Sk.Path != "/a" || values[0].CurrentValue != "apple" {
+		t.Error("value a")
+	}
+	if values[1] != nil || values[3] != nil {
+		t.Error("empty slots")
+	}
+	if values[2] == nil || values[2].Sk.Path != "/b" || values[2].CurrentValue != nil {
+		t.Error("value b")
+	}
+
+	if addresses, values, err = tsc.GetRelationships(MakeStoreKey("missing")); err != nil {
+		t.Fatal(err)
+	}
+	if addresses != nil || values != nil {
+		t.Error("missing key")
+	}
+}
+
+func TestAddRemoveRelationship(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	addrA, _, err := tsc.SetKey(MakeStoreKey("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrB, _, err := tsc.SetKey(MakeStoreKey("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sk := MakeStoreKey("links")
+	if _, exists, err := tsc.AddRelationship(sk, addrA); err != nil || exists {
+		t.Error("add to missing key")
+	}
+
+	if _, _, err = tsc.SetKeyValue(sk, "value"); err != nil {
+		t.Fatal(err)
+	}
+	expiration := time.Now().Add(time.Hour)
+	if _, err = tsc.SetKeyTtl(sk, &expiration); err != nil {
+		t.Fatal(err)
+	}
+	checkTtl := func(step string) {
+		ttl, err := tsc.GetKeyTtl(sk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ttl == nil || ttl.UnixNano() != expiration.UnixNano() {
+			t.Errorf("expiration kept by %s", step)
+		}
+	}
+
+	for n, addr := range []StoreAddress{addrA, addrB, addrA} {
+		index, exists, err := tsc.AddRelationship(sk, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !exists || index != n {
+			t.Error("add")
+		}
+	}
+	checkTtl("add")
+
+	removed, err := tsc.RemoveRelationship(sk, addrA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !removed {
+		t.Error("remove")
+	}
+	checkTtl("remove")
+
+	addresses, _, err := tsc.GetRelationships(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(addresses, []StoreAddress{0, addrB, addrA}) {
+		t.Error("slot emptied")
+	}
+
+	addr, err := tsc.RemoveRelationshipAt(sk, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != addrA {
+		t.Error("remove at")
+	}
+	checkTtl("remove at")
+	if addr, err = tsc.RemoveRelationshipAt(sk, 5); err != nil || addr != 0 {
+		t.Error("remove out of range")
+	}
+
+	if addresses, _, err = tsc.GetRelationships(sk); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(addresses, []StoreAddress{0, addrB}) {
+		t.Error("trailing slots trimmed")
+	}
+
+	value, _, _, err := tsc.GetKeyValue(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "value" {
+		t.Error("value kept")
+	}
+}
+
+func TestAddRelationshipConcurrent(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	sk := MakeStoreKey("links")
+	if _, _, err := tsc.SetKeyValue(sk, "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	// writers on separate connections add slots; none may be overwritten
+	const writers = 4
+	const adds = 10
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		writer := tsc.(*tsClient).dedicated()
+		defer writer.Close()
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for n := 0; n < adds; n++ {
+				if _, _, err := writer.AddRelationship(sk, StoreAddress(i*adds+n+1)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	addresses, _, err := tsc.GetRelationships(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(addresses)
+	for n, addr := range addresses {
+		if addr != StoreAddress(n+1) {
+			t.Fatalf("expected %d slots, got %v", writers*adds, addresses)
+		}
+	}
+	if len(addresses) != writers*adds {
+		t.Errorf("expected %d slots, got %d", writers*adds, len(addresses))
+	}
+}
+
+func TestNamedRelationships(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	addrOwner, _, err := tsc.SetKeyValue(MakeStoreKey("users", "ann"), "Ann")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrParent, _, err := tsc.SetKey(MakeStoreKey("folders", "root"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sk := MakeStoreKey("folders", "docs")
+	if _, _, err = tsc.SetKey(sk); err != nil {
+		t.Fatal(err)
+	}
+	expiration := time.Now().Add(time.Hour)
+	if _, err = tsc.SetKeyTtl(sk, &expiration); err != nil {
+		t.Fatal(err)
+	}
+
+	index, exists, err := tsc.SetRelationshipByName(sk, "owner", addrOwner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists || index != 0 {
+		t.Error("owner slot")
+	}
+	if index, _, err = tsc.SetRelationshipByName(sk, "parent", addrParent); err != nil {
+		t.Fatal(err)
+	}
+	if index != 1 {
+		t.Error("parent slot")
+	}
+
+	// an emptied trailing slot keeps its name
+	if _, err = tsc.RemoveRelationshipAt(sk, 1); err != nil {
+		t.Fatal(err)
+	}
+	if index, _, err = tsc.SetRelationshipByName(sk, "editor", addrOwner); err != nil {
+		t.Fatal(err)
+	}
+	if index != 2 {
+		t.Error("editor slot")
+	}
+	if index, _, err = tsc.SetRelationshipByName(sk, "parent", addrParent); err != nil {
+		t.Fatal(err)
+	}
+	if index != 1 {
+		t.Error("parent slot reused")
+	}
+
+	ttl, err := tsc.GetKeyTtl(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl == nil || ttl.UnixNano() != expiration.UnixNano() {
+		t.Error("expiration kept")
+	}
+
+	hasLink, rv, err := tsc.GetRelationshipValueByName(sk, "owner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasLink || rv == nil || rv.Sk.Path != "/users/ann" || rv.CurrentValue != "Ann" {
+		t.Error("follow owner")
+	}
+
+	if hasLink, _, err = tsc.GetRelationshipValueByName(sk, "reviewer"); err != nil {
+		t.Fatal(err)
+	}
+	if hasLink {
+		t.Error("undefined name")
+	}
+
+	index, named, err := tsc.GetRelationshipIndex(sk, "parent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !named || index != 1 {
+		t.Error("parent index")
+	}
+
+	if _, exists, err = tsc.SetRelationshipByName(MakeStoreKey("missing"), "owner", addrOwner); err != nil || exists {
+		t.Error("missing key")
+	}
+}
+
+func TestKeysFromAddresses(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	addrA, _, err := tsc.SetKeyValue(MakeStoreKey("a"), "apple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrB, _, err := tsc.SetKey(MakeStoreKey("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addrs := []StoreAddress{addrB, 0, addrA, 999, addrB}
+
+	results, err := tsc.KeysFromAddresses(addrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 5 {
+		t.Fatal("results")
+	}
+	if !results[0].KeyExists || results[0].Sk.Path != "/b" || results[4].Sk.Path != "/b" {
+		t.Error("key b")
+	}
+	if results[1].KeyExists || results[3].KeyExists {
+		t.Error("missing addresses")
+	}
+	if !results[2].KeyExists || results[2].Sk.Path != "/a" || results[2].ValueExists {
+		t.Error("key a")
+	}
+
+	if results, err = tsc.KeyValuesFromAddresses(addrs); err != nil {
+		t.Fatal(err)
+	}
+	if !results[2].ValueExists || results[2].Value != "apple" || results[2].Sk.Path != "/a" {
+		t.Error("value a")
+	}
+	if !results[0].KeyExists || results[0].ValueExists {
+		t.Error("value b")
+	}
+}
+
+func TestDeleteKeyTreeCascade(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	addrDoc, _, err := tsc.SetKey(MakeStoreKey("docs", "1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrPage, _, err := tsc.SetKey(MakeStoreKey("docs", "1", "page"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrOther, _, err := tsc.SetKey(MakeStoreKey("docs", "2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refA := MakeStoreKey("refs", "a")
+	refB := MakeStoreKey("refs", "b")
+	refC := MakeStoreKey("refs", "c")
+	if _, _, _, err = tsc.SetKeyValueEx(refA, nil, 0, nil, []StoreAddress{addrDoc, addrOther}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err = tsc.SetKeyValueEx(refB, nil, 0, nil, []StoreAddress{addrOther, addrPage, addrOther}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err = tsc.SetKeyValueEx(refC, nil, 0, nil, []StoreAddress{addrOther}); err != nil {
+		t.Fatal(err)
+	}
+	expiration := time.Now().Add(time.Hour)
+	if _, err = tsc.SetKeyTtl(refA, &expiration); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, referrers, err := tsc.DeleteKeyTreeCascade(MakeStoreKey("docs", "1"), CascadeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !removed || len(referrers) != 2 || referrers[0].Path != "/refs/a" || referrers[1].Path != "/refs/b" {
+		t.Error("cascade")
+	}
+
+	addresses, _, err := tsc.GetRelationships(refA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(addresses, []StoreAddress{0, addrOther}) {
+		t.Error("slot emptied")
+	}
+	ttl, err := tsc.GetKeyTtl(refA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl == nil || ttl.UnixNano() != expiration.UnixNano() {
+		t.Error("referrer expiration kept")
+	}
+	if addresses, _, err = tsc.GetRelationships(refB); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(addresses, []StoreAddress{addrOther, 0, addrOther}) {
+		t.Error("child slot emptied")
+	}
+
+	if removed, referrers, err = tsc.DeleteKeyTreeCascade(MakeStoreKey("docs", "2"), CascadeOptions{ReferrersPattern: MakeStoreKey("refs", "*"), RemoveSlots: true}); err != nil {
+		t.Fatal(err)
+	}
+	if !removed || len(referrers) != 3 {
+		t.Error("cascade removal")
+	}
+	if addresses, _, err = tsc.GetRelationships(refB); err != nil {
+		t.Fatal(err)
+	}
+	if len(addresses) != 1 || addresses[0] != 0 {
+		t.Error("slots removed")
+	}
+	if addresses, _, err = tsc.GetRelationships(refC); err != nil {
+		t.Fatal(err)
+	}
+	if len(addresses) != 1 || addresses[0] != 0 {
+		t.Error("all slots removed")
+	}
+}
+
+func TestMoveReferencedKeys(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	stageTtl := time.Now().Add(time.Minute)
+	for _, id := range []string{"1", "2", "3"} {
+		if _, _, _, err := tsc.SetKeyValueEx(MakeStoreKey("staging", id), "record "+id, 0, &stageTtl, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	moved, err := tsc.MoveReferencedKeys([]MoveSpec{
+		{SrcSk: MakeStoreKey("staging", "1"), DestSk: MakeStoreKey("records", "1"), Ttl: &ZeroTime, Refs: []StoreKey{MakeStoreKey("index", "a")}},
+		{SrcSk: MakeStoreKey("staging", "2"), DestSk: MakeStoreKey("records", "2"), Ttl: &ZeroTime, Refs: []StoreKey{MakeStoreKey("index", "b")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != 2 {
+		t.Error("moved")
+	}
+
+	hasLink, rv, err := tsc.GetRelationshipValue(MakeStoreKey("index", "b"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasLink || rv == nil || rv.Sk.Path != "/records/2" || rv.CurrentValue != "record 2" {
+		t.Error("index b")
+	}
+
+	// a missing source is found before anything moves
+	_, err = tsc.MoveReferencedKeys([]MoveSpec{
+		{SrcSk: MakeStoreKey("staging", "3"), DestSk: MakeStoreKey("records", "3")},
+		{SrcSk: MakeStoreKey("staging", "missing"), DestSk: MakeStoreKey("records", "4")},
+	})
+	if !errors.Is(err, ErrMoveFailed) {
+		t.Error("missing source")
+	}
+	if exists, _ := tsc.KeyExists(MakeStoreKey("records", "3")); exists {
+		t.Error("checked first")
+	}
+
+	// the second move fails, so the first is moved back
+	moved, err = tsc.MoveReferencedKeys([]MoveSpec{
+		{SrcSk: MakeStoreKey("staging", "3"), DestSk: MakeStoreKey("records", "3"), Ttl: &ZeroTime, Refs: []StoreKey{MakeStoreKey("index", "c")}},
+		{SrcSk: MakeStoreKey("records", "1"), DestSk: MakeStoreKey("records", "3")},
+	})
+	if !errors.Is(err, ErrMoveFailed) || moved != 0 {
+		t.Error("rolled back")
+	}
+
+	ttl, err := tsc.GetKeyTtl(MakeStoreKey("staging", "3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl == nil || ttl.UnixNano() != stageTtl.UnixNano() {
+		t.Error("staged ttl restored")
+	}
+	if exists, _ := tsc.KeyExists(MakeStoreKey("records", "3")); exists {
+		t.Error("destination cleared")
+	}
+	if hasLink, rv, err = tsc.GetRelationshipValue(MakeStoreKey("index", "c"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if rv != nil {
+		t.Error("index unreferenced")
+	}
+}
+
+func TestDefineAutoLinkKeyFiltered(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	dsk := MakeStoreKey("people")
+	isk := MakeStoreKey("active-by-city")
+
+	records := map[string]any{
+		"1": map[string]any{"city": "nyc", "status": "active", "address": map[string]any{"zip": "10001"}},
+		"2": map[string]any{"city": "nyc", "status": "retired"},
+	}
+	for id, record := range records {
+		if _, _, err := tsc.SetKeyJson(AppendStoreKeySegmentStrings(dsk, id), record, JsonStringValuesAsKeys); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, _, err := tsc.DefineAutoLinkKeyFiltered(dsk, isk, []SubPath{{SubPathSegment("city")}, {}}, `status ==`); err == nil {
+		t.Error("invalid filter")
+	}
+
+	_, created, err := tsc.DefineAutoLinkKeyFiltered(dsk, isk, []SubPath{{SubPathSegment("city")}, {}}, `status == "active" && [address.zip] == "10001"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created {
+		t.Error("created")
+	}
+
+	matches, err := tsc.LookupAutoLinkedPrefix(isk, "nyc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 || matches[0].RecordSk.Path != "/people/1" {
+		t.Error("filtered lookup")
+	}
+	if exists, _ := tsc.KeyExists(MakeStoreKey("active-by-city", "nyc", "2")); exists {
+		t.Error("pruned")
+	}
+
+	// the server links a new record, which the lookup filters until pruned
+	if _, _, err = tsc.SetKeyJson(MakeStoreKey("people", "3"), map[string]any{"city": "sf"}, JsonStringValuesAsKeys); err != nil {
+		t.Fatal(err)
+	}
+	_, _, found, err := tsc.LookupAutoLinked(isk, "sf", "3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Error("new record filtered")
+	}
+
+	problems, err := tsc.VerifyAutoLinks(dsk, isk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || problems[0].LinkSk.Path != "/active-by-city/sf/3" || problems[0].Problem != AutoLinkStale {
+		t.Error("unpruned link")
+	}
+
+	removed, err := tsc.PruneAutoLinks(isk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Error("prune")
+	}
+
+	if err = tsc.RebuildAutoLinks(dsk, isk); err != nil {
+		t.Fatal(err)
+	}
+	if problems, err = tsc.VerifyAutoLinks(dsk, isk); err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Error("rebuilt with filter")
+	}
+}
+
+func TestGetAllAutoLinkDefinitions(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	if _, _, err := tsc.DefineAutoLinkKey(MakeStoreKey("people"), MakeStoreKey("people-by-name"), []SubPath{MakeSubPath("name")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tsc.DefineAutoLinkKey(MakeStoreKey("people"), MakeStoreKey("people-by-city"), []SubPath{MakeSubPath("city"), {}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tsc.DefineAutoLinkKey(MakeStoreKey("org", "teams"), MakeStoreKey("teams-by-id"), []SubPath{{}}); err != nil {
+		t.Fatal(err)
+	}
+
+	parents, err := tsc.GetAllAutoLinkDefinitions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parents) != 2 || parents[0].DataParentSk.Path != "/org/teams" || parents[1].DataParentSk.Path != "/people" {
+		t.Fatal("parents")
+	}
+
+	defs := parents[1].Definitions
+	if len(defs) != 2 || defs[0].AutoLinkSk.Path != "/people-by-city" || defs[1].AutoLinkSk.Path != "/people-by-name" {
+		t.Fatal("definitions")
+	}
+	if len(defs[0].Fields) != 2 || string(defs[0].Fields[0][0]) != "city" || len(defs[0].Fields[1]) != 0 {
+		t.Error("fields")
+	}
+}
+
+func TestTraverseGraph(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	addrs := map[string]StoreAddress{}
+	for _, name := range []string{"a", "b", "c", "d"} {
+		addr, _, err := tsc.SetKeyValue(MakeStoreKey("graph", name), name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs[name] = addr
+	}
+
+	edges := map[string][]string{"a": {"b", "c"}, "b": {"d"}, "c": {"d"}, "d": {"a"}}
+	for from, tos := range edges {
+		relationships := []StoreAddress{}
+		for _, to := range tos {
+			relationships = append(relationships, addrs[to])
+		}
+		if _, _, _, err := tsc.SetKeyValueEx(MakeStoreKey("graph", from), nil, SetExNoValueUpdate, nil, relationships); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	traverse := func(maxDepth int, order GraphOrder, limit int) (visited []string) {
+		err := tsc.TraverseGraph(MakeStoreKey("graph", "a"), maxDepth, order, func(node *GraphNode) bool {
+			visited = append(visited, fmt.Sprintf("%v@%d", node.Value, node.Depth))
+			return len(visited) < limit
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	if visited := traverse(0, GraphBreadthFirst, 100); !reflect.DeepEqual(visited, []string{"a@0", "b@1", "c@1", "d@2"}) {
+		t.Errorf("breadth first %v", visited)
+	}
+	if visited := traverse(0, GraphDepthFirst, 100); !reflect.DeepEqual(visited, []string{"a@0", "b@1", "d@2", "c@1"}) {
+		t.Errorf("depth first %v", visited)
+	}
+	if visited := traverse(1, GraphDepthFirst, 100); !reflect.DeepEqual(visited, []string{"a@0", "b@1", "c@1"}) {
+		t.Errorf("max depth %v", visited)
+	}
+	if visited := traverse(0, GraphBreadthFirst, 2); !reflect.DeepEqual(visited, []string{"a@0", "b@1"}) {
+		t.Errorf("stopped %v", visited)
+	}
+
+	var fromD *GraphNode
+	err := tsc.TraverseGraph(MakeStoreKey("graph", "d"), 1, GraphBreadthFirst, func(node *GraphNode) bool {
+		if node.Depth == 1 {
+			fromD = node
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fromD == nil || fromD.Sk.Path != "/graph/a" || fromD.FromSk.Path != "/graph/d" || fromD.RelationshipIndex != 0 {
+		t.Error("link details")
+	}
+}
+
+func TestIndexedClient(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	if _, _, err := tsc.SetKeyValue(MakeStoreKey("users", "1"), "ann@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	ic := NewIndexedClient(tsc)
+	byDomain := func(value any) []string {
+		email, _ := value.(string)
+		if _, domain, found := strings.Cut(email, "@"); found {
+			return []string{domain}
+		}
+		return nil
+	}
+	if err := ic.DefineIndex("by-domain", MakeStoreKey("users"), byDomain); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := ic.SetKeyValue(MakeStoreKey("users", "2"), "bob@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ic.SetKeyValue(MakeStoreKey("users", "3"), "cat@test.org"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ic.SetKeyValue(MakeStoreKey("users", "3", "nickname"), "kitty@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	matches, err := ic.QueryIndex("by-domain", "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 2 || matches[0].Sk.Path != "/users/1" || matches[1].Sk.Path != "/users/2" || matches[1].Value != "bob@example.com" {
+		t.Error("query")
+	}
+
+	// a changed value moves to its new term
+	if _, _, err = ic.SetKeyValue(MakeStoreKey("users", "2"), "bob@test.org"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err = ic.DeleteKey(MakeStoreKey("users", "1")); err != nil {
+		t.Fatal(err)
+	}
+	if matches, err = ic.QueryIndex("by-domain", "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 0 {
+		t.Error("entries removed")
+	}
+	if exists, _ := tsc.KeyExists(AppendStoreKeySegmentStrings(IndexesSk, "by-domain", "terms", "example.com")); exists {
+		t.Error("empty term removed")
+	}
+
+	if matches, err = ic.QueryIndex("by-domain", "test.org"); err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 2 {
+		t.Error("new term")
+	}
+
+	if _, err = ic.DeleteKeyTree(MakeStoreKey("users", "3")); err != nil {
+		t.Fatal(err)
+	}
+	if matches, err = ic.QueryIndex("by-domain", "test.org"); err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 || matches[0].Sk.Path != "/users/2" {
+		t.Error("tree deleted")
+	}
+
+	if _, err = ic.QueryIndex("missing", "x"); err == nil {
+		t.Error("undefined index")
+	}
+	if err = ic.DropIndex("by-domain"); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := tsc.KeyExists(AppendStoreKeySegmentStrings(IndexesSk, "by-domain")); exists {
+		t.Error("dropped")
+	}
+}
+
+func TestFindKeysByValue(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	values := map[string]any{
+		"/app":            "on",
+		"/app/a":          "on",
+		"/app/a/b":        "off",
+		"/app/c":          "on",
+		"/app/d":          5,
+		"/other":          "on",
+		"/app/a/b/c/deep": "on",
+	}
+	for path, value := range values {
+		if _, _, err := tsc.SetKeyValue(MakeStoreKeyFromPath(TokenPath(path)), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys, err := tsc.FindKeysByValue(MakeStoreKey("app"), "on", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := []TokenPath{}
+	for _, sk := range keys {
+		paths = append(paths, sk.Path)
+	}
+	if !reflect.DeepEqual(paths, []TokenPath{"/app", "/app/a", "/app/a/b/c/deep", "/app/c"}) {
+		t.Errorf("found %v", paths)
+	}
+
+	if keys, err = tsc.FindKeysByValue(MakeStoreKey("app"), "on", 2); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Error("limit")
+	}
+
+	if keys, err = tsc.FindKeysByValue(MakeStoreKey("app"), 5, 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Path != "/app/d" {
+		t.Error("number")
+	}
+}
+
+func TestTextSearch(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	ic := NewIndexedClient(tsc)
+	if err := ic.DefineTextIndex("notes-text", MakeStoreKey("notes")); err != nil {
+		t.Fatal(err)
+	}
+
+	notes := map[string]any{
+		"1": "The quick brown fox",
+		"2": "A lazy brown dog, and a Quick cat",
+		"3": "Nothing to see here",
+		"4": 42,
+	}
+	for id, note := range notes {
+		if _, _, err := ic.SetKeyValue(MakeStoreKey("notes", id), note); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	results, err := ic.Search("notes-text", "quick, brown DOG!", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].Sk.Path != "/notes/2" || results[0].Hits != 3 || results[1].Sk.Path != "/notes/1" || results[1].Hits != 2 {
+		t.Error("ranking")
+	}
+	if results[1].Value != "The quick brown fox" {
+		t.Error("value")
+	}
+
+	if results, err = ic.Search("notes-text", "brown", 1); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Sk.Path != "/notes/1" {
+		t.Error("limit")
+	}
+
+	if _, _, err = ic.SetKeyValue(MakeStoreKey("notes", "1"), "slow green turtle"); err != nil {
+		t.Fatal(err)
+	}
+	if results, err = ic.Search("notes-text", "fox turtle", 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Sk.Path != "/notes/1" || results[0].Hits != 1 {
+		t.Error("reindexed")
+	}
+}
+
+func TestGetMatchingKeysRegexStream(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	for _, path := range []string{"/users/1/sessions", "/users/22/sessions", "/users/bob/sessions", "/users/3/sessions/x", "/users/4/profile"} {
+		if _, _, err := tsc.SetKey(MakeStoreKeyFromPath(TokenPath(path))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var paths []TokenPath
+	err := tsc.GetMatchingKeysRegexStream(MakeStoreKey("users", "**"), `^/users/[0-9]+/sessions$`, func(km *KeyMatch) bool {
+		paths = append(paths, km.Key)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(paths, []TokenPath{"/users/1/sessions", "/users/22/sessions", "/users/3/sessions"}) {
+		t.Errorf("matched %v", paths)
+	}
+
+	if err = tsc.GetMatchingKeysRegexStream(MakeStoreKey("**"), `[`, func(km *KeyMatch) bool { return true }); err == nil {
+		t.Error("invalid expression")
+	}
+}
+
+func TestGetMatchingKeysEx(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	now := time.Now()
+	items := []struct {
+		id     string
+		value  any
+		expire *time.Time
+	}{
+		{"a", 30, nil},
+		{"b", "text", &[]time.Time{now.Add(time.Hour)}[0]},
+		{"c", 10, &[]time.Time{now.Add(3 * time.Hour)}[0]},
+		{"d", 20.5, &[]time.Time{now.Add(2 * time.Hour)}[0]},
+	}
+	for _, item := range items {
+		if _, _, _, err := tsc.SetKeyValueEx(MakeStoreKey("items", item.id), item.value, 0, item.expire, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	order := func(opts MatchOptions, startAt, limit int) (paths []TokenPath) {
+		keys, err := tsc.GetMatchingKeysEx(MakeStoreKey("items", "*"), startAt, limit, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, km := range keys {
+			paths = append(paths, km.Key)
+		}
+		return
+	}
+
+	if paths := order(MatchOptions{}, 0, 10); !reflect.DeepEqual(paths, []TokenPath{"/items/a", "/items/b", "/items/c", "/items/d"}) {
+		t.Errorf("key order %v", paths)
+	}
+	if paths := order(MatchOptions{Order: MatchOrderValue}, 0, 10); !reflect.DeepEqual(paths, []TokenPath{"/items/c", "/items/d", "/items/a", "/items/b"}) {
+		t.Errorf("value order %v", paths)
+	}
+	if paths := order(MatchOptions{Order: MatchOrderValue}, 1, 2); !reflect.DeepEqual(paths, []TokenPath{"/items/d", "/items/a"}) {
+		t.Errorf("value page %v", paths)
+	}
+	if paths := order(MatchOptions{Order: MatchOrderTtl}, 0, 10); !reflect.DeepEqual(paths, []TokenPath{"/items/b", "/items/d", "/items/c", "/items/a"}) {
+		t.Errorf("ttl order %v", paths)
+	}
+
+	values, err := tsc.GetMatchingKeyValuesEx(MakeStoreKey("items", "*"), 0, 1, MatchOptions{Order: MatchOrderValue})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 1 || values[0].Key != "/items/c" || values[0].CurrentValue != 10 {
+		t.Error("values")
+	}
+}
+
+func TestGetMatchingKeysExMetadata(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	for _, id := range []string{"a", "b", "c", "d"} {
+		if _, _, err := tsc.SetKeyValue(MakeStoreKey("docs", id), id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for id, status := range map[string]string{"a": "draft", "c": "final", "d": "draft"} {
+		if _, _, err := tsc.SetMetadataAttribute(MakeStoreKey("docs", id), "status", status); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	order := func(opts MatchOptions, startAt, limit int) (paths []TokenPath) {
+		keys, err := tsc.GetMatchingKeysEx(MakeStoreKey("docs", "*"), startAt, limit, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, km := range keys {
+			paths = append(paths, km.Key)
+		}
+		return
+	}
+
+	if paths := order(MatchOptions{MetadataAttribute: "status"}, 0, 10); !reflect.DeepEqual(paths, []TokenPath{"/docs/a", "/docs/c", "/docs/d"}) {
+		t.Errorf("attribute %v", paths)
+	}
+	draft := "draft"
+	if paths := order(MatchOptions{MetadataAttribute: "status", MetadataValue: &draft}, 0, 10); !reflect.DeepEqual(paths, []TokenPath{"/docs/a", "/docs/d"}) {
+		t.Errorf("attribute value %v", paths)
+	}
+	if paths := order(MatchOptions{MetadataAttribute: "status", MetadataValue: &draft}, 1, 10); !reflect.DeepEqual(paths, []TokenPath{"/docs/d"}) {
+		t.Errorf("filtered page %v", paths)
+	}
+
+	values, err := tsc.GetMatchingKeyValuesEx(MakeStoreKey("docs", "*"), 0, 10, MatchOptions{MetadataAttribute: "missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 0 {
+		t.Error("missing attribute")
+	}
+}
+
+func TestGetExpiringKeys(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	now := time.Now()
+	soon := now.Add(time.Minute)
+	sooner := now.Add(30 * time.Second)
+	later := now.Add(time.Hour)
+	for id, expire := range map[string]*time.Time{"a": &soon, "b": nil, "c": &later, "d": &sooner} {
+		if _, _, _, err := tsc.SetKeyValueEx(MakeStoreKey("cache", id), id, 0, expire, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys, err := tsc.GetExpiringKeys(MakeStoreKey("cache", "*"), 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0].Sk.Path != "/cache/d" || keys[1].Sk.Path != "/cache/a" {
+		t.Errorf("expiring %v", keys)
+	}
+	if len(keys) > 0 && keys[0].Expire.Sub(sooner).Abs() > time.Second {
+		t.Error("expire time")
+	}
+
+	if keys, err = tsc.GetExpiringKeys(MakeStoreKey("cache", "*"), 2*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 3 {
+		t.Error("wide window")
+	}
+}
+
+func TestAggregateKeyValues(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	for id, value := range map[string]any{"a": 4, "b": 2.5, "c": "n/a", "d": uint8(10), "e": -1} {
+		if _, _, err := tsc.SetKeyValue(MakeStoreKey("metrics", id), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := map[AggregateOp]float64{
+		AggregateSum:   15.5,
+		AggregateMin:   -1,
+		AggregateMax:   10,
+		AggregateAvg:   3.875,
+		AggregateCount: 4,
+	}
+	for op, want := range expected {
+		result, count, err := tsc.AggregateKeyValues(MakeStoreKey("metrics", "*"), op)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != want || count != 4 {
+			t.Errorf("%s: %v of %d", op, result, count)
+		}
+	}
+
+	result, count, err := tsc.AggregateKeyValues(MakeStoreKey("missing", "*"), AggregateMin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != 0 || count != 0 {
+		t.Error("no values")
+	}
+
+	if _, _, err = tsc.AggregateKeyValues(MakeStoreKey("metrics", "*"), AggregateOp(99)); err == nil {
+		t.Error("unknown op")
+	}
+}
+
+func TestGetLevelKeysRange(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	for _, id := range []string{"2024-01-05", "2024-02-11", "2024-02-20", "2024-03-01", "2024-04-15"} {
+		if _, _, err := tsc.SetKey(MakeStoreKey("events", id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	segments := func(from, to string, limit int) (result []string) {
+		keys, err := tsc.GetLevelKeysRange(MakeStoreKey("events"), TokenSegment(from), TokenSegment(to), limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, lk := range keys {
+			result = append(result, string(lk.Segment))
+		}
+		return
+	}
+
+	if result := segments("2024-02", "2024-03", 0); !reflect.DeepEqual(result, []string{"2024-02-11", "2024-02-20"}) {
+		t.Errorf("february %v", result)
+	}
+	if result := segments("2024-02-20", "", 2); !reflect.DeepEqual(result, []string{"2024-02-20", "2024-03-01"}) {
+		t.Errorf("open end %v", result)
+	}
+	if result := segments("", "2024-02", 0); !reflect.DeepEqual(result, []string{"2024-01-05"}) {
+		t.Errorf("open start %v", result)
+	}
+	if result := segments("2025", "", 0); len(result) != 0 {
+		t.Errorf("empty %v", result)
+	}
+}
+
+func TestDescendingOrder(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	for _, id := range []string{"01", "02", "03", "04", "05"} {
+		if _, _, err := tsc.SetKeyValue(MakeStoreKey("log", id), id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	levelKeys := func(startAt, limit int) (result []string) {
+		keys, err := tsc.GetLevelKeysEx(MakeStoreKey("log"), "*", startAt, limit, LevelKeyOptions{Descending: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, lk := range keys {
+			result = append(result, string(lk.Segment))
+		}
+		return
+	}
+
+	if result := levelKeys(0, 3); !reflect.DeepEqual(result, []string{"05", "04", "03"}) {
+		t.Errorf("latest %v", result)
+	}
+	if result := levelKeys(3, 3); !reflect.DeepEqual(result, []string{"02", "01"}) {
+		t.Errorf("last page %v", result)
+	}
+	if result := levelKeys(5, 3); len(result) != 0 {
+		t.Errorf("past end %v", result)
+	}
+
+	keys, err := tsc.GetMatchingKeysEx(MakeStoreKey("log", "*"), 1, 2, MatchOptions{Descending: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0].Key != "/log/04" || keys[1].Key != "/log/03" {
+		t.Error("matching keys")
+	}
+
+	values, err := tsc.GetMatchingKeyValuesEx(MakeStoreKey("log", "*"), 0, 1, MatchOptions{Descending: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 1 || values[0].Key != "/log/05" || values[0].CurrentValue != "05" {
+		t.Error("matching values")
+	}
+
+	if keys, err = tsc.GetMatchingKeysEx(MakeStoreKey("log", "*"), 0, 2, MatchOptions{Order: MatchOrderValue, Descending: true}); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0].Key != "/log/05" || keys[1].Key != "/log/04" {
+		t.Error("sorted descending")
+	}
+}
+
+func TestGetLevelKeyValues(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	expire := time.Now().Add(time.Hour)
+	if _, _, _, err := tsc.SetKeyValueEx(MakeStoreKey("cfg", "a"), 1, 0, &expire, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tsc.SetKeyValue(MakeStoreKey("cfg", "b"), "two"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tsc.SetKey(MakeStoreKey("cfg", "c", "d")); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := tsc.GetLevelKeyValues(MakeStoreKey("cfg"), "*", 0, 10, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 3 {
+		t.Fatalf("listed %d", len(keys))
+	}
+	if string(keys[0].Segment) != "a" || !keys[0].HasValue || keys[0].Value != 1 || keys[0].Ttl == nil || keys[0].Ttl.Sub(expire).Abs() > time.Second {
+		t.Error("first")
+	}
+	if string(keys[1].Segment) != "b" || keys[1].Value != "two" || keys[1].Ttl != nil {
+		t.Error("second")
+	}
+	if string(keys[2].Segment) != "c" || keys[2].HasValue || !keys[2].HasChildren {
+		t.Error("third")
+	}
+
+	if keys, err = tsc.GetLevelKeyValues(MakeStoreKey("cfg"), "*", 1, 1, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || string(keys[0].Segment) != "b" || keys[0].Ttl != nil {
+		t.Error("paged")
+	}
+}
+
+func TestScanParallel(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	expected := map[TokenPath]bool{}
+	for i := 0; i < 6; i++ {
+		for j := 0; j < 20; j++ {
+			sk := MakeStoreKey("scan", fmt.Sprintf("p%d", i), fmt.Sprintf("k%02d", j))
+			if _, _, err := tsc.SetKeyValue(sk, j); err != nil {
+				t.Fatal(err)
+			}
+			expected[sk.Path] = true
+		}
+		expected[MakeStoreKey("scan", fmt.Sprintf("p%d", i)).Path] = true
+	}
+
+	scan := func(skPattern StoreKey) map[TokenPath]bool {
+		var mu sync.Mutex
+		found := map[TokenPath]bool{}
+		err := tsc.ScanParallel(skPattern, 4, func(km *KeyMatch) bool {
+			mu.Lock()
+			defer mu.Unlock()
+			if found[km.Key] {
+				t.Errorf("duplicate %s", km.Key)
+			}
+			found[km.Key] = true
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return found
+	}
+
+	if found := scan(MakeStoreKey("scan", "**")); !reflect.DeepEqual(found, expected) {
+		t.Errorf("multi-level: %d of %d", len(found), len(expected))
+	}
+
+	found := scan(MakeStoreKey("scan", "*", "k1*"))
+	if len(found) != 60 || !found[MakeStoreKey("scan", "p3", "k15").Path] {
+		t.Errorf("single level: %d", len(found))
+	}
+
+	if found = scan(MakeStoreKey("scan", "p2", "k07")); len(found) != 1 {
+		t.Error("literal")
+	}
+
+	var calls atomic.Int32
+	err := tsc.ScanParallel(MakeStoreKey("scan", "**"), 3, func(km *KeyMatch) bool {
+		calls.Add(1)
+		return false
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls.Load() > 3 {
+		t.Errorf("stopped after %d", calls.Load())
+	}
+}
+
+func TestGetTreeStats(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	if _, _, err := tsc.SetKeyValue(MakeStoreKey("tree"), "root"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tsc.SetKeyValue(MakeStoreKey("tree", "a"), "12345"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tsc.SetKeyValue(MakeStoreKey("tree", "a", "x"), []byte{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tsc.SetKey(MakeStoreKey("tree", "b", "y", "z")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tsc.SetKey(MakeStoreKey("other")); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := tsc.GetTreeStats(MakeStoreKey("tree"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Keys != 6 || stats.Values != 3 || stats.ValueBytes != 12 || stats.Depth != 3 || !reflect.DeepEqual(stats.LevelKeys, []int{2, 2, 1}) {
+		t.Errorf("stats %+v", stats)
+	}
+
+	if stats, err = tsc.GetTreeStats(MakeStoreKey("missing")); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Keys != 0 || stats.Depth != 0 || len(stats.LevelKeys) != 0 {
+		t.Errorf("missing %+v", stats)
+	}
+
+	if stats, err = tsc.GetTreeStats(MakeStoreKey()); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Keys != 7 || stats.Depth != 4 || stats.LevelKeys[0] != 2 {
+		t.Errorf("root %+v", stats)
+	}
+}
+
+func TestEscapePattern(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	for _, segment := range []string{"*", "a*", "ab", `a\b`, "x"} {
+		if _, _, err := tsc.SetKeyValue(MakeStoreKey("glob", segment, "v"), segment); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if EscapePattern(`a*\`) != `a\*\\` {
+		t.Error("escape")
+	}
+
+	match := func(skPattern StoreKey, opts MatchOptions) (paths []TokenPath) {
+		keys, err := tsc.GetMatchingKeysEx(skPattern, 0, 100, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, km := range keys {
+			paths = append(paths, km.Key)
+		}
+		return
+	}
+
+	if paths := match(MakeStoreKey("glob", EscapePattern("*"), "v"), MatchOptions{}); !reflect.DeepEqual(paths, []TokenPath{MakeStoreKey("glob", "*", "v").Path}) {
+		t.Errorf("escaped star %v", paths)
+	}
+	if paths := match(MakeStoreKey("glob", EscapePattern("a*"), "*"), MatchOptions{}); !reflect.DeepEqual(paths, []TokenPath{MakeStoreKey("glob", "a*", "v").Path}) {
+		t.Errorf("escaped with wildcard %v", paths)
+	}
+	if paths := match(MakeStoreKey("glob", "a*", "v"), MatchOptions{Literal: true}); !reflect.DeepEqual(paths, []TokenPath{MakeStoreKey("glob", "a*", "v").Path}) {
+		t.Errorf("literal %v", paths)
+	}
+	if paths := match(MakeStoreKey("glob", EscapePattern(`a\b`), "v"), MatchOptions{}); !reflect.DeepEqual(paths, []TokenPath{MakeStoreKey("glob", `a\b`, "v").Path}) {
+		t.Errorf("escaped backslash %v", paths)
+	}
+	if paths := match(MakeStoreKey("glob", EscapePattern("*"), "**"), MatchOptions{}); !reflect.DeepEqual(paths, []TokenPath{MakeStoreKey("glob", "*", "v").Path}) {
+		t.Errorf("escaped with multi-level %v", paths)
+	}
+
+	values, err := tsc.GetMatchingKeyValuesEx(MakeStoreKey("glob", "*", "v"), 0, 100, MatchOptions{Literal: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 1 || values[0].CurrentValue != "*" {
+		t.Error("literal values")
+	}
+}
+
+func TestLevelKeysCursor(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	for i := 0; i < 30; i++ {
+		if _, _, err := tsc.SetKey(MakeStoreKey("level", fmt.Sprintf("%02d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seen := map[string]int{}
+	cursor := ""
+	pages := 0
+	for {
+		keys, nextCursor, err := tsc.GetLevelKeysCursor(MakeStoreKey("level"), "*", cursor, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, lk := range keys {
+			seen[string(lk.Segment)]++
+		}
+		if nextCursor == "" {
+			break
+		}
+		cursor = nextCursor
+		pages++
+
+		if pages == 3 {
+			// remove children that were already listed, shifting offsets
+			for i := 0; i < 10; i++ {
+				if _, err = tsc.DeleteKeyTree(MakeStoreKey("level", fmt.Sprintf("%02d", i))); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+
+	for i := 0; i < 30; i++ {
+		segment := fmt.Sprintf("%02d", i)
+		if seen[segment] != 1 {
+			t.Errorf("child %s seen %d times", segment, seen[segment])
+		}
+	}
+
+	if _, _, err := tsc.GetLevelKeysCursor(MakeStoreKey("level"), "*", "not a cursor", 4); err == nil {
+		t.Error("invalid cursor accepted")
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	var mu sync.Mutex
+	var changes []string
+	tsc.SetCircuitBreaker(2, 100*time.Millisecond, func(from, to CircuitState) {
+		mu.Lock()
+		defer mu.Unlock()
+		changes = append(changes, from.String()+">"+to.String())
+	})
+
+	sk := MakeStoreKey("breaker")
+	if _, _, err := tsc.SetKeyValue(sk, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing listens on this port
+	tsc.SetServer("localhost", 6779)
+	for i := 0; i < 2; i++ {
+		if _, _, _, err := tsc.GetKeyValue(sk); err == nil || errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("failure %d: %v", i, err)
+		}
+	}
+	if tsc.GetCircuitState() != CircuitOpen {
+		t.Fatal("not open")
+	}
+	if _, _, _, err := tsc.GetKeyValue(sk); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("fail fast: %v", err)
+	}
+
+	// the probe after the cooldown fails, opening the circuit again
+	time.Sleep(150 * time.Millisecond)
+	if _, _, _, err := tsc.GetKeyValue(sk); err == nil || errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("failed probe: %v", err)
+	}
+	if tsc.GetCircuitState() != CircuitOpen {
+		t.Error("reopened")
+	}
+
+	tsc.SetServer("localhost", 6771)
+	time.Sleep(150 * time.Millisecond)
+	value, _, _, err := tsc.GetKeyValue(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != 1 || tsc.GetCircuitState() != CircuitClosed {
+		t.Error("closed")
+	}
+
+	// server errors are responses, not failures
+	if _, err = tsc.RawCommand("nosuchcommand"); err == nil {
+		t.Error("bad command")
+	}
+	if _, err = tsc.RawCommand("nosuchcommand"); err == nil {
+		t.Error("bad command")
+	}
+	if tsc.GetCircuitState() != CircuitClosed {
+		t.Error("server errors")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	expected := []string{"closed>open", "open>half-open", "half-open>open", "open>half-open", "half-open>closed"}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("changes %v", changes)
+	}
+
+	tsc.SetCircuitBreaker(0, 0, nil)
+	if tsc.GetCircuitState() != CircuitClosed {
+		t.Error("removed")
+	}
+}
+
+func TestCircuitBreakerStaleOutcome(t *testing.T) {
+	cb := &circuitBreaker{threshold: 1, cooldown: time.Hour}
+
+	// a slow command is let through while the circuit is closed
+	slow, err := cb.allow()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failed, err := cb.allow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cb.record(failed, nil, io.EOF)
+	if cb.state != CircuitOpen {
+		t.Fatal("not open")
+	}
+	openedAt := cb.openedAt
+
+	// the slow command's outcome doesn't end the cooldown or restart it
+	cb.record(slow, map[string]any{}, nil)
+	if cb.state != CircuitOpen {
+		t.Error("stale success closed the circuit")
+	}
+	cb.record(slow, nil, io.EOF)
+	if cb.openedAt != openedAt {
+		t.Error("stale failure restarted the cooldown")
+	}
+
+	// the probe's outcome counts
+	cb.openedAt = time.Now().Add(-2 * time.Hour)
+	probe, err := cb.allow()
+	if err != nil || cb.state != CircuitHalfOpen {
+		t.Fatal("no probe")
+	}
+	if _, err = cb.allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Error("second probe")
+	}
+	cb.record(probe, map[string]any{}, nil)
+	if cb.state != CircuitClosed {
+		t.Error("probe closed the circuit")
+	}
+}
+
+func TestClientInterceptors(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	type ctxKey struct{}
+	var log []string
+	logging := func(ctx context.Context, cmd []string, next Invoker) (map[string]any, error) {
+		log = append(log, "log:"+cmd[0])
+		return next(context.WithValue(ctx, ctxKey{}, "tagged"), cmd)
+	}
+	rewriting := func(ctx context.Context, cmd []string, next Invoker) (map[string]any, error) {
+		log = append(log, "rewrite:"+ctx.Value(ctxKey{}).(string))
+		if cmd[0] == "getv" {
+			cmd = append([]string{cmd[0], string(MakeStoreKey("b").Path)}, cmd[2:]...)
+		}
+		return next(ctx, cmd)
+	}
+
+	if _, _, err := tsc.SetKeyValue(MakeStoreKey("a"), "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tsc.SetKeyValue(MakeStoreKey("b"), "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	intercepted := tsc.With(ClientInterceptors(logging, rewriting))
+	value, _, _, err := intercepted.GetKeyValue(MakeStoreKey("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "b" {
+		t.Error("rewritten")
+	}
+	if !reflect.DeepEqual(log, []string{"log:getv", "rewrite:tagged"}) {
+		t.Errorf("order %v", log)
+	}
+
+	// an interceptor can answer without sending
+	blocking := func(ctx context.Context, cmd []string, next Invoker) (map[string]any, error) {
+		return nil, errors.New("blocked")
+	}
+	log = nil
+	if _, _, _, err = intercepted.With(ClientInterceptors(blocking)).GetKeyValue(MakeStoreKey("a")); err == nil || err.Error() != "blocked" {
+		t.Errorf("blocked: %v", err)
+	}
+	if len(log) != 2 {
+		t.Error("inherited interceptors")
+	}
+
+	log = nil
+	if _, _, _, err = tsc.GetKeyValue(MakeStoreKey("a")); err != nil {
+		t.Fatal(err)
+	}
+	if len(log) != 0 {
+		t.Error("original client")
+	}
+}
+
+type stallingConn struct {
+	net.Conn
+	budget  *atomic.Int32
+	corrupt *atomic.Bool
+}
+
+func (c *stallingConn) Read(b []byte) (int, error) {
+	if c.budget.Load() == 0 {
+		return 0, os.ErrDeadlineExceeded
+	}
+	if budget := int(c.budget.Load()); budget > 0 && len(b) > budget {
+		b = b[:budget]
+	}
+
+	n, err := c.Conn.Read(b)
+	if c.budget.Load() > 0 {
+		c.budget.Add(int32(-n))
+	}
+	if n > 4 && c.corrupt.CompareAndSwap(true, false) {
+		b[4] = 'x'
+	}
+	return n, err
+}
+
+func TestResponseResync(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	var budget atomic.Int32
+	var corrupt atomic.Bool
+	var dials atomic.Int32
+	budget.Store(-1)
+	tsc.SetDialer(func(ctx context.Context, network, address string) (net.Conn, error) {
+		dials.Add(1)
+		cxn, err := (&net.Dialer{}).DialContext(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		return &stallingConn{Conn: cxn, budget: &budget, corrupt: &corrupt}, nil
+	})
+
+	sk := MakeStoreKey("resync")
+	if _, _, err := tsc.SetKeyValue(sk, "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the response stalls after part of the frame
+	budget.Store(6)
+	_, _, _, err := tsc.GetKeyValue(sk)
+	if !errors.Is(err, ErrResponseLost) || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("lost response: %v", err)
+	}
+	if !strings.Contains(err.Error(), "getv response had 6 of") {
+		t.Errorf("lost details: %v", err)
+	}
+
+	// the partial frame is discarded with the connection
+	budget.Store(-1)
+	value, _, _, err := tsc.GetKeyValue(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "value" || dials.Load() != 2 {
+		t.Error("reconnected")
+	}
+
+	// an unparsable frame is skipped, keeping the connection
+	corrupt.Store(true)
+	if _, _, _, err = tsc.GetKeyValue(sk); err == nil {
+		t.Error("bad frame")
+	}
+	if value, _, _, err = tsc.GetKeyValue(sk); err != nil {
+		t.Fatal(err)
+	}
+	if value != "value" || dials.Load() != 2 {
+		t.Error("resynchronized")
+	}
+}
+
+func TestCommandErrorContext(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	_, err := tsc.RawCommand("setv", "/some/key")
+	if err == nil {
+		t.Fatal("missing value accepted")
+	}
+	if !strings.HasPrefix(err.Error(), "setv /some/key on localhost:6771: ") {
+		t.Errorf("server error: %v", err)
+	}
+
+	if _, _, err = tsc.With(ClientReadOnly()).SetKey(MakeStoreKey("ro")); !errors.Is(err, ErrReadOnly) || err.Error() != "setk /ro: "+ErrReadOnly.Error() {
+		t.Errorf("refused: %v", err)
+	}
+
+	tsc.SetServer("localhost", 6779)
+	if _, _, _, err = tsc.GetKeyValue(MakeStoreKey("down")); err == nil || !strings.HasPrefix(err.Error(), "getv /down on localhost:6779: ") {
+		t.Errorf("connection error: %v", err)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	sk := MakeStoreKey("limited")
+	tsc.SetRateLimit(20, 0, true)
+	for i := 0; i < 20; i++ {
+		if _, _, err := tsc.SetKeyValue(sk, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, _, err := tsc.GetKeyValue(sk); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("fail fast: %v", err)
+	}
+
+	tsc.SetRateLimit(50, 0, false)
+	started := time.Now()
+	for i := 0; i < 60; i++ {
+		if _, _, _, err := tsc.GetKeyValue(sk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(started); elapsed < 150*time.Millisecond {
+		t.Errorf("not limited: %v", elapsed)
+	}
+
+	tsc.SetRateLimit(0, 1000, true)
+	if _, _, err := tsc.SetKeyValue(sk, strings.Repeat("x", 900)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tsc.SetKeyValue(sk, strings.Repeat("x", 900)); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("bytes: %v", err)
+	}
+
+	tsc.SetRateLimit(0, 0, false)
+	for i := 0; i < 100; i++ {
+		if _, _, _, err := tsc.GetKeyValue(sk); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAsyncQueueLimit(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	tsc.SetAsyncQueueLimit(2)
+
+	// stall the connection so that async commands pile up
+	impl := tsc.(*tsClient)
+	impl.Lock()
+
+	first := tsc.SetKeyValueAsync(MakeStoreKey("queued", "first"), 1)
+	for impl.invoked.Load() < 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	queued := []*Future[SetKeyValueResult]{
+		tsc.SetKeyValueAsync(MakeStoreKey("queued", "second"), 2),
+		tsc.SetKeyValueAsync(MakeStoreKey("queued", "third"), 3),
+	}
+
+	full := tsc.GetKeyValueAsync(MakeStoreKey("queued", "first"))
+	select {
+	case <-full.Done():
+	default:
+		t.Fatal("a full queue should resolve immediately")
+	}
+	if _, err := full.Wait(); !errors.Is(err, ErrQueueFull) {
+		t.Error("async queue limit not enforced")
+	}
+	if _, err := tsc.RawCommandAsync("getv", "/queued/first").Wait(); !errors.Is(err, ErrQueueFull) {
+		t.Error("async queue limit not enforced for raw commands")
+	}
+
+	impl.Unlock()
+
+	for _, f := range append(queued, first) {
+		if _, err := f.Wait(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tsc.SetAsyncQueueLimit(0)
+	result, err := tsc.GetKeyValueAsync(MakeStoreKey("queued", "third")).Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Value != 3 {
+		t.Error("queued value")
+	}
+}
+
+type slowConn struct {
+	net.Conn
+	delay *atomic.Int64
+}
+
+func (c *slowConn) Read(b []byte) (int, error) {
+	time.Sleep(time.Duration(c.delay.Load()))
+	return c.Conn.Read(b)
+}
+
+func TestHedgedReads(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	// only the client's own connection is slow
+	var delay atomic.Int64
+	var dials atomic.Int32
+	tsc.SetDialer(func(ctx context.Context, network, address string) (net.Conn, error) {
+		cxn, err := (&net.Dialer{}).DialContext(ctx, network, address)
+		if err != nil || dials.Add(1) > 1 {
+			return cxn, err
+		}
+		return &slowConn{Conn: cxn, delay: &delay}, nil
+	})
+
+	sk := MakeStoreKey("hedged")
+	if _, _, err := tsc.SetKeyValue(sk, "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	tsc.SetHedgedReads(20 * time.Millisecond)
+	defer tsc.SetHedgedReads(0)
+
+	// writes are never hedged
+	delay.Store(int64(100 * time.Millisecond))
+	start := time.Now()
+	if _, _, err := tsc.SetKeyValue(sk, "value2"); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) < 100*time.Millisecond || dials.Load() != 1 {
+		t.Error("write was hedged")
+	}
+
+	// a slow read is answered by the second connection
+	delay.Store(int64(time.Second))
+	start = time.Now()
+	value, _, _, err := tsc.GetKeyValue(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "value2" {
+		t.Error("hedged value")
+	}
+	if time.Since(start) >= 500*time.Millisecond || dials.Load() != 2 {
+		t.Error("read was not hedged")
+	}
+
+	// without hedging, the read waits for the slow connection
+	tsc.SetHedgedReads(0)
+	delay.Store(int64(100 * time.Millisecond))
+	start = time.Now()
+	if _, _, _, err = tsc.GetKeyValue(sk); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) < 100*time.Millisecond {
+		t.Error("read was hedged after hedging stopped")
+	}
+	delay.Store(0)
+}
+
+func TestListPushPopConcurrent(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	sk := MakeStoreKey("list")
+	if err := tsc.ListPush(sk, -1); err != nil {
+		t.Fatal(err)
+	}
+
+	// pushes and pops on separate connections; every element must come out
+	// exactly once
+	const workers = 3
+	const values = 20
+	var mu sync.Mutex
+	seen := map[float64]int{}
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		pusher := tsc.(*tsClient).dedicated()
+		defer pusher.Close()
+		popper := tsc.(*tsClient).dedicated()
+		defer popper.Close()
+
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for n := 0; n < values; n++ {
+				if err := pusher.ListPush(sk, i*values+n); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < values; n++ {
+				value, exists, err := popper.ListPop(sk)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if exists {
+					mu.Lock()
+					seen[value.(float64)]++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	rest, err := tsc.ListRange(sk, 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range rest {
+		seen[value.(float64)]++
+	}
+
+	if len(seen) != workers*values+1 {
+		t.Errorf("expected %d elements, got %d", workers*values+1, len(seen))
+	}
+	for value, count := range seen {
+		if count != 1 {
+			t.Errorf("element %v was seen %d times", value, count)
+		}
+	}
+}
+
+func TestSortedSetConcurrent(t *testing.T) {
+	_, tsc := testSetup(t)
+
+	sk := MakeStoreKey("board")
+
+	// writers on separate connections update the same member
+	const writers = 4
+	const increments = 10
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		writer := tsc.(*tsClient).dedicated()
+		defer writer.Close()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < increments; n++ {
+				if _, err := writer.ZIncrBy(sk, "ann", 1); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	score, _, err := tsc.ZScore(sk, "ann")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if score != writers*increments {
+		t.Errorf("expected a score of %d, got %v", writers*increments, score)
+	}
+
+	// no ranks key is left behind by the updates
+	count, err := tsc.ZCard(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("expected 1 member, got %d", count)
+	}
+}
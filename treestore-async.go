@@ -0,0 +1,113 @@
+package treestore_client
+
+type (
+	// The eventual result of an asynchronous command.
+	Future[T any] struct {
+		done  chan struct{}
+		value T
+		err   error
+	}
+)
+
+func newFuture[T any]() *Future[T] {
+	return &Future[T]{done: make(chan struct{})}
+}
+
+func (f *Future[T]) resolve(value T, err error) {
+	f.value = value
+	f.err = err
+	close(f.done)
+}
+
+// Returns a channel that is closed when the result is available.
+func (f *Future[T]) Done() <-chan struct{} {
+	return f.done
+}
+
+// Blocks until the command completes, and returns its result.
+func (f *Future[T]) Wait() (value T, err error) {
+	<-f.done
+	return f.value, f.err
+}
+
+// Queues a task for the connection's async worker. The worker is started on
+// demand and exits when the queue is drained, so an idle client holds no
+// goroutine. Returns false without queuing the task if the queue is at the
+// limit set by SetAsyncQueueLimit.
+func (tsc *tsClient) enqueueAsync(task func()) bool {
+	tsc.asyncMu.Lock()
+	defer tsc.asyncMu.Unlock()
+
+	if tsc.asyncLimit > 0 && len(tsc.asyncQueue) >= tsc.asyncLimit {
+		return false
+	}
+
+	tsc.asyncQueue = append(tsc.asyncQueue, task)
+	if !tsc.asyncRunning {
+		tsc.asyncRunning = true
+		go tsc.runAsync()
+	}
+	return true
+}
+
+// Runs queued tasks in order until the queue is empty.
+func (tsc *tsClient) runAsync() {
+	for {
+		tsc.asyncMu.Lock()
+		if len(tsc.asyncQueue) == 0 {
+			tsc.asyncQueue = nil
+			tsc.asyncRunning = false
+			tsc.asyncMu.Unlock()
+			return
+		}
+		task := tsc.asyncQueue[0]
+		tsc.asyncQueue[0] = nil
+		tsc.asyncQueue = tsc.asyncQueue[1:]
+		tsc.asyncMu.Unlock()
+
+		task()
+	}
+}
+
+// Queues a raw command, returning a future for the response.
+func (tsc *tsClient) RawCommandAsync(args ...string) *Future[map[string]any] {
+	f := newFuture[map[string]any]()
+	queued := tsc.enqueueAsync(func() {
+		f.resolve(tsc.RawCommand(args...))
+	})
+	if !queued {
+		f.resolve(nil, ErrQueueFull)
+	}
+	return f
+}
+
+// Queues a SetKeyValue, returning a future for the result.
+func (tsc *tsClient) SetKeyValueAsync(sk StoreKey, value any) *Future[SetKeyValueResult] {
+	f := newFuture[SetKeyValueResult]()
+	queued := tsc.enqueueAsync(func() {
+		var result SetKeyValueResult
+		var err error
+		result.Address, result.FirstValue, err = tsc.SetKeyValue(sk, value)
+		f.resolve(result, err)
+	})
+	if !queued {
+		f.resolve(SetKeyValueResult{}, ErrQueueFull)
+	}
+	return f
+}
+
+// Queues a GetKeyValue, returning a future for the result.
+func (tsc *tsClient) GetKeyValueAsync(sk StoreKey) *Future[GetKeyValueResult] {
+	f := newFuture[GetKeyValueResult]()
+	queued := tsc.enqueueAsync(func() {
+		var result GetKeyValueResult
+		var err error
+		result.Value, result.KeyExists, result.ValueExists, err = tsc.GetKeyValue(sk)
+		result.ValueIsNil = result.ValueExists && result.Value == nil
+		f.resolve(result, err)
+	})
+	if !queued {
+		f.resolve(GetKeyValueResult{}, ErrQueueFull)
+	}
+	return f
+}
@@ -0,0 +1,543 @@
+package treestore_client
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Knetic/govaluate"
+	"github.com/jimsnab/go-treestore"
+)
+
+// The metadata attribute of an auto-link key that holds its filter
+// expression (see DefineAutoLinkKeyFiltered).
+const AutoLinkFilterAttribute = "autolink-filter"
+
+type (
+	// The fields of a record, as parameters of an auto-link filter. Fields
+	// that the record doesn't have are nil.
+	autoLinkRecordFields map[string]any
+
+	// The auto-link definitions of a data parent key, found by
+	// GetAllAutoLinkDefinitions.
+	DataParentAutoLinks struct {
+		DataParentSk StoreKey
+		Definitions  []AutoLinkDefinition
+	}
+
+	// The kind of problem found by VerifyAutoLinks.
+	AutoLinkProblemKind int
+
+	// A problem with an auto-link key found by VerifyAutoLinks.
+	AutoLinkProblem struct {
+		LinkSk StoreKey // the auto-link key
+		// The record that should be linked; for a stale link, the record it
+		// points at, or an empty key if that record no longer exists.
+		RecordSk StoreKey
+		Problem  AutoLinkProblemKind
+	}
+
+	// A record found through an auto-link key.
+	AutoLinkMatch struct {
+		LinkSk   StoreKey // the auto-link key
+		RecordSk StoreKey // the linked record
+		Value    any      // the current value of the record key, if any
+	}
+)
+
+const (
+	// A record doesn't have its auto-link key.
+	AutoLinkMissing AutoLinkProblemKind = iota + 1
+	// An auto-link key points at a record that is missing, expired, or
+	// doesn't match the key's field values.
+	AutoLinkStale
+)
+
+func (kind AutoLinkProblemKind) String() string {
+	switch kind {
+	case AutoLinkMissing:
+		return "missing"
+	case AutoLinkStale:
+		return "stale"
+	}
+	return "unknown"
+}
+
+// Finds the record linked by the auto-link key made of `fieldValues` under
+// `autoLinkSk` (see DefineAutoLinkKey), by following relationship 0 of the
+// link. `found` is false if there is no such link, if the link points to a
+// record that no longer exists, or if the record doesn't pass the auto-link
+// filter.
+func (tsc *tsClient) LookupAutoLinked(autoLinkSk StoreKey, fieldValues ...string) (recordSk StoreKey, value any, found bool, err error) {
+	hasLink, rv, err := tsc.GetRelationshipValue(AppendStoreKeySegmentStrings(autoLinkSk, fieldValues...), 0)
+	if err != nil || !hasLink || rv == nil {
+		return
+	}
+
+	filter, err := tsc.autoLinkFilter(autoLinkSk)
+	if err != nil {
+		return
+	}
+	var matched bool
+	if matched, err = tsc.autoLinkFilterMatches(filter, rv.Sk); err != nil || !matched {
+		return
+	}
+
+	recordSk = rv.Sk
+	value = rv.CurrentValue
+	found = true
+	return
+}
+
+// Finds all of the records linked by auto-link keys under `autoLinkSk` that
+// start with `fieldValues`, which can be fewer than the fields of the
+// auto-link definition. The values are key segment patterns, so they may use
+// wildcards. Links to records that no longer exist or don't pass the auto-link
+// filter are skipped.
+func (tsc *tsClient) LookupAutoLinkedPrefix(autoLinkSk StoreKey, fieldValues ...string) (matches []AutoLinkMatch, err error) {
+	pattern := AppendStoreKeySegmentStrings(autoLinkSk, append(append([]string{}, fieldValues...), "**")...)
+
+	var links []*KeyMatch
+	err = tsc.GetMatchingKeysStream(pattern, func(km *KeyMatch) bool {
+		if len(km.Relationships) > 0 && km.Relationships[0] != 0 {
+			links = append(links, km)
+		}
+		return true
+	})
+	if err != nil {
+		return
+	}
+
+	filter, err := tsc.autoLinkFilter(autoLinkSk)
+	if err != nil {
+		return
+	}
+
+	matches = []AutoLinkMatch{}
+	for _, link := range links {
+		var keyExists bool
+		var match AutoLinkMatch
+		if keyExists, _, match.RecordSk, match.Value, err = tsc.KeyValueFromAddress(link.Relationships[0]); err != nil {
+			return
+		}
+		if keyExists {
+			if keyExists, err = tsc.autoLinkFilterMatches(filter, match.RecordSk); err != nil {
+				return
+			}
+		}
+		if keyExists {
+			match.LinkSk = MakeStoreKeyFromPath(link.Key)
+			matches = append(matches, match)
+		}
+	}
+	return
+}
+
+// Checks the auto-link keys under `autoLinkSk` against the records under
+// `dataParentSk`, and reports the links that are missing, and the links that
+// are stale - pointing at a record that no longer exists, has expired, no
+// longer has the linked field values, or doesn't pass the auto-link filter.
+// An empty report means the auto-link index is intact.
+//
+// The server doesn't check links, so the records are read and the expected
+// links are worked out by the client. Field subpath segments are used as
+// key patterns. The records and links are read separately, so records that
+// change during the check can be reported.
+func (tsc *tsClient) VerifyAutoLinks(dataParentSk, autoLinkSk StoreKey) (problems []AutoLinkProblem, err error) {
+	def, err := tsc.findAutoLinkDefinition(dataParentSk, autoLinkSk)
+	if err != nil {
+		return
+	}
+
+	filter, err := tsc.autoLinkFilter(autoLinkSk)
+	if err != nil {
+		return
+	}
+
+	expected, err := tsc.expectedAutoLinks(dataParentSk, autoLinkSk, def.Fields, filter)
+	if err != nil {
+		return
+	}
+
+	pattern := autoLinkSk
+	for range def.Fields {
+		pattern = AppendStoreKeySegmentStrings(pattern, "*")
+	}
+	var links []*KeyMatch
+	err = tsc.GetMatchingKeysStream(pattern, func(km *KeyMatch) bool {
+		if len(km.Relationships) > 0 && km.Relationships[0] != 0 {
+			links = append(links, km)
+		}
+		return true
+	})
+	if err != nil {
+		return
+	}
+
+	problems = []AutoLinkProblem{}
+	found := make(map[TokenPath]bool, len(links))
+	now := time.Now()
+	for _, link := range links {
+		found[link.Key] = true
+
+		var targetSk StoreKey
+		var targetExists bool
+		if targetSk, targetExists, err = tsc.KeyFromAddress(link.Relationships[0]); err != nil {
+			return
+		}
+		if targetExists {
+			var ttl *time.Time
+			if ttl, err = tsc.GetKeyTtl(targetSk); err != nil {
+				return
+			}
+			targetExists = !ttlIsSet(ttl) || ttl.After(now)
+		}
+
+		recordPath, isExpected := expected[link.Key]
+		if !targetExists || !isExpected || targetSk.Path != recordPath {
+			problems = append(problems, AutoLinkProblem{
+				LinkSk:   MakeStoreKeyFromPath(link.Key),
+				RecordSk: targetSk,
+				Problem:  AutoLinkStale,
+			})
+		}
+	}
+
+	linkPaths := make([]TokenPath, 0, len(expected))
+	for linkPath := range expected {
+		if !found[linkPath] {
+			linkPaths = append(linkPaths, linkPath)
+		}
+	}
+	sort.Slice(linkPaths, func(i, j int) bool { return linkPaths[i] < linkPaths[j] })
+	for _, linkPath := range linkPaths {
+		problems = append(problems, AutoLinkProblem{
+			LinkSk:   MakeStoreKeyFromPath(linkPath),
+			RecordSk: MakeStoreKeyFromPath(expected[linkPath]),
+			Problem:  AutoLinkMissing,
+		})
+	}
+	return
+}
+
+// Re-creates the auto-link keys under `autoLinkSk` from the records under
+// `dataParentSk`, by removing the auto-link definition and defining it again
+// with the same fields. The server links every record as the definition is
+// made, and a filter is applied again.
+//
+// The two steps are separate commands, so lookups made between them find no
+// links; callers that can't tolerate that should pause readers of the index.
+func (tsc *tsClient) RebuildAutoLinks(dataParentSk, autoLinkSk StoreKey) (err error) {
+	def, err := tsc.findAutoLinkDefinition(dataParentSk, autoLinkSk)
+	if err != nil {
+		return
+	}
+
+	_, filter, err := tsc.GetMetadataAttribute(autoLinkSk, AutoLinkFilterAttribute)
+	if err != nil {
+		return
+	}
+
+	if _, _, err = tsc.RemoveAutoLinkKey(dataParentSk, autoLinkSk); err != nil {
+		return
+	}
+	_, _, err = tsc.DefineAutoLinkKeyFiltered(dataParentSk, autoLinkSk, def.Fields, filter)
+	return
+}
+
+// Returns the definition of the auto-link key `autoLinkSk` on `dataParentSk`.
+func (tsc *tsClient) findAutoLinkDefinition(dataParentSk, autoLinkSk StoreKey) (def AutoLinkDefinition, err error) {
+	defs, err := tsc.GetAutoLinkDefinition(dataParentSk)
+	if err != nil {
+		return
+	}
+
+	for _, d := range defs {
+		if d.AutoLinkSk.Path == autoLinkSk.Path {
+			def = d
+			return
+		}
+	}
+	err = fmt.Errorf("no auto-link definition for %s on %s", autoLinkSk.Path, dataParentSk.Path)
+	return
+}
+
+// Works out the auto-link keys that the records under `dataParentSk` passing
+// `filter` should have, mapped to the path of the record each one links.
+func (tsc *tsClient) expectedAutoLinks(dataParentSk, autoLinkSk StoreKey, fields []SubPath, filter *govaluate.EvaluableExpression) (expected map[TokenPath]TokenPath, err error) {
+	var records []TokenSegment
+	err = tsc.GetLevelKeysStream(dataParentSk, "*", func(lk LevelKey) bool {
+		records = append(records, lk.Segment)
+		return true
+	})
+	if err != nil {
+		return
+	}
+
+	expected = map[TokenPath]TokenPath{}
+	for _, record := range records {
+		recordSk := MakeStoreKeyFromPath(dataParentSk.Path + "/" + TokenPath(TokenSegmentToString(record)))
+
+		var matched bool
+		if matched, err = tsc.autoLinkFilterMatches(filter, recordSk); err != nil {
+			return
+		}
+		if !matched {
+			continue
+		}
+
+		combos := [][]TokenSegment{{}}
+		for _, field := range fields {
+			var values []TokenSegment
+			if values, err = tsc.autoLinkFieldValues(recordSk, record, field); err != nil {
+				return
+			}
+
+			next := make([][]TokenSegment, 0, len(combos)*len(values))
+			for _, combo := range combos {
+				for _, value := range values {
+					next = append(next, append(append(make([]TokenSegment, 0, len(fields)), combo...), value))
+				}
+			}
+			combos = next
+		}
+
+		for _, combo := range combos {
+			linkSk := MakeStoreKeyFromPath(autoLinkSk.Path)
+			for _, value := range combo {
+				linkSk = AppendStoreKeySegments(linkSk, value)
+			}
+			expected[linkSk.Path] = recordSk.Path
+		}
+	}
+	return
+}
+
+// Returns the values that a record has for an auto-link field: the record
+// id for an empty field, otherwise the child segments of the field subpath.
+func (tsc *tsClient) autoLinkFieldValues(recordSk StoreKey, record TokenSegment, field SubPath) (values []TokenSegment, err error) {
+	if len(field) == 0 {
+		values = []TokenSegment{record}
+		return
+	}
+
+	pattern := MakeStoreKeyFromPath(recordSk.Path)
+	for _, segment := range field {
+		if segment == nil {
+			pattern = AppendStoreKeySegmentStrings(pattern, "*")
+		} else {
+			pattern = AppendStoreKeySegments(pattern, TokenSegment(segment))
+		}
+	}
+	pattern = AppendStoreKeySegmentStrings(pattern, "*")
+
+	err = tsc.GetMatchingKeysStream(pattern, func(km *KeyMatch) bool {
+		tokens := MakeStoreKeyFromPath(km.Key).Tokens
+		values = append(values, tokens[len(tokens)-1])
+		return true
+	})
+	return
+}
+
+// Makes an auto-link definition, as DefineAutoLinkKey does, that only links
+// the records passing `filter`, an expression such as `status == "active"`
+// in the syntax of CalculateKeyValue. The fields of the record (read as json
+// with JsonStringValuesAsKeys) are the parameters of the expression; nested
+// fields are named with dots and bracketed, as in `[address.city] == "nyc"`,
+// and fields the record doesn't have are nil. An empty filter links every
+// record.
+//
+// The server links every record, so the filter is applied by the client: it
+// is stored in the AutoLinkFilterAttribute metadata of `autoLinkSk`, the
+// links of records that don't pass it are deleted with PruneAutoLinks, and
+// the lookups check the records they find against it. Call PruneAutoLinks
+// after storing records to keep the index small.
+func (tsc *tsClient) DefineAutoLinkKeyFiltered(dataParentSk, autoLinkSk StoreKey, fields []SubPath, filter string) (recordKeyExists, autoLinkCreated bool, err error) {
+	if filter != "" {
+		if _, err = govaluate.NewEvaluableExpression(filter); err != nil {
+			err = fmt.Errorf("invalid auto-link filter: %w", err)
+			return
+		}
+	}
+
+	if recordKeyExists, autoLinkCreated, err = tsc.DefineAutoLinkKey(dataParentSk, autoLinkSk, fields); err != nil || !autoLinkCreated || filter == "" {
+		return
+	}
+
+	if _, _, err = tsc.SetMetadataAttribute(autoLinkSk, AutoLinkFilterAttribute, filter); err != nil {
+		return
+	}
+	_, err = tsc.PruneAutoLinks(autoLinkSk)
+	return
+}
+
+// Deletes the auto-link keys under `autoLinkSk` that link records not passing
+// its filter (see DefineAutoLinkKeyFiltered), returning the number deleted.
+// Nothing is done if the auto-link key has no filter.
+func (tsc *tsClient) PruneAutoLinks(autoLinkSk StoreKey) (removed int, err error) {
+	filter, err := tsc.autoLinkFilter(autoLinkSk)
+	if err != nil || filter == nil {
+		return
+	}
+
+	var links []*KeyMatch
+	err = tsc.GetMatchingKeysStream(AppendStoreKeySegmentStrings(autoLinkSk, "**"), func(km *KeyMatch) bool {
+		if len(km.Relationships) > 0 && km.Relationships[0] != 0 {
+			links = append(links, km)
+		}
+		return true
+	})
+	if err != nil {
+		return
+	}
+
+	for _, link := range links {
+		var recordSk StoreKey
+		var exists bool
+		if recordSk, exists, err = tsc.KeyFromAddress(link.Relationships[0]); err != nil {
+			return
+		}
+		if exists {
+			if exists, err = tsc.autoLinkFilterMatches(filter, recordSk); err != nil {
+				return
+			}
+		}
+		if exists {
+			continue
+		}
+
+		var keyRemoved bool
+		if keyRemoved, _, _, err = tsc.DeleteKey(MakeStoreKeyFromPath(link.Key)); err != nil {
+			return
+		}
+		if keyRemoved {
+			removed++
+		}
+	}
+	return
+}
+
+// Reads the filter of an auto-link key, which is nil if it has none.
+func (tsc *tsClient) autoLinkFilter(autoLinkSk StoreKey) (filter *govaluate.EvaluableExpression, err error) {
+	hasFilter, expression, err := tsc.GetMetadataAttribute(autoLinkSk, AutoLinkFilterAttribute)
+	if err != nil || !hasFilter || expression == "" {
+		return
+	}
+
+	if filter, err = govaluate.NewEvaluableExpression(expression); err != nil {
+		err = fmt.Errorf("invalid auto-link filter on %s: %w", autoLinkSk.Path, err)
+	}
+	return
+}
+
+// Evaluates `filter` with the fields of the record at `recordSk`. A nil
+// filter passes every record.
+func (tsc *tsClient) autoLinkFilterMatches(filter *govaluate.EvaluableExpression, recordSk StoreKey) (matched bool, err error) {
+	if filter == nil {
+		matched = true
+		return
+	}
+
+	record, err := tsc.GetKeyAsJson(recordSk, JsonStringValuesAsKeys)
+	if err != nil {
+		return
+	}
+
+	fields := autoLinkRecordFields{}
+	fields.add("", record)
+	result, err := filter.Eval(fields)
+	if err != nil {
+		err = fmt.Errorf("auto-link filter on %s: %w", recordSk.Path, err)
+		return
+	}
+	matched, _ = result.(bool)
+	return
+}
+
+// Adds the fields of a json object, naming nested fields with dots.
+func (fields autoLinkRecordFields) add(prefix string, data any) {
+	obj, is := data.(map[string]any)
+	if !is {
+		if prefix != "" {
+			fields[prefix] = data
+		}
+		return
+	}
+	for name, value := range obj {
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+		fields.add(name, value)
+	}
+}
+
+func (fields autoLinkRecordFields) Get(name string) (any, error) {
+	return fields[name], nil
+}
+
+// Returns every data parent key that has auto-link definitions, with its
+// definitions, in key order, so that the auto-link configuration of the store
+// can be audited.
+//
+// The server only reports the definitions of a given key, so the store is
+// exported, which includes the definitions; this holds the server's
+// exclusive lock and builds the whole export in memory, so it is meant for
+// occasional administrative use.
+func (tsc *tsClient) GetAllAutoLinkDefinitions() (parents []DataParentAutoLinks, err error) {
+	node, err := tsc.exportHistoryNode(StoreKey{Tokens: TokenSet{}})
+	if err != nil {
+		return
+	}
+
+	parents = []DataParentAutoLinks{}
+	if node != nil {
+		err = tsc.collectAutoLinkDefinitions("", node, &parents)
+	}
+	return
+}
+
+// Appends the auto-link definitions found in an exported key and its
+// children, in key order.
+func (tsc *tsClient) collectAutoLinkDefinitions(relPath TokenPath, node *exportedHistoryNode, parents *[]DataParentAutoLinks) (err error) {
+	if len(node.Kals) > 0 {
+		var kals []struct {
+			IndexKey string   `json:"index_key"`
+			Fields   []string `json:"fields"`
+		}
+		if err = json.Unmarshal(node.Kals, &kals); err != nil {
+			return
+		}
+
+		parent := DataParentAutoLinks{
+			DataParentSk: MakeStoreKeyFromPath(relPath),
+			Definitions:  make([]AutoLinkDefinition, 0, len(kals)),
+		}
+		for _, kal := range kals {
+			def := AutoLinkDefinition{
+				AutoLinkSk: tsc.responseKey(kal.IndexKey),
+				Fields:     make([]SubPath, 0, len(kal.Fields)),
+			}
+			for _, field := range kal.Fields {
+				def.Fields = append(def.Fields, treestore.UnescapeSubPath(EscapedSubPath(field)))
+			}
+			parent.Definitions = append(parent.Definitions, def)
+		}
+		sort.Slice(parent.Definitions, func(i, j int) bool {
+			return parent.Definitions[i].AutoLinkSk.Path < parent.Definitions[j].AutoLinkSk.Path
+		})
+		*parents = append(*parents, parent)
+	}
+
+	segments := make([]string, 0, len(node.Children))
+	for segment := range node.Children {
+		segments = append(segments, segment)
+	}
+	sort.Strings(segments)
+	for _, segment := range segments {
+		if err = tsc.collectAutoLinkDefinitions(relPath+"/"+TokenPath(segment), node.Children[segment], parents); err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,185 @@
+package treestore_client
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+)
+
+// The value types of big numbers. The server has no native encoding for them,
+// so they are sent in json form, as their decimal text.
+const (
+	bigIntValueType   = "json-*big.Int"
+	bigFloatValueType = "json-*big.Float"
+)
+
+// Encodes a big.Int or big.Float as decimal text.
+func bigValueToCmdline(val any) (value, valueType string, err error) {
+	switch t := val.(type) {
+	case big.Int:
+		return bigValueToCmdline(&t)
+	case big.Float:
+		return bigValueToCmdline(&t)
+
+	case *big.Int:
+		if t == nil {
+			err = errors.New("nil *big.Int value")
+			return
+		}
+		value = bytesToEscapedValue([]byte(t.String()))
+		valueType = bigIntValueType
+
+	case *big.Float:
+		if t == nil {
+			err = errors.New("nil *big.Float value")
+			return
+		}
+		if t.IsInf() {
+			err = errors.New("infinite *big.Float value")
+			return
+		}
+		// the shortest decimal text that identifies the value at its precision,
+		// quoted to be a json string
+		value = bytesToEscapedValue([]byte(`"` + t.Text('g', -1) + `"`))
+		valueType = bigFloatValueType
+	}
+	return
+}
+
+// Parses the decimal text of a big number, which may be a json string.
+func parseBigValue(value []byte, valueType string) (val any, err error) {
+	text := strings.Trim(string(value), `"`)
+
+	if valueType == bigIntValueType {
+		bi, valid := new(big.Int).SetString(text, 10)
+		if !valid {
+			err = fmt.Errorf("invalid big integer value %q", text)
+			return
+		}
+		val = bi
+		return
+	}
+
+	bf, _, err := big.ParseFloat(text, 10, bigFloatPrec(text), big.ToNearestEven)
+	if err != nil {
+		err = fmt.Errorf("invalid big float value %q: %w", text, err)
+		return
+	}
+	val = bf
+	return
+}
+
+// The precision needed to hold the significant digits of decimal text, and
+// at least that of a float64.
+func bigFloatPrec(text string) uint {
+	mantissa, _, _ := strings.Cut(strings.ToLower(text), "e")
+	digits := 0
+	for _, ch := range mantissa {
+		if ch >= '0' && ch <= '9' {
+			digits++
+		}
+	}
+	return max(64, uint(math.Ceil(float64(digits)*math.Log2(10)))+1)
+}
+
+// Returns the value of `sk` as a big integer. Values stored as big integers,
+// integers of any size, and decimal integer text (string or []byte) are
+// accepted. `exists` is false if the key has no value.
+func (tsc *tsClient) GetKeyValueBigInt(sk StoreKey) (value *big.Int, exists bool, err error) {
+	raw, _, exists, err := tsc.GetKeyValue(sk)
+	if err != nil || !exists {
+		return
+	}
+	value, err = bigIntFromValue(raw)
+	return
+}
+
+// Converts a value to a big integer.
+func bigIntFromValue(raw any) (value *big.Int, err error) {
+	switch t := raw.(type) {
+	case *big.Int:
+		value = t
+	case int:
+		value = big.NewInt(int64(t))
+	case int8:
+		value = big.NewInt(int64(t))
+	case int16:
+		value = big.NewInt(int64(t))
+	case int32:
+		value = big.NewInt(int64(t))
+	case int64:
+		value = big.NewInt(t)
+	case uint8:
+		value = new(big.Int).SetUint64(uint64(t))
+	case uint16:
+		value = new(big.Int).SetUint64(uint64(t))
+	case uint32:
+		value = new(big.Int).SetUint64(uint64(t))
+	case uint64:
+		value = new(big.Int).SetUint64(t)
+	case string, []byte:
+		var val any
+		if val, err = parseBigValue(asBytes(t), bigIntValueType); err != nil {
+			return
+		}
+		value = val.(*big.Int)
+	default:
+		err = fmt.Errorf("value of type %T is not a big integer", raw)
+	}
+	return
+}
+
+// Returns the value of `sk` as a big float. Values stored as big floats or
+// big integers, numbers of any type, and decimal text (string or []byte) are
+// accepted. `exists` is false if the key has no value.
+func (tsc *tsClient) GetKeyValueBigFloat(sk StoreKey) (value *big.Float, exists bool, err error) {
+	raw, _, exists, err := tsc.GetKeyValue(sk)
+	if err != nil || !exists {
+		return
+	}
+	value, err = bigFloatFromValue(raw)
+	return
+}
+
+// Converts a value to a big float.
+func bigFloatFromValue(raw any) (value *big.Float, err error) {
+	switch t := raw.(type) {
+	case *big.Float:
+		value = t
+	case *big.Int:
+		value = new(big.Float).SetPrec(max(64, uint(t.BitLen()))).SetInt(t)
+	case float32:
+		value = big.NewFloat(float64(t))
+	case float64:
+		if math.IsNaN(t) {
+			err = errors.New("NaN is not a big float")
+			return
+		}
+		value = big.NewFloat(t)
+	case int, int8, int16, int32, int64, uint8, uint16, uint32, uint64:
+		var bi *big.Int
+		if bi, err = bigIntFromValue(t); err != nil {
+			return
+		}
+		value = new(big.Float).SetInt(bi)
+	case string, []byte:
+		var val any
+		if val, err = parseBigValue(asBytes(t), bigFloatValueType); err != nil {
+			return
+		}
+		value = val.(*big.Float)
+	default:
+		err = fmt.Errorf("value of type %T is not a big float", raw)
+	}
+	return
+}
+
+// Converts a string or []byte to bytes.
+func asBytes(v any) []byte {
+	if s, isStr := v.(string); isStr {
+		return []byte(s)
+	}
+	return v.([]byte)
+}
@@ -0,0 +1,150 @@
+package treestore_client
+
+import (
+	"sync"
+	"time"
+)
+
+type (
+	// The state of the client's circuit breaker.
+	CircuitState int
+
+	// Invoked when the circuit breaker changes state.
+	CircuitStateHandler func(from, to CircuitState)
+
+	circuitBreaker struct {
+		mu        sync.Mutex
+		threshold int
+		cooldown  time.Duration
+		onChange  CircuitStateHandler
+		state     CircuitState
+		failures  int
+		openedAt  time.Time
+		probing   bool
+		// counts the changes of state, so that the outcome of a command let
+		// through in an earlier state is ignored
+		generation uint64
+	}
+)
+
+const (
+	// Commands are sent to the server.
+	CircuitClosed CircuitState = iota
+	// Commands fail with ErrCircuitOpen without being sent.
+	CircuitOpen
+	// The cooldown has passed; one command is sent to test the server while
+	// the others fail with ErrCircuitOpen.
+	CircuitHalfOpen
+)
+
+func (state CircuitState) String() string {
+	switch state {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// Installs a circuit breaker that opens after `threshold` consecutive
+// commands fail to reach the server or to get a response, such as when the
+// server is down. While the circuit is open, commands fail immediately with
+// ErrCircuitOpen rather than waiting for a connection or a timeout. After
+// `cooldown`, one command is let through to test the server: the circuit
+// closes if it gets a response, and opens for another cooldown if not.
+//
+// Errors reported by the server are responses, and don't count as failures.
+// `onChange`, which may be nil, is invoked on each change of state, from the
+// goroutine of the command that caused it. Specify a `threshold` of 0 to
+// remove the breaker. The breaker is shared by the clients derived with
+// With().
+func (tsc *tsClient) SetCircuitBreaker(threshold int, cooldown time.Duration, onChange CircuitStateHandler) {
+	if threshold <= 0 {
+		tsc.breaker.Store(nil)
+		return
+	}
+	tsc.breaker.Store(&circuitBreaker{threshold: threshold, cooldown: cooldown, onChange: onChange})
+}
+
+// Returns the state of the circuit breaker; CircuitClosed when there is no
+// breaker.
+func (tsc *tsClient) GetCircuitState() CircuitState {
+	cb := tsc.breaker.Load()
+	if cb == nil {
+		return CircuitClosed
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state
+}
+
+// Determines if a command may be sent, returning ErrCircuitOpen if not. The
+// returned generation is passed to record with the command's outcome.
+func (cb *circuitBreaker) allow() (generation uint64, err error) {
+	cb.mu.Lock()
+	from := cb.state
+	switch {
+	case cb.state == CircuitOpen && time.Since(cb.openedAt) >= cb.cooldown:
+		cb.setState(CircuitHalfOpen)
+		cb.probing = true
+	case cb.state == CircuitOpen, cb.state == CircuitHalfOpen && cb.probing:
+		err = ErrCircuitOpen
+	case cb.state == CircuitHalfOpen:
+		cb.probing = true
+	}
+	to := cb.state
+	generation = cb.generation
+	cb.mu.Unlock()
+
+	cb.notify(from, to)
+	return
+}
+
+// Records the outcome of a command that allow let through in `generation`. A
+// failure to reach the server or to get a response has no response. The
+// outcome of a command that started before the last change of state is
+// ignored, so that a slow command can't close the circuit during a cooldown,
+// or restart the cooldown.
+func (cb *circuitBreaker) record(generation uint64, response map[string]any, err error) {
+	cb.mu.Lock()
+	if generation != cb.generation {
+		cb.mu.Unlock()
+		return
+	}
+
+	from := cb.state
+	cb.probing = false
+	if err != nil && response == nil {
+		cb.failures++
+		if cb.state == CircuitHalfOpen || cb.failures >= cb.threshold {
+			cb.setState(CircuitOpen)
+			cb.openedAt = time.Now()
+		}
+	} else {
+		cb.failures = 0
+		cb.setState(CircuitClosed)
+	}
+	to := cb.state
+	cb.mu.Unlock()
+
+	cb.notify(from, to)
+}
+
+// Changes the state, starting a new generation if it differs. The caller
+// must hold the lock.
+func (cb *circuitBreaker) setState(state CircuitState) {
+	if cb.state != state {
+		cb.state = state
+		cb.generation++
+	}
+}
+
+func (cb *circuitBreaker) notify(from, to CircuitState) {
+	if from != to && cb.onChange != nil {
+		cb.onChange(from, to)
+	}
+}
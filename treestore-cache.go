@@ -0,0 +1,250 @@
+package treestore_client
+
+import (
+	"container/list"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// Identifies a cached json projection: the absolute key path and the
+	// options it was projected with.
+	JsonCacheKey struct {
+		Key  TokenPath
+		Opts JsonOptions
+	}
+
+	// Holds json projections returned by GetKeyAsJson, GetKeyAsJsonBytes and
+	// GetKeyAsJsonBase64. Implementations must be safe for concurrent use.
+	JsonCache interface {
+		// Returns the cached json document, if present.
+		Get(key JsonCacheKey) (jsonData []byte, found bool)
+
+		// Caches a json document. The cache owns `jsonData`.
+		Put(key JsonCacheKey, jsonData []byte)
+
+		// Discards the projections affected by a change to `tokenPath`: those
+		// of the key itself, its ancestors and its descendants. An empty token
+		// path discards everything.
+		Invalidate(tokenPath TokenPath)
+	}
+
+	// a least recently used JsonCache with an entry lifetime
+	memoryJsonCache struct {
+		mu         sync.Mutex
+		maxEntries int
+		ttl        time.Duration
+		entries    map[JsonCacheKey]*list.Element
+		lru        *list.List
+	}
+
+	memoryJsonCacheEntry struct {
+		key      JsonCacheKey
+		jsonData []byte
+		expires  time.Time
+	}
+)
+
+// Returns an in-memory JsonCache that holds up to `maxEntries` projections,
+// discarding the least recently used when full. When `ttl` is non-zero,
+// projections are discarded after that long, which bounds how stale a
+// projection can be when other clients write to the tree store.
+func NewJsonCache(maxEntries int, ttl time.Duration) JsonCache {
+	return &memoryJsonCache{
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		entries:    map[JsonCacheKey]*list.Element{},
+		lru:        list.New(),
+	}
+}
+
+func (mc *memoryJsonCache) Get(key JsonCacheKey) (jsonData []byte, found bool) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	elem := mc.entries[key]
+	if elem == nil {
+		return
+	}
+
+	entry := elem.Value.(*memoryJsonCacheEntry)
+	if mc.ttl > 0 && time.Now().After(entry.expires) {
+		mc.remove(elem)
+		return
+	}
+
+	mc.lru.MoveToFront(elem)
+	return entry.jsonData, true
+}
+
+func (mc *memoryJsonCache) Put(key JsonCacheKey, jsonData []byte) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	if elem := mc.entries[key]; elem != nil {
+		mc.remove(elem)
+	}
+
+	entry := &memoryJsonCacheEntry{key: key, jsonData: jsonData, expires: time.Now().Add(mc.ttl)}
+	mc.entries[key] = mc.lru.PushFront(entry)
+
+	for mc.maxEntries > 0 && mc.lru.Len() > mc.maxEntries {
+		mc.remove(mc.lru.Back())
+	}
+}
+
+func (mc *memoryJsonCache) Invalidate(tokenPath TokenPath) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	for key, elem := range mc.entries {
+		if jsonProjectionAffected(key.Key, tokenPath) {
+			mc.remove(elem)
+		}
+	}
+}
+
+func (mc *memoryJsonCache) remove(elem *list.Element) {
+	entry := mc.lru.Remove(elem).(*memoryJsonCacheEntry)
+	delete(mc.entries, entry.key)
+}
+
+// Determines if the projection of `projected` includes `changed`, or the
+// other way around.
+func jsonProjectionAffected(projected, changed TokenPath) bool {
+	p := string(projected)
+	c := string(changed)
+	return p == "" || c == "" || p == c || strings.HasPrefix(c, p+"/") || strings.HasPrefix(p, c+"/")
+}
+
+// Installs a cache for json projections, shared by the clients derived with
+// With(), or removes the cache when `cache` is nil.
+//
+// Commands sent by this client that modify the tree store invalidate the
+// projections of the keys they name, but changes made by other clients are
+// not seen, so the cache should have a lifetime (see NewJsonCache) unless this
+// client is the only writer.
+//
+// Only the keys named in a command are invalidated. The server also updates
+// auto-link index keys (see DefineAutoLinkKey) when a record under an
+// auto-linked data parent is written, and those index keys aren't named in
+// the command, so a cached projection of an auto-link index stays stale after
+// a record write, even from this client. Call InvalidateJsonCache on the
+// auto-link key after such writes, or don't cache its projections.
+func (tsc *tsClient) SetJsonCache(cache JsonCache) {
+	tsc.jsonCacheMu.Lock()
+	defer tsc.jsonCacheMu.Unlock()
+	tsc.jsonCache = cache
+	tsc.jsonCacheGen++
+}
+
+// Discards the cached json projections affected by a change to `sk`.
+func (tsc *tsClient) InvalidateJsonCache(sk StoreKey) {
+	tsc.invalidateJsonCache(TokenPath(tsc.keyArg(sk)))
+}
+
+func (tsc *tsClient) invalidateJsonCache(tokenPaths ...TokenPath) {
+	tsc.jsonCacheMu.Lock()
+	defer tsc.jsonCacheMu.Unlock()
+
+	if tsc.jsonCache == nil {
+		return
+	}
+
+	// a projection fetched before the invalidation must not be cached after it
+	tsc.jsonCacheGen++
+	for _, tokenPath := range tokenPaths {
+		tsc.jsonCache.Invalidate(tokenPath)
+	}
+}
+
+func (tsc *tsClient) getJsonCache() (cache JsonCache, gen uint64) {
+	tsc.jsonCacheMu.Lock()
+	defer tsc.jsonCacheMu.Unlock()
+	return tsc.jsonCache, tsc.jsonCacheGen
+}
+
+// Caches a projection unless there was an invalidation since it was fetched.
+func (tsc *tsClient) putJsonCache(key JsonCacheKey, jsonData []byte, gen uint64) {
+	tsc.jsonCacheMu.Lock()
+	defer tsc.jsonCacheMu.Unlock()
+
+	if tsc.jsonCache != nil && tsc.jsonCacheGen == gen {
+		tsc.jsonCache.Put(key, jsonData)
+	}
+}
+
+// Invalidates the json projections affected by a command that modifies the
+// tree store. Every argument that looks like a key path is treated as a
+// changed key, which may discard more than necessary. Keys the server changes
+// as a side effect, such as auto-link index keys, aren't named in the
+// arguments and aren't invalidated.
+func (tsc *tsClient) invalidateForCommand(args []string) {
+	if len(args) == 0 || !writeCommands[args[0]] {
+		return
+	}
+
+	if args[0] == "purge" {
+		tsc.invalidateJsonCache("")
+		return
+	}
+
+	var tokenPaths []TokenPath
+	for _, arg := range args[1:] {
+		if strings.HasPrefix(arg, "/") {
+			tokenPaths = append(tokenPaths, TokenPath(arg))
+		}
+	}
+	tsc.invalidateJsonCache(tokenPaths...)
+}
+
+// Fetches the json projection of a key, from the cache if possible.
+func (tsc *tsClient) getKeyJsonCached(sk StoreKey, opt JsonOptions) (jsonData []byte, err error) {
+	cache, gen := tsc.getJsonCache()
+	key := JsonCacheKey{Key: TokenPath(tsc.keyArg(sk)), Opts: opt}
+	if cache != nil {
+		var found bool
+		if jsonData, found = cache.Get(key); found {
+			return
+		}
+	}
+
+	args := []string{"getjson", string(key.Key), "--base64"}
+	if (opt & JsonStringValuesAsKeys) != 0 {
+		args = append(args, "--straskey")
+	}
+
+	response, err := tsc.RawCommand(args...)
+	if err != nil {
+		return
+	}
+
+	b64, valid := response["base64"].(string)
+	if !valid {
+		err = errors.New("invalid getjson response")
+		return
+	}
+
+	if jsonData, err = base64.StdEncoding.DecodeString(b64); err != nil {
+		return
+	}
+
+	if cache != nil {
+		tsc.putJsonCache(key, jsonData, gen)
+	}
+	return
+}
+
+// Serves GetKeyAsJson from the cache.
+func (tsc *tsClient) getKeyAsJsonCached(sk StoreKey, opt JsonOptions) (jsonData any, err error) {
+	marshalled, err := tsc.getKeyJsonCached(sk, opt)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(marshalled, &jsonData)
+	return
+}
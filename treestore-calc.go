@@ -0,0 +1,275 @@
+package treestore_client
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/Knetic/govaluate"
+)
+
+// Quotes text as a calc expression string literal. Backslashes and quotes are
+// escaped, so the text can't terminate the literal early.
+func quoteCalcString(text string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, ch := range text {
+		if ch == '\\' || ch == '"' || ch == '\'' {
+			sb.WriteByte('\\')
+		}
+		sb.WriteRune(ch)
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+// Makes a lookup() call for use in a CalculateKeyValue expression, which
+// reads the value of `sk`. The key path is absolute and includes the client's
+// key prefix, and it is escaped so that any key can be referenced safely.
+func (tsc *tsClient) Lookup(sk StoreKey) (expression string) {
+	return "lookup(" + quoteCalcString(tsc.keyArg(sk)) + ")"
+}
+
+// Verifies that each of `sourceSks` has a value, and then evaluates
+// `expression` with CalculateKeyValue. The expression is expected to refer to
+// the sources with lookup() calls made by Lookup.
+//
+// A missing source fails with ErrLookupKeyMissing rather than submitting an
+// expression that the server can't evaluate. The check is made before the
+// calculation, so a source deleted in between can still cause the
+// calculation to fail.
+func (tsc *tsClient) CalculateKeyValueFrom(sk StoreKey, expression string, sourceSks ...StoreKey) (address StoreAddress, newValue any, err error) {
+	results, err := tsc.GetKeyValues(sourceSks)
+	if err != nil {
+		return
+	}
+
+	for index, result := range results {
+		if !result.ValueExists {
+			err = fmt.Errorf("%w: %s", ErrLookupKeyMissing, sourceSks[index].Path)
+			return
+		}
+	}
+
+	return tsc.CalculateKeyValue(sk, expression)
+}
+
+type (
+	// A calc expression template with named parameters, written as {name} in
+	// the template and supplied with Bind. Bound values are converted to
+	// literals (or lookup() calls, for a StoreKey), so values from user input
+	// can't change the structure of the expression.
+	CalcExpression struct {
+		template string
+		bindings map[string]any
+	}
+)
+
+// the functions provided by the server to calc expressions
+var calcFunctions = map[string]govaluate.ExpressionFunction{
+	"lookup": calcFunctionStub,
+	"utcns":  calcFunctionStub,
+	"utc":    calcFunctionStub,
+	"fail":   calcFunctionStub,
+	"int":    calcFunctionStub,
+	"uint":   calcFunctionStub,
+	"float":  calcFunctionStub,
+}
+
+// the variables provided by the server to calc expressions
+var calcVariables = map[string]bool{
+	"self": true,
+	"i":    true,
+	"u":    true,
+	"f":    true,
+}
+
+func calcFunctionStub(args ...any) (any, error) {
+	return nil, nil
+}
+
+// Starts a calc expression from a template, such as "i + {delta}".
+func Expr(template string) *CalcExpression {
+	return &CalcExpression{template: template, bindings: map[string]any{}}
+}
+
+// Binds a value to the {name} parameter. The value can be an integer, float,
+// string, bool, or a StoreKey (which becomes a lookup() of the key).
+func (ce *CalcExpression) Bind(name string, value any) *CalcExpression {
+	ce.bindings[name] = value
+	return ce
+}
+
+// Converts a bound value to expression text.
+func (tsc *tsClient) calcLiteral(name string, value any) (literal string, err error) {
+	switch v := value.(type) {
+	case StoreKey:
+		literal = tsc.Lookup(v)
+	case string:
+		literal = quoteCalcString(v)
+	case bool:
+		literal = strconv.FormatBool(v)
+	case int:
+		literal = strconv.FormatInt(int64(v), 10)
+	case int8:
+		literal = strconv.FormatInt(int64(v), 10)
+	case int16:
+		literal = strconv.FormatInt(int64(v), 10)
+	case int32:
+		literal = strconv.FormatInt(int64(v), 10)
+	case int64:
+		literal = strconv.FormatInt(v, 10)
+	case uint:
+		literal = strconv.FormatUint(uint64(v), 10)
+	case uint8:
+		literal = strconv.FormatUint(uint64(v), 10)
+	case uint16:
+		literal = strconv.FormatUint(uint64(v), 10)
+	case uint32:
+		literal = strconv.FormatUint(uint64(v), 10)
+	case uint64:
+		literal = strconv.FormatUint(v, 10)
+	case float32:
+		literal, err = calcFloatLiteral(name, float64(v))
+	case float64:
+		literal, err = calcFloatLiteral(name, v)
+	default:
+		err = fmt.Errorf("unsupported type %T bound to {%s}", value, name)
+	}
+
+	// negative numbers are parenthesized so that "i-{n}" can't become "i--5"
+	if strings.HasPrefix(literal, "-") {
+		literal = "(" + literal + ")"
+	}
+	return
+}
+
+func calcFloatLiteral(name string, v float64) (literal string, err error) {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		err = fmt.Errorf("non-finite number bound to {%s}", name)
+		return
+	}
+	literal = strconv.FormatFloat(v, 'f', -1, 64)
+	return
+}
+
+// Substitutes the bound values into the template and validates the syntax of
+// the result.
+func (tsc *tsClient) buildCalcExpression(ce *CalcExpression) (expression string, err error) {
+	var sb strings.Builder
+	template := ce.template
+	for {
+		open := strings.IndexByte(template, '{')
+		if open < 0 {
+			sb.WriteString(template)
+			break
+		}
+		end := strings.IndexByte(template[open:], '}')
+		if end < 0 {
+			err = fmt.Errorf("unterminated parameter in calc expression: %s", ce.template)
+			return
+		}
+
+		name := template[open+1 : open+end]
+		value, bound := ce.bindings[name]
+		if !bound {
+			err = fmt.Errorf("parameter {%s} is not bound", name)
+			return
+		}
+
+		var literal string
+		if literal, err = tsc.calcLiteral(name, value); err != nil {
+			return
+		}
+
+		sb.WriteString(template[:open])
+		sb.WriteString(literal)
+		template = template[open+end+1:]
+	}
+
+	expression = sb.String()
+	err = validateCalcExpression(expression)
+	return
+}
+
+// Parses a calc expression with the same parser as the server, and checks
+// that it only uses the functions and variables the server provides.
+func validateCalcExpression(expression string) (err error) {
+	parsed, err := govaluate.NewEvaluableExpressionWithFunctions(expression, calcFunctions)
+	if err != nil {
+		err = fmt.Errorf("invalid calc expression: %w", err)
+		return
+	}
+
+	for _, token := range parsed.Tokens() {
+		if token.Kind == govaluate.VARIABLE {
+			name, _ := token.Value.(string)
+			if !calcVariables[name] {
+				err = fmt.Errorf("invalid calc expression: unknown variable %s", name)
+				return
+			}
+		}
+	}
+	return
+}
+
+// Builds the expression from its template and bound values, validates it, and
+// evaluates it with CalculateKeyValue.
+func (tsc *tsClient) CalculateKeyValueExpr(sk StoreKey, ce *CalcExpression) (address StoreAddress, newValue any, err error) {
+	expression, err := tsc.buildCalcExpression(ce)
+	if err != nil {
+		return
+	}
+
+	return tsc.CalculateKeyValue(sk, expression)
+}
+
+// Adds `delta` to the integer value of `sk` on the server, and returns the new
+// value. A key without a value counts from zero. Pass a negative `delta` to
+// decrement. The value is stored as an int.
+//
+// The server transmits int values as 32 bits, so the expression checks the
+// range of the sum and leaves the value unchanged with fail() when it would
+// not fit. The server doesn't say why an expression failed, so the same
+// ErrIncrementNotApplied is returned when the current value isn't a number.
+func (tsc *tsClient) IncrementKeyValue(sk StoreKey, delta int64) (newValue int64, err error) {
+	ce := Expr("i + {delta} >= {min} && i + {delta} <= {max} ? i + {delta} : fail()").
+		Bind("delta", delta).
+		Bind("min", math.MinInt32).
+		Bind("max", math.MaxInt32)
+	_, result, err := tsc.CalculateKeyValueExpr(sk, ce)
+	if err != nil {
+		return
+	}
+
+	switch v := result.(type) {
+	case nil:
+		err = ErrIncrementNotApplied
+	case int:
+		newValue = int64(v)
+	case int64:
+		newValue = v
+	default:
+		err = fmt.Errorf("unexpected increment result type %T", result)
+	}
+	return
+}
+
+// Adds `delta` to the float value of `sk` on the server, and returns the new
+// value. A key without a value counts from zero. The value is stored as a
+// float64.
+func (tsc *tsClient) IncrementKeyValueFloat(sk StoreKey, delta float64) (newValue float64, err error) {
+	_, result, err := tsc.CalculateKeyValueExpr(sk, Expr("f + {delta}").Bind("delta", delta))
+	if err != nil {
+		return
+	}
+
+	v, ok := result.(float64)
+	if !ok {
+		err = fmt.Errorf("unexpected increment result type %T", result)
+		return
+	}
+	newValue = v
+	return
+}
@@ -0,0 +1,270 @@
+package treestore_client
+
+import (
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type (
+	// The kind of difference found by a diff.
+	DiffKind int
+
+	// A difference between a stored json document and another document.
+	JsonDiff struct {
+		// The json path of the difference, such as `$.animals[1].name`, in the
+		// syntax of JsonPathToSubPath.
+		Path string
+		Kind DiffKind
+		// The stored json, nil when Kind is DiffAdded.
+		Old any
+		// The provided json, nil when Kind is DiffRemoved.
+		New any
+	}
+
+	// A difference between two subtrees found by DiffKeys.
+	KeyDiff struct {
+		// The key that differs, relative to the compared subtrees.
+		Sk   StoreKey
+		Kind DiffKind
+		// The metadata attribute that differs, or empty when the key or its
+		// value differs.
+		Attribute string
+		// The value or attribute in the first subtree, nil when Kind is
+		// DiffAdded.
+		Old any
+		// The value or attribute in the second subtree, nil when Kind is
+		// DiffRemoved.
+		New any
+	}
+)
+
+const (
+	DiffAdded DiffKind = iota + 1
+	DiffRemoved
+	DiffChanged
+)
+
+func (kind DiffKind) String() string {
+	switch kind {
+	case DiffAdded:
+		return "added"
+	case DiffRemoved:
+		return "removed"
+	case DiffChanged:
+		return "changed"
+	}
+	return "unknown"
+}
+
+// Compares the json document stored at `sk` with `jsonData`, and returns the
+// paths that `jsonData` adds, removes or changes, in path order. Objects are
+// compared field by field, and arrays element by element. A value that
+// changes between a scalar, an object and an array is a single change.
+//
+// An empty diff means a SetKeyJson of `jsonData` would not change the
+// document. Note that MergeKeyJson doesn't remove fields, and appends arrays
+// unless an array merge strategy is specified.
+func (tsc *tsClient) DiffKeyJson(sk StoreKey, jsonData any) (diffs []JsonDiff, err error) {
+	provided, err := remarshalJson(jsonData)
+	if err != nil {
+		return
+	}
+
+	stored, err := tsc.GetKeyAsJson(sk, 0)
+	if err != nil {
+		return
+	}
+
+	diffs = diffJson("$", stored, provided, []JsonDiff{})
+	return
+}
+
+// Appends the differences between `old` and `new` at `path`.
+func diffJson(path string, old, new any, diffs []JsonDiff) []JsonDiff {
+	switch o := old.(type) {
+	case map[string]any:
+		if n, is := new.(map[string]any); is {
+			fields := make([]string, 0, len(o)+len(n))
+			for field := range o {
+				fields = append(fields, field)
+			}
+			for field := range n {
+				if _, found := o[field]; !found {
+					fields = append(fields, field)
+				}
+			}
+			sort.Strings(fields)
+
+			for _, field := range fields {
+				ov, inOld := o[field]
+				nv, inNew := n[field]
+				fieldPath := path + formatJsonPathField(field)
+				switch {
+				case !inNew:
+					diffs = append(diffs, JsonDiff{Path: fieldPath, Kind: DiffRemoved, Old: ov})
+				case !inOld:
+					diffs = append(diffs, JsonDiff{Path: fieldPath, Kind: DiffAdded, New: nv})
+				default:
+					diffs = diffJson(fieldPath, ov, nv, diffs)
+				}
+			}
+			return diffs
+		}
+
+	case []any:
+		if n, is := new.([]any); is {
+			for i := 0; i < max(len(o), len(n)); i++ {
+				elementPath := path + "[" + strconv.Itoa(i) + "]"
+				switch {
+				case i >= len(n):
+					diffs = append(diffs, JsonDiff{Path: elementPath, Kind: DiffRemoved, Old: o[i]})
+				case i >= len(o):
+					diffs = append(diffs, JsonDiff{Path: elementPath, Kind: DiffAdded, New: n[i]})
+				default:
+					diffs = diffJson(elementPath, o[i], n[i], diffs)
+				}
+			}
+			return diffs
+		}
+	}
+
+	switch {
+	case old == nil && new != nil && path == "$":
+		diffs = append(diffs, JsonDiff{Path: path, Kind: DiffAdded, New: new})
+	case new == nil && old != nil && path == "$":
+		diffs = append(diffs, JsonDiff{Path: path, Kind: DiffRemoved, Old: old})
+	case !reflect.DeepEqual(old, new):
+		diffs = append(diffs, JsonDiff{Path: path, Kind: DiffChanged, Old: old, New: new})
+	}
+	return diffs
+}
+
+// Formats an object field as a json path step, quoting names that aren't
+// plain identifiers.
+func formatJsonPathField(field string) string {
+	plain := field != ""
+	for _, ch := range field {
+		if !(ch == '_' || ch == '$' || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || (ch >= '0' && ch <= '9')) {
+			plain = false
+			break
+		}
+	}
+	if plain {
+		return "." + field
+	}
+
+	var sb strings.Builder
+	sb.WriteString("['")
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\'' || field[i] == '\\' {
+			sb.WriteByte('\\')
+		}
+		sb.WriteByte(field[i])
+	}
+	sb.WriteString("']")
+	return sb.String()
+}
+
+// Compares the subtrees at `skA` and `skB`, and returns the keys, values and
+// metadata attributes that `skB` adds, removes or changes, in key order. A key
+// that exists in only one subtree is a single difference, whatever its
+// children. Value history, expirations and relationships are not compared.
+//
+// Each subtree is exported by its own command, and the differing values are
+// then read with GetKeyValue, because the export format doesn't keep the value
+// types. Nothing holds the subtrees still in between, so when they are being
+// written, the diff can mix states, and the reported Old and New values can
+// be newer than the values that were compared, even equal to each other.
+func (tsc *tsClient) DiffKeys(skA, skB StoreKey) (diffs []KeyDiff, err error) {
+	nodeA, err := tsc.exportHistoryNode(skA)
+	if err != nil {
+		return
+	}
+	nodeB, err := tsc.exportHistoryNode(skB)
+	if err != nil {
+		return
+	}
+
+	diffs = diffKeyNodes("", nodeA, nodeB, []KeyDiff{})
+
+	for n := range diffs {
+		diff := &diffs[n]
+		if diff.Attribute != "" {
+			continue
+		}
+		if diff.Kind != DiffAdded {
+			if diff.Old, _, _, err = tsc.GetKeyValue(MakeStoreKeyFromPath(skA.Path + diff.Sk.Path)); err != nil {
+				return
+			}
+		}
+		if diff.Kind != DiffRemoved {
+			if diff.New, _, _, err = tsc.GetKeyValue(MakeStoreKeyFromPath(skB.Path + diff.Sk.Path)); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// Appends the differences between two exported keys at `relPath`. Values are
+// filled in by DiffKeys.
+func diffKeyNodes(relPath TokenPath, a, b *exportedHistoryNode, diffs []KeyDiff) []KeyDiff {
+	switch {
+	case a == nil && b == nil:
+		return diffs
+	case a == nil:
+		return append(diffs, KeyDiff{Sk: MakeStoreKeyFromPath(relPath), Kind: DiffAdded})
+	case b == nil:
+		return append(diffs, KeyDiff{Sk: MakeStoreKeyFromPath(relPath), Kind: DiffRemoved})
+	}
+
+	currentA, currentB := a.current(), b.current()
+	if (currentA == nil) != (currentB == nil) ||
+		(currentA != nil && (currentA.Value != currentB.Value || currentA.Type != currentB.Type)) {
+		diffs = append(diffs, KeyDiff{Sk: MakeStoreKeyFromPath(relPath), Kind: DiffChanged})
+	}
+
+	attributes := make([]string, 0, len(a.Metadata)+len(b.Metadata))
+	for attribute := range a.Metadata {
+		attributes = append(attributes, attribute)
+	}
+	for attribute := range b.Metadata {
+		if _, found := a.Metadata[attribute]; !found {
+			attributes = append(attributes, attribute)
+		}
+	}
+	sort.Strings(attributes)
+	for _, attribute := range attributes {
+		va, inA := a.Metadata[attribute]
+		vb, inB := b.Metadata[attribute]
+		diff := KeyDiff{Sk: MakeStoreKeyFromPath(relPath), Attribute: attribute}
+		switch {
+		case !inB:
+			diff.Kind, diff.Old = DiffRemoved, metadataUnescape(va)
+		case !inA:
+			diff.Kind, diff.New = DiffAdded, metadataUnescape(vb)
+		case va != vb:
+			diff.Kind, diff.Old, diff.New = DiffChanged, metadataUnescape(va), metadataUnescape(vb)
+		default:
+			continue
+		}
+		diffs = append(diffs, diff)
+	}
+
+	segments := make([]string, 0, len(a.Children)+len(b.Children))
+	for segment := range a.Children {
+		segments = append(segments, segment)
+	}
+	for segment := range b.Children {
+		if _, found := a.Children[segment]; !found {
+			segments = append(segments, segment)
+		}
+	}
+	sort.Strings(segments)
+	for _, segment := range segments {
+		diffs = diffKeyNodes(relPath+"/"+TokenPath(segment), a.Children[segment], b.Children[segment], diffs)
+	}
+	return diffs
+}
@@ -0,0 +1,63 @@
+package treestore_client
+
+import (
+	"fmt"
+)
+
+// Configures the server that the client switches to when its current server
+// drains, for rolling restarts. After a switch, the drained server becomes the
+// standby, so the client can switch back when the other server restarts.
+// Specify an empty host to remove the standby.
+func (tsc *tsClient) SetStandbyServer(host string, port int) {
+	tsc.Lock()
+	defer tsc.Unlock()
+
+	if host == "" {
+		tsc.standby = ""
+	} else {
+		tsc.standby = fmt.Sprintf("%s:%d", host, port)
+	}
+}
+
+// Switches the client to the standby server: new commands wait, commands in
+// flight finish, the connection to the current server is closed, and then the
+// waiting commands are sent to the standby server. Use this when the current
+// server is about to shut down.
+func (tsc *tsClient) Drain() (err error) {
+	tsc.Lock()
+	endpoint := tsc.hostAndPort
+	tsc.Unlock()
+
+	if !tsc.failover(endpoint) {
+		err = ErrNoStandby
+	}
+	return
+}
+
+// Switches from `endpoint` to the standby server once the commands in flight
+// have finished. Returns true if the client is no longer using `endpoint`,
+// including when another Drain already switched.
+func (tsc *tsClient) failover(endpoint string) bool {
+	tsc.drainMu.Lock()
+	defer tsc.drainMu.Unlock()
+
+	tsc.Lock()
+	defer tsc.Unlock()
+
+	if tsc.hostAndPort != endpoint {
+		return true
+	}
+	if tsc.standby == "" {
+		return false
+	}
+
+	if tsc.cxn != nil {
+		tsc.cxn.Close()
+		tsc.cxn = nil
+	}
+	tsc.inbound = nil
+
+	tsc.hostAndPort, tsc.standby = tsc.standby, tsc.hostAndPort
+	tsc.l.Infof("drained server %s, switched to %s", tsc.standby, tsc.hostAndPort)
+	return true
+}
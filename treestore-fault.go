@@ -0,0 +1,106 @@
+package treestore_client
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"time"
+)
+
+type (
+	// Establishes the network connection to the treestore server.
+	Dialer func(ctx context.Context, network, address string) (net.Conn, error)
+
+	// Describes the failures injected by a fault-injecting dialer. Rates are
+	// probabilities from 0 to 1, evaluated independently for each operation.
+	FaultPolicy struct {
+		// Delay added before each request is written.
+		Latency time.Duration
+
+		// Probability that the connection is dropped instead of writing a request.
+		DropRate float64
+
+		// Probability that only part of a request frame is written, after which
+		// the connection is dropped.
+		TruncateRate float64
+
+		// Delay added before each read of the response.
+		SlowReadDelay time.Duration
+
+		// When non-zero, limits the number of bytes returned by each read, so
+		// that responses arrive in fragments.
+		MaxReadSize int
+
+		// Probability that the dial fails.
+		DialFailRate float64
+	}
+
+	faultConn struct {
+		net.Conn
+		policy FaultPolicy
+	}
+)
+
+var errInjectedFault = errors.New("injected fault")
+
+// Returns a Dialer that wraps `base` (or a plain TCP dialer when nil) and
+// injects failures into the connection according to `policy`. Install it with
+// SetDialer to test an application's resilience to treestore failures.
+func NewFaultInjectingDialer(policy FaultPolicy, base Dialer) Dialer {
+	if base == nil {
+		base = defaultDialer
+	}
+
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		if faultOccurs(policy.DialFailRate) {
+			return nil, errInjectedFault
+		}
+
+		cxn, err := base(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		return &faultConn{Conn: cxn, policy: policy}, nil
+	}
+}
+
+func defaultDialer(ctx context.Context, network, address string) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, address)
+}
+
+func faultOccurs(rate float64) bool {
+	return rate > 0 && rand.Float64() < rate
+}
+
+func (fc *faultConn) Write(b []byte) (n int, err error) {
+	if fc.policy.Latency > 0 {
+		time.Sleep(fc.policy.Latency)
+	}
+
+	if faultOccurs(fc.policy.DropRate) {
+		fc.Conn.Close()
+		return 0, errInjectedFault
+	}
+
+	if len(b) > 1 && faultOccurs(fc.policy.TruncateRate) {
+		n, err = fc.Conn.Write(b[:rand.Intn(len(b)-1)+1])
+		fc.Conn.Close()
+		return
+	}
+
+	return fc.Conn.Write(b)
+}
+
+func (fc *faultConn) Read(b []byte) (n int, err error) {
+	if fc.policy.SlowReadDelay > 0 {
+		time.Sleep(fc.policy.SlowReadDelay)
+	}
+
+	if fc.policy.MaxReadSize > 0 && len(b) > fc.policy.MaxReadSize {
+		b = b[:fc.policy.MaxReadSize]
+	}
+
+	return fc.Conn.Read(b)
+}
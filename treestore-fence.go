@@ -0,0 +1,125 @@
+package treestore_client
+
+import (
+	"time"
+)
+
+type (
+	// A write fence captures the address of a key at read time. A key that is
+	// deleted and recreated gets a new address, so a mutation made through the
+	// fence can detect that it would otherwise update a different incarnation
+	// of the key (a lost update).
+	KeyFence struct {
+		Sk      StoreKey
+		Address StoreAddress
+	}
+)
+
+// Captures the current address of `sk` as a write fence.
+func (tsc *tsClient) FenceKey(sk StoreKey) (fence KeyFence, exists bool, err error) {
+	address, exists, err := tsc.LocateKey(sk)
+	if err != nil || !exists {
+		return
+	}
+
+	fence = KeyFence{Sk: sk, Address: address}
+	return
+}
+
+// Reads the current value of `sk` along with a write fence. The value is
+// read by address, so it belongs to the same incarnation of the key as the
+// fence.
+func (tsc *tsClient) GetKeyValueFenced(sk StoreKey) (value any, valueExists bool, fence KeyFence, err error) {
+	fence, exists, err := tsc.FenceKey(sk)
+	if err != nil || !exists {
+		return
+	}
+
+	keyExists, valueExists, addrSk, value, err := tsc.KeyValueFromAddress(fence.Address)
+	if err != nil {
+		return
+	}
+	if !keyExists || addrSk.Path != sk.Path {
+		// replaced between the two reads
+		err = ErrFenceViolated
+	}
+	return
+}
+
+// Verifies the fenced key still exists at the fenced address.
+func (tsc *tsClient) checkFence(fence KeyFence) (err error) {
+	sk, exists, err := tsc.KeyFromAddress(fence.Address)
+	if err != nil {
+		return
+	}
+	if !exists || sk.Path != fence.Sk.Path {
+		err = ErrFenceViolated
+	}
+	return
+}
+
+// Sets the value of the fenced key, if the key still exists at the fenced
+// address. Otherwise ErrFenceViolated is returned and no change is made.
+//
+// The fence is checked before the write, and the address of the written key
+// is checked after. If the key is recreated between the two, the write has
+// been made to the new key and ErrFenceViolated is returned.
+//
+// The key's expiration is read with the fence check and set again by the
+// write, so it is kept unless it changes between the two.
+func (tsc *tsClient) SetKeyValueFenced(fence KeyFence, value any) (originalValue any, err error) {
+	if err = tsc.checkFence(fence); err != nil {
+		return
+	}
+
+	// the write is a setex, which otherwise removes the expiration
+	ttl, err := tsc.GetKeyTtl(fence.Sk)
+	if err != nil {
+		return
+	}
+	var expire *time.Time
+	if ttlIsSet(ttl) {
+		expire = ttl
+	}
+
+	address, exists, originalValue, err := tsc.SetKeyValueEx(fence.Sk, value, SetExMustExist, expire, nil)
+	if err != nil {
+		return
+	}
+	if !exists || address != fence.Address {
+		err = ErrFenceViolated
+	}
+	return
+}
+
+// Replaces the json subtree of the fenced key, if the key still exists at the
+// fenced address. Otherwise ErrFenceViolated is returned and no change is made.
+func (tsc *tsClient) ReplaceKeyJsonFenced(fence KeyFence, jsonData any, opt JsonOptions) (err error) {
+	if err = tsc.checkFence(fence); err != nil {
+		return
+	}
+
+	replaced, address, err := tsc.ReplaceKeyJson(fence.Sk, jsonData, opt)
+	if err != nil {
+		return
+	}
+	if !replaced || address != fence.Address {
+		err = ErrFenceViolated
+	}
+	return
+}
+
+// Deletes the fenced key, if the key still exists at the fenced address.
+// Otherwise ErrFenceViolated is returned and no change is made.
+//
+// The server has no conditional delete, so the fence is checked before the
+// delete, and a deleted key can't be checked after. If the key is recreated
+// between the check and the delete, the new key is deleted and no error is
+// returned.
+func (tsc *tsClient) DeleteKeyFenced(fence KeyFence) (keyRemoved, valueRemoved bool, originalValue any, err error) {
+	if err = tsc.checkFence(fence); err != nil {
+		return
+	}
+
+	return tsc.DeleteKey(fence.Sk)
+}
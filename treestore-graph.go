@@ -0,0 +1,178 @@
+package treestore_client
+
+type (
+	// The order in which TraverseGraph visits keys.
+	GraphOrder int
+
+	// A key reached by TraverseGraph.
+	GraphNode struct {
+		Sk      StoreKey
+		Address StoreAddress
+		Value   any // the current value of the key, if any
+		Depth   int // the number of links followed from the start key
+		// The key whose relationship led here, and the index of that
+		// relationship; empty and -1 for the start key.
+		FromSk            StoreKey
+		RelationshipIndex int
+	}
+
+	// A relationship waiting to be followed.
+	graphLink struct {
+		from  *GraphNode
+		index int
+		addr  StoreAddress
+	}
+)
+
+const (
+	// Visits every key at one depth before any deeper key.
+	GraphBreadthFirst GraphOrder = iota
+	// Follows each relationship as deep as it goes before the next one.
+	GraphDepthFirst
+)
+
+// Visits `startSk` and the keys reachable from it by following relationships,
+// in `order`, down to `maxDepth` links from `startSk` (0 for no limit). Each
+// key is visited once, so cycles are not followed around, and relationships
+// to keys that no longer exist are skipped. The traversal stops early when
+// `visitor` returns false.
+//
+// The relationships of each key are read with a key match, and the targets
+// are resolved in batches with KeyValuesFromAddresses - a depth at a time for
+// breadth first, and a key at a time for depth first. The graph can change
+// during the traversal, as it is read with several commands.
+func (tsc *tsClient) TraverseGraph(startSk StoreKey, maxDepth int, order GraphOrder, visitor func(node *GraphNode) bool) (err error) {
+	addr, exists, err := tsc.LocateKey(startSk)
+	if err != nil || !exists {
+		return
+	}
+	value, _, _, err := tsc.GetKeyValue(startSk)
+	if err != nil {
+		return
+	}
+
+	start := &GraphNode{Sk: startSk, Address: addr, Value: value, RelationshipIndex: -1}
+	visited := map[StoreAddress]bool{addr: true}
+	if !visitor(start) {
+		return
+	}
+
+	if order == GraphDepthFirst {
+		_, err = tsc.traverseDepthFirst(start, maxDepth, visited, visitor)
+		return
+	}
+
+	frontier := []*GraphNode{start}
+	for len(frontier) > 0 && (maxDepth <= 0 || frontier[0].Depth < maxDepth) {
+		var links []graphLink
+		for _, node := range frontier {
+			var nodeLinks []graphLink
+			if nodeLinks, err = tsc.graphLinks(node, visited); err != nil {
+				return
+			}
+			links = append(links, nodeLinks...)
+		}
+
+		var next []*GraphNode
+		var stopped bool
+		if next, stopped, err = tsc.visitGraphLinks(links, visited, visitor); err != nil || stopped {
+			return
+		}
+		frontier = next
+	}
+	return
+}
+
+// Visits the keys reachable from `node` depth first, returning true if the
+// visitor stopped the traversal.
+func (tsc *tsClient) traverseDepthFirst(node *GraphNode, maxDepth int, visited map[StoreAddress]bool, visitor func(node *GraphNode) bool) (stopped bool, err error) {
+	if maxDepth > 0 && node.Depth >= maxDepth {
+		return
+	}
+
+	links, err := tsc.graphLinks(node, visited)
+	if err != nil {
+		return
+	}
+
+	results, err := tsc.KeyValuesFromAddresses(graphLinkAddresses(links))
+	if err != nil {
+		return
+	}
+
+	for n, link := range links {
+		// an earlier sibling's subtree may have reached this key
+		if !results[n].KeyExists || visited[link.addr] {
+			continue
+		}
+		visited[link.addr] = true
+
+		next := newGraphNode(link, results[n])
+		if !visitor(next) {
+			stopped = true
+			return
+		}
+		if stopped, err = tsc.traverseDepthFirst(next, maxDepth, visited, visitor); err != nil || stopped {
+			return
+		}
+	}
+	return
+}
+
+// Resolves `links` as a batch and visits the keys not visited yet, returning
+// them in order.
+func (tsc *tsClient) visitGraphLinks(links []graphLink, visited map[StoreAddress]bool, visitor func(node *GraphNode) bool) (nodes []*GraphNode, stopped bool, err error) {
+	results, err := tsc.KeyValuesFromAddresses(graphLinkAddresses(links))
+	if err != nil {
+		return
+	}
+
+	for n, link := range links {
+		if !results[n].KeyExists || visited[link.addr] {
+			continue
+		}
+		visited[link.addr] = true
+
+		node := newGraphNode(link, results[n])
+		if !visitor(node) {
+			stopped = true
+			return
+		}
+		nodes = append(nodes, node)
+	}
+	return
+}
+
+// Returns the relationships of `node` to keys that haven't been visited.
+func (tsc *tsClient) graphLinks(node *GraphNode, visited map[StoreAddress]bool) (links []graphLink, err error) {
+	relationships, _, _, err := tsc.keyRelationships(node.Sk)
+	if err != nil {
+		return
+	}
+
+	for index, addr := range relationships {
+		if addr != 0 && !visited[addr] {
+			links = append(links, graphLink{from: node, index: index, addr: addr})
+		}
+	}
+	return
+}
+
+func graphLinkAddresses(links []graphLink) []StoreAddress {
+	addrs := make([]StoreAddress, 0, len(links))
+	for _, link := range links {
+		addrs = append(addrs, link.addr)
+	}
+	return addrs
+}
+
+func newGraphNode(link graphLink, result AddressResult) *GraphNode {
+	return &GraphNode{
+		Sk:                result.Sk,
+		Address:           link.addr,
+		Value:             result.Value,
+		Depth:             link.from.Depth + 1,
+		FromSk:            link.from.Sk,
+		RelationshipIndex: link.index,
+	}
+}
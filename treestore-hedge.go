@@ -0,0 +1,103 @@
+package treestore_client
+
+import (
+	"time"
+)
+
+type (
+	// The hedging set by SetHedgedReads.
+	hedgedReads struct {
+		after  time.Duration
+		client *tsClient
+	}
+
+	hedgeResult struct {
+		response map[string]any
+		err      error
+	}
+)
+
+// commands that only read the tree store, which can be sent twice; export is
+// left out because it holds an exclusive server lock while it runs
+var readCommands = map[string]bool{
+	"lsk":         true,
+	"keys":        true,
+	"ttlk":        true,
+	"ttlv":        true,
+	"getv":        true,
+	"vat":         true,
+	"nodes":       true,
+	"lsv":         true,
+	"getmeta":     true,
+	"lsmeta":      true,
+	"indexed":     true,
+	"getk":        true,
+	"follow":      true,
+	"addrk":       true,
+	"addrv":       true,
+	"getjson":     true,
+	"getautolink": true,
+}
+
+// Hedges read commands: a read that hasn't been answered after `after` is
+// sent again on a second connection to the server, and the first response
+// is used. A read that waits behind a slow command on the client's
+// connection, or that is delayed by a stalled connection, is then answered
+// by the second connection. Commands that modify the tree store are never
+// hedged.
+//
+// The second connection is made to the server the client uses when this is
+// called. Specify 0 to stop hedging and close the second connection. The
+// hedging is shared by the clients derived with With().
+func (tsc *tsClient) SetHedgedReads(after time.Duration) {
+	var hr *hedgedReads
+	if after > 0 {
+		hr = &hedgedReads{after: after, client: tsc.dedicated()}
+	}
+
+	if old := tsc.hedge.Swap(hr); old != nil {
+		old.client.close()
+	}
+}
+
+// Sends a command as attemptCommand does, hedging it on the second connection
+// if it is a read that isn't answered in time. A server error is an answer;
+// when a connection fails instead, the other connection's response is
+// awaited.
+func (tsc *tsClient) attemptHedged(args []string) (response map[string]any, err error) {
+	hr := tsc.hedge.Load()
+	if hr == nil || len(args) == 0 || !readCommands[args[0]] {
+		return tsc.attemptCommand(args)
+	}
+
+	// buffered so that the slower attempt can finish after the command returns
+	results := make(chan hedgeResult, 2)
+	go func() {
+		response, err := tsc.attemptCommand(args)
+		results <- hedgeResult{response, err}
+	}()
+
+	timer := time.NewTimer(hr.after)
+	defer timer.Stop()
+
+	select {
+	case result := <-results:
+		return result.response, result.err
+	case <-timer.C:
+	}
+
+	tsc.l.Debugf("hedging %s after %s", args[0], hr.after)
+	go func() {
+		response, err := hr.client.attemptCommand(args)
+		results <- hedgeResult{response, err}
+	}()
+
+	for attempts := 0; attempts < 2; attempts++ {
+		result := <-results
+		response, err = result.response, result.err
+		if err == nil || response != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,317 @@
+package treestore_client
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+type (
+	// A value history entry, as found in the export format.
+	exportedHistoryValue struct {
+		Timestamp     int64    `json:"timestamp"`
+		Value         string   `json:"value"`
+		Type          string   `json:"type,omitempty"`
+		Relationships []string `json:"relationships,omitempty"`
+	}
+
+	// A key node of the export format, with the fields that ExportAtTime
+	// doesn't change kept as they are.
+	exportedHistoryNode struct {
+		History    []exportedHistoryValue          `json:"history,omitempty"`
+		Metadata   map[string]string               `json:"metadata,omitempty"`
+		Expiration *int64                          `json:"expiration,omitempty"`
+		Children   map[string]*exportedHistoryNode `json:"children,omitempty"`
+		Kals       json.RawMessage                 `json:"kals,omitempty"`
+	}
+
+	// A value from the history of a key, and when it was set.
+	TimedValue struct {
+		Timestamp time.Time
+		Value     any
+	}
+
+	historyPolicy struct {
+		skPattern  StoreKey
+		maxEntries int
+		maxAge     time.Duration
+	}
+)
+
+// The key holding the history retention policies, one metadata attribute per
+// key pattern.
+var HistoryPolicySk = MakeStoreKey("treestore-client", "history-policy")
+
+// Records a value history retention policy for keys matching `skPattern`,
+// enforced by Compact. Keys keep at most `maxEntries` history entries, and
+// entries older than `maxAge` are removed; specify 0 for no limit. The current
+// value is always kept. Specify 0 for both to remove the policy.
+func (tsc *tsClient) ConfigureHistoryPolicy(skPattern StoreKey, maxEntries int, maxAge time.Duration) (err error) {
+	attribute := string(skPattern.Path)
+	if maxEntries <= 0 && maxAge <= 0 {
+		_, _, err = tsc.ClearMetadataAttribute(HistoryPolicySk, attribute)
+		return
+	}
+
+	if _, _, err = tsc.SetKey(HistoryPolicySk); err != nil {
+		return
+	}
+	_, _, err = tsc.SetMetadataAttribute(HistoryPolicySk, attribute, fmt.Sprintf("%d %d", max(maxEntries, 0), max(maxAge, 0)))
+	return
+}
+
+// Loads the retention policies recorded by ConfigureHistoryPolicy.
+func (tsc *tsClient) historyPolicies() (policies []historyPolicy, err error) {
+	attributes, err := tsc.GetMetadataAttributes(HistoryPolicySk)
+	if err != nil {
+		return
+	}
+
+	for _, attribute := range attributes {
+		var exists bool
+		var value string
+		if exists, value, err = tsc.GetMetadataAttribute(HistoryPolicySk, attribute); err != nil {
+			return
+		}
+		if !exists {
+			continue
+		}
+
+		policy := historyPolicy{skPattern: MakeStoreKeyFromPath(TokenPath(attribute))}
+		var maxAgeNs int64
+		if _, err = fmt.Sscanf(value, "%d %d", &policy.maxEntries, &maxAgeNs); err != nil {
+			err = fmt.Errorf("invalid history policy for %s: %w", attribute, err)
+			return
+		}
+		policy.maxAge = time.Duration(maxAgeNs)
+		policies = append(policies, policy)
+	}
+	return
+}
+
+// Enforces the history retention policies recorded by ConfigureHistoryPolicy,
+// returning the number of keys that had history removed.
+//
+// The server does not have a command to trim history, so each key is
+// exported, its history trimmed, and the key imported again. The key keeps its
+// address, metadata and expiration. Keys with children are skipped, because
+// reimporting them would give the children new addresses. A value written to
+// a key between its export and import is lost, so compaction is best run when
+// the keys are not being written.
+func (tsc *tsClient) Compact() (compacted int, err error) {
+	policies, err := tsc.historyPolicies()
+	if err != nil {
+		return
+	}
+
+	for _, policy := range policies {
+		var candidates []StoreKey
+		err = tsc.GetMatchingKeyValuesStream(policy.skPattern, func(kvm *KeyValueMatch) bool {
+			if !kvm.HasChildren {
+				candidates = append(candidates, MakeStoreKeyFromPath(kvm.Key))
+			}
+			return true
+		})
+		if err != nil {
+			return
+		}
+
+		for _, sk := range candidates {
+			var trimmed bool
+			if trimmed, err = tsc.compactKey(sk, policy); err != nil {
+				return
+			}
+			if trimmed {
+				compacted++
+			}
+		}
+	}
+	return
+}
+
+// Trims the value history of a single key according to the policy.
+func (tsc *tsClient) compactKey(sk StoreKey, policy historyPolicy) (trimmed bool, err error) {
+	b64, err := tsc.ExportBase64(sk)
+	if err != nil {
+		return
+	}
+	exported, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return
+	}
+
+	var node map[string]json.RawMessage
+	if err = json.Unmarshal(exported, &node); err != nil || node == nil || node["children"] != nil {
+		return
+	}
+
+	var history []exportedHistoryValue
+	if raw := node["history"]; raw != nil {
+		if err = json.Unmarshal(raw, &history); err != nil {
+			return
+		}
+	}
+
+	// oldest first, which is also the order the import requires, as it takes
+	// the last entry as the current value; the current value is always kept
+	sort.Slice(history, func(i, j int) bool {
+		return history[i].Timestamp < history[j].Timestamp
+	})
+
+	keep := len(history)
+	if policy.maxEntries > 0 {
+		keep = min(keep, policy.maxEntries)
+	}
+	if policy.maxAge > 0 {
+		cutoff := time.Now().Add(-policy.maxAge).UnixNano()
+		for keep > 1 && history[len(history)-keep].Timestamp < cutoff {
+			keep--
+		}
+	}
+	if keep >= len(history) {
+		return
+	}
+
+	if node["history"], err = json.Marshal(history[len(history)-keep:]); err != nil {
+		return
+	}
+	if exported, err = json.Marshal(node); err != nil {
+		return
+	}
+
+	if err = tsc.ImportBase64(sk, base64.StdEncoding.EncodeToString(exported)); err != nil {
+		return
+	}
+	trimmed = true
+	return
+}
+
+// Returns the values of `sk` set from `from` through `to`, inclusive, oldest
+// first. A zero `from` or `to` leaves that end of the range open.
+//
+// The server has no command to list the value history, so the key is exported
+// to find the times of its values, and each value in the range is then
+// fetched with GetKeyValueAtTime, which keeps the value types. The export
+// includes the children of the key, so this is best used on leaf keys.
+func (tsc *tsClient) GetKeyValuesInRange(sk StoreKey, from, to time.Time) (values []TimedValue, err error) {
+	b64, err := tsc.ExportBase64(sk)
+	if err != nil {
+		return
+	}
+	exported, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return
+	}
+
+	var node struct {
+		History []exportedHistoryValue `json:"history"`
+	}
+	if err = json.Unmarshal(exported, &node); err != nil {
+		return
+	}
+
+	sort.Slice(node.History, func(i, j int) bool {
+		return node.History[i].Timestamp < node.History[j].Timestamp
+	})
+
+	values = []TimedValue{}
+	for _, entry := range node.History {
+		when := time.Unix(0, entry.Timestamp)
+		if (!from.IsZero() && when.Before(from)) || (!to.IsZero() && when.After(to)) {
+			continue
+		}
+
+		var value any
+		var exists bool
+		if value, exists, err = tsc.GetKeyValueAtTime(sk, &when); err != nil {
+			return
+		}
+		if exists {
+			values = append(values, TimedValue{Timestamp: when, Value: value})
+		}
+	}
+	return
+}
+
+// Serializes the subtree at `sk` in the export format, with each key holding
+// only the value it had at `when`. The document can be passed to Import to
+// restore the snapshot.
+//
+// The value history is the only record of time in the store, so a key whose
+// values were all set after `when`, and that has no children left in the
+// snapshot, is taken to have been created later and is omitted. Keys that
+// never had a value are always included, and metadata and expirations are
+// their current ones. Numbers are decoded as json.Number, so that timestamps
+// keep their nanosecond precision.
+func (tsc *tsClient) ExportAtTime(sk StoreKey, when time.Time) (jsonData any, err error) {
+	node, err := tsc.exportHistoryNode(sk)
+	if err != nil || node == nil {
+		return
+	}
+	snapshotNode(node, when.UnixNano())
+
+	exported, err := json.Marshal(node)
+	if err != nil {
+		return
+	}
+	decoder := json.NewDecoder(bytes.NewReader(exported))
+	decoder.UseNumber()
+	err = decoder.Decode(&jsonData)
+	return
+}
+
+// Exports the subtree at `sk`, returning nil if it doesn't exist.
+func (tsc *tsClient) exportHistoryNode(sk StoreKey) (node *exportedHistoryNode, err error) {
+	b64, err := tsc.ExportBase64(sk)
+	if err != nil {
+		return
+	}
+	exported, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(exported, &node)
+	return
+}
+
+// Returns the current value of an exported key, or nil if it has none.
+func (node *exportedHistoryNode) current() (current *exportedHistoryValue) {
+	for i := range node.History {
+		if current == nil || node.History[i].Timestamp >= current.Timestamp {
+			current = &node.History[i]
+		}
+	}
+	return
+}
+
+// Reduces the history of `node` and its children to the values in effect at
+// `whenNs`, returning false if the node didn't exist yet.
+func snapshotNode(node *exportedHistoryNode, whenNs int64) (existed bool) {
+	// a timestamp of 0 is a current value that has no history
+	var current *exportedHistoryValue
+	for i := range node.History {
+		entry := &node.History[i]
+		if entry.Timestamp <= whenNs && (current == nil || entry.Timestamp >= current.Timestamp) {
+			current = entry
+		}
+	}
+	existed = current != nil || len(node.History) == 0
+	if current != nil {
+		node.History = []exportedHistoryValue{*current}
+	} else {
+		node.History = nil
+	}
+
+	for segment, child := range node.Children {
+		if snapshotNode(child, whenNs) {
+			existed = true
+		} else {
+			delete(node.Children, segment)
+		}
+	}
+	return
+}
@@ -1,12 +1,15 @@
 package treestore_client
 
 import (
+	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"strings"
 	"sync"
@@ -18,23 +21,74 @@ import (
 )
 
 type (
-	tsClient struct {
+	// State shared by a client and the clients derived from it with With().
+	tsConnection struct {
 		sync.Mutex
-		l           lane.Lane
-		cxn         net.Conn
-		hostAndPort string
-		inbound     []byte
-		invoked     atomic.Int32
+		cxn          net.Conn
+		hostAndPort  string
+		dial         Dialer
+		inbound      []byte
+		invoked      atomic.Int32
+		maxQueued    atomic.Int32
+		stagedMu     sync.Mutex
+		staged       map[TokenPath]StoreKey
+		asyncMu      sync.Mutex
+		asyncQueue   []func()
+		asyncRunning bool
+		asyncLimit   int
+		profileMu    sync.Mutex
+		profiles     map[TokenPath]*ClientProfile
+		sizeStatsMu  sync.Mutex
+		sizeStats    map[TokenPath]*prefixSizeStats
+		jsonCacheMu  sync.Mutex
+		jsonCache    JsonCache
+		jsonCacheGen uint64
+		drainMu      sync.RWMutex
+		standby      string
+		breaker      atomic.Pointer[circuitBreaker]
+		rateLimit    atomic.Pointer[rateLimiter]
+		hedge        atomic.Pointer[hedgedReads]
+	}
+
+	tsClient struct {
+		*tsConnection
+		l            lane.Lane
+		timeout      time.Duration
+		readOnly     bool
+		prefix       StoreKey
+		retries      int
+		retryBackoff time.Duration
+		lockWarning  time.Duration
+		base64Above  int
+		maxRequest   int
+		touchOnRead  time.Duration
+		interceptors []Interceptor
 	}
 )
 
+// the time limit for a server response, unless overridden by ClientTimeout
+const defaultCommandTimeout = 20 * time.Second
+
+// the json payload size above which the payload is sent base64 encoded, unless
+// overridden by ClientBase64Threshold
+const defaultBase64Threshold = 16 * 1024
+
+// the largest request sent to the server, unless overridden by
+// ClientMaxRequestSize
+const defaultMaxRequestSize = 64 * 1024 * 1024
+
 var ZeroTime = time.Time{}
 var ExpiredTime = time.Date(0, 0, 0, 0, 0, 0, 1, time.UTC)
 
 func NewTSClient(l lane.Lane) TSClient {
 	tsc := &tsClient{
+		tsConnection: &tsConnection{
+			hostAndPort: "localhost:6770",
+		},
 		l:           l,
-		hostAndPort: "localhost:6770",
+		timeout:     defaultCommandTimeout,
+		base64Above: defaultBase64Threshold,
+		maxRequest:  defaultMaxRequestSize,
 	}
 
 	return tsc
@@ -47,6 +101,7 @@ func (tsc *tsClient) close() (err error) {
 		if tsc.cxn != nil {
 			err = tsc.cxn.Close()
 			tsc.cxn = nil
+			tsc.inbound = nil
 		}
 		invoked = tsc.invoked.Load() != 0
 		tsc.Unlock()
@@ -70,18 +125,222 @@ func (tsc *tsClient) SetServer(host string, port int) {
 	tsc.hostAndPort = fmt.Sprintf("%s:%d", host, port)
 }
 
-// Disconnects from the treestore server.
+// Replaces the function used to connect to the server, such as one made by
+// NewFaultInjectingDialer. The current connection, if any, is closed. Specify
+// nil to restore the default TCP dialer.
+func (tsc *tsClient) SetDialer(dial Dialer) {
+	tsc.close()
+
+	tsc.Lock()
+	defer tsc.Unlock()
+	tsc.dial = dial
+}
+
+// Limits the number of commands that can wait for the connection while another
+// command is in flight. When the limit is reached, commands fail immediately
+// with ErrBusy, so that a stalled server produces backpressure rather than an
+// unbounded number of blocked goroutines. Specify 0 for no limit (the default).
+func (tsc *tsClient) SetRequestQueueLimit(maxQueued int) {
+	tsc.maxQueued.Store(int32(maxQueued))
+}
+
+// Limits the number of async commands that can be queued for the connection's
+// worker. When the limit is reached, the futures of new async commands resolve
+// immediately with ErrQueueFull, so that the queue doesn't grow without bound
+// when the server slows down. Specify 0 for no limit (the default).
+func (tsc *tsClient) SetAsyncQueueLimit(maxQueued int) {
+	tsc.asyncMu.Lock()
+	defer tsc.asyncMu.Unlock()
+	tsc.asyncLimit = maxQueued
+}
+
+// Disconnects from the treestore server. Staged keys that were registered
+// for cleanup are deleted first.
 func (tsc *tsClient) Close() (err error) {
+	tsc.cleanupRegisteredStaged()
 	err = tsc.close()
+	if hr := tsc.hedge.Load(); hr != nil {
+		hr.client.close()
+	}
+	return
+}
+
+// Establishes the connection to the treestore server ahead of the first
+// command, so that the first request doesn't pay the dial latency. Returns
+// immediately if the client is already connected.
+func (tsc *tsClient) Connect(ctx context.Context) (err error) {
+	tsc.Lock()
+	defer tsc.Unlock()
+
+	return tsc.connect(ctx)
+}
+
+// Dials the server if not already connected. The caller must hold the lock.
+func (tsc *tsClient) connect(ctx context.Context) (err error) {
+	if tsc.cxn != nil {
+		return
+	}
+
+	dial := tsc.dial
+	if dial == nil {
+		dial = defaultDialer
+	}
+
+	cxn, err := dial(ctx, "tcp", tsc.hostAndPort)
+	if err != nil {
+		tsc.l.Errorf("can't connect to %s: %s", tsc.hostAndPort, err.Error())
+		return
+	}
+
+	tsc.cxn = cxn
 	return
 }
 
 // Sends a raw command-line encoded command to the treestore server. This
 // can be used to implement a CLI client.
 func (tsc *tsClient) RawCommand(args ...string) (response map[string]any, err error) {
-	tsc.invoked.Add(1)
+	if len(tsc.interceptors) > 0 {
+		return tsc.intercept(context.Background(), args, 0)
+	}
+	return tsc.sendRawCommand(args)
+}
+
+// Sends a command that has passed the client's interceptors.
+func (tsc *tsClient) sendRawCommand(args []string) (response map[string]any, err error) {
+	var endpoint string
+	defer func() {
+		if err != nil {
+			err = commandError(args, endpoint, err)
+		}
+	}()
+
+	if tsc.readOnly && len(args) > 0 && writeCommands[args[0]] {
+		err = ErrReadOnly
+		return
+	}
+
+	if err = tsc.checkRequestSize(args); err != nil {
+		return
+	}
+
+	if rl := tsc.rateLimit.Load(); rl != nil {
+		if err = rl.acquire(requestSize(args)); err != nil {
+			return
+		}
+	}
+
+	pending := tsc.invoked.Add(1)
 	defer tsc.invoked.Add(-1)
 
+	// the outcome of a failed mutation is unknown, so it invalidates too
+	defer tsc.invalidateForCommand(args)
+
+	// one command is in flight on the connection; the rest wait for it
+	maxQueued := tsc.maxQueued.Load()
+	if maxQueued > 0 && pending > maxQueued+1 {
+		err = ErrBusy
+		return
+	}
+
+	cb := tsc.breaker.Load()
+	var generation uint64
+	if cb != nil {
+		if generation, err = cb.allow(); err != nil {
+			return
+		}
+	}
+
+	// a drain waits for the commands in flight, and holds new ones back
+	tsc.drainMu.RLock()
+	tsc.Lock()
+	endpoint = tsc.hostAndPort
+	tsc.Unlock()
+	response, err = tsc.attemptHedged(args)
+	tsc.drainMu.RUnlock()
+
+	if cb != nil {
+		cb.record(generation, response, err)
+	}
+	return
+}
+
+// Adds the command, its key and the server address to an error, so that the
+// error identifies the failed operation wherever it is logged. The address is
+// empty when the command was refused before it was sent.
+func commandError(args []string, endpoint string, err error) error {
+	var sb strings.Builder
+	if len(args) > 0 {
+		sb.WriteString(args[0])
+	} else {
+		sb.WriteString("command")
+	}
+	if len(args) > 1 && strings.HasPrefix(args[1], "/") {
+		sb.WriteString(" ")
+		sb.WriteString(args[1])
+	}
+	if endpoint != "" {
+		sb.WriteString(" on ")
+		sb.WriteString(endpoint)
+	}
+	return fmt.Errorf("%s: %w", sb.String(), err)
+}
+
+// Sends a command, retrying as allowed by ClientRetries.
+func (tsc *tsClient) attemptCommand(args []string) (response map[string]any, err error) {
+	for attempt := 0; ; attempt++ {
+		var sent bool
+		response, sent, err = tsc.sendCommand(args)
+		if err == nil || response != nil || attempt >= tsc.retries {
+			return
+		}
+
+		// the server has no idempotency tokens, so a mutation can only be
+		// retried if it certainly wasn't received
+		if sent && len(args) > 0 && writeCommands[args[0]] {
+			return
+		}
+
+		tsc.l.Debugf("retrying %s after: %s", args[0], err.Error())
+		time.Sleep(tsc.retryBackoff * time.Duration(attempt+1))
+	}
+}
+
+// Refuses a request that exceeds the size limit, naming the largest argument,
+// rather than sending a frame the server may not be able to take.
+func (tsc *tsClient) checkRequestSize(args []string) error {
+	size := int64(requestSize(args))
+	largest := 0
+	for i, arg := range args {
+		if len(arg) > len(args[largest]) {
+			largest = i
+		}
+	}
+
+	// the frame length is 32 bits
+	limit := min(int64(tsc.maxRequest), math.MaxUint32)
+	if size <= limit {
+		return nil
+	}
+
+	return fmt.Errorf("%w: %s request is %d bytes (limit %d), of which argument %d is %d bytes; use a Base64 variant for binary data, or split the data across several commands (such as MergeKeyJson of the parts of a json document)",
+		ErrRequestTooLarge, args[0], size, limit, largest, len(args[largest]))
+}
+
+// Returns the size of the request frame's payload.
+func requestSize(args []string) int {
+	// args are separated by line breaks
+	size := len(args) - 1
+	for _, arg := range args {
+		size += len(arg)
+	}
+	return size
+}
+
+// Makes one attempt to send a command and read its response. The `sent`
+// flag indicates the complete request was written, and so may have been
+// executed even if an error occurred afterward. A non-nil `response` with
+// an error is an error reported by the server.
+func (tsc *tsClient) sendCommand(args []string) (response map[string]any, sent bool, err error) {
 	//
 	// Ensure connection
 	//
@@ -89,15 +348,8 @@ func (tsc *tsClient) RawCommand(args ...string) (response map[string]any, err er
 	tsc.Lock()
 	defer tsc.Unlock()
 
-	if tsc.cxn == nil {
-		var cxn net.Conn
-		cxn, err = net.Dial("tcp", tsc.hostAndPort)
-		if err != nil {
-			tsc.l.Errorf("can't connect to %s: %s", tsc.hostAndPort, err.Error())
-			return
-		}
-
-		tsc.cxn = cxn
+	if err = tsc.connect(context.Background()); err != nil {
+		return
 	}
 
 	//
@@ -107,25 +359,31 @@ func (tsc *tsClient) RawCommand(args ...string) (response map[string]any, err er
 	//
 
 	joined := strings.Join(args, "\n")
+	started := time.Now()
 
 	req := make([]byte, len(joined)+4)
 	binary.BigEndian.PutUint32(req, uint32(len(joined)))
 	copy(req[4:], []byte(joined))
 
+	if len(tsc.inbound) > 0 {
+		// nothing is expected between responses
+		tsc.l.Warnf("discarding %d unexpected bytes from %s", len(tsc.inbound), tsc.cxn.RemoteAddr().String())
+		tsc.inbound = nil
+	}
+
 	n, err := tsc.cxn.Write(req)
 	if err != nil {
 		tsc.l.Errorf("failed to write request: %s", err.Error())
-		tsc.cxn.Close()
-		tsc.cxn = nil
+		tsc.dropConnection()
 		return
 	}
 	if n != len(req) {
 		err = fmt.Errorf("%d bytes sent of %d", n, len(req))
 		tsc.l.Errorf("failed to write request: %s", err.Error())
-		tsc.cxn.Close()
-		tsc.cxn = nil
+		tsc.dropConnection()
 		return
 	}
+	sent = true
 
 	//
 	// The response will be returned in json.
@@ -136,15 +394,17 @@ func (tsc *tsClient) RawCommand(args ...string) (response map[string]any, err er
 		buffer := make([]byte, 1024*8)
 
 		// put a time limit on an api
-		tsc.cxn.SetReadDeadline(time.Now().Add(20 * time.Second))
+		tsc.cxn.SetReadDeadline(time.Now().Add(tsc.commandTimeout(args)))
 		n, err = tsc.cxn.Read(buffer)
 
 		if err != nil {
 			if !errors.Is(err, io.EOF) && !strings.HasSuffix(err.Error(), "use of closed network connection") {
 				tsc.l.Errorf("read error from %s: %s", tsc.cxn.RemoteAddr().String(), err.Error())
 			}
-			tsc.cxn.Close()
-			tsc.cxn = nil
+			if len(tsc.inbound) > 0 {
+				err = tsc.responseLost(args, err)
+			}
+			tsc.dropConnection()
 			return
 		}
 
@@ -159,13 +419,15 @@ func (tsc *tsClient) RawCommand(args ...string) (response map[string]any, err er
 		var length int
 		length, response, err = tsc.parseResponse()
 		if err != nil {
+			// the length prefix is intact, so skip to the next frame and keep
+			// the connection
 			tsc.l.Errorf("bad response from %s: %s", tsc.cxn.RemoteAddr().String(), err.Error())
-			tsc.cxn.Close()
-			tsc.cxn = nil
+			tsc.inbound = tsc.inbound[length:]
 			return
 		}
 		if response != nil {
 			tsc.inbound = tsc.inbound[length:]
+			tsc.checkLockDuration(args, time.Since(started))
 
 			errText, isError := response["error"].(string)
 			if isError {
@@ -177,6 +439,9 @@ func (tsc *tsClient) RawCommand(args ...string) (response map[string]any, err er
 	}
 }
 
+// Parses the response frame at the start of the inbound data, returning a nil
+// response if the frame is incomplete. The frame length is returned even
+// when the frame can't be parsed, so that it can be skipped.
 func (tsc *tsClient) parseResponse() (length int, response map[string]any, err error) {
 	if len(tsc.inbound) < 4 {
 		return
@@ -188,19 +453,38 @@ func (tsc *tsClient) parseResponse() (length int, response map[string]any, err e
 		return
 	}
 
-	packet := tsc.inbound[4 : 4+packetSize]
+	length = 4 + int(packetSize)
+	packet := tsc.inbound[4:length]
 	if err = json.Unmarshal(packet, &response); err != nil {
-		return
+		response = nil
 	}
-
-	length = 4 + int(packetSize)
 	return
 }
 
+// Describes the partial response that is discarded when the connection fails
+// mid-frame. The command may have been executed.
+func (tsc *tsClient) responseLost(args []string, readErr error) error {
+	expected := "an unknown number of"
+	if len(tsc.inbound) >= 4 {
+		expected = fmt.Sprintf("%d", 4+int(binary.BigEndian.Uint32(tsc.inbound)))
+	}
+	tsc.l.Errorf("discarding %d bytes of a response from %s", len(tsc.inbound), tsc.cxn.RemoteAddr().String())
+	return fmt.Errorf("%w: %s response had %d of %s bytes: %w", ErrResponseLost, args[0], len(tsc.inbound), expected, readErr)
+}
+
+// Closes the connection after a failure, discarding any partial response, so
+// that the next command starts on a new connection at a frame boundary. The
+// caller must hold the lock.
+func (tsc *tsClient) dropConnection() {
+	tsc.cxn.Close()
+	tsc.cxn = nil
+	tsc.inbound = nil
+}
+
 // Set a key without a value and without an expiration, doing nothing if the
 // key already exists. The key index is not altered.
 func (tsc *tsClient) SetKey(sk StoreKey) (address StoreAddress, exists bool, err error) {
-	response, err := tsc.RawCommand("setk", string(sk.Path))
+	response, err := tsc.RawCommand("setk", tsc.keyArg(sk))
 	if err != nil {
 		return
 	}
@@ -217,7 +501,7 @@ func (tsc *tsClient) SetKey(sk StoreKey) (address StoreAddress, exists bool, err
 // If the test key does not exist, address will be returned as 0.
 // The return value 'exists' is true if the target sk exists.
 func (tsc *tsClient) SetKeyIfExists(testSk, sk StoreKey) (address StoreAddress, exists bool, err error) {
-	response, err := tsc.RawCommand("setkif", string(testSk.Path), string(sk.Path))
+	response, err := tsc.RawCommand("setkif", tsc.keyArg(testSk), tsc.keyArg(sk))
 	if err != nil {
 		return
 	}
@@ -230,12 +514,12 @@ func (tsc *tsClient) SetKeyIfExists(testSk, sk StoreKey) (address StoreAddress,
 // Set a key with a value, without an expiration, adding to value history if the
 // key already exists.
 func (tsc *tsClient) SetKeyValue(sk StoreKey, value any) (address StoreAddress, firstValue bool, err error) {
-	val, valType, err := nativeValueToCmdline(value)
+	val, valType, err := tsc.encodeValue(sk, value)
 	if err != nil {
 		return
 	}
 
-	args := []string{"setv", string(sk.Path), val}
+	args := []string{"setv", tsc.keyArg(sk), val}
 	if valType != "" {
 		args = append(args, "--value-type", valType)
 	}
@@ -250,6 +534,55 @@ func (tsc *tsClient) SetKeyValue(sk StoreKey, value any) (address StoreAddress,
 	return
 }
 
+// Set a key with a value given as base64 text, without an expiration, adding
+// to value history if the key already exists. The value is stored as bytes.
+//
+// This is only a convenience wrapper: the server has no base64 form of setv,
+// so the text is decoded here and the bytes are sent by SetKeyValue, with
+// value escaping, at the cost of the extra decode.
+func (tsc *tsClient) SetKeyValueBase64(sk StoreKey, b64 string) (address StoreAddress, firstValue bool, err error) {
+	value, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return
+	}
+	return tsc.SetKeyValue(sk, value)
+}
+
+// Sets the value of a key to null, which GetKeyValue distinguishes from a key
+// without a value. The key is created if necessary, and its children are kept.
+// The value history is replaced and the expiration is removed.
+func (tsc *tsClient) SetKeyValueNil(sk StoreKey) (address StoreAddress, err error) {
+	// the server has no null value encoding; json null is stored as nil
+	response, err := tsc.RawCommand("mergejson", tsc.keyArg(sk), "null")
+	if err != nil {
+		return
+	}
+
+	address = responseAddress(response["address"])
+	return
+}
+
+// Sets the values of many keys, in the order of `pairs`, returning the
+// address and first value flag for each. This is a best-effort batch, not a
+// multi-set.
+//
+// The server does not have a multi-set command, so the values are set one at
+// a time and the operation is not atomic: other clients may observe some of
+// the values before the rest are set. The first error stops the operation
+// partway, and `results` holds the outcome of the values that were set; they
+// are not rolled back.
+func (tsc *tsClient) SetKeyValuesBestEffort(pairs []KeyValuePair) (results []SetKeyValueResult, err error) {
+	results = make([]SetKeyValueResult, 0, len(pairs))
+	for _, pair := range pairs {
+		var result SetKeyValueResult
+		if result.Address, result.FirstValue, err = tsc.SetKeyValue(pair.Sk, pair.Value); err != nil {
+			return
+		}
+		results = append(results, result)
+	}
+	return
+}
+
 // Ensures a key exists, optionally sets a value, optionally sets or removes key expiration, and
 // optionally replaces the relationships array.
 //
@@ -271,13 +604,13 @@ func (tsc *tsClient) SetKeyValue(sk StoreKey, value any) (address StoreAddress,
 // A non-nil `relationships` will replace the relationships of the key node. An empty array
 // removes all relationships. Specify nil to retain the current key relationships.
 func (tsc *tsClient) SetKeyValueEx(sk StoreKey, value any, flags SetExFlags, expire *time.Time, relationships []StoreAddress) (address StoreAddress, exists bool, originalValue any, err error) {
-	args := []string{"setex", string(sk.Path)}
+	args := []string{"setex", tsc.keyArg(sk)}
 	if (flags & SetExNoValueUpdate) == 0 {
 		if value == nil {
 			args = append(args, "--nil")
 		} else {
 			var val, valType string
-			val, valType, err = nativeValueToCmdline(value)
+			val, valType, err = tsc.encodeValue(sk, value)
 			if err != nil {
 				return
 			}
@@ -330,16 +663,79 @@ func (tsc *tsClient) SetKeyValueEx(sk StoreKey, value any, flags SetExFlags, exp
 	orgVal, hasOrgVal := response["original_value"].(string)
 	if hasOrgVal {
 		orgValType, _ := response["original_type"].(string)
-		if originalValue, err = cmdlineToNativeValue(orgVal, orgValType); err != nil {
+		if originalValue, err = tsc.decodeValue(tsc.keyArg(sk), orgVal, orgValType); err != nil {
 			return
 		}
 	}
 	return
 }
 
+// Sets a key's value and returns the value it replaced, in a single round trip.
+// The swap is atomic on the server, so no other writer's value can be lost
+// between reading the old value and writing the new one. `originalValue` is nil
+// when the key didn't exist or had no value.
+//
+// The write is a SetKeyValueEx, so the key's expiration is removed, and its
+// relationships are kept.
+func (tsc *tsClient) GetSetKeyValue(sk StoreKey, newValue any) (address StoreAddress, originalValue any, err error) {
+	address, _, originalValue, err = tsc.SetKeyValueEx(sk, newValue, 0, nil, nil)
+	return
+}
+
+// Sets a key's value only if its current value matches `expectedValue`. Specify
+// nil for `expectedValue` to require that the key has no value.
+//
+// When the current value doesn't match, no change is made, `swapped` is false
+// and `actualValue` holds the current value. When it matches, `actualValue`
+// holds the value that was replaced. The key's expiration is kept.
+//
+// The server doesn't offer a compare-and-swap primitive, so the comparison is
+// made by the client while it holds a lock on the key (see LocksSk). The swap
+// is atomic with respect to other SetKeyValueCAS calls, on any connection, but
+// not to plain writes such as SetKeyValue, which don't take the lock.
+func (tsc *tsClient) SetKeyValueCAS(sk StoreKey, expectedValue, newValue any) (swapped bool, actualValue any, err error) {
+	unlock, err := tsc.lockKey(sk)
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	current, _, valueExists, err := tsc.GetKeyValue(sk)
+	if err != nil {
+		return
+	}
+
+	if expectedValue == nil {
+		if valueExists {
+			actualValue = current
+			return
+		}
+	} else {
+		if !valueExists {
+			return
+		}
+		var equal bool
+		if equal, err = valuesEqual(current, expectedValue); err != nil {
+			return
+		}
+		if !equal {
+			actualValue = current
+			return
+		}
+	}
+
+	if _, _, err = tsc.SetKeyValue(sk, newValue); err != nil {
+		return
+	}
+
+	swapped = true
+	actualValue = current
+	return
+}
+
 // Looks up the key in the index and returns true if it exists and has value history.
 func (tsc *tsClient) IsKeyIndexed(sk StoreKey) (address StoreAddress, exists bool, err error) {
-	response, err := tsc.RawCommand("indexed", string(sk.Path))
+	response, err := tsc.RawCommand("indexed", tsc.keyArg(sk))
 	if err != nil {
 		return
 	}
@@ -353,7 +749,7 @@ func (tsc *tsClient) IsKeyIndexed(sk StoreKey) (address StoreAddress, exists boo
 // the key path is indexed. This avoids putting a lock on the index, but will lock
 // tree levels while walking the tree.
 func (tsc *tsClient) LocateKey(sk StoreKey) (address StoreAddress, exists bool, err error) {
-	response, err := tsc.RawCommand("getk", string(sk.Path))
+	response, err := tsc.RawCommand("getk", tsc.keyArg(sk))
 	if err != nil {
 		return
 	}
@@ -366,10 +762,23 @@ func (tsc *tsClient) LocateKey(sk StoreKey) (address StoreAddress, exists bool,
 	return
 }
 
+// Returns true if the key exists. The server has no dedicated existence
+// command; this uses the same tree walk as LocateKey, whose response is just
+// the address, without parsing it.
+func (tsc *tsClient) KeyExists(sk StoreKey) (exists bool, err error) {
+	response, err := tsc.RawCommand("getk", tsc.keyArg(sk))
+	if err != nil {
+		return
+	}
+
+	_, exists = response["address"]
+	return
+}
+
 // Navigates to the valueInstance key node and returns the expiration time in Unix nanoseconds, or
 // -1 if the key path does not exist.
 func (tsc *tsClient) GetKeyTtl(sk StoreKey) (ttl *time.Time, err error) {
-	response, err := tsc.RawCommand("ttlk", string(sk.Path))
+	response, err := tsc.RawCommand("ttlk", tsc.keyArg(sk))
 	if err != nil {
 		return
 	}
@@ -384,7 +793,7 @@ func (tsc *tsClient) GetKeyTtl(sk StoreKey) (ttl *time.Time, err error) {
 // Navigates to the valueInstance key node and sets the expiration time in Unix nanoseconds.
 // Specify nil for no expiration.
 func (tsc *tsClient) SetKeyTtl(sk StoreKey, expiration *time.Time) (exists bool, err error) {
-	response, err := tsc.RawCommand("expirekns", string(sk.Path), requestEpochNs(expiration))
+	response, err := tsc.RawCommand("expirekns", tsc.keyArg(sk), requestEpochNs(expiration))
 	if err != nil {
 		return
 	}
@@ -393,10 +802,65 @@ func (tsc *tsClient) SetKeyTtl(sk StoreKey, expiration *time.Time) (exists bool,
 	return
 }
 
+// Sets the expiration of the key node to `extendBy` from now, as with a
+// sliding expiration, returning whether the key exists. The expiration is
+// set with one command, so concurrent touches don't conflict. The time is
+// taken from the client's clock.
+func (tsc *tsClient) TouchKey(sk StoreKey, extendBy time.Duration) (exists bool, err error) {
+	expiration := time.Now().Add(extendBy)
+	return tsc.SetKeyTtl(sk, &expiration)
+}
+
+// Removes the expiration of the key node, returning whether it had one.
+//
+// The server reports the expiration and clears it with separate commands, so
+// `hadTtl` can be stale if another client changes the expiration in between.
+func (tsc *tsClient) PersistKey(sk StoreKey) (hadTtl bool, err error) {
+	ttl, err := tsc.GetKeyTtl(sk)
+	if err != nil {
+		return
+	}
+	if hadTtl = ttlIsSet(ttl); !hadTtl {
+		return
+	}
+
+	_, err = tsc.SetKeyTtl(sk, nil)
+	return
+}
+
+// Sets the expiration of every key matching `skPattern`, returning the number
+// of keys updated. Specify nil to clear the expirations.
+//
+// The server does not have a bulk expiration command, so the matches are
+// collected first and then updated one at a time; the operation is not
+// atomic. The matches are collected before any update, because an expiration
+// in the past removes keys, which would shift the offsets of a stream that is
+// still in progress.
+func (tsc *tsClient) SetTtlMatching(skPattern StoreKey, expiration *time.Time) (updated int, err error) {
+	sks := []StoreKey{}
+	if err = tsc.GetMatchingKeysStream(skPattern, func(km *KeyMatch) bool {
+		sks = append(sks, MakeStoreKeyFromPath(km.Key))
+		return true
+	}); err != nil {
+		return
+	}
+
+	for _, sk := range sks {
+		var exists bool
+		if exists, err = tsc.SetKeyTtl(sk, expiration); err != nil {
+			return
+		}
+		if exists {
+			updated++
+		}
+	}
+	return
+}
+
 // Looks up the key in the index and returns the current value and flags
 // that indicate if the key was set, and if so, if it has a value.
 func (tsc *tsClient) GetKeyValue(sk StoreKey) (value any, keyExists, valueExists bool, err error) {
-	response, err := tsc.RawCommand("getv", string(sk.Path))
+	response, err := tsc.RawCommand("getv", tsc.keyArg(sk))
 	if err != nil {
 		return
 	}
@@ -407,11 +871,58 @@ func (tsc *tsClient) GetKeyValue(sk StoreKey) (value any, keyExists, valueExists
 		valStr, valueExists = response["value"].(string)
 		if valueExists {
 			valType, _ := response["type"].(string)
-			value, err = cmdlineToNativeValue(valStr, valType)
+			value, err = tsc.decodeValue(tsc.keyArg(sk), valStr, valType)
 			if err != nil {
 				return
 			}
 		}
+
+		// a touch is a write, which a read-only client can't make
+		if tsc.touchOnRead > 0 && !tsc.readOnly {
+			_, err = tsc.TouchKey(sk, tsc.touchOnRead)
+		}
+	}
+	return
+}
+
+// Looks up the key and returns the bytes of its current value as base64 text,
+// whatever the value type, without converting them to a Go value.
+//
+// This is only a convenience wrapper: the server has no base64 form of getv,
+// so the value arrives with value escaping, and is encoded as base64 here.
+func (tsc *tsClient) GetKeyValueBase64(sk StoreKey) (b64 string, keyExists, valueExists bool, err error) {
+	response, err := tsc.RawCommand("getv", tsc.keyArg(sk))
+	if err != nil {
+		return
+	}
+
+	keyExists = responseBool(response["key_exists"])
+	if keyExists {
+		var valStr string
+		valStr, valueExists = response["value"].(string)
+		if valueExists {
+			tsc.recordValueSize(tsc.keyArg(sk), valStr, false)
+			b64 = base64.StdEncoding.EncodeToString(valueUnescape(valStr))
+		}
+	}
+	return
+}
+
+// Looks up many keys, returning the current value and existence flags for
+// each, in the order of `sks`.
+//
+// The server does not have a multi-get command, and it processes one command
+// per connection at a time, so the lookups are sent back to back. The first
+// error stops the lookups.
+func (tsc *tsClient) GetKeyValues(sks []StoreKey) (results []GetKeyValueResult, err error) {
+	results = make([]GetKeyValueResult, len(sks))
+	for index, sk := range sks {
+		result := &results[index]
+		if result.Value, result.KeyExists, result.ValueExists, err = tsc.GetKeyValue(sk); err != nil {
+			results = nil
+			return
+		}
+		result.ValueIsNil = result.ValueExists && result.Value == nil
 	}
 	return
 }
@@ -419,7 +930,7 @@ func (tsc *tsClient) GetKeyValue(sk StoreKey) (value any, keyExists, valueExists
 // Looks up the key and returns the expiration time in Unix nanoseconds, or
 // nil if the key value does not exist.
 func (tsc *tsClient) GetKeyValueTtl(sk StoreKey) (ttl *time.Time, err error) {
-	response, err := tsc.RawCommand("ttlv", string(sk.Path))
+	response, err := tsc.RawCommand("ttlv", tsc.keyArg(sk))
 	if err != nil {
 		return
 	}
@@ -434,7 +945,7 @@ func (tsc *tsClient) GetKeyValueTtl(sk StoreKey) (ttl *time.Time, err error) {
 // Looks up the key and sets the expiration time in Unix nanoseconds. Specify
 // expiration as nil to clear the ttl.
 func (tsc *tsClient) SetKeyValueTtl(sk StoreKey, expiration *time.Time) (exists bool, err error) {
-	response, err := tsc.RawCommand("expirevns", string(sk.Path), requestEpochNs(expiration))
+	response, err := tsc.RawCommand("expirevns", tsc.keyArg(sk), requestEpochNs(expiration))
 	if err != nil {
 		return
 	}
@@ -443,13 +954,30 @@ func (tsc *tsClient) SetKeyValueTtl(sk StoreKey, expiration *time.Time) (exists
 	return
 }
 
+// Removes the expiration of the key's value, returning whether it had one.
+//
+// The server reports the expiration and clears it with separate commands, so
+// `hadTtl` can be stale if another client changes the expiration in between.
+func (tsc *tsClient) PersistKeyValue(sk StoreKey) (hadTtl bool, err error) {
+	ttl, err := tsc.GetKeyValueTtl(sk)
+	if err != nil {
+		return
+	}
+	if hadTtl = ttlIsSet(ttl); !hadTtl {
+		return
+	}
+
+	_, err = tsc.SetKeyValueTtl(sk, nil)
+	return
+}
+
 // Looks up the key in the index and scans history for the specified Unix ns tick,
 // returning the value at that moment in time, if one exists.
 //
 // To specify a relative time, specify `tickNs` as the negative ns from the current
 // time, e.g., -1000000000 is one second ago.
 func (tsc *tsClient) GetKeyValueAtTime(sk StoreKey, when *time.Time) (value any, exists bool, err error) {
-	response, err := tsc.RawCommand("vat", string(sk.Path), requestEpochNs(when))
+	response, err := tsc.RawCommand("vat", tsc.keyArg(sk), requestEpochNs(when))
 	if err != nil {
 		return
 	}
@@ -457,8 +985,8 @@ func (tsc *tsClient) GetKeyValueAtTime(sk StoreKey, when *time.Time) (value any,
 	var valStr string
 	valStr, exists = response["value"].(string)
 	if exists {
-		valType, _ := response["value_type"].(string)
-		if value, err = cmdlineToNativeValue(valStr, valType); err != nil {
+		valType, _ := response["type"].(string)
+		if value, err = tsc.decodeValue(tsc.keyArg(sk), valStr, valType); err != nil {
 			return
 		}
 	}
@@ -473,7 +1001,7 @@ func (tsc *tsClient) GetKeyValueAtTime(sk StoreKey, when *time.Time) (value any,
 //
 // The valueInstance key will still exist if it has children or if it is the sentinel key node.
 func (tsc *tsClient) DeleteKeyWithValue(sk StoreKey, clean bool) (removed bool, originalValue any, err error) {
-	args := []string{"delv", string(sk.Path)}
+	args := []string{"delv", tsc.keyArg(sk)}
 	if clean {
 		args = append(args, "--clean")
 	}
@@ -486,7 +1014,7 @@ func (tsc *tsClient) DeleteKeyWithValue(sk StoreKey, clean bool) (removed bool,
 	orgValStr, removed = response["original_value"].(string)
 	if removed {
 		orgValType, _ := response["original_type"].(string)
-		if originalValue, err = cmdlineToNativeValue(orgValStr, orgValType); err != nil {
+		if originalValue, err = tsc.decodeValue(tsc.keyArg(sk), orgValStr, orgValType); err != nil {
 			return
 		}
 	}
@@ -506,7 +1034,7 @@ func (tsc *tsClient) DeleteKeyWithValue(sk StoreKey, clean bool) (removed bool,
 //
 // The sentinal (root) key node cannot be deleted; only its value can be cleared.
 func (tsc *tsClient) DeleteKey(sk StoreKey) (keyRemoved, valueRemoved bool, originalValue any, err error) {
-	response, err := tsc.RawCommand("delk", string(sk.Path))
+	response, err := tsc.RawCommand("delk", tsc.keyArg(sk))
 	if err != nil {
 		return
 	}
@@ -517,7 +1045,7 @@ func (tsc *tsClient) DeleteKey(sk StoreKey) (keyRemoved, valueRemoved bool, orig
 	orgValStr, valueRemoved = response["original_value"].(string)
 	if valueRemoved {
 		orgValType, _ := response["original_type"].(string)
-		if originalValue, err = cmdlineToNativeValue(orgValStr, orgValType); err != nil {
+		if originalValue, err = tsc.decodeValue(tsc.keyArg(sk), orgValStr, orgValType); err != nil {
 			return
 		}
 	}
@@ -531,7 +1059,7 @@ func (tsc *tsClient) DeleteKey(sk StoreKey) (keyRemoved, valueRemoved bool, orig
 //
 // The sentinal (root) key node cannot be deleted; only its value can be cleared.
 func (tsc *tsClient) DeleteKeyTree(sk StoreKey) (removed bool, err error) {
-	response, err := tsc.RawCommand("deltree", string(sk.Path))
+	response, err := tsc.RawCommand("deltree", tsc.keyArg(sk))
 	if err != nil {
 		return
 	}
@@ -540,49 +1068,94 @@ func (tsc *tsClient) DeleteKeyTree(sk StoreKey) (removed bool, err error) {
 	return
 }
 
+// Deletes up to `limit` keys matching `skPattern`, along with their child
+// data, and returns the number of keys deleted.
+//
+// The server does not have a bulk delete command, so the matches are fetched
+// a page at a time and deleted individually. A match that is a child of a key
+// already deleted is removed along with its parent, and is not counted.
+func (tsc *tsClient) DeleteMatchingKeys(skPattern StoreKey, limit int) (removed int, err error) {
+	startAt := 0
+	for removed < limit {
+		var keys []*KeyMatch
+		if keys, err = tsc.GetMatchingKeys(skPattern, startAt, min(limit-removed, streamPageSize)); err != nil {
+			return
+		}
+		if len(keys) == 0 {
+			return
+		}
+
+		deleted := 0
+		for _, km := range keys {
+			var wasRemoved bool
+			if wasRemoved, err = tsc.DeleteKeyTree(MakeStoreKeyFromPath(km.Key)); err != nil {
+				return
+			}
+			if wasRemoved {
+				deleted++
+			}
+		}
+		removed += deleted
+
+		// deleted keys no longer match, so the next page starts at the same
+		// offset, unless nothing on the page could be deleted
+		if deleted == 0 {
+			startAt += len(keys)
+		}
+	}
+	return
+}
+
 // Sets a metadata attribute on a key, returning the original value (if any)
+//
+// The server takes an argument that begins with a dash for an option, so a
+// leading dash is stored as `\2D`, and the client's metadata reads turn it
+// back into a dash. Other clients of the server see the escape. The rest of
+// the value is stored as it is.
 func (tsc *tsClient) SetMetadataAttribute(sk StoreKey, attribute, value string) (keyExists bool, priorValue string, err error) {
-	response, err := tsc.RawCommand("setmeta", string(sk.Path), attribute, value)
+	response, err := tsc.RawCommand("setmeta", tsc.keyArg(sk), attribute, metadataEscape(value))
 	if err != nil {
 		return
 	}
 
 	keyExists = responseBool(response["key_exists"])
-	priorValue = response["prior_value"].(string)
+	priorValue = metadataUnescape(response["prior_value"].(string))
 	return
 }
 
 // Removes a single metadata attribute from a key
 func (tsc *tsClient) ClearMetadataAttribute(sk StoreKey, attribute string) (attributeExists bool, originalValue string, err error) {
-	response, err := tsc.RawCommand("delmeta", string(sk.Path), attribute)
+	response, err := tsc.RawCommand("delmeta", tsc.keyArg(sk), attribute)
 	if err != nil {
 		return
 	}
 
 	originalValue, attributeExists = response["original_value"].(string)
+	originalValue = metadataUnescape(originalValue)
 	return
 }
 
 // Discards all metadata on the specific key
 func (tsc *tsClient) ClearKeyMetadata(sk StoreKey) (err error) {
-	_, err = tsc.RawCommand("resetmeta", string(sk.Path))
+	_, err = tsc.RawCommand("resetmeta", tsc.keyArg(sk))
 	return
 }
 
 // Fetches a key's metadata value for a specific attribute
 func (tsc *tsClient) GetMetadataAttribute(sk StoreKey, attribute string) (attributeExists bool, value string, err error) {
-	response, err := tsc.RawCommand("getmeta", string(sk.Path), attribute)
+	response, err := tsc.RawCommand("getmeta", tsc.keyArg(sk), attribute)
 	if err != nil {
 		return
 	}
 
 	value, attributeExists = response["value"].(string)
+	value = metadataUnescape(value)
 	return
 }
 
 // Returns an array of attribute names of metadata stored for the specified key
 func (tsc *tsClient) GetMetadataAttributes(sk StoreKey) (attributes []string, err error) {
-	response, err := tsc.RawCommand("lsmeta", string(sk.Path))
+	response, err := tsc.RawCommand("lsmeta", tsc.keyArg(sk))
 	if err != nil {
 		return
 	}
@@ -606,7 +1179,7 @@ func (tsc *tsClient) KeyFromAddress(addr StoreAddress) (sk StoreKey, exists bool
 
 	tokenPath, exists := response["key"].(string)
 	if exists {
-		sk = StoreKey(treestore.MakeStoreKeyFromPath(treestore.TokenPath(tokenPath)))
+		sk = tsc.responseKey(tokenPath)
 	}
 	return
 }
@@ -620,13 +1193,13 @@ func (tsc *tsClient) KeyValueFromAddress(addr StoreAddress) (keyExists, valueExi
 
 	tokenPath, keyExists := response["key"].(string)
 	if keyExists {
-		sk = StoreKey(treestore.MakeStoreKeyFromPath(treestore.TokenPath(tokenPath)))
+		sk = tsc.responseKey(tokenPath)
 
 		var valStr string
 		valStr, valueExists = response["value"].(string)
 		if valueExists {
 			valType, _ := response["type"].(string)
-			if value, err = cmdlineToNativeValue(valStr, valType); err != nil {
+			if value, err = tsc.decodeValue(tokenPath, valStr, valType); err != nil {
 				return
 			}
 		}
@@ -634,12 +1207,56 @@ func (tsc *tsClient) KeyValueFromAddress(addr StoreAddress) (keyExists, valueExi
 	return
 }
 
+// Converts many addresses to store keys, in the order of `addrs`.
+//
+// As with GetKeyValues, the server does not have a multi-address command, so
+// the lookups are sent back to back. Each distinct address is looked up once,
+// and a zero address, which is an empty relationship slot, is not looked up.
+// The first error stops the lookups.
+func (tsc *tsClient) KeysFromAddresses(addrs []StoreAddress) (results []AddressResult, err error) {
+	return resolveAddresses(addrs, func(addr StoreAddress, result *AddressResult) (err error) {
+		result.Sk, result.KeyExists, err = tsc.KeyFromAddress(addr)
+		return
+	})
+}
+
+// Fetches the keys and current values of many addresses, in the order of
+// `addrs`, with the lookups made as for KeysFromAddresses.
+func (tsc *tsClient) KeyValuesFromAddresses(addrs []StoreAddress) (results []AddressResult, err error) {
+	return resolveAddresses(addrs, func(addr StoreAddress, result *AddressResult) (err error) {
+		result.KeyExists, result.ValueExists, result.Sk, result.Value, err = tsc.KeyValueFromAddress(addr)
+		return
+	})
+}
+
+// Resolves each distinct, non-zero address with `lookup`.
+func resolveAddresses(addrs []StoreAddress, lookup func(addr StoreAddress, result *AddressResult) error) (results []AddressResult, err error) {
+	results = make([]AddressResult, len(addrs))
+	resolved := make(map[StoreAddress]int, len(addrs))
+	for index, addr := range addrs {
+		if addr == 0 {
+			continue
+		}
+		if prior, found := resolved[addr]; found {
+			results[index] = results[prior]
+			continue
+		}
+
+		if err = lookup(addr, &results[index]); err != nil {
+			results = nil
+			return
+		}
+		resolved[addr] = index
+	}
+	return
+}
+
 // Retreives a value by following a relationship link. The target value is
 // returned in `rv`, and will be nil if the target doesn't exist. The
 // `hasLink` flag indicates true when a relationship is stored at the
 // specified `relationshipIndex`.
 func (tsc *tsClient) GetRelationshipValue(sk StoreKey, relationshipIndex int) (hasLink bool, rv *RelationshipValue, err error) {
-	response, err := tsc.RawCommand("follow", string(sk.Path), fmt.Sprintf("%d", relationshipIndex))
+	response, err := tsc.RawCommand("follow", tsc.keyArg(sk), fmt.Sprintf("%d", relationshipIndex))
 	if err != nil {
 		return
 	}
@@ -649,14 +1266,14 @@ func (tsc *tsClient) GetRelationshipValue(sk StoreKey, relationshipIndex int) (h
 	tokenPath, keyExists := response["key"].(string)
 	if keyExists {
 		rv = &RelationshipValue{}
-		rvsk := StoreKey(treestore.MakeStoreKeyFromPath(treestore.TokenPath(tokenPath)))
+		rvsk := tsc.responseKey(tokenPath)
 		rv.Sk = rvsk
 
 		valStr, valueExists := response["value"].(string)
 		if valueExists {
 			valType, _ := response["type"].(string)
 			var v any
-			if v, err = cmdlineToNativeValue(valStr, valType); err != nil {
+			if v, err = tsc.decodeValue(tokenPath, valStr, valType); err != nil {
 				return
 			}
 			rv.CurrentValue = v
@@ -672,7 +1289,7 @@ func (tsc *tsClient) GetRelationshipValue(sk StoreKey, relationshipIndex int) (h
 // Memory is allocated up front to hold `limit` keys, so be careful to pass
 // a reasonable limit.
 func (tsc *tsClient) GetLevelKeys(sk StoreKey, pattern string, startAt, limit int) (keys []LevelKey, err error) {
-	response, err := tsc.RawCommand("nodes", string(sk.Path), pattern, "--start", fmt.Sprintf("%d", startAt), "--limit", fmt.Sprintf("%d", limit), "--detailed")
+	response, err := tsc.RawCommand("nodes", tsc.keyArg(sk), pattern, "--start", fmt.Sprintf("%d", startAt), "--limit", fmt.Sprintf("%d", limit), "--detailed")
 	if err != nil {
 		return
 	}
@@ -696,10 +1313,40 @@ func (tsc *tsClient) GetLevelKeys(sk StoreKey, pattern string, startAt, limit in
 	return
 }
 
+// Returns the number of immediate children of `sk`, and whether `sk` has a
+// value, without transferring the child segments' details or the value.
+//
+// The server doesn't have a count command, so the children are counted from
+// a listing of their segments, fetched a page at a time. The value flag comes
+// from the parent's listing of `sk`. A key that doesn't exist has no children
+// and no value.
+func (tsc *tsClient) GetKeyChildrenCount(sk StoreKey) (children int, hasValue bool, err error) {
+	if children, err = tsc.countMatches("segments", "nodes", tsc.keyArg(sk), "*"); err != nil {
+		return
+	}
+
+	if len(sk.Tokens) == 0 {
+		return
+	}
+
+	// the leaf segment may contain wildcard characters, so more than the key
+	// itself can match; only the exact segment is considered
+	leaf := sk.LeafSegment()
+	parentSk := MakeStoreKeyFromTokenSegments(sk.Tokens[:len(sk.Tokens)-1]...)
+	err = tsc.GetLevelKeysStream(parentSk, string(leaf), func(lk LevelKey) bool {
+		if string(lk.Segment) == string(leaf) {
+			hasValue = lk.HasValue
+			return false
+		}
+		return true
+	})
+	return
+}
+
 // Full iteration function walks each tree store level according to skPattern and returns every
 // detail of matching keys.
 func (tsc *tsClient) GetMatchingKeys(skPattern StoreKey, startAt, limit int) (keys []*KeyMatch, err error) {
-	response, err := tsc.RawCommand("lsk", string(skPattern.Path), "--start", fmt.Sprintf("%d", startAt), "--limit", fmt.Sprintf("%d", limit), "--detailed")
+	response, err := tsc.RawCommand("lsk", tsc.keyArg(skPattern), "--start", fmt.Sprintf("%d", startAt), "--limit", fmt.Sprintf("%d", limit), "--detailed")
 	if err != nil {
 		return
 	}
@@ -718,9 +1365,9 @@ func (tsc *tsClient) GetMatchingKeys(skPattern StoreKey, startAt, limit int) (ke
 		rawRelationships, relExists := key["relationships"].([]any)
 		var relationships []StoreAddress
 		if relExists {
-			relationships = make([]StoreAddress, len(rawRelationships))
+			relationships = make([]StoreAddress, 0, len(rawRelationships))
 			for _, rel := range rawRelationships {
-				relationships = append(relationships, rel.(StoreAddress))
+				relationships = append(relationships, responseAddress(rel))
 			}
 		}
 
@@ -729,12 +1376,12 @@ func (tsc *tsClient) GetMatchingKeys(skPattern StoreKey, startAt, limit int) (ke
 		if mdExists {
 			metadata = make(map[string]string, len(rawMetadata))
 			for k, v := range rawMetadata {
-				metadata[k] = v.(string)
+				metadata[k] = metadataUnescape(v.(string))
 			}
 		}
 
 		km := &KeyMatch{
-			Key:           TokenPath(tokenPath),
+			Key:           tsc.responseKey(tokenPath).Path,
 			Metadata:      metadata,
 			HasValue:      hasValue,
 			HasChildren:   hasChildren,
@@ -742,7 +1389,7 @@ func (tsc *tsClient) GetMatchingKeys(skPattern StoreKey, startAt, limit int) (ke
 		}
 		if vsExists {
 			var v any
-			if v, err = cmdlineToNativeValue(valStr, valType); err != nil {
+			if v, err = tsc.decodeValue(tokenPath, valStr, valType); err != nil {
 				return
 			}
 			km.CurrentValue = v
@@ -756,7 +1403,7 @@ func (tsc *tsClient) GetMatchingKeys(skPattern StoreKey, startAt, limit int) (ke
 // Full iteration function walks each tree store level according to skPattern and returns every
 // detail of matching keys that have values.
 func (tsc *tsClient) GetMatchingKeyValues(skPattern StoreKey, startAt, limit int) (values []*KeyValueMatch, err error) {
-	response, err := tsc.RawCommand("lsv", string(skPattern.Path), "--start", fmt.Sprintf("%d", startAt), "--limit", fmt.Sprintf("%d", limit), "--detailed")
+	response, err := tsc.RawCommand("lsv", tsc.keyArg(skPattern), "--start", fmt.Sprintf("%d", startAt), "--limit", fmt.Sprintf("%d", limit), "--detailed")
 	if err != nil {
 		return
 	}
@@ -774,9 +1421,9 @@ func (tsc *tsClient) GetMatchingKeyValues(skPattern StoreKey, startAt, limit int
 		rawRelationships, relExists := value["relationships"].([]any)
 		var relationships []StoreAddress
 		if relExists {
-			relationships = make([]StoreAddress, len(rawRelationships))
+			relationships = make([]StoreAddress, 0, len(rawRelationships))
 			for _, rel := range rawRelationships {
-				relationships = append(relationships, rel.(StoreAddress))
+				relationships = append(relationships, responseAddress(rel))
 			}
 		}
 
@@ -785,19 +1432,19 @@ func (tsc *tsClient) GetMatchingKeyValues(skPattern StoreKey, startAt, limit int
 		if mdExists {
 			metadata = make(map[string]string, len(rawMetadata))
 			for k, v := range rawMetadata {
-				metadata[k] = v.(string)
+				metadata[k] = metadataUnescape(v.(string))
 			}
 		}
 
 		kvm := &KeyValueMatch{
-			Key:           TokenPath(tokenPath),
+			Key:           tsc.responseKey(tokenPath).Path,
 			Metadata:      metadata,
 			HasChildren:   hasChildren,
 			Relationships: relationships,
 		}
 		if vsExists {
 			var v any
-			if v, err = cmdlineToNativeValue(valStr, valType); err != nil {
+			if v, err = tsc.decodeValue(tokenPath, valStr, valType); err != nil {
 				return
 			}
 			kvm.CurrentValue = v
@@ -808,12 +1455,55 @@ func (tsc *tsClient) GetMatchingKeyValues(skPattern StoreKey, startAt, limit int
 	return
 }
 
+// Counts the keys matching `skPattern`. When `countValues` is true, the keys
+// that have values are counted too, otherwise `withValues` is 0.
+//
+// Only key paths are transferred to count the keys. The server doesn't have a
+// count-only listing of values, so counting values also transfers them.
+func (tsc *tsClient) CountMatchingKeys(skPattern StoreKey, countValues bool) (keys, withValues int, err error) {
+	if keys, err = tsc.countMatches("keypaths", "lsk", tsc.keyArg(skPattern)); err != nil {
+		return
+	}
+	if countValues {
+		withValues, err = tsc.countMatches("key_values", "lsv", tsc.keyArg(skPattern))
+	}
+	return
+}
+
+// Pages through a non-detailed listing command, counting the entries of the
+// response `field`.
+func (tsc *tsClient) countMatches(field string, args ...string) (count int, err error) {
+	pageSize := streamPageSize * 10
+	for {
+		pageArgs := append(args[:len(args):len(args)], "--start", fmt.Sprintf("%d", count), "--limit", fmt.Sprintf("%d", pageSize))
+
+		var response map[string]any
+		response, err = tsc.RawCommand(pageArgs...)
+		if err != nil {
+			return
+		}
+
+		var n int
+		switch matches := response[field].(type) {
+		case []any:
+			n = len(matches)
+		case map[string]any:
+			n = len(matches)
+		}
+
+		count += n
+		if n < pageSize {
+			return
+		}
+	}
+}
+
 // Serialize the tree store into a single JSON doc.
 //
 // N.B., The document is constructed entirely in memory and will hold an
 // exclusive lock during the operation.
 func (tsc *tsClient) Export(sk StoreKey) (jsonData any, err error) {
-	response, err := tsc.RawCommand("export", string(sk.Path))
+	response, err := tsc.RawCommand("export", tsc.keyArg(sk))
 	if err != nil {
 		return
 	}
@@ -829,7 +1519,7 @@ func (tsc *tsClient) Export(sk StoreKey) (jsonData any, err error) {
 //
 // This variant provides the export data in a base64 encoded string.
 func (tsc *tsClient) ExportBase64(sk StoreKey) (b64 string, err error) {
-	response, err := tsc.RawCommand("export", string(sk.Path), "--base64")
+	response, err := tsc.RawCommand("export", tsc.keyArg(sk), "--base64")
 	if err != nil {
 		return
 	}
@@ -838,6 +1528,16 @@ func (tsc *tsClient) ExportBase64(sk StoreKey) (b64 string, err error) {
 	return
 }
 
+// Returns the command arguments carrying a marshalled json payload. Large
+// payloads, and those with backslashes the server would take as escapes, are
+// sent base64 encoded, so callers don't need to pick the *Base64 variants.
+func (tsc *tsClient) jsonPayloadArgs(marshalled []byte) []string {
+	if len(marshalled) > tsc.base64Above || bytes.IndexByte(marshalled, '\\') >= 0 {
+		return []string{base64.StdEncoding.EncodeToString(marshalled), "--base64"}
+	}
+	return []string{string(marshalled)}
+}
+
 // Creates a key from an export format json doc and adds it to the tree store
 // at the specified sk. If the key exists, it and its children will be replaced.
 func (tsc *tsClient) Import(sk StoreKey, jsonData any) (err error) {
@@ -846,7 +1546,7 @@ func (tsc *tsClient) Import(sk StoreKey, jsonData any) (err error) {
 		return
 	}
 
-	_, err = tsc.RawCommand("import", string(sk.Path), string(marshalled))
+	_, err = tsc.RawCommand(append([]string{"import", tsc.keyArg(sk)}, tsc.jsonPayloadArgs(marshalled)...)...)
 	if err != nil {
 		return
 	}
@@ -858,7 +1558,7 @@ func (tsc *tsClient) Import(sk StoreKey, jsonData any) (err error) {
 //
 // This variant accepts the import data in a base64 encoded string.
 func (tsc *tsClient) ImportBase64(sk StoreKey, b64 string) (err error) {
-	_, err = tsc.RawCommand("import", string(sk.Path), b64, "--base64")
+	_, err = tsc.RawCommand("import", tsc.keyArg(sk), b64, "--base64")
 	if err != nil {
 		return
 	}
@@ -869,7 +1569,19 @@ func (tsc *tsClient) ImportBase64(sk StoreKey, b64 string) (err error) {
 // metadata "array" is "true" then the child key nodes are treated as
 // array indicies. (They must be big endian uint32.)
 func (tsc *tsClient) GetKeyAsJson(sk StoreKey, opt JsonOptions) (jsonData any, err error) {
-	args := []string{"getjson", string(sk.Path)}
+	if (opt & jsonProjectionOptions) != 0 {
+		if jsonData, err = tsc.GetKeyAsJson(sk, opt&^jsonProjectionOptions); err != nil {
+			return
+		}
+		jsonData = projectJson(jsonData, opt)
+		return
+	}
+
+	if cache, _ := tsc.getJsonCache(); cache != nil {
+		return tsc.getKeyAsJsonCached(sk, opt)
+	}
+
+	args := []string{"getjson", tsc.keyArg(sk)}
 	if (opt & JsonStringValuesAsKeys) != 0 {
 		args = append(args, "--straskey")
 	}
@@ -890,7 +1602,23 @@ func (tsc *tsClient) GetKeyAsJson(sk StoreKey, opt JsonOptions) (jsonData any, e
 // This variant provides the data in raw bytes, typically for an
 // application to call json.Unmarshal on its own struct type.
 func (tsc *tsClient) GetKeyAsJsonBytes(sk StoreKey, opt JsonOptions) (bytes []byte, err error) {
-	args := []string{"getjson", string(sk.Path), "--base64"}
+	if (opt & jsonProjectionOptions) != 0 {
+		if bytes, err = tsc.GetKeyAsJsonBytes(sk, opt&^jsonProjectionOptions); err != nil {
+			return
+		}
+		return convertJsonArrays(bytes, func(data any) any { return projectJson(data, opt) })
+	}
+
+	if cache, _ := tsc.getJsonCache(); cache != nil {
+		var cached []byte
+		if cached, err = tsc.getKeyJsonCached(sk, opt); err != nil {
+			return
+		}
+		bytes = append([]byte(nil), cached...)
+		return
+	}
+
+	args := []string{"getjson", tsc.keyArg(sk), "--base64"}
 	if (opt & JsonStringValuesAsKeys) != 0 {
 		args = append(args, "--straskey")
 	}
@@ -916,7 +1644,16 @@ func (tsc *tsClient) GetKeyAsJsonBytes(sk StoreKey, opt JsonOptions) (bytes []by
 //
 // This variant provides the json data in a base64 encoded string.
 func (tsc *tsClient) GetKeyAsJsonBase64(sk StoreKey, opt JsonOptions) (b64 string, err error) {
-	args := []string{"getjson", string(sk.Path), "--base64"}
+	if cache, _ := tsc.getJsonCache(); cache != nil {
+		var cached []byte
+		if cached, err = tsc.getKeyJsonCached(sk, opt); err != nil {
+			return
+		}
+		b64 = base64.StdEncoding.EncodeToString(cached)
+		return
+	}
+
+	args := []string{"getjson", tsc.keyArg(sk), "--base64"}
 	if (opt & JsonStringValuesAsKeys) != 0 {
 		args = append(args, "--straskey")
 	}
@@ -933,13 +1670,34 @@ func (tsc *tsClient) GetKeyAsJsonBase64(sk StoreKey, opt JsonOptions) (b64 strin
 // Takes the generalized json data and stores it at the specified key path.
 // If the sk exists, its value, children and history are deleted, and the new
 // json data takes its place.
+//
+// The data is marshalled with encoding/json, so a struct can be passed
+// directly, and its `json:"..."` field tags, omitempty and MarshalJSON
+// implementations are honored. The same goes for CreateKeyJson,
+// ReplaceKeyJson and MergeKeyJson.
 func (tsc *tsClient) SetKeyJson(sk StoreKey, jsonData any, opt JsonOptions) (replaced bool, address StoreAddress, err error) {
 	marshalled, err := json.Marshal(jsonData)
 	if err != nil {
 		return
 	}
 
-	args := []string{"setjson", string(sk.Path), string(marshalled)}
+	return tsc.SetKeyJsonBytes(sk, marshalled, opt)
+}
+
+// Takes the generalized json data and stores it at the specified key path.
+// If the sk exists, its value, children and history are deleted, and the new
+// json data takes its place.
+//
+// This variant accepts json data that is already marshalled, and sends it
+// without encoding it again.
+func (tsc *tsClient) SetKeyJsonBytes(sk StoreKey, marshalled []byte, opt JsonOptions) (replaced bool, address StoreAddress, err error) {
+	if (opt & JsonNumericSegmentsAsArrays) != 0 {
+		if marshalled, err = convertJsonArrays(marshalled, arraysToNumericObjects); err != nil {
+			return
+		}
+	}
+
+	args := append([]string{"setjson", tsc.keyArg(sk)}, tsc.jsonPayloadArgs(marshalled)...)
 	if (opt & JsonStringValuesAsKeys) != 0 {
 		args = append(args, "--straskey")
 	}
@@ -963,7 +1721,7 @@ func (tsc *tsClient) SetKeyJson(sk StoreKey, jsonData any, opt JsonOptions) (rep
 //
 // This variant accepts the json data in a base64 encoded string.
 func (tsc *tsClient) SetKeyJsonBase64(sk StoreKey, b64 string, opt JsonOptions) (replaced bool, address StoreAddress, err error) {
-	args := []string{"setjson", string(sk.Path), b64, "--base64"}
+	args := []string{"setjson", tsc.keyArg(sk), b64, "--base64"}
 	if (opt & JsonStringValuesAsKeys) != 0 {
 		args = append(args, "--straskey")
 	}
@@ -988,13 +1746,16 @@ func (tsc *tsClient) SetKeyJsonBase64(sk StoreKey, b64 string, opt JsonOptions)
 //
 // The caller provides a staging key, and the json data is stored under a subkey
 // with a unique identifier.
+//
+// Specify JsonStageCleanupOnClose to have the temporary key deleted when the
+// client is closed, if it still exists.
 func (tsc *tsClient) StageKeyJson(stagingSk StoreKey, jsonData any, opts JsonOptions) (tempSk StoreKey, address StoreAddress, err error) {
 	marshalled, err := json.Marshal(jsonData)
 	if err != nil {
 		return
 	}
 
-	args := []string{"stagejson", string(stagingSk.Path), string(marshalled)}
+	args := append([]string{"stagejson", tsc.keyArg(stagingSk)}, tsc.jsonPayloadArgs(marshalled)...)
 	if (opts & JsonStringValuesAsKeys) != 0 {
 		args = append(args, "--straskey")
 	}
@@ -1004,11 +1765,16 @@ func (tsc *tsClient) StageKeyJson(stagingSk StoreKey, jsonData any, opts JsonOpt
 		return
 	}
 
-	tempSk = MakeStoreKeyFromPath(TokenPath(response["tempkey"].(string)))
+	tempKey, _ := response["tempkey"].(string)
+	tempSk = tsc.responseKey(tempKey)
 	addrStr, exists := response["address"].(float64)
 	if exists {
 		address = responseAddress(addrStr)
 	}
+
+	if (opts & JsonStageCleanupOnClose) != 0 {
+		tsc.registerStaged(MakeStoreKeyFromPath(TokenPath(tempKey)))
+	}
 	return
 }
 
@@ -1022,7 +1788,7 @@ func (tsc *tsClient) StageKeyJson(stagingSk StoreKey, jsonData any, opts JsonOpt
 //
 // This variant accepts the json data in a base64 encoded string.
 func (tsc *tsClient) StageKeyJsonBase64(stagingSk StoreKey, b64 string, opts JsonOptions) (tempSk StoreKey, address StoreAddress, err error) {
-	args := []string{"stagejson", string(stagingSk.Path), b64, "--base64"}
+	args := []string{"stagejson", tsc.keyArg(stagingSk), b64, "--base64"}
 	if (opts & JsonStringValuesAsKeys) != 0 {
 		args = append(args, "--straskey")
 	}
@@ -1032,11 +1798,16 @@ func (tsc *tsClient) StageKeyJsonBase64(stagingSk StoreKey, b64 string, opts Jso
 		return
 	}
 
-	tempSk = MakeStoreKeyFromPath(TokenPath(response["tempkey"].(string)))
+	tempKey, _ := response["tempkey"].(string)
+	tempSk = tsc.responseKey(tempKey)
 	addrStr, exists := response["address"].(float64)
 	if exists {
 		address = responseAddress(addrStr)
 	}
+
+	if (opts & JsonStageCleanupOnClose) != 0 {
+		tsc.registerStaged(MakeStoreKeyFromPath(TokenPath(tempKey)))
+	}
 	return
 }
 
@@ -1049,7 +1820,23 @@ func (tsc *tsClient) CreateKeyJson(sk StoreKey, jsonData any, opt JsonOptions) (
 		return
 	}
 
-	args := []string{"createjson", string(sk.Path), string(marshalled)}
+	return tsc.CreateKeyJsonBytes(sk, marshalled, opt)
+}
+
+// Takes the generalized json data and stores it at the specified key path.
+// If the sk exists, no changes are made. Otherwise a new key node is created
+// with its child data set according to the json structure.
+//
+// This variant accepts json data that is already marshalled, and sends it
+// without encoding it again.
+func (tsc *tsClient) CreateKeyJsonBytes(sk StoreKey, marshalled []byte, opt JsonOptions) (created bool, address StoreAddress, err error) {
+	if (opt & JsonNumericSegmentsAsArrays) != 0 {
+		if marshalled, err = convertJsonArrays(marshalled, arraysToNumericObjects); err != nil {
+			return
+		}
+	}
+
+	args := append([]string{"createjson", tsc.keyArg(sk)}, tsc.jsonPayloadArgs(marshalled)...)
 	if (opt & JsonStringValuesAsKeys) != 0 {
 		args = append(args, "--straskey")
 	}
@@ -1073,7 +1860,7 @@ func (tsc *tsClient) CreateKeyJson(sk StoreKey, jsonData any, opt JsonOptions) (
 //
 // This variant accepts the json data in a base64 encoded string.
 func (tsc *tsClient) CreateKeyJsonBase64(sk StoreKey, b64 string, opt JsonOptions) (created bool, address StoreAddress, err error) {
-	args := []string{"createjson", string(sk.Path), b64, "--base64"}
+	args := []string{"createjson", tsc.keyArg(sk), b64, "--base64"}
 	if (opt & JsonStringValuesAsKeys) != 0 {
 		args = append(args, "--straskey")
 	}
@@ -1100,7 +1887,23 @@ func (tsc *tsClient) ReplaceKeyJson(sk StoreKey, jsonData any, opt JsonOptions)
 		return
 	}
 
-	args := []string{"replacejson", string(sk.Path), string(marshalled)}
+	return tsc.ReplaceKeyJsonBytes(sk, marshalled, opt)
+}
+
+// Takes the generalized json data and stores it at the specified key path.
+// If the sk doesn't exists, no changes are made. Otherwise the key node's
+// value and children are deleted, and the new json data takes its place.
+//
+// This variant accepts json data that is already marshalled, and sends it
+// without encoding it again.
+func (tsc *tsClient) ReplaceKeyJsonBytes(sk StoreKey, marshalled []byte, opt JsonOptions) (replaced bool, address StoreAddress, err error) {
+	if (opt & JsonNumericSegmentsAsArrays) != 0 {
+		if marshalled, err = convertJsonArrays(marshalled, arraysToNumericObjects); err != nil {
+			return
+		}
+	}
+
+	args := append([]string{"replacejson", tsc.keyArg(sk)}, tsc.jsonPayloadArgs(marshalled)...)
 	if (opt & JsonStringValuesAsKeys) != 0 {
 		args = append(args, "--straskey")
 	}
@@ -1124,7 +1927,7 @@ func (tsc *tsClient) ReplaceKeyJson(sk StoreKey, jsonData any, opt JsonOptions)
 //
 // This variant accepts the json data in a base64 encoded string.
 func (tsc *tsClient) ReplaceKeyJsonBase64(sk StoreKey, b64 string, opt JsonOptions) (replaced bool, address StoreAddress, err error) {
-	args := []string{"replacejson", string(sk.Path), b64, "--base64"}
+	args := []string{"replacejson", tsc.keyArg(sk), b64, "--base64"}
 	if (opt & JsonStringValuesAsKeys) != 0 {
 		args = append(args, "--straskey")
 	}
@@ -1145,13 +1948,36 @@ func (tsc *tsClient) ReplaceKeyJsonBase64(sk StoreKey, b64 string, opt JsonOptio
 // Overlays json data on top of existing data. This is one of the slower APIs
 // because each part of json is independently written to the store, and a
 // write lock is required across the whole operation.
+//
+// Arrays are appended to existing arrays, unless JsonMergeArraysReplace or
+// JsonMergeArraysByIndex is specified (see mergeKeyJsonArrays).
 func (tsc *tsClient) MergeKeyJson(sk StoreKey, jsonData any, opt JsonOptions) (address StoreAddress, err error) {
 	marshalled, err := json.Marshal(jsonData)
 	if err != nil {
 		return
 	}
 
-	args := []string{"mergejson", string(sk.Path), string(marshalled)}
+	return tsc.MergeKeyJsonBytes(sk, marshalled, opt)
+}
+
+// Overlays json data on top of existing data. This is one of the slower APIs
+// because each part of json is independently written to the store, and a
+// write lock is required across the whole operation.
+//
+// This variant accepts json data that is already marshalled, and sends it
+// without encoding it again.
+func (tsc *tsClient) MergeKeyJsonBytes(sk StoreKey, marshalled []byte, opt JsonOptions) (address StoreAddress, err error) {
+	if (opt & JsonNumericSegmentsAsArrays) != 0 {
+		if marshalled, err = convertJsonArrays(marshalled, arraysToNumericObjects); err != nil {
+			return
+		}
+	}
+
+	if (opt & (JsonMergeArraysReplace | JsonMergeArraysByIndex)) != 0 {
+		return tsc.mergeKeyJsonArrays(sk, marshalled, opt)
+	}
+
+	args := append([]string{"mergejson", tsc.keyArg(sk)}, tsc.jsonPayloadArgs(marshalled)...)
 	if (opt & JsonStringValuesAsKeys) != 0 {
 		args = append(args, "--straskey")
 	}
@@ -1174,7 +2000,15 @@ func (tsc *tsClient) MergeKeyJson(sk StoreKey, jsonData any, opt JsonOptions) (a
 //
 // This variant accepts the json data in a base64 encoded string.
 func (tsc *tsClient) MergeKeyJsonBase64(sk StoreKey, b64 string, opt JsonOptions) (address StoreAddress, err error) {
-	args := []string{"mergejson", string(sk.Path), b64, "--base64"}
+	if (opt & (JsonMergeArraysReplace | JsonMergeArraysByIndex)) != 0 {
+		var marshalled []byte
+		if marshalled, err = base64.StdEncoding.DecodeString(b64); err != nil {
+			return
+		}
+		return tsc.mergeKeyJsonArrays(sk, marshalled, opt)
+	}
+
+	args := []string{"mergejson", tsc.keyArg(sk), b64, "--base64"}
 	if (opt & JsonStringValuesAsKeys) != 0 {
 		args = append(args, "--straskey")
 	}
@@ -1191,6 +2025,16 @@ func (tsc *tsClient) MergeKeyJsonBase64(sk StoreKey, b64 string, opt JsonOptions
 	return
 }
 
+// Stores json data at the specified key path, creating the key if it doesn't
+// exist, or overlaying the data on the existing key if it does.
+//
+// The server's merge creates a missing key within the same locked operation,
+// so a single mergejson command does the upsert, and no other writer can
+// create the key between a failed create and a merge.
+func (tsc *tsClient) UpsertKeyJson(sk StoreKey, jsonData any, opt JsonOptions) (address StoreAddress, err error) {
+	return tsc.MergeKeyJson(sk, jsonData, opt)
+}
+
 // Evaluate a math expression and store the result.
 //
 // The expression operators include + - / * & | ^ ** % >> <<,
@@ -1233,7 +2077,7 @@ func (tsc *tsClient) MergeKeyJsonBase64(sk StoreKey, b64 string, opt JsonOptions
 //
 //	"i>100?i+1:fail()"        no modifications if the sk value is < 100
 func (tsc *tsClient) CalculateKeyValue(sk StoreKey, expression string) (address StoreAddress, newValue any, err error) {
-	response, err := tsc.RawCommand("calc", string(sk.Path), expression)
+	response, err := tsc.RawCommand("calc", tsc.keyArg(sk), expression)
 	if err != nil {
 		return
 	}
@@ -1254,7 +2098,7 @@ func (tsc *tsClient) CalculateKeyValue(sk StoreKey, expression string) (address
 
 // Moves a key tree to a new location, optionally overwriting an existing tree.
 func (tsc *tsClient) MoveKey(srcSk StoreKey, destSk StoreKey, overwrite bool) (exists, moved bool, err error) {
-	args := []string{"mv", string(srcSk.Path), string(destSk.Path)}
+	args := []string{"mv", tsc.keyArg(srcSk), tsc.keyArg(destSk)}
 	if overwrite {
 		args = append(args, "--overwrite")
 	}
@@ -1302,7 +2146,7 @@ func (tsc *tsClient) MoveKey(srcSk StoreKey, destSk StoreKey, overwrite bool) (e
 // delete by making source and destination the same and specifying an already
 // expired ttl.
 func (tsc *tsClient) MoveReferencedKey(srcSk StoreKey, destSk StoreKey, overwrite bool, ttl *time.Time, refs []StoreKey, unrefs []StoreKey) (exists, moved bool, err error) {
-	args := []string{"mvref", string(srcSk.Path), string(destSk.Path)}
+	args := []string{"mvref", tsc.keyArg(srcSk), tsc.keyArg(destSk)}
 	if overwrite {
 		args = append(args, "--overwrite")
 	}
@@ -1319,10 +2163,10 @@ func (tsc *tsClient) MoveReferencedKey(srcSk StoreKey, destSk StoreKey, overwrit
 		args = append(args, "--ns", fmt.Sprintf("%d", ns))
 	}
 	for _, ref := range refs {
-		args = append(args, "--ref", string(ref.Path))
+		args = append(args, "--ref", tsc.keyArg(ref))
 	}
 	for _, unref := range unrefs {
-		args = append(args, "--unref", string(unref.Path))
+		args = append(args, "--unref", tsc.keyArg(unref))
 	}
 
 	response, err := tsc.RawCommand(args...)
@@ -1383,7 +2227,7 @@ func (tsc *tsClient) Purge() (err error) {
 // include the record ID at the tail of the field subpath, to avoid overlapping
 // auto-link keys (which results in loss of links).
 func (tsc *tsClient) DefineAutoLinkKey(dataParentSk, autoLinkSk StoreKey, fields []SubPath) (recordKeyExists, autoLinkCreated bool, err error) {
-	args := []string{"autolink", string(dataParentSk.Path), string(autoLinkSk.Path)}
+	args := []string{"autolink", tsc.keyArg(dataParentSk), tsc.keyArg(autoLinkSk)}
 	for _, field := range fields {
 		args = append(args, "--field", string(treestore.EscapeSubPath(field)))
 	}
@@ -1405,7 +2249,7 @@ func (tsc *tsClient) DefineAutoLinkKey(dataParentSk, autoLinkSk StoreKey, fields
 // An exclusive lock is held during the removal of the auto-link definition. If the
 // number of links are high, the operation may take some time to delete.
 func (tsc *tsClient) RemoveAutoLinkKey(dataParentSk, autoLinkSk StoreKey) (recordKeyExists, autoLinkRemoved bool, err error) {
-	response, err := tsc.RawCommand("rmautolink", string(dataParentSk.Path), string(autoLinkSk.Path))
+	response, err := tsc.RawCommand("rmautolink", tsc.keyArg(dataParentSk), tsc.keyArg(autoLinkSk))
 	if err != nil {
 		return
 	}
@@ -1417,7 +2261,7 @@ func (tsc *tsClient) RemoveAutoLinkKey(dataParentSk, autoLinkSk StoreKey) (recor
 
 // Returns all auto-link definitions defined for the specified data key, or nil if none.
 func (tsc *tsClient) GetAutoLinkDefinition(dataParentSk StoreKey) (alds []AutoLinkDefinition, err error) {
-	response, err := tsc.RawCommand("getautolink", string(dataParentSk.Path))
+	response, err := tsc.RawCommand("getautolink", tsc.keyArg(dataParentSk))
 	if err != nil {
 		return
 	}
@@ -1434,7 +2278,7 @@ func (tsc *tsClient) GetAutoLinkDefinition(dataParentSk StoreKey) (alds []AutoLi
 			fieldPaths, _ := m["field_paths"].([]any)
 			if fieldPaths != nil {
 				def := AutoLinkDefinition{
-					AutoLinkSk: MakeStoreKeyFromPath(treestore.TokenPath(autoLinkKey)),
+					AutoLinkSk: tsc.responseKey(autoLinkKey),
 					Fields:     make([]treestore.SubPath, 0, len(fieldPaths)),
 				}
 				for _, fp := range fieldPaths {
@@ -0,0 +1,308 @@
+package treestore_client
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+type (
+	// A client that maintains secondary indexes of the values of the children
+	// of indexed parent keys. It wraps a TSClient, and offers only the writes
+	// that keep the indexes up to date: SetKeyValue, SetKeyValueEx, DeleteKey
+	// and DeleteKeyTree. Writes made any other way, including through the
+	// wrapped client, aren't indexed.
+	IndexedClient struct {
+		tsc     TSClient
+		mu      sync.Mutex
+		indexes map[string]*clientIndex
+	}
+
+	// Extracts the index terms of a value. A nil value is passed for a key
+	// that has no value.
+	IndexExtractor func(value any) []string
+
+	// A record found by QueryIndex.
+	IndexMatch struct {
+		Sk    StoreKey
+		Value any
+	}
+
+	clientIndex struct {
+		parentSk  StoreKey
+		extractor IndexExtractor
+	}
+)
+
+// The key under which IndexedClient stores its index entries. The entries of
+// an index are stored as <IndexesSk>/<name>/terms/<term>/<record id>, along
+// with <IndexesSk>/<name>/records/<record id>/<term> to find the terms of a
+// record when it changes.
+var IndexesSk = MakeStoreKey("treestore-client", "indexes")
+
+// Wraps `tsc` in a client that maintains secondary indexes.
+func NewIndexedClient(tsc TSClient) *IndexedClient {
+	return &IndexedClient{tsc: tsc, indexes: map[string]*clientIndex{}}
+}
+
+// Defines the index `name` over the children of `parentSk`: the value of each
+// child is passed to `extractor`, and the child can be found by QueryIndex
+// with any of the terms returned. The existing children are indexed now,
+// replacing any entries left by an earlier definition of `name`.
+//
+// The definition is held by this client only; define the index again when a
+// new client is made, and make every write to the indexed keys with the write
+// methods of an IndexedClient that has the index. Other writes, such as
+// SetKeyValuesBestEffort, SetKeyJson or MoveKey on the wrapped client, leave
+// the index stale until the index is defined again.
+func (ic *IndexedClient) DefineIndex(name string, parentSk StoreKey, extractor IndexExtractor) (err error) {
+	if name == "" || extractor == nil {
+		err = fmt.Errorf("an index needs a name and an extractor")
+		return
+	}
+
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+
+	idx := &clientIndex{parentSk: parentSk, extractor: extractor}
+	if _, err = ic.tsc.DeleteKeyTree(indexSk(name)); err != nil {
+		return
+	}
+
+	var children []StoreKey
+	err = ic.tsc.GetLevelKeysStream(parentSk, "*", func(lk LevelKey) bool {
+		children = append(children, AppendStoreKeySegments(MakeStoreKeyFromPath(parentSk.Path), lk.Segment))
+		return true
+	})
+	if err != nil {
+		return
+	}
+
+	results, err := ic.tsc.GetKeyValues(children)
+	if err != nil {
+		return
+	}
+	for n, child := range children {
+		if err = ic.reindex(name, idx, child, results[n].Value, true); err != nil {
+			return
+		}
+	}
+
+	ic.indexes[name] = idx
+	return
+}
+
+// Removes the index `name` and its entries.
+func (ic *IndexedClient) DropIndex(name string) (err error) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+
+	delete(ic.indexes, name)
+	_, err = ic.tsc.DeleteKeyTree(indexSk(name))
+	return
+}
+
+// Finds the records of the index `name` that have the term `term`, in key
+// order, with their current values.
+func (ic *IndexedClient) QueryIndex(name, term string) (matches []IndexMatch, err error) {
+	ic.mu.Lock()
+	idx := ic.indexes[name]
+	ic.mu.Unlock()
+	if idx == nil {
+		err = fmt.Errorf("index %s is not defined", name)
+		return
+	}
+
+	var sks []StoreKey
+	termSk := AppendStoreKeySegmentStrings(indexSk(name), "terms", term)
+	err = ic.tsc.GetLevelKeysStream(termSk, "*", func(lk LevelKey) bool {
+		sks = append(sks, AppendStoreKeySegments(MakeStoreKeyFromPath(idx.parentSk.Path), lk.Segment))
+		return true
+	})
+	if err != nil {
+		return
+	}
+
+	results, err := ic.tsc.GetKeyValues(sks)
+	if err != nil {
+		return
+	}
+
+	matches = []IndexMatch{}
+	for n, sk := range sks {
+		if results[n].KeyExists {
+			matches = append(matches, IndexMatch{Sk: sk, Value: results[n].Value})
+		}
+	}
+	return
+}
+
+// Sets the value of `sk`, and updates the index entries of `sk` if it is a
+// child of an indexed key.
+func (ic *IndexedClient) SetKeyValue(sk StoreKey, value any) (address StoreAddress, firstValue bool, err error) {
+	if address, firstValue, err = ic.tsc.SetKeyValue(sk, value); err != nil {
+		return
+	}
+	err = ic.reindexKey(sk, value, true)
+	return
+}
+
+// Calls SetKeyValueEx, and updates the index entries of `sk` if it is a child
+// of an indexed key and its value was set.
+func (ic *IndexedClient) SetKeyValueEx(sk StoreKey, value any, flags SetExFlags, expire *time.Time, relationships []StoreAddress) (address StoreAddress, exists bool, originalValue any, err error) {
+	if address, exists, originalValue, err = ic.tsc.SetKeyValueEx(sk, value, flags, expire, relationships); err != nil {
+		return
+	}
+
+	if (flags&SetExNoValueUpdate) != 0 || ((flags&SetExMustExist) != 0 && !exists) || ((flags&SetExMustNotExist) != 0 && exists) {
+		return
+	}
+	err = ic.reindexKey(sk, value, true)
+	return
+}
+
+// Deletes the key, and removes its index entries if it is a child of an
+// indexed key.
+func (ic *IndexedClient) DeleteKey(sk StoreKey) (keyRemoved, valueRemoved bool, originalValue any, err error) {
+	if keyRemoved, valueRemoved, originalValue, err = ic.tsc.DeleteKey(sk); err != nil {
+		return
+	}
+
+	if keyRemoved {
+		err = ic.reindexKey(sk, nil, false)
+	} else if valueRemoved {
+		err = ic.reindexKey(sk, nil, true)
+	}
+	return
+}
+
+// Deletes a key and all of its child data, removing the index entries of the
+// deleted records, or all of the entries of an index whose parent key is
+// deleted.
+func (ic *IndexedClient) DeleteKeyTree(sk StoreKey) (removed bool, err error) {
+	if removed, err = ic.tsc.DeleteKeyTree(sk); err != nil || !removed {
+		return
+	}
+
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+
+	for name, idx := range ic.indexes {
+		if isSameOrDescendant(idx.parentSk.Path, sk.Path) {
+			if _, err = ic.tsc.DeleteKeyTree(indexSk(name)); err != nil {
+				return
+			}
+		} else if isChildKey(idx.parentSk, sk) {
+			if err = ic.reindex(name, idx, sk, nil, false); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// Updates the entries of every index that `sk` is a record of.
+func (ic *IndexedClient) reindexKey(sk StoreKey, value any, exists bool) (err error) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+
+	for name, idx := range ic.indexes {
+		if isChildKey(idx.parentSk, sk) {
+			if err = ic.reindex(name, idx, sk, value, exists); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// Replaces the entries of the record `sk` in the index `name` with the terms
+// of `value`, or removes them if the record no longer exists.
+func (ic *IndexedClient) reindex(name string, idx *clientIndex, sk StoreKey, value any, exists bool) (err error) {
+	id := sk.Tokens[len(sk.Tokens)-1]
+	recordSk := AppendStoreKeySegments(AppendStoreKeySegmentStrings(indexSk(name), "records"), id)
+
+	oldTerms := map[string]bool{}
+	err = ic.tsc.GetLevelKeysStream(recordSk, "*", func(lk LevelKey) bool {
+		oldTerms[string(lk.Segment)] = true
+		return true
+	})
+	if err != nil {
+		return
+	}
+
+	newTerms := map[string]bool{}
+	if exists {
+		for _, term := range idx.extractor(value) {
+			newTerms[term] = true
+		}
+	}
+
+	terms := make([]string, 0, len(oldTerms)+len(newTerms))
+	for term := range oldTerms {
+		terms = append(terms, term)
+	}
+	for term := range newTerms {
+		if !oldTerms[term] {
+			terms = append(terms, term)
+		}
+	}
+	sort.Strings(terms)
+
+	for _, term := range terms {
+		termSk := AppendStoreKeySegments(AppendStoreKeySegmentStrings(indexSk(name), "terms", term), id)
+		recordTermSk := AppendStoreKeySegmentStrings(MakeStoreKeyFromPath(recordSk.Path), term)
+		switch {
+		case oldTerms[term] && !newTerms[term]:
+			if err = ic.deleteIndexEntry(termSk); err != nil {
+				return
+			}
+			if _, err = ic.tsc.DeleteKeyTree(recordTermSk); err != nil {
+				return
+			}
+		case newTerms[term] && !oldTerms[term]:
+			if _, _, err = ic.tsc.SetKey(termSk); err != nil {
+				return
+			}
+			if _, _, err = ic.tsc.SetKey(recordTermSk); err != nil {
+				return
+			}
+		}
+	}
+
+	if len(newTerms) == 0 && len(oldTerms) > 0 {
+		_, err = ic.tsc.DeleteKeyTree(recordSk)
+	}
+	return
+}
+
+// Deletes an index entry, along with its term key once no record has the
+// term.
+func (ic *IndexedClient) deleteIndexEntry(termSk StoreKey) (err error) {
+	if _, err = ic.tsc.DeleteKeyTree(termSk); err != nil {
+		return
+	}
+
+	parentSk := MakeStoreKeyFromTokenSegments(termSk.Tokens[:len(termSk.Tokens)-1]...)
+	children, _, err := ic.tsc.GetKeyChildrenCount(parentSk)
+	if err == nil && children == 0 {
+		_, err = ic.tsc.DeleteKeyTree(parentSk)
+	}
+	return
+}
+
+// Returns the key under which the entries of an index are stored.
+func indexSk(name string) StoreKey {
+	return AppendStoreKeySegmentStrings(MakeStoreKeyFromPath(IndexesSk.Path), name)
+}
+
+// Determines if `sk` is an immediate child of `parentSk`.
+func isChildKey(parentSk, sk StoreKey) bool {
+	return len(sk.Tokens) == len(parentSk.Tokens)+1 && isSameOrDescendant(sk.Path, parentSk.Path)
+}
+
+// Determines if `path` is `ancestor` or one of its descendants.
+func isSameOrDescendant(path, ancestor TokenPath) bool {
+	return path == ancestor || (len(path) > len(ancestor) && path[:len(ancestor)] == ancestor && path[len(ancestor)] == '/')
+}
@@ -0,0 +1,291 @@
+package treestore_client
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+)
+
+// the number of goroutines that decode and write records during an import
+const ingestWorkers = 4
+
+// the number of records read ahead of the workers during an import
+const ingestBatchSize = 64
+
+type (
+	// A record read by an import, and the line it came from. The key is set
+	// when the reader determines it.
+	ingestRecord struct {
+		line int
+		data []byte
+		sk   StoreKey
+	}
+
+	// Controls how ImportCsv maps rows to keys.
+	CsvImportOptions struct {
+		// The field delimiter; a comma if 0.
+		Comma rune
+
+		// The header of the column holding the row id, which becomes the key
+		// segment of the row. Rows are keyed by their row number (starting
+		// at 1) if empty. With NoHeader, this is the column index.
+		KeyColumn string
+
+		// The first row is data rather than headers; columns are named by
+		// their index, starting at 0.
+		NoHeader bool
+
+		// Cells holding numbers or true/false are stored as numbers and
+		// booleans rather than as strings.
+		InferTypes bool
+
+		// Empty cells are left out of the row, rather than stored as empty
+		// strings.
+		SkipEmpty bool
+	}
+
+	// Collects the first error of an import's workers.
+	ingestErrors struct {
+		mu  sync.Mutex
+		err error
+	}
+)
+
+func (ie *ingestErrors) set(err error) {
+	ie.mu.Lock()
+	defer ie.mu.Unlock()
+	if ie.err == nil {
+		ie.err = err
+	}
+}
+
+func (ie *ingestErrors) get() error {
+	ie.mu.Lock()
+	defer ie.mu.Unlock()
+	return ie.err
+}
+
+// Reads newline-delimited json records from `r` and stores each one with
+// SetKeyJson under `parentSk`, at the key returned by `keyFunc`, which is
+// relative to `parentSk`. A nil `keyFunc`, or one returning an empty key,
+// stores the record under its line number. Blank lines are skipped.
+//
+// Records are read ahead in batches and decoded by several goroutines, which
+// write them without marshalling them again. Records are therefore not
+// written in order; if two records have the same key, either may be kept.
+// The import stops at the first error, and returns the number of records
+// stored.
+func (tsc *tsClient) ImportJsonLines(parentSk StoreKey, r io.Reader, keyFunc func(doc any) StoreKey) (imported int, err error) {
+	read := func(emit func(record ingestRecord) bool) (err error) {
+		br := bufio.NewReader(r)
+		line := 0
+		for {
+			data, readErr := br.ReadBytes('\n')
+			line++
+			if data = bytes.TrimSpace(data); len(data) > 0 {
+				if !emit(ingestRecord{line: line, data: data}) {
+					return
+				}
+			}
+			if readErr != nil {
+				if !errors.Is(readErr, io.EOF) {
+					err = readErr
+				}
+				return
+			}
+		}
+	}
+
+	store := func(record ingestRecord) (err error) {
+		sk, err := jsonLineKey(parentSk, record, keyFunc)
+		if err == nil {
+			_, _, err = tsc.SetKeyJsonBytes(sk, record.data, 0)
+		}
+		if err != nil {
+			err = fmt.Errorf("line %d: %w", record.line, err)
+		}
+		return
+	}
+
+	return ingestConcurrently(read, store)
+}
+
+// Runs an import: `read` emits the records, which are passed to `store` by
+// several goroutines. Emitting returns false once a record has failed, and
+// the import returns the first error and the number of records stored.
+func ingestConcurrently(read func(emit func(record ingestRecord) bool) error, store func(record ingestRecord) error) (imported int, err error) {
+	records := make(chan ingestRecord, ingestBatchSize)
+	var errs ingestErrors
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for i := 0; i < ingestWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for record := range records {
+				if errs.get() != nil {
+					continue // drain
+				}
+				if err := store(record); err != nil {
+					errs.set(err)
+					continue
+				}
+
+				mu.Lock()
+				imported++
+				mu.Unlock()
+			}
+		}()
+	}
+
+	readErr := read(func(record ingestRecord) bool {
+		if errs.get() != nil {
+			return false
+		}
+		records <- record
+		return true
+	})
+	if readErr != nil {
+		errs.set(readErr)
+	}
+
+	close(records)
+	wg.Wait()
+	err = errs.get()
+	return
+}
+
+// Decodes a json line record and returns the key at which it is stored.
+func jsonLineKey(parentSk StoreKey, record ingestRecord, keyFunc func(doc any) StoreKey) (sk StoreKey, err error) {
+	var relSk StoreKey
+	if keyFunc != nil {
+		var doc any
+		if err = json.Unmarshal(record.data, &doc); err != nil {
+			return
+		}
+		relSk = keyFunc(doc)
+	} else if !json.Valid(record.data) {
+		err = errors.New("invalid json")
+		return
+	}
+
+	if len(relSk.Tokens) == 0 {
+		relSk = MakeStoreKey(strconv.Itoa(record.line))
+	}
+	sk = MakeStoreKeyFromPath(parentSk.Path + relSk.Path)
+	return
+}
+
+// Reads CSV rows from `r` and stores each one as a record key under
+// `parentSk`, with the column headers as child keys holding the cells. The
+// record key is the row's value in opts.KeyColumn, or its row number. Autolinks
+// defined on `parentSk` index the rows as they are stored.
+//
+// As with ImportJsonLines, rows are written concurrently and not in order, and
+// the import stops at the first error.
+func (tsc *tsClient) ImportCsv(parentSk StoreKey, r io.Reader, opts CsvImportOptions) (imported int, err error) {
+	cr := csv.NewReader(r)
+	if opts.Comma != 0 {
+		cr.Comma = opts.Comma
+	}
+
+	var headers []string
+	if !opts.NoHeader {
+		if headers, err = cr.Read(); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = nil
+			}
+			return
+		}
+	}
+
+	keyColumn := -1
+	if opts.KeyColumn != "" {
+		for n, header := range headers {
+			if header == opts.KeyColumn {
+				keyColumn = n
+			}
+		}
+		if keyColumn < 0 {
+			if index, convErr := strconv.Atoi(opts.KeyColumn); convErr == nil && opts.NoHeader {
+				keyColumn = index
+			} else {
+				err = fmt.Errorf("csv key column %s not found", opts.KeyColumn)
+				return
+			}
+		}
+	}
+
+	read := func(emit func(record ingestRecord) bool) (err error) {
+		for row := 1; ; row++ {
+			var cells []string
+			if cells, err = cr.Read(); err != nil {
+				if errors.Is(err, io.EOF) {
+					err = nil
+				}
+				return
+			}
+
+			record := ingestRecord{line: row}
+			if record.data, err = csvRowJson(headers, cells, opts); err != nil {
+				return
+			}
+
+			segment := strconv.Itoa(row)
+			if keyColumn >= 0 {
+				if keyColumn >= len(cells) || cells[keyColumn] == "" {
+					err = fmt.Errorf("row %d: missing key column %s", row, opts.KeyColumn)
+					return
+				}
+				segment = cells[keyColumn]
+			}
+			record.sk = AppendStoreKeySegmentStrings(parentSk, segment)
+
+			if !emit(record) {
+				return
+			}
+		}
+	}
+
+	store := func(record ingestRecord) (err error) {
+		if _, _, err = tsc.SetKeyJsonBytes(record.sk, record.data, 0); err != nil {
+			err = fmt.Errorf("row %d: %w", record.line, err)
+		}
+		return
+	}
+
+	return ingestConcurrently(read, store)
+}
+
+// Converts a CSV row to a json object keyed by the column headers.
+func csvRowJson(headers, cells []string, opts CsvImportOptions) ([]byte, error) {
+	row := make(map[string]any, len(cells))
+	for n, cell := range cells {
+		if cell == "" && opts.SkipEmpty {
+			continue
+		}
+
+		column := strconv.Itoa(n)
+		if n < len(headers) {
+			column = headers[n]
+		}
+
+		var value any = cell
+		if opts.InferTypes {
+			if cell == "true" || cell == "false" {
+				value = cell == "true"
+			} else if _, err := strconv.ParseFloat(cell, 64); err == nil && json.Valid([]byte(cell)) {
+				value = json.Number(cell)
+			}
+		}
+		row[column] = value
+	}
+	return json.Marshal(row)
+}
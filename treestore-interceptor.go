@@ -0,0 +1,41 @@
+package treestore_client
+
+import (
+	"context"
+)
+
+type (
+	// Sends a command to the server, or on to the next interceptor.
+	Invoker func(ctx context.Context, cmd []string) (response map[string]any, err error)
+
+	// Wraps each command of a client, such as for logging, metrics or
+	// injecting arguments. The interceptor calls `next` to continue the
+	// command, possibly with changed arguments or more than once, or returns
+	// without calling it to answer the command itself.
+	Interceptor func(ctx context.Context, cmd []string, next Invoker) (response map[string]any, err error)
+)
+
+// Installs interceptors around the commands of the client, including the
+// commands sent by its higher level methods. The first interceptor is the
+// outermost. Interceptors added by With() run inside those the client
+// already has.
+//
+// The client's methods don't take a context, so the chain starts with
+// context.Background(); an interceptor can pass values to the interceptors
+// after it in the context it gives `next`.
+func ClientInterceptors(interceptors ...Interceptor) ClientOption {
+	return func(tsc *tsClient) {
+		tsc.interceptors = append(tsc.interceptors[:len(tsc.interceptors):len(tsc.interceptors)], interceptors...)
+	}
+}
+
+// Runs the command through the interceptors from `index` onward, and then
+// sends it.
+func (tsc *tsClient) intercept(ctx context.Context, cmd []string, index int) (response map[string]any, err error) {
+	if index >= len(tsc.interceptors) {
+		return tsc.sendRawCommand(cmd)
+	}
+	return tsc.interceptors[index](ctx, cmd, func(ctx context.Context, cmd []string) (map[string]any, error) {
+		return tsc.intercept(ctx, cmd, index+1)
+	})
+}
@@ -0,0 +1,157 @@
+package treestore_client
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+)
+
+// The options that GetKeyAsJson applies to the json returned by the server.
+const jsonProjectionOptions = JsonNumericSegmentsAsArrays | JsonOmitEmpty
+
+// Applies the jsonProjectionOptions in `opt` to json returned by the server.
+func projectJson(data any, opt JsonOptions) any {
+	if (opt & JsonNumericSegmentsAsArrays) != 0 {
+		data = numericObjectsToArrays(data)
+	}
+	if (opt & JsonOmitEmpty) != 0 {
+		data, _ = omitEmptyJson(data)
+	}
+	return data
+}
+
+// Removes the object fields that are null, for keys without a value or
+// children, or that are objects left empty by the removal, for JsonOmitEmpty.
+// Array elements are kept, so that the indexes don't change. Returns false if
+// `data` is itself empty.
+func omitEmptyJson(data any) (compacted any, nonEmpty bool) {
+	switch v := data.(type) {
+	case nil:
+		return nil, false
+
+	case []any:
+		for i, element := range v {
+			v[i], _ = omitEmptyJson(element)
+		}
+
+	case map[string]any:
+		for field, value := range v {
+			if compacted, nonEmpty := omitEmptyJson(value); nonEmpty {
+				v[field] = compacted
+			} else {
+				delete(v, field)
+			}
+		}
+		return v, len(v) > 0
+	}
+	return data, true
+}
+
+// Converts json data to store arrays as objects with decimal index fields,
+// for JsonNumericSegmentsAsArrays.
+func arraysToNumericObjects(data any) any {
+	switch v := data.(type) {
+	case []any:
+		obj := make(map[string]any, len(v))
+		for i, element := range v {
+			obj[strconv.Itoa(i)] = arraysToNumericObjects(element)
+		}
+		return obj
+
+	case map[string]any:
+		obj := make(map[string]any, len(v))
+		for field, value := range v {
+			obj[field] = arraysToNumericObjects(value)
+		}
+		return obj
+	}
+	return data
+}
+
+// Converts objects whose fields are all decimal indexes to arrays, for
+// JsonNumericSegmentsAsArrays. Missing indexes become nulls, but an object
+// with indexes at least twice its field count is kept as an object, so that
+// a sparse object doesn't become a huge array.
+func numericObjectsToArrays(data any) any {
+	switch v := data.(type) {
+	case []any:
+		for i, element := range v {
+			v[i] = numericObjectsToArrays(element)
+		}
+
+	case map[string]any:
+		for field, value := range v {
+			v[field] = numericObjectsToArrays(value)
+		}
+
+		if len(v) == 0 {
+			return v
+		}
+		maxIndex := -1
+		for field := range v {
+			index, err := strconv.Atoi(field)
+			if err != nil || index < 0 || strconv.Itoa(index) != field || index >= 2*len(v) {
+				return v
+			}
+			maxIndex = max(maxIndex, index)
+		}
+
+		arr := make([]any, maxIndex+1)
+		for field, value := range v {
+			index, _ := strconv.Atoi(field)
+			arr[index] = value
+		}
+		return arr
+	}
+	return data
+}
+
+// Rewrites marshalled json for JsonNumericSegmentsAsArrays, with `convert`
+// being arraysToNumericObjects or numericObjectsToArrays.
+func convertJsonArrays(marshalled []byte, convert func(data any) any) (converted []byte, err error) {
+	decoder := json.NewDecoder(bytes.NewReader(marshalled))
+	decoder.UseNumber()
+	var data any
+	if err = decoder.Decode(&data); err != nil {
+		return
+	}
+	return json.Marshal(convert(data))
+}
+
+// Sets the "array" metadata attribute on the keys matching `skPattern`, so
+// that GetKeyAsJson returns their children as array elements, or clears it
+// when `isArray` is false. The children of an array key must have four byte
+// big endian index segments, as SetKeyJson makes. Returns the number of keys
+// updated.
+func (tsc *tsClient) SetJsonArrayMetadata(skPattern StoreKey, isArray bool) (updated int, err error) {
+	var keys []StoreKey
+	err = tsc.GetMatchingKeysStream(skPattern, func(km *KeyMatch) bool {
+		keys = append(keys, MakeStoreKeyFromPath(km.Key))
+		return true
+	})
+	if err != nil {
+		return
+	}
+
+	for _, sk := range keys {
+		var changed bool
+		if isArray {
+			var exists bool
+			var original string
+			if exists, original, err = tsc.SetMetadataAttribute(sk, "array", "true"); err != nil {
+				return
+			}
+			changed = exists && original != "true"
+		} else {
+			var exists bool
+			if exists, _, err = tsc.ClearMetadataAttribute(sk, "array"); err != nil {
+				return
+			}
+			changed = exists
+		}
+		if changed {
+			updated++
+		}
+	}
+	return
+}
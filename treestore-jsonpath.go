@@ -0,0 +1,622 @@
+package treestore_client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Converts a relative json path, such as `animals[2].name` or
+// `$.config["log.level"]`, to the subpath of the store keys holding that part
+// of a json document.
+//
+// Object fields are written as .name, or as ['name'] or ["name"] when the name
+// contains other characters; within quotes, a backslash escapes the next
+// character. Array elements are written as [index], and map to the four byte
+// index segments the server uses for arrays. A leading $ is optional.
+func JsonPathToSubPath(jsonPath string) (subPath SubPath, err error) {
+	path := strings.TrimPrefix(jsonPath, "$")
+	if path != "" && path[0] != '.' && path[0] != '[' {
+		// a leading field name doesn't need a dot
+		path = "." + path
+	}
+	subPath = SubPath{}
+
+	pos := 0
+	for pos < len(path) {
+		switch path[pos] {
+		case '.':
+			pos++
+			end := pos
+			for end < len(path) && path[end] != '.' && path[end] != '[' && path[end] != ']' {
+				end++
+			}
+			if end == pos {
+				err = fmt.Errorf("empty field name in json path %s", jsonPath)
+				return
+			}
+			subPath = append(subPath, SubPathSegment(path[pos:end]))
+			pos = end
+
+		case '[':
+			pos++
+			if pos < len(path) && (path[pos] == '\'' || path[pos] == '"') {
+				var name string
+				if name, pos, err = scanJsonPathName(path, pos); err != nil {
+					err = fmt.Errorf("%w in json path %s", err, jsonPath)
+					return
+				}
+				subPath = append(subPath, SubPathSegment(name))
+			} else {
+				end := strings.IndexByte(path[pos:], ']')
+				if end < 0 {
+					err = fmt.Errorf("unterminated index in json path %s", jsonPath)
+					return
+				}
+				var index uint64
+				if index, err = strconv.ParseUint(path[pos:pos+end], 10, 32); err != nil {
+					err = fmt.Errorf("invalid array index %q in json path %s", path[pos:pos+end], jsonPath)
+					return
+				}
+				subPath = append(subPath, jsonArrayIndexSegment(int(index)))
+				pos += end
+			}
+
+			if pos >= len(path) || path[pos] != ']' {
+				err = fmt.Errorf("missing ] in json path %s", jsonPath)
+				return
+			}
+			pos++
+
+		default:
+			err = fmt.Errorf("unexpected %q in json path %s", path[pos], jsonPath)
+			return
+		}
+	}
+	return
+}
+
+// Scans a quoted field name starting at the quote character at `pos`,
+// returning the name and the offset following the closing quote.
+func scanJsonPathName(path string, pos int) (name string, next int, err error) {
+	quote := path[pos]
+	var sb strings.Builder
+	for next = pos + 1; next < len(path); next++ {
+		ch := path[next]
+		if ch == '\\' && next+1 < len(path) {
+			next++
+			sb.WriteByte(path[next])
+		} else if ch == quote {
+			name = sb.String()
+			next++
+			return
+		} else {
+			sb.WriteByte(ch)
+		}
+	}
+	err = fmt.Errorf("unterminated field name")
+	return
+}
+
+// The key segment of a json array element.
+func jsonArrayIndexSegment(index int) SubPathSegment {
+	seg := make([]byte, 4)
+	binary.BigEndian.PutUint32(seg, uint32(index))
+	return seg
+}
+
+// Deletes the part of the json document at `sk` found at `relativePath` (see
+// JsonPathToSubPath), including its value, children and history.
+//
+// Deleting an array element doesn't renumber the elements after it.
+func (tsc *tsClient) DeleteKeyJsonPath(sk StoreKey, relativePath string) (removed bool, err error) {
+	subPath, err := JsonPathToSubPath(relativePath)
+	if err != nil {
+		return
+	}
+	if len(subPath) == 0 {
+		err = fmt.Errorf("json path %s does not refer to a nested part of the document", relativePath)
+		return
+	}
+
+	return tsc.DeleteKeyTree(JoinSubPath(sk, subPath))
+}
+
+// Replaces the part of the json document at `sk` found at `subPath` with
+// `jsonData`, leaving the rest of the document as it is. Use
+// JsonPathToSubPath to address the part with a json path.
+//
+// The keys under `subPath` are replaced as by SetKeyJson, so unlike
+// MergeKeyJson, fields missing from `jsonData` are removed from that part.
+func (tsc *tsClient) SetKeyJsonAtPath(sk StoreKey, subPath SubPath, jsonData any, opt JsonOptions) (replaced bool, address StoreAddress, err error) {
+	if len(subPath) == 0 {
+		err = errors.New("the subpath does not refer to a nested part of the document")
+		return
+	}
+
+	return tsc.SetKeyJson(JoinSubPath(sk, subPath), jsonData, opt)
+}
+
+type (
+	jsonPathStepKind int
+
+	// A step of a json path query, applied to each node matched so far.
+	jsonPathStep struct {
+		kind   jsonPathStepKind
+		name   string
+		index  int
+		filter *jsonPathFilter
+	}
+
+	// A filter expression, such as `?(@.sound=='bark')`, that keeps the
+	// elements for which the operand compares true with the literal, or for
+	// which the operand exists when there is no operator.
+	jsonPathFilter struct {
+		operand []jsonPathStep
+		op      string
+		literal any
+	}
+)
+
+const (
+	jsonPathField jsonPathStepKind = iota
+	jsonPathIndex
+	jsonPathWildcard
+	jsonPathDescend
+	jsonPathFilterStep
+)
+
+// Evaluates the json path query `expr` against the json document at `sk`,
+// and returns the matching part of the document.
+//
+// In addition to the paths of JsonPathToSubPath, the query may have
+// wildcards (`.*` or `[*]`), recursive descent (`..name`), negative array
+// indexes counting from the end, and filters such as
+// `[?(@.sound=='bark')]` that compare a field of each element with a
+// string, number, boolean or null literal using ==, !=, <, <=, > or >=, or
+// test that the field exists, as in `[?(@.sound)]`.
+//
+// The leading fields and array indexes of the query are resolved by the
+// server, so only that branch of the document is transferred; the rest of
+// the query is evaluated by the client. A query made only of fields and
+// indexes returns the single value found, or nil; any other query returns
+// the list of matches.
+func (tsc *tsClient) GetKeyJsonPath(sk StoreKey, expr string) (jsonData any, err error) {
+	steps, err := parseJsonPathQuery(expr, expr)
+	if err != nil {
+		return
+	}
+
+	subPath := SubPath{}
+	definite := true
+	rest := steps
+	for n, step := range steps {
+		if step.kind != jsonPathField && step.kind != jsonPathIndex {
+			definite = false
+			break
+		}
+		if step.kind == jsonPathIndex && step.index < 0 {
+			break
+		}
+		rest = steps[n+1:]
+		if step.kind == jsonPathField {
+			subPath = append(subPath, SubPathSegment(step.name))
+		} else {
+			subPath = append(subPath, jsonArrayIndexSegment(step.index))
+		}
+	}
+	for _, step := range rest {
+		if step.kind != jsonPathField && step.kind != jsonPathIndex {
+			definite = false
+		}
+	}
+
+	branch, err := tsc.GetKeyAsJson(JoinSubPath(sk, subPath), 0)
+	if err != nil {
+		return
+	}
+
+	var matches []any
+	if branch != nil {
+		matches = evalJsonPath(rest, []any{branch})
+	}
+
+	if definite {
+		if len(matches) > 0 {
+			jsonData = matches[0]
+		}
+	} else {
+		if matches == nil {
+			matches = []any{}
+		}
+		jsonData = matches
+	}
+	return
+}
+
+// Parses a json path query into its steps. `query` is the whole query, for
+// error messages.
+func parseJsonPathQuery(jsonPath, query string) (steps []jsonPathStep, err error) {
+	path := strings.TrimPrefix(jsonPath, "$")
+	if path != "" && path[0] != '.' && path[0] != '[' {
+		// a leading field name doesn't need a dot
+		path = "." + path
+	}
+
+	pos := 0
+	for pos < len(path) {
+		switch path[pos] {
+		case '.':
+			pos++
+			if pos < len(path) && path[pos] == '.' {
+				steps = append(steps, jsonPathStep{kind: jsonPathDescend})
+				pos++
+				if pos < len(path) && path[pos] == '[' {
+					continue
+				}
+			}
+			end := pos
+			for end < len(path) && path[end] != '.' && path[end] != '[' && path[end] != ']' {
+				end++
+			}
+			if end == pos {
+				err = fmt.Errorf("empty field name in json path %s", query)
+				return
+			}
+			if path[pos:end] == "*" {
+				steps = append(steps, jsonPathStep{kind: jsonPathWildcard})
+			} else {
+				steps = append(steps, jsonPathStep{kind: jsonPathField, name: path[pos:end]})
+			}
+			pos = end
+
+		case '[':
+			pos++
+			switch {
+			case pos < len(path) && (path[pos] == '\'' || path[pos] == '"'):
+				var name string
+				if name, pos, err = scanJsonPathName(path, pos); err != nil {
+					err = fmt.Errorf("%w in json path %s", err, query)
+					return
+				}
+				steps = append(steps, jsonPathStep{kind: jsonPathField, name: name})
+
+			case strings.HasPrefix(path[pos:], "*"):
+				steps = append(steps, jsonPathStep{kind: jsonPathWildcard})
+				pos++
+
+			case strings.HasPrefix(path[pos:], "?("):
+				end := scanJsonPathFilterEnd(path, pos+2)
+				if end < 0 {
+					err = fmt.Errorf("unterminated filter in json path %s", query)
+					return
+				}
+				var filter *jsonPathFilter
+				if filter, err = parseJsonPathFilter(path[pos+2:end], query); err != nil {
+					return
+				}
+				steps = append(steps, jsonPathStep{kind: jsonPathFilterStep, filter: filter})
+				pos = end + 1
+
+			default:
+				end := strings.IndexByte(path[pos:], ']')
+				if end < 0 {
+					err = fmt.Errorf("unterminated index in json path %s", query)
+					return
+				}
+				var index int64
+				if index, err = strconv.ParseInt(path[pos:pos+end], 10, 32); err != nil {
+					err = fmt.Errorf("invalid array index %q in json path %s", path[pos:pos+end], query)
+					return
+				}
+				steps = append(steps, jsonPathStep{kind: jsonPathIndex, index: int(index)})
+				pos += end
+			}
+
+			if pos >= len(path) || path[pos] != ']' {
+				err = fmt.Errorf("missing ] in json path %s", query)
+				return
+			}
+			pos++
+
+		default:
+			err = fmt.Errorf("unexpected %q in json path %s", path[pos], query)
+			return
+		}
+	}
+	return
+}
+
+// Returns the offset of the parenthesis closing a filter that starts at
+// `pos`, skipping quoted literals, or -1 if there isn't one.
+func scanJsonPathFilterEnd(path string, pos int) int {
+	depth := 0
+	for ; pos < len(path); pos++ {
+		switch path[pos] {
+		case '\'', '"':
+			quote := path[pos]
+			for pos++; pos < len(path) && path[pos] != quote; pos++ {
+				if path[pos] == '\\' {
+					pos++
+				}
+			}
+		case '(':
+			depth++
+		case ')':
+			if depth == 0 {
+				return pos
+			}
+			depth--
+		}
+	}
+	return -1
+}
+
+// Parses the expression inside `?( )`.
+func parseJsonPathFilter(expr, query string) (filter *jsonPathFilter, err error) {
+	expr = strings.TrimSpace(expr)
+	if !strings.HasPrefix(expr, "@") {
+		err = fmt.Errorf("filter must start with @ in json path %s", query)
+		return
+	}
+
+	operand, rest := expr, ""
+	if end := strings.IndexAny(expr, " =!<>"); end >= 0 {
+		operand, rest = expr[:end], strings.TrimSpace(expr[end:])
+	}
+
+	filter = &jsonPathFilter{}
+	if filter.operand, err = parseJsonPathQuery(operand[1:], query); err != nil {
+		return
+	}
+	for _, step := range filter.operand {
+		if step.kind != jsonPathField && step.kind != jsonPathIndex {
+			err = fmt.Errorf("filter operand must be made of fields and indexes in json path %s", query)
+			return
+		}
+	}
+	if rest == "" {
+		return
+	}
+
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">"} {
+		if strings.HasPrefix(rest, op) {
+			filter.op = op
+			rest = strings.TrimSpace(rest[len(op):])
+			break
+		}
+	}
+	if filter.op == "" {
+		err = fmt.Errorf("invalid filter operator in json path %s", query)
+		return
+	}
+
+	if rest != "" && rest[0] == '\'' {
+		var next int
+		var name string
+		if name, next, err = scanJsonPathName(rest, 0); err != nil || next != len(rest) {
+			err = fmt.Errorf("invalid filter literal %s in json path %s", rest, query)
+			return
+		}
+		filter.literal = name
+	} else if err = json.Unmarshal([]byte(rest), &filter.literal); err != nil {
+		err = fmt.Errorf("invalid filter literal %s in json path %s", rest, query)
+		return
+	}
+	return
+}
+
+// Applies the query steps to the nodes, returning the nodes matched.
+func evalJsonPath(steps []jsonPathStep, nodes []any) []any {
+	for _, step := range steps {
+		var next []any
+		for _, node := range nodes {
+			switch step.kind {
+			case jsonPathField:
+				if obj, is := node.(map[string]any); is {
+					if child, found := obj[step.name]; found {
+						next = append(next, child)
+					}
+				}
+
+			case jsonPathIndex:
+				if arr, is := node.([]any); is {
+					index := step.index
+					if index < 0 {
+						index += len(arr)
+					}
+					if index >= 0 && index < len(arr) {
+						next = append(next, arr[index])
+					}
+				}
+
+			case jsonPathWildcard:
+				next = append(next, jsonPathChildren(node)...)
+
+			case jsonPathDescend:
+				next = appendJsonPathDescendants(next, node)
+
+			case jsonPathFilterStep:
+				for _, child := range jsonPathChildren(node) {
+					if step.filter.matches(child) {
+						next = append(next, child)
+					}
+				}
+			}
+		}
+		nodes = next
+	}
+	return nodes
+}
+
+// Returns the elements of an array, or the field values of an object in
+// field name order.
+func jsonPathChildren(node any) []any {
+	switch v := node.(type) {
+	case []any:
+		return v
+	case map[string]any:
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		children := make([]any, 0, len(v))
+		for _, name := range names {
+			children = append(children, v[name])
+		}
+		return children
+	}
+	return nil
+}
+
+// Appends the node and all of its descendants.
+func appendJsonPathDescendants(nodes []any, node any) []any {
+	nodes = append(nodes, node)
+	for _, child := range jsonPathChildren(node) {
+		nodes = appendJsonPathDescendants(nodes, child)
+	}
+	return nodes
+}
+
+// Tests an element against the filter.
+func (filter *jsonPathFilter) matches(node any) bool {
+	operands := evalJsonPath(filter.operand, []any{node})
+	if len(operands) == 0 {
+		return false
+	}
+	if filter.op == "" {
+		return true
+	}
+
+	value := operands[0]
+	switch literal := filter.literal.(type) {
+	case float64:
+		if n, is := value.(float64); is {
+			return compareJsonPathOrdered(n, literal, filter.op)
+		}
+	case string:
+		if s, is := value.(string); is {
+			return compareJsonPathOrdered(s, literal, filter.op)
+		}
+	default:
+		switch filter.op {
+		case "==":
+			return value == filter.literal
+		case "!=":
+			return value != filter.literal
+		}
+		return false
+	}
+	return filter.op == "!="
+}
+
+func compareJsonPathOrdered[T float64 | string](a, b T, op string) bool {
+	switch op {
+	case "==":
+		return a == b
+	case "!=":
+		return a != b
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	}
+	return false
+}
+
+// Merges json data with one of the array merge strategies. The server's merge
+// always appends arrays, so the data is split at its arrays: the branches
+// without arrays are merged in one command, an array is replaced with
+// SetKeyJson (JsonMergeArraysReplace), or its elements are each merged onto
+// the element key at the same index (JsonMergeArraysByIndex).
+func (tsc *tsClient) mergeKeyJsonArrays(sk StoreKey, marshalled []byte, opt JsonOptions) (address StoreAddress, err error) {
+	decoder := json.NewDecoder(bytes.NewReader(marshalled))
+	decoder.UseNumber()
+	var data any
+	if err = decoder.Decode(&data); err != nil {
+		return
+	}
+
+	return tsc.mergeJsonBranch(sk, data, opt)
+}
+
+// Merges one branch of the data split by mergeKeyJsonArrays, returning the
+// address of `sk`.
+func (tsc *tsClient) mergeJsonBranch(sk StoreKey, data any, opt JsonOptions) (address StoreAddress, err error) {
+	plainOpt := opt &^ (JsonMergeArraysReplace | JsonMergeArraysByIndex)
+
+	switch v := data.(type) {
+	case []any:
+		if (opt & JsonMergeArraysReplace) != 0 {
+			_, address, err = tsc.SetKeyJson(sk, v, plainOpt)
+			return
+		}
+
+		// merging an empty array marks the key as an array without appending
+		if address, err = tsc.MergeKeyJson(sk, []any{}, plainOpt); err != nil {
+			return
+		}
+		for i, element := range v {
+			if _, err = tsc.mergeJsonBranch(JoinSubPath(sk, SubPath{jsonArrayIndexSegment(i)}), element, opt); err != nil {
+				return
+			}
+		}
+
+	case map[string]any:
+		plain := map[string]any{}
+		var arrayFields []string
+		for field, value := range v {
+			if jsonHasArray(value) {
+				arrayFields = append(arrayFields, field)
+			} else {
+				plain[field] = value
+			}
+		}
+
+		if len(plain) > 0 || len(arrayFields) == 0 {
+			if address, err = tsc.MergeKeyJson(sk, plain, plainOpt); err != nil {
+				return
+			}
+		}
+
+		sort.Strings(arrayFields)
+		for _, field := range arrayFields {
+			if _, err = tsc.mergeJsonBranch(AppendStoreKeySegmentStrings(sk, field), v[field], opt); err != nil {
+				return
+			}
+		}
+		if address == 0 {
+			// the key was made along with its children
+			address, _, err = tsc.LocateKey(sk)
+		}
+
+	default:
+		address, err = tsc.MergeKeyJson(sk, v, plainOpt)
+	}
+	return
+}
+
+// Returns true if the json data has an array anywhere within it.
+func jsonHasArray(data any) bool {
+	switch v := data.(type) {
+	case []any:
+		return true
+	case map[string]any:
+		for _, value := range v {
+			if jsonHasArray(value) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,55 @@
+package treestore_client
+
+import (
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+// The key under which the client holds the locks that serialize its
+// read-modify-write helpers, such as SetKeyValueCAS. Each lock is a child of
+// LocksSk named by the full path of the locked key.
+var LocksSk = MakeStoreKey("treestore-client", "locks")
+
+const (
+	// how long a lock lasts if its holder goes away without releasing it
+	keyLockTtl = 30 * time.Second
+
+	// the longest wait between attempts to take a held lock
+	keyLockMaxWait = 50 * time.Millisecond
+)
+
+// Takes the client lock on `sk`, waiting while another caller holds it, and
+// returns the function that releases it.
+//
+// The server has no compare-and-swap, but it does create a key only if it
+// doesn't exist, so the lock is a key made that way. It excludes the other
+// callers of lockKey on any connection, not plain writes to `sk`. The lock
+// expires after keyLockTtl, in case its holder goes away.
+func (tsc *tsClient) lockKey(sk StoreKey) (unlock func(), err error) {
+	root := tsc.unscoped()
+	root.touchOnRead = 0
+
+	lockSk := AppendStoreKeySegments(MakeStoreKeyFromPath(LocksSk.Path), TokenSegment(tsc.keyArg(sk)))
+	token := strconv.FormatUint(rand.Uint64(), 36)
+
+	for wait := time.Millisecond; ; wait = min(wait*2, keyLockMaxWait) {
+		expire := time.Now().Add(keyLockTtl)
+		var exists bool
+		if _, exists, _, err = root.SetKeyValueEx(lockSk, token, SetExMustNotExist, &expire, nil); err != nil {
+			return
+		}
+		if !exists {
+			break
+		}
+		time.Sleep(wait)
+	}
+
+	unlock = func() {
+		// a lock that expired may have been taken by another caller
+		if value, _, _, err := root.GetKeyValue(lockSk); err == nil && value == token {
+			root.DeleteKey(lockSk)
+		}
+	}
+	return
+}
@@ -0,0 +1,114 @@
+package treestore_client
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Appends `values` to the list at `sk`, creating the list if necessary. A list
+// is a json array: the elements are child keys with four byte index segments,
+// and the list key has the "array" metadata attribute, so GetKeyAsJson returns
+// the list as an array. Elements are stored as json, so numbers are read back
+// as float64.
+//
+// The values are appended with a single json merge, made while the client
+// holds a lock on the list (see LocksSk), so that a push doesn't reuse the
+// index of an element that a concurrent ListPop is removing.
+func (tsc *tsClient) ListPush(sk StoreKey, values ...any) (err error) {
+	if len(values) == 0 {
+		return
+	}
+
+	unlock, err := tsc.lockKey(sk)
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	marshalled, err := json.Marshal(values)
+	if err != nil {
+		return
+	}
+
+	// the server appends an array merged into an existing array
+	args := append([]string{"mergejson", tsc.keyArg(sk)}, tsc.jsonPayloadArgs(marshalled)...)
+	_, err = tsc.RawCommand(args...)
+	return
+}
+
+// Removes the last element of the list at `sk` and returns it. `exists` is
+// false if the list is empty or doesn't exist.
+//
+// The server has no pop command, so the last element is read and then
+// deleted while the client holds a lock on the list. The server appends at
+// the index of the element count, so without the lock, a push between the
+// read and the delete would store its element at the index being popped.
+// Pops and pushes through ListPop and ListPush, on any connection, are
+// serialized by the lock, so each element is returned by only one pop. The
+// list must not be changed by other means, such as MergeKeyJson, while pops
+// are in progress.
+func (tsc *tsClient) ListPop(sk StoreKey) (value any, exists bool, err error) {
+	unlock, err := tsc.lockKey(sk)
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	for {
+		var length int
+		if length, err = tsc.ListLength(sk); err != nil || length == 0 {
+			return
+		}
+
+		elementSk := JoinSubPath(sk, SubPath{jsonArrayIndexSegment(length - 1)})
+		if value, err = tsc.GetKeyAsJson(elementSk, 0); err != nil {
+			return
+		}
+
+		var removed bool
+		if removed, err = tsc.DeleteKeyTree(elementSk); err != nil {
+			return
+		}
+		if removed {
+			exists = true
+			return
+		}
+	}
+}
+
+// Returns the elements of the list at `sk` from index `start` through `stop`,
+// inclusive. Negative indexes count from the end of the list, so -1 is the
+// last element. Indexes beyond the list are clamped, as in Redis LRANGE.
+func (tsc *tsClient) ListRange(sk StoreKey, start, stop int) (values []any, err error) {
+	jsonData, err := tsc.GetKeyAsJson(sk, 0)
+	if err != nil || jsonData == nil {
+		return
+	}
+
+	list, isList := jsonData.([]any)
+	if !isList {
+		err = fmt.Errorf("key %s is not a list", sk.Path)
+		return
+	}
+
+	length := len(list)
+	if start < 0 {
+		start = max(length+start, 0)
+	}
+	if stop < 0 {
+		stop = length + stop
+	}
+	stop = min(stop, length-1)
+
+	values = []any{}
+	if start <= stop {
+		values = append(values, list[start:stop+1]...)
+	}
+	return
+}
+
+// Returns the number of elements in the list at `sk`.
+func (tsc *tsClient) ListLength(sk StoreKey) (length int, err error) {
+	length, _, err = tsc.GetKeyChildrenCount(sk)
+	return
+}
@@ -0,0 +1,345 @@
+package treestore_client
+
+import (
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+type (
+	// The order of the matches returned by GetMatchingKeysEx and
+	// GetMatchingKeyValuesEx.
+	MatchOrder int
+
+	// Options of GetMatchingKeysEx and GetMatchingKeyValuesEx.
+	MatchOptions struct {
+		// The order of the matches; the server's key order if zero.
+		Order MatchOrder
+		// Reverses the order, so that the last matches come first.
+		Descending bool
+		// When not empty, only keys that have this metadata attribute match.
+		MetadataAttribute string
+		// When not nil, only keys whose MetadataAttribute has this value
+		// match.
+		MetadataValue *string
+		// Matches the pattern's segments exactly, without wildcards, as if
+		// each segment were passed through EscapePattern.
+		Literal bool
+	}
+
+	// A key found by GetExpiringKeys.
+	ExpiringKey struct {
+		Sk     StoreKey
+		Expire time.Time
+	}
+
+	// A match with the key used to order it.
+	orderedMatch[T any] struct {
+		match   T
+		hasSort bool
+		sortBy  float64
+	}
+)
+
+const (
+	// Key path order, as the server iterates: segment by segment in byte
+	// order, with a parent ahead of its children.
+	MatchOrderKey MatchOrder = iota
+	// Ascending numeric value. Keys without a numeric value follow, in key
+	// order.
+	MatchOrderValue
+	// Soonest expiration first. Keys without an expiration follow, in key
+	// order.
+	MatchOrderTtl
+)
+
+// Finds the keys matching `skPattern`, as GetMatchingKeys does, in the order
+// of opts.Order, skipping `startAt` matches and returning up to `limit`.
+//
+// Key order is the server's order, and is paged by the server. The server
+// can't sort otherwise, so for the other orders every match is fetched (a
+// page at a time) and sorted by the client before the page is cut; ordering
+// by ttl also reads the expiration of each match. Matches that tie keep key
+// order, so the order is deterministic across pages.
+//
+// opts.Descending reverses the order entirely, including the matches that
+// have no value or ttl to sort by. In key order, the server counts the
+// matches and the mirrored page is fetched and reversed, so "latest N"
+// listings don't fetch every match.
+//
+// The server can't filter by metadata either. With opts.MetadataAttribute,
+// the metadata returned with each match is checked by the client, and
+// `startAt` counts the matches that pass the filter.
+//
+// A backslash in a segment of `skPattern` escapes the next character, so
+// that a segment made with EscapePattern matches a `*` literally. The server
+// has no escapes: an escaped `*` is sent as a wildcard, and the keys that
+// don't match it literally are filtered out by the client, as are keys that
+// fail the metadata filter.
+func (tsc *tsClient) GetMatchingKeysEx(skPattern StoreKey, startAt, limit int, opts MatchOptions) (keys []*KeyMatch, err error) {
+	skPattern, exact := opts.serverPattern(skPattern)
+	if opts.isServerPaged(exact) {
+		if !opts.Descending {
+			return tsc.GetMatchingKeys(skPattern, startAt, limit)
+		}
+		return reversePage(startAt, limit,
+			func() (int, error) {
+				return tsc.countMatches("keypaths", "lsk", tsc.keyArg(skPattern))
+			},
+			func(start, limit int) ([]*KeyMatch, error) {
+				return tsc.GetMatchingKeys(skPattern, start, limit)
+			},
+		)
+	}
+
+	var all []*KeyMatch
+	err = tsc.GetMatchingKeysStream(skPattern, func(km *KeyMatch) bool {
+		if opts.keepMatch(exact, km.Key, km.Metadata) {
+			all = append(all, km)
+		}
+		return true
+	})
+	if err != nil {
+		return
+	}
+
+	return sortMatches(tsc, all, opts, startAt, limit, func(km *KeyMatch) (TokenPath, any) {
+		return km.Key, km.CurrentValue
+	})
+}
+
+// Finds the keys with values matching `skPattern`, as GetMatchingKeyValues
+// does, in the order of opts.Order. See GetMatchingKeysEx.
+func (tsc *tsClient) GetMatchingKeyValuesEx(skPattern StoreKey, startAt, limit int, opts MatchOptions) (values []*KeyValueMatch, err error) {
+	skPattern, exact := opts.serverPattern(skPattern)
+	if opts.isServerPaged(exact) {
+		if !opts.Descending {
+			return tsc.GetMatchingKeyValues(skPattern, startAt, limit)
+		}
+		return reversePage(startAt, limit,
+			func() (int, error) {
+				return tsc.countMatches("key_values", "lsv", tsc.keyArg(skPattern))
+			},
+			func(start, limit int) ([]*KeyValueMatch, error) {
+				return tsc.GetMatchingKeyValues(skPattern, start, limit)
+			},
+		)
+	}
+
+	var all []*KeyValueMatch
+	err = tsc.GetMatchingKeyValuesStream(skPattern, func(kvm *KeyValueMatch) bool {
+		if opts.keepMatch(exact, kvm.Key, kvm.Metadata) {
+			all = append(all, kvm)
+		}
+		return true
+	})
+	if err != nil {
+		return
+	}
+
+	return sortMatches(tsc, all, opts, startAt, limit, func(kvm *KeyValueMatch) (TokenPath, any) {
+		return kvm.Key, kvm.CurrentValue
+	})
+}
+
+// Escapes the wildcard characters of `s`, so that it matches only itself as
+// a segment of the patterns of GetMatchingKeysEx and GetMatchingKeyValuesEx.
+func EscapePattern(s string) string {
+	return patternEscaper.Replace(s)
+}
+
+var patternEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`)
+
+// Converts a pattern that may have escaped characters into the pattern sent
+// to the server, which has no escapes, and an expression over the key path
+// that the server's matches must also match. The expression is nil when the
+// pattern has no escapes, and the server's matches are exact.
+func (opts *MatchOptions) serverPattern(skPattern StoreKey) (serverSk StoreKey, exact *regexp.Regexp) {
+	tokens := make(TokenSet, 0, len(skPattern.Tokens))
+	var expr strings.Builder
+	expr.WriteString("^")
+	escaped := false
+
+	for n, token := range skPattern.Tokens {
+		segment := string(token)
+		if opts.Literal {
+			segment = EscapePattern(segment)
+		}
+
+		if segment == "**" {
+			tokens = append(tokens, token)
+			if n == len(skPattern.Tokens)-1 {
+				expr.WriteString("(/[^/]*)+")
+			} else {
+				expr.WriteString("(/[^/]*)*")
+			}
+			continue
+		}
+
+		var sb strings.Builder
+		expr.WriteString("/")
+		escaping := false
+		for _, ch := range segment {
+			switch {
+			case escaping:
+				// an escaped `*` is a wildcard to the server
+				escaping = false
+				escaped = true
+				sb.WriteRune(ch)
+				expr.WriteString(regexp.QuoteMeta(EscapeTokenString(string(ch))))
+			case ch == '\\':
+				escaping = true
+			case ch == '*':
+				sb.WriteRune(ch)
+				expr.WriteString("[^/]*")
+			default:
+				sb.WriteRune(ch)
+				expr.WriteString(regexp.QuoteMeta(EscapeTokenString(string(ch))))
+			}
+		}
+		if escaping {
+			sb.WriteRune('\\')
+			expr.WriteString(regexp.QuoteMeta(EscapeTokenString(`\`)))
+		}
+		tokens = append(tokens, TokenSegment(sb.String()))
+	}
+
+	if !escaped {
+		serverSk = skPattern
+		return
+	}
+
+	expr.WriteString("$")
+	serverSk = MakeStoreKeyFromTokenSegments(tokens...)
+	exact = regexp.MustCompile(expr.String())
+	return
+}
+
+// Determines if the server can page the matches itself.
+func (opts *MatchOptions) isServerPaged(exact *regexp.Regexp) bool {
+	return opts.Order == MatchOrderKey && opts.MetadataAttribute == "" && exact == nil
+}
+
+// Determines if a match of the server passes the filters applied by the
+// client.
+func (opts *MatchOptions) keepMatch(exact *regexp.Regexp, key TokenPath, metadata map[string]string) bool {
+	if exact != nil && !exact.MatchString(string(key)) {
+		return false
+	}
+	if opts.MetadataAttribute == "" {
+		return true
+	}
+	value, found := metadata[opts.MetadataAttribute]
+	return found && (opts.MetadataValue == nil || *opts.MetadataValue == value)
+}
+
+// Finds the keys matching `skPattern` that expire within `within` from now,
+// soonest first, so that they can be refreshed before they expire. Keys
+// without an expiration, and keys that have already expired, are not
+// returned.
+//
+// The server can't match by expiration, so the expiration of each match is
+// read by the client; keep `skPattern` narrow.
+func (tsc *tsClient) GetExpiringKeys(skPattern StoreKey, within time.Duration) (keys []ExpiringKey, err error) {
+	var sks []StoreKey
+	err = tsc.GetMatchingKeysStream(skPattern, func(km *KeyMatch) bool {
+		sks = append(sks, MakeStoreKeyFromPath(km.Key))
+		return true
+	})
+	if err != nil {
+		return
+	}
+
+	deadline := time.Now().Add(within)
+	keys = []ExpiringKey{}
+	for _, sk := range sks {
+		var ttl *time.Time
+		if ttl, err = tsc.GetKeyTtl(sk); err != nil {
+			return
+		}
+		if ttlIsSet(ttl) && !ttl.After(deadline) {
+			keys = append(keys, ExpiringKey{Sk: sk, Expire: *ttl})
+		}
+	}
+
+	sort.SliceStable(keys, func(i, j int) bool {
+		return keys[i].Expire.Before(keys[j].Expire)
+	})
+	return
+}
+
+// Sorts matches that are in key order by the order of `opts`, and returns the
+// page of `limit` matches at `startAt`.
+func sortMatches[T any](tsc *tsClient, all []T, opts MatchOptions, startAt, limit int, describe func(match T) (key TokenPath, value any)) (page []T, err error) {
+	ordered := make([]orderedMatch[T], len(all))
+	for n, match := range all {
+		om := &ordered[n]
+		om.match = match
+		key, value := describe(match)
+		switch opts.Order {
+		case MatchOrderValue:
+			om.sortBy, om.hasSort = numericValue(value)
+		case MatchOrderTtl:
+			var ttl *time.Time
+			if ttl, err = tsc.GetKeyTtl(MakeStoreKeyFromPath(key)); err != nil {
+				return
+			}
+			if ttlIsSet(ttl) {
+				om.sortBy, om.hasSort = float64(ttl.UnixNano()), true
+			}
+		}
+	}
+
+	sort.SliceStable(ordered, func(i, j int) bool {
+		a, b := &ordered[i], &ordered[j]
+		if a.hasSort != b.hasSort {
+			return a.hasSort
+		}
+		return a.hasSort && a.sortBy < b.sortBy
+	})
+	if opts.Descending {
+		slices.Reverse(ordered)
+	}
+
+	page = []T{}
+	for n := startAt; n < len(ordered) && len(page) < limit; n++ {
+		page = append(page, ordered[n].match)
+	}
+	return
+}
+
+// Converts a value of any Go numeric type to a float.
+func numericValue(value any) (number float64, isNumber bool) {
+	isNumber = true
+	switch v := value.(type) {
+	case int:
+		number = float64(v)
+	case int8:
+		number = float64(v)
+	case int16:
+		number = float64(v)
+	case int32:
+		number = float64(v)
+	case int64:
+		number = float64(v)
+	case uint:
+		number = float64(v)
+	case uint8:
+		number = float64(v)
+	case uint16:
+		number = float64(v)
+	case uint32:
+		number = float64(v)
+	case uint64:
+		number = float64(v)
+	case float32:
+		number = float64(v)
+	case float64:
+		number = v
+	default:
+		isNumber = false
+	}
+	return
+}
@@ -0,0 +1,115 @@
+package treestore_client
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sets a metadata attribute on a key to a typed value, returning the original
+// value (if any) as text. Metadata is stored as text, so `value` is formatted:
+// bools as true or false, integers and floats in decimal, and times in
+// RFC 3339 form with nanoseconds. Strings are stored as they are.
+//
+// Use the typed getters, such as GetMetadataAttributeInt, to read the value.
+func (tsc *tsClient) SetMetadataAttributeTyped(sk StoreKey, attribute string, value any) (keyExists bool, priorValue string, err error) {
+	var text string
+	switch t := value.(type) {
+	case string:
+		text = t
+	case bool:
+		text = strconv.FormatBool(t)
+	case int:
+		text = strconv.FormatInt(int64(t), 10)
+	case int8:
+		text = strconv.FormatInt(int64(t), 10)
+	case int16:
+		text = strconv.FormatInt(int64(t), 10)
+	case int32:
+		text = strconv.FormatInt(int64(t), 10)
+	case int64:
+		text = strconv.FormatInt(t, 10)
+	case uint:
+		text = strconv.FormatUint(uint64(t), 10)
+	case uint8:
+		text = strconv.FormatUint(uint64(t), 10)
+	case uint16:
+		text = strconv.FormatUint(uint64(t), 10)
+	case uint32:
+		text = strconv.FormatUint(uint64(t), 10)
+	case uint64:
+		text = strconv.FormatUint(t, 10)
+	case float32:
+		text = strconv.FormatFloat(float64(t), 'g', -1, 32)
+	case float64:
+		text = strconv.FormatFloat(t, 'g', -1, 64)
+	case time.Time:
+		text = t.Format(time.RFC3339Nano)
+	default:
+		err = fmt.Errorf("unsupported metadata value type %T", value)
+		return
+	}
+
+	return tsc.SetMetadataAttribute(sk, attribute, text)
+}
+
+// Fetches a key's metadata attribute as an integer. An error is returned if
+// the attribute exists but isn't an integer.
+func (tsc *tsClient) GetMetadataAttributeInt(sk StoreKey, attribute string) (attributeExists bool, value int64, err error) {
+	attributeExists, text, err := tsc.getMetadataAttributeText(sk, attribute)
+	if err != nil || !attributeExists {
+		return
+	}
+	if value, err = strconv.ParseInt(text, 10, 64); err != nil {
+		err = fmt.Errorf("metadata attribute %s is not an integer: %w", attribute, err)
+	}
+	return
+}
+
+// Fetches a key's metadata attribute as a float. An error is returned if the
+// attribute exists but isn't a number.
+func (tsc *tsClient) GetMetadataAttributeFloat(sk StoreKey, attribute string) (attributeExists bool, value float64, err error) {
+	attributeExists, text, err := tsc.getMetadataAttributeText(sk, attribute)
+	if err != nil || !attributeExists {
+		return
+	}
+	if value, err = strconv.ParseFloat(text, 64); err != nil {
+		err = fmt.Errorf("metadata attribute %s is not a number: %w", attribute, err)
+	}
+	return
+}
+
+// Fetches a key's metadata attribute as a bool, such as the "array" attribute
+// of json arrays. An error is returned if the attribute exists but isn't a
+// bool.
+func (tsc *tsClient) GetMetadataAttributeBool(sk StoreKey, attribute string) (attributeExists bool, value bool, err error) {
+	attributeExists, text, err := tsc.getMetadataAttributeText(sk, attribute)
+	if err != nil || !attributeExists {
+		return
+	}
+	if value, err = strconv.ParseBool(text); err != nil {
+		err = fmt.Errorf("metadata attribute %s is not a bool: %w", attribute, err)
+	}
+	return
+}
+
+// Fetches a key's metadata attribute as a time. An error is returned if the
+// attribute exists but isn't a time in RFC 3339 form.
+func (tsc *tsClient) GetMetadataAttributeTime(sk StoreKey, attribute string) (attributeExists bool, value time.Time, err error) {
+	attributeExists, text, err := tsc.getMetadataAttributeText(sk, attribute)
+	if err != nil || !attributeExists {
+		return
+	}
+	if value, err = time.Parse(time.RFC3339Nano, text); err != nil {
+		err = fmt.Errorf("metadata attribute %s is not a time: %w", attribute, err)
+	}
+	return
+}
+
+// Fetches a metadata attribute for a typed getter, without surrounding space.
+func (tsc *tsClient) getMetadataAttributeText(sk StoreKey, attribute string) (attributeExists bool, text string, err error) {
+	attributeExists, text, err = tsc.GetMetadataAttribute(sk, attribute)
+	text = strings.TrimSpace(text)
+	return
+}
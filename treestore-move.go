@@ -0,0 +1,96 @@
+package treestore_client
+
+import (
+	"fmt"
+	"time"
+)
+
+type (
+	// A move made by MoveReferencedKeys, with the arguments of
+	// MoveReferencedKey.
+	MoveSpec struct {
+		SrcSk     StoreKey
+		DestSk    StoreKey
+		Overwrite bool
+		Ttl       *time.Time
+		Refs      []StoreKey
+		Unrefs    []StoreKey
+	}
+)
+
+// Moves several staged records to their destinations, maintaining their index
+// keys, as a series of MoveReferencedKey calls, and returns the number of
+// records moved.
+//
+// The server can only move one key per command, so the batch is not one
+// atomic operation, and readers can see some of the records before the
+// others. Every source and destination is checked before anything is moved,
+// and if a move fails anyway, the records already moved are moved back to
+// their sources with their expirations restored, their Refs index keys are
+// unreferenced, and the failure is returned.
+//
+// The rollback is not a full undo. The index keys that a move unreferenced
+// through Unrefs are not restored, so their entries are lost; a record that
+// overwrote its destination can't be moved back, and is counted in `moved`.
+func (tsc *tsClient) MoveReferencedKeys(moves []MoveSpec) (moved int, err error) {
+	srcTtls := make([]*time.Time, len(moves))
+	for n, move := range moves {
+		// the server reports a ttl for every existing key, 0 if it has none
+		if srcTtls[n], err = tsc.GetKeyTtl(move.SrcSk); err != nil {
+			return
+		}
+		if srcTtls[n] == nil {
+			err = fmt.Errorf("move %d: source %s not found: %w", n, move.SrcSk.Path, ErrMoveFailed)
+			return
+		}
+		if !move.Overwrite {
+			var exists bool
+			if exists, err = tsc.KeyExists(move.DestSk); err != nil {
+				return
+			}
+			if exists {
+				err = fmt.Errorf("move %d: destination %s exists: %w", n, move.DestSk.Path, ErrMoveFailed)
+				return
+			}
+		}
+	}
+
+	for n, move := range moves {
+		exists, keyMoved, moveErr := tsc.MoveReferencedKey(move.SrcSk, move.DestSk, move.Overwrite, move.Ttl, move.Refs, move.Unrefs)
+		if moveErr == nil && (!exists || !keyMoved) {
+			moveErr = fmt.Errorf("move %d: %s to %s: %w", n, move.SrcSk.Path, move.DestSk.Path, ErrMoveFailed)
+		}
+		if moveErr != nil {
+			err = moveErr
+			moved = tsc.rollbackMoves(moves[:n], srcTtls)
+			return
+		}
+	}
+
+	moved = len(moves)
+	return
+}
+
+// Moves the records of `moves` back to their sources with their original
+// expirations, in reverse order, and returns the number that couldn't be
+// moved back.
+func (tsc *tsClient) rollbackMoves(moves []MoveSpec, srcTtls []*time.Time) (remaining int) {
+	for n := len(moves) - 1; n >= 0; n-- {
+		move := moves[n]
+		if move.Overwrite {
+			remaining++
+			continue
+		}
+
+		ttl := &ZeroTime
+		if ttlIsSet(srcTtls[n]) {
+			ttl = srcTtls[n]
+		}
+		_, keyMoved, err := tsc.MoveReferencedKey(move.DestSk, move.SrcSk, false, ttl, nil, move.Refs)
+		if err != nil || !keyMoved {
+			tsc.l.Errorf("can't move %s back to %s", move.DestSk.Path, move.SrcSk.Path)
+			remaining++
+		}
+	}
+	return
+}
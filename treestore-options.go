@@ -0,0 +1,230 @@
+package treestore_client
+
+import (
+	"strings"
+	"time"
+
+	"github.com/jimsnab/go-lane"
+)
+
+type (
+	// Adjusts the behavior of a client derived with With().
+	ClientOption func(tsc *tsClient)
+)
+
+// commands that modify the tree store, which are refused by a read-only client
+var writeCommands = map[string]bool{
+	"setk":        true,
+	"setkif":      true,
+	"setv":        true,
+	"setstr":      true,
+	"setint":      true,
+	"setex":       true,
+	"expirek":     true,
+	"expirekns":   true,
+	"expirev":     true,
+	"expirevns":   true,
+	"delv":        true,
+	"delk":        true,
+	"deltree":     true,
+	"setmeta":     true,
+	"delmeta":     true,
+	"resetmeta":   true,
+	"import":      true,
+	"setjson":     true,
+	"createjson":  true,
+	"replacejson": true,
+	"mergejson":   true,
+	"stagejson":   true,
+	"calc":        true,
+	"mv":          true,
+	"mvref":       true,
+	"purge":       true,
+	"autolink":    true,
+	"rmautolink":  true,
+}
+
+// commands that hold exclusive server locks while they run, which are timed
+// when ClientLockWarning is set
+var lockingCommands = map[string]bool{
+	"export":      true,
+	"import":      true,
+	"setjson":     true,
+	"createjson":  true,
+	"replacejson": true,
+	"mergejson":   true,
+	"stagejson":   true,
+	"calc":        true,
+	"deltree":     true,
+	"mv":          true,
+	"mvref":       true,
+	"purge":       true,
+	"autolink":    true,
+	"rmautolink":  true,
+}
+
+// Sets the time limit for each server response.
+func ClientTimeout(timeout time.Duration) ClientOption {
+	return func(tsc *tsClient) {
+		tsc.timeout = timeout
+	}
+}
+
+// Sets the lane used for logging.
+func ClientLane(l lane.Lane) ClientOption {
+	return func(tsc *tsClient) {
+		tsc.l = l
+	}
+}
+
+// Enables automatic retries of commands that fail due to a connection error,
+// making up to `retries` additional attempts, waiting `backoff` longer before
+// each.
+//
+// The server does not support idempotency tokens, so a retried mutation can't
+// be recognized as a duplicate. To protect against applying a mutation twice
+// (such as appending a value to the history twice), mutations are retried only
+// when the request was not completely sent. When the request was sent and the
+// response was lost, the outcome is ambiguous and the error is returned.
+// Commands that only read are always retried.
+func ClientRetries(retries int, backoff time.Duration) ClientOption {
+	return func(tsc *tsClient) {
+		tsc.retries = retries
+		tsc.retryBackoff = backoff
+	}
+}
+
+// Logs a warning through the lane when a command that holds exclusive server
+// locks (such as export, mergejson or autolink) takes longer than `threshold`
+// to complete, so lock contention is visible. Specify 0 to disable.
+//
+// The warning has the form:
+//
+//	long lock: command=mergejson key=/the/key elapsed=1.2s threshold=1s
+func ClientLockWarning(threshold time.Duration) ClientOption {
+	return func(tsc *tsClient) {
+		tsc.lockWarning = threshold
+	}
+}
+
+// Sets the size in bytes above which json payloads (of SetKeyJson, Import and
+// the like) are sent to the server base64 encoded, rather than as escaped
+// command line text. The default is 16K. Specify 0 to always use base64.
+func ClientBase64Threshold(threshold int) ClientOption {
+	return func(tsc *tsClient) {
+		tsc.base64Above = threshold
+	}
+}
+
+// Sets the largest request, in bytes, the client sends to the server. Larger
+// requests fail with ErrRequestTooLarge. The default is 64M.
+func ClientMaxRequestSize(maxBytes int) ClientOption {
+	return func(tsc *tsClient) {
+		tsc.maxRequest = maxBytes
+	}
+}
+
+// Makes GetKeyValue touch each key it finds (see TouchKey), pushing its
+// expiration out to `extendBy` from now, for sliding expiration caches. Every
+// key read through the client gets an expiration, and each read costs a
+// second command. A read-only client doesn't touch the keys it reads. Specify
+// 0 to disable.
+func ClientTouchOnRead(extendBy time.Duration) ClientOption {
+	return func(tsc *tsClient) {
+		tsc.touchOnRead = extendBy
+	}
+}
+
+// Makes the client refuse commands that modify the tree store, returning
+// ErrReadOnly instead.
+func ClientReadOnly() ClientOption {
+	return func(tsc *tsClient) {
+		tsc.readOnly = true
+	}
+}
+
+// Scopes the client to the subtree at `prefixSk`. Keys passed to the client
+// are relative to the prefix, and keys returned by the client have the prefix
+// removed. If the client already has a prefix, `prefixSk` is relative to it.
+//
+// Keys returned by the server that are outside of the prefix (for example,
+// from an address or relationship that points elsewhere) are returned
+// unchanged. Keys inside calc expressions are not translated.
+func ClientKeyPrefix(prefixSk StoreKey) ClientOption {
+	return func(tsc *tsClient) {
+		tsc.prefix = MakeStoreKeyFromPath(tsc.prefix.Path + prefixSk.Path)
+	}
+}
+
+// Returns a client that shares this client's connection, with its behavior
+// adjusted by `opts`.
+func (tsc *tsClient) With(opts ...ClientOption) TSClient {
+	derived := *tsc
+	for _, opt := range opts {
+		opt(&derived)
+	}
+	return &derived
+}
+
+// Returns a client that shares this client's connection, without a key prefix
+// or read-only restriction, for internal housekeeping.
+func (tsc *tsClient) unscoped() *tsClient {
+	derived := *tsc
+	derived.prefix = StoreKey{}
+	derived.readOnly = false
+	return &derived
+}
+
+// Returns a client with the same settings as this client, but a connection
+// of its own to the same server, for work that shouldn't contend with the
+// caller's commands. Close it when done.
+func (tsc *tsClient) dedicated() *tsClient {
+	tsc.Lock()
+	hostAndPort := tsc.hostAndPort
+	dial := tsc.dial
+	tsc.Unlock()
+
+	tsc.profileMu.Lock()
+	profiles := make(map[TokenPath]*ClientProfile, len(tsc.profiles))
+	for prefix, profile := range tsc.profiles {
+		profiles[prefix] = profile
+	}
+	tsc.profileMu.Unlock()
+
+	derived := *tsc
+	derived.tsConnection = &tsConnection{hostAndPort: hostAndPort, dial: dial, profiles: profiles}
+	return &derived
+}
+
+// Converts a caller's key to the key path sent to the server.
+func (tsc *tsClient) keyArg(sk StoreKey) string {
+	return string(tsc.prefix.Path + sk.Path)
+}
+
+// Converts a key path returned by the server to the caller's key.
+func (tsc *tsClient) responseKey(tokenPath string) StoreKey {
+	prefix := string(tsc.prefix.Path)
+	if prefix != "" {
+		if tokenPath == prefix {
+			return StoreKey{Tokens: TokenSet{}}
+		}
+		if strings.HasPrefix(tokenPath, prefix+"/") {
+			tokenPath = tokenPath[len(prefix):]
+		}
+	}
+	return MakeStoreKeyFromPath(TokenPath(tokenPath))
+}
+
+// Warns if a command holding exclusive server locks ran longer than the
+// ClientLockWarning threshold.
+func (tsc *tsClient) checkLockDuration(args []string, elapsed time.Duration) {
+	if tsc.lockWarning <= 0 || elapsed <= tsc.lockWarning || len(args) == 0 || !lockingCommands[args[0]] {
+		return
+	}
+
+	key := ""
+	if len(args) > 1 {
+		key = args[1]
+	}
+	tsc.l.Warnf("long lock: command=%s key=%s elapsed=%s threshold=%s", args[0], key, elapsed, tsc.lockWarning)
+}
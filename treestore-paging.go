@@ -0,0 +1,424 @@
+package treestore_client
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"slices"
+	"time"
+)
+
+type (
+	// A child key listed by GetLevelKeyValues, with its current value and
+	// expiration.
+	LevelKeyValue struct {
+		Segment     TokenSegment
+		HasValue    bool
+		HasChildren bool
+		Value       any
+		Ttl         *time.Time // nil when the key doesn't expire, or wasn't requested
+	}
+
+	// Options of GetLevelKeysEx.
+	LevelKeyOptions struct {
+		// Lists the children in descending order, last segment first.
+		Descending bool
+	}
+
+	// Position of a cursor in an ordered iteration: the offset where the next
+	// page is expected to start, and the last key that was returned.
+	iterationCursor struct {
+		Offset int       `json:"o"`
+		Key    TokenPath `json:"k"`
+	}
+)
+
+// number of extra matches fetched around the expected cursor position, to
+// absorb keys added or removed ahead of the cursor
+const cursorSlack = 16
+
+// number of matches fetched per request by the streaming iterators
+var streamPageSize = 1000
+
+func encodeCursor(pos iterationCursor) string {
+	by, _ := json.Marshal(pos)
+	return base64.RawURLEncoding.EncodeToString(by)
+}
+
+func decodeCursor(cursor string) (pos iterationCursor, err error) {
+	if cursor == "" {
+		return
+	}
+
+	by, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		err = errors.New("invalid cursor")
+		return
+	}
+	if err = json.Unmarshal(by, &pos); err != nil {
+		err = errors.New("invalid cursor")
+	}
+	return
+}
+
+// Iterates the keys matching `skPattern`, resuming after the position encoded
+// in `cursor`. Specify an empty cursor to start at the beginning.
+//
+// Up to `limit` keys are returned, along with `nextCursor` to resume the
+// iteration. When the iteration is complete, `nextCursor` is empty.
+//
+// The cursor records the last key returned, and matches are returned in key
+// order. Resuming skips everything up to and including that key, so keys that
+// exist for the whole iteration are returned exactly once, even if other keys
+// are added or removed in the meantime.
+func (tsc *tsClient) GetMatchingKeysCursor(skPattern StoreKey, cursor string, limit int) (keys []*KeyMatch, nextCursor string, err error) {
+	pos, err := decodeCursor(cursor)
+	if err != nil {
+		return
+	}
+	if limit <= 0 {
+		return
+	}
+
+	keys, pos, more, err := nextOrderedPage(pos, limit,
+		func(start, limit int) ([]*KeyMatch, error) {
+			return tsc.GetMatchingKeys(skPattern, start, limit)
+		},
+		func(km *KeyMatch) TokenPath { return km.Key },
+	)
+	if err != nil {
+		return
+	}
+
+	if more {
+		nextCursor = encodeCursor(pos)
+	}
+	return
+}
+
+// Lists the children of `sk` with segments matching `pattern`, resuming after
+// the position encoded in `cursor`, as GetMatchingKeysCursor does for key
+// matches. Specify an empty cursor to start at the first child.
+//
+// Up to `limit` children are returned, along with `nextCursor` to resume the
+// listing; when the listing is complete, `nextCursor` is empty. The cursor
+// records the last segment returned, so children that exist for the whole
+// listing are returned exactly once, even if other children are added or
+// removed in the meantime.
+func (tsc *tsClient) GetLevelKeysCursor(sk StoreKey, pattern string, cursor string, limit int) (keys []LevelKey, nextCursor string, err error) {
+	pos, err := decodeCursor(cursor)
+	if err != nil {
+		return
+	}
+	if limit <= 0 {
+		return
+	}
+
+	keys, pos, more, err := nextOrderedPage(pos, limit,
+		func(start, limit int) ([]LevelKey, error) {
+			return tsc.GetLevelKeys(sk, pattern, start, limit)
+		},
+		levelKeyPath,
+	)
+	if err != nil {
+		return
+	}
+
+	if more {
+		nextCursor = encodeCursor(pos)
+	}
+	return
+}
+
+// Fetches up to `limit` matches that follow `pos`, using `fetch` to retrieve
+// key-ordered matches by offset. Returns the updated position, and whether
+// more matches may follow.
+func nextOrderedPage[T any](pos iterationCursor, limit int, fetch func(start, limit int) ([]T, error), keyOf func(T) TokenPath) (matches []T, next iterationCursor, more bool, err error) {
+	var last TokenSet
+	if pos.Key != "" {
+		last = TokenPathToTokenSet(pos.Key)
+	}
+
+	next = pos
+	matches = make([]T, 0, limit)
+	pageSize := limit + cursorSlack
+	start := max(0, pos.Offset-cursorSlack)
+	positioned := (last == nil)
+	exhausted := false
+
+	for len(matches) < limit {
+		var page []T
+		if page, err = fetch(start, pageSize); err != nil {
+			return
+		}
+
+		if !positioned {
+			// if keys ahead of the cursor were removed, the page starts beyond
+			// the cursor key, or beyond the end when enough were removed; back
+			// up until the cursor key is bracketed
+			if start > 0 && (len(page) == 0 || compareKeyOrder(TokenPathToTokenSet(keyOf(page[0])), last) > 0) {
+				start = max(0, start-pageSize)
+				continue
+			}
+			positioned = true
+		}
+
+		for index, match := range page {
+			key := keyOf(match)
+			tokens := TokenPathToTokenSet(key)
+			if last != nil && compareKeyOrder(tokens, last) <= 0 {
+				continue
+			}
+			matches = append(matches, match)
+			next = iterationCursor{Offset: start + index + 1, Key: key}
+			last = tokens
+			if len(matches) >= limit {
+				break
+			}
+		}
+
+		if len(page) < pageSize {
+			exhausted = true
+			break
+		}
+		start += len(page)
+	}
+
+	more = !exhausted || len(matches) >= limit
+	return
+}
+
+// Invokes `fn` for each key matching `skPattern`, fetching the matches from
+// the server a page at a time. Iteration stops early when `fn` returns false.
+//
+// Matches are delivered in key order, and keys that exist for the whole
+// iteration are delivered exactly once, even if other keys are added or removed
+// in the meantime.
+func (tsc *tsClient) GetMatchingKeysStream(skPattern StoreKey, fn func(km *KeyMatch) bool) (err error) {
+	var pos iterationCursor
+	for {
+		var page []*KeyMatch
+		var more bool
+		page, pos, more, err = nextOrderedPage(pos, streamPageSize,
+			func(start, limit int) ([]*KeyMatch, error) {
+				return tsc.GetMatchingKeys(skPattern, start, limit)
+			},
+			func(km *KeyMatch) TokenPath { return km.Key },
+		)
+		if err != nil {
+			return
+		}
+
+		for _, km := range page {
+			if !fn(km) {
+				return
+			}
+		}
+
+		if !more {
+			return
+		}
+	}
+}
+
+// Invokes `fn` for each key with a value matching `skPattern`, fetching the
+// matches from the server a page at a time. Iteration stops early when `fn`
+// returns false.
+func (tsc *tsClient) GetMatchingKeyValuesStream(skPattern StoreKey, fn func(kvm *KeyValueMatch) bool) (err error) {
+	var pos iterationCursor
+	for {
+		var page []*KeyValueMatch
+		var more bool
+		page, pos, more, err = nextOrderedPage(pos, streamPageSize,
+			func(start, limit int) ([]*KeyValueMatch, error) {
+				return tsc.GetMatchingKeyValues(skPattern, start, limit)
+			},
+			func(kvm *KeyValueMatch) TokenPath { return kvm.Key },
+		)
+		if err != nil {
+			return
+		}
+
+		for _, kvm := range page {
+			if !fn(kvm) {
+				return
+			}
+		}
+
+		if !more {
+			return
+		}
+	}
+}
+
+// Invokes `fn` for each child of `sk` with a segment matching `pattern`,
+// fetching the children from the server a page at a time. Iteration stops
+// early when `fn` returns false.
+//
+// Children are delivered in segment order, and children that exist for the
+// whole iteration are delivered exactly once, even if other children are added
+// or removed in the meantime.
+func (tsc *tsClient) GetLevelKeysStream(sk StoreKey, pattern string, fn func(lk LevelKey) bool) (err error) {
+	var pos iterationCursor
+	for {
+		var page []LevelKey
+		var more bool
+		page, pos, more, err = nextOrderedPage(pos, streamPageSize,
+			func(start, limit int) ([]LevelKey, error) {
+				return tsc.GetLevelKeys(sk, pattern, start, limit)
+			},
+			levelKeyPath,
+		)
+		if err != nil {
+			return
+		}
+
+		for _, lk := range page {
+			if !fn(lk) {
+				return
+			}
+		}
+
+		if !more {
+			return
+		}
+	}
+}
+
+// Returns the children of `sk` with segments in the range [`fromSegment`,
+// `toSegment`), in byte order, up to `limit` children (0 for no limit). An
+// empty `fromSegment` starts at the first child, and an empty `toSegment`
+// continues to the last, so children keyed by sortable ids or timestamps can
+// be queried by range without wildcards.
+//
+// The server only matches wildcards, so the children are streamed a page at
+// a time from the first, and the range is applied by the client.
+func (tsc *tsClient) GetLevelKeysRange(sk StoreKey, fromSegment, toSegment TokenSegment, limit int) (keys []LevelKey, err error) {
+	keys = []LevelKey{}
+	err = tsc.GetLevelKeysStream(sk, "*", func(lk LevelKey) bool {
+		if len(toSegment) > 0 && bytes.Compare(lk.Segment, toSegment) >= 0 {
+			return false
+		}
+		if bytes.Compare(lk.Segment, fromSegment) >= 0 {
+			keys = append(keys, lk)
+		}
+		return limit <= 0 || len(keys) < limit
+	})
+	return
+}
+
+// Returns the children of `sk` with segments matching `pattern`, as
+// GetLevelKeys does, with options such as descending order.
+//
+// The server lists children in ascending order only. For descending order,
+// the matching children are counted (without their details), and the
+// mirrored page is fetched and reversed, so the last children can be listed
+// without fetching the others.
+func (tsc *tsClient) GetLevelKeysEx(sk StoreKey, pattern string, startAt, limit int, opts LevelKeyOptions) (keys []LevelKey, err error) {
+	if !opts.Descending {
+		return tsc.GetLevelKeys(sk, pattern, startAt, limit)
+	}
+	return reversePage(startAt, limit,
+		func() (int, error) {
+			return tsc.countMatches("segments", "nodes", tsc.keyArg(sk), pattern)
+		},
+		func(start, limit int) ([]LevelKey, error) {
+			return tsc.GetLevelKeys(sk, pattern, start, limit)
+		},
+	)
+}
+
+// Lists the children of `sk` with segments matching `pattern`, as
+// GetLevelKeys does, along with each child's current value, so that a level
+// can be listed without a GetKeyValue per child.
+//
+// The children and their values are fetched in one request, by matching
+// `sk`/`pattern` rather than listing the level. The server doesn't report
+// expirations in listings, so when `withTtl` is true, the ttl of each child
+// is read with a request of its own.
+func (tsc *tsClient) GetLevelKeyValues(sk StoreKey, pattern string, startAt, limit int, withTtl bool) (keys []LevelKeyValue, err error) {
+	matches, err := tsc.GetMatchingKeys(AppendStoreKeySegmentStrings(MakeStoreKeyFromPath(sk.Path), pattern), startAt, limit)
+	if err != nil {
+		return
+	}
+
+	keys = make([]LevelKeyValue, 0, len(matches))
+	for _, km := range matches {
+		childSk := MakeStoreKeyFromPath(km.Key)
+		lkv := LevelKeyValue{
+			Segment:     childSk.Tokens[len(childSk.Tokens)-1],
+			HasValue:    km.HasValue,
+			HasChildren: km.HasChildren,
+			Value:       km.CurrentValue,
+		}
+		if withTtl {
+			var ttl *time.Time
+			if ttl, err = tsc.GetKeyTtl(childSk); err != nil {
+				return
+			}
+			if ttlIsSet(ttl) {
+				lkv.Ttl = ttl
+			}
+		}
+		keys = append(keys, lkv)
+	}
+	return
+}
+
+// Fetches the page of `limit` entries at `startAt` counting back from the
+// last entry, by fetching the mirrored page in ascending order and reversing
+// it. Entries added or removed between the count and the fetch shift the
+// page, as they do between the pages of an ascending listing.
+func reversePage[T any](startAt, limit int, count func() (int, error), fetch func(start, limit int) ([]T, error)) (page []T, err error) {
+	total, err := count()
+	if err != nil {
+		return
+	}
+
+	end := total - startAt
+	if end <= 0 || limit <= 0 {
+		page = []T{}
+		return
+	}
+
+	start := max(0, end-limit)
+	if page, err = fetch(start, end-start); err != nil {
+		return
+	}
+	slices.Reverse(page)
+	return
+}
+
+// Orders level keys by segment, as a single-segment token path.
+func levelKeyPath(lk LevelKey) TokenPath {
+	return TokenSetToTokenPath(TokenSet{lk.Segment})
+}
+
+// Walks the subtree under `sk` breadth first, one level at a time, invoking
+// `fn` for each key. Keys one level below `sk` are depth 1; specify
+// `maxDepth` as 0 for no limit. The walk stops early when `fn` returns false.
+//
+// Each level is fetched with a wildcard pattern and streamed a page at a time.
+func (tsc *tsClient) WalkTree(sk StoreKey, maxDepth int, fn func(km *KeyMatch) bool) (err error) {
+	levelSk := sk
+	for depth := 1; maxDepth <= 0 || depth <= maxDepth; depth++ {
+		levelSk = AppendStoreKeySegmentStrings(levelSk, "*")
+
+		stopped := false
+		deeper := false
+		err = tsc.GetMatchingKeysStream(levelSk, func(km *KeyMatch) bool {
+			if km.HasChildren {
+				deeper = true
+			}
+			if !fn(km) {
+				stopped = true
+			}
+			return !stopped
+		})
+		if err != nil || stopped || !deeper {
+			return
+		}
+	}
+	return
+}
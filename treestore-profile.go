@@ -0,0 +1,108 @@
+package treestore_client
+
+import (
+	"strings"
+	"time"
+)
+
+type (
+	// Transforms values of the keys covered by a profile, for example to
+	// serialize application types or to encrypt. EncodeValue is applied before a
+	// value is sent to the server, and DecodeValue after a value is received.
+	// The key is the absolute key path on the server.
+	ValueCodec interface {
+		EncodeValue(tokenPath TokenPath, value any) (encoded any, err error)
+		DecodeValue(tokenPath TokenPath, encoded any) (value any, err error)
+	}
+
+	// Behavior applied to the keys under a prefix. Zero fields keep the
+	// client's behavior.
+	ClientProfile struct {
+		// Time limit for a server response to a command on a key under the prefix.
+		Timeout time.Duration
+
+		// Codec applied to the values of keys under the prefix.
+		Codec ValueCodec
+	}
+)
+
+// Registers a profile for the keys under `prefixSk` (relative to the client's
+// key prefix), or removes it when `profile` is nil. Profiles are shared by the
+// clients derived with With(). When profiles are nested, the one with the
+// longest prefix applies.
+func (tsc *tsClient) SetProfile(prefixSk StoreKey, profile *ClientProfile) {
+	tsc.profileMu.Lock()
+	defer tsc.profileMu.Unlock()
+
+	prefix := TokenPath(tsc.keyArg(prefixSk))
+	if profile == nil {
+		delete(tsc.profiles, prefix)
+		return
+	}
+
+	if tsc.profiles == nil {
+		tsc.profiles = map[TokenPath]*ClientProfile{}
+	}
+	copied := *profile
+	tsc.profiles[prefix] = &copied
+}
+
+// Finds the profile with the longest prefix containing the absolute key path,
+// or nil if none.
+func (tsc *tsClient) profileFor(tokenPath string) (profile *ClientProfile) {
+	tsc.profileMu.Lock()
+	defer tsc.profileMu.Unlock()
+
+	longest := -1
+	for prefix, candidate := range tsc.profiles {
+		p := string(prefix)
+		if len(p) > longest && (tokenPath == p || strings.HasPrefix(tokenPath, p+"/") || p == "") {
+			profile = candidate
+			longest = len(p)
+		}
+	}
+	return
+}
+
+// Determines the response time limit for a command. Commands are matched to
+// profiles by their first argument, which is the key for most commands.
+func (tsc *tsClient) commandTimeout(args []string) time.Duration {
+	if len(args) > 1 && strings.HasPrefix(args[1], "/") {
+		if profile := tsc.profileFor(args[1]); profile != nil && profile.Timeout > 0 {
+			return profile.Timeout
+		}
+	}
+	return tsc.timeout
+}
+
+// Converts a value to its command line form, applying the codec of the key's
+// profile.
+func (tsc *tsClient) encodeValue(sk StoreKey, value any) (val, valType string, err error) {
+	tokenPath := tsc.keyArg(sk)
+	if profile := tsc.profileFor(tokenPath); profile != nil && profile.Codec != nil {
+		if value, err = profile.Codec.EncodeValue(TokenPath(tokenPath), value); err != nil {
+			return
+		}
+	}
+
+	if val, valType, err = nativeValueToCmdline(value); err != nil {
+		return
+	}
+	tsc.recordValueSize(tokenPath, val, true)
+	return
+}
+
+// Converts a value from its command line form, applying the codec of the
+// profile for the absolute key path.
+func (tsc *tsClient) decodeValue(tokenPath string, valStr, valType string) (value any, err error) {
+	tsc.recordValueSize(tokenPath, valStr, false)
+
+	if value, err = cmdlineToNativeValue(valStr, valType); err != nil {
+		return
+	}
+
+	if profile := tsc.profileFor(tokenPath); profile != nil && profile.Codec != nil {
+		value, err = profile.Codec.DecodeValue(TokenPath(tokenPath), value)
+	}
+	return
+}
@@ -0,0 +1,85 @@
+package treestore_client
+
+import (
+	"sync"
+	"time"
+)
+
+type (
+	// A token bucket for commands and request bytes. Each bucket holds up to
+	// one second of its rate.
+	rateLimiter struct {
+		mu          sync.Mutex
+		commandRate float64
+		byteRate    float64
+		failFast    bool
+		commands    float64
+		bytes       float64
+		updated     time.Time
+	}
+)
+
+// Limits the rate at which the client sends commands to `commandsPerSec`,
+// and the rate of request bytes to `bytesPerSec`, so that a batch job can't
+// saturate a shared server. Specify 0 for either to leave it unlimited, or 0
+// for both to remove the limit. Bursts of up to one second of each rate are
+// allowed.
+//
+// A command over the limit waits until it is within the limit, or with
+// `failFast`, fails with ErrRateLimited without being sent. A request larger
+// than one second of `bytesPerSec` is sent once the bucket is full, and the
+// commands after it wait for the excess. The limit is shared by the clients
+// derived with With().
+func (tsc *tsClient) SetRateLimit(commandsPerSec, bytesPerSec float64, failFast bool) {
+	if commandsPerSec <= 0 && bytesPerSec <= 0 {
+		tsc.rateLimit.Store(nil)
+		return
+	}
+
+	tsc.rateLimit.Store(&rateLimiter{
+		commandRate: max(commandsPerSec, 0),
+		byteRate:    max(bytesPerSec, 0),
+		failFast:    failFast,
+		commands:    max(commandsPerSec, 1),
+		bytes:       max(bytesPerSec, 0),
+		updated:     time.Now(),
+	})
+}
+
+// Takes a command of `size` bytes from the buckets, waiting for them to
+// refill as needed, or failing with ErrRateLimited in fail-fast mode.
+func (rl *rateLimiter) acquire(size int) error {
+	for {
+		rl.mu.Lock()
+		now := time.Now()
+		elapsed := now.Sub(rl.updated).Seconds()
+		rl.updated = now
+
+		var wait float64
+		if rl.commandRate > 0 {
+			rl.commands = min(rl.commands+elapsed*rl.commandRate, max(rl.commandRate, 1))
+			if rl.commands < 1 {
+				wait = (1 - rl.commands) / rl.commandRate
+			}
+		}
+		if rl.byteRate > 0 {
+			rl.bytes = min(rl.bytes+elapsed*rl.byteRate, rl.byteRate)
+			if needed := min(float64(size), rl.byteRate); rl.bytes < needed {
+				wait = max(wait, (needed-rl.bytes)/rl.byteRate)
+			}
+		}
+
+		if wait == 0 {
+			rl.commands--
+			rl.bytes -= float64(size)
+			rl.mu.Unlock()
+			return nil
+		}
+		rl.mu.Unlock()
+
+		if rl.failFast {
+			return ErrRateLimited
+		}
+		time.Sleep(time.Duration(wait * float64(time.Second)))
+	}
+}
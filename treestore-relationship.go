@@ -0,0 +1,352 @@
+package treestore_client
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	// Controls how DeleteKeyTreeCascade cleans up relationships to the
+	// deleted keys.
+	CascadeOptions struct {
+		// The keys that are checked for relationships to the deleted keys;
+		// all keys if empty.
+		ReferrersPattern StoreKey
+
+		// Removes the relationship slots that link to the deleted keys,
+		// shifting the later slots down, rather than emptying them. Emptying
+		// keeps the indexes of the other relationships, including named ones.
+		RemoveSlots bool
+	}
+)
+
+// The metadata attribute prefix of relationship names. The attribute
+// `relationship:<name>` holds the index of the named relationship slot.
+const RelationshipNamePrefix = "relationship:"
+
+// Returns all of the relationships of `sk` and the keys and values they link
+// to. `values` parallels `addresses`; an entry is nil if the slot is empty (a
+// zero address) or the target doesn't exist. Both are nil if `sk` doesn't
+// exist.
+//
+// The relationship list is read with a single key match, rather than by
+// following relationship indexes until one is missing, and then the targets
+// are fetched with KeyValuesFromAddresses.
+func (tsc *tsClient) GetRelationships(sk StoreKey) (addresses []StoreAddress, values []*RelationshipValue, err error) {
+	relationships, _, exists, err := tsc.keyRelationships(sk)
+	if err != nil || !exists {
+		return
+	}
+
+	results, err := tsc.KeyValuesFromAddresses(relationships)
+	if err != nil {
+		return
+	}
+
+	addresses = relationships
+	values = make([]*RelationshipValue, len(addresses))
+	for n, result := range results {
+		if result.KeyExists {
+			values[n] = &RelationshipValue{Sk: result.Sk, CurrentValue: result.Value}
+		}
+	}
+	return
+}
+
+// Stores `addr` in a new relationship slot of `sk`, after the last slot in
+// use, and returns its index. Nothing is done if `sk` doesn't exist.
+//
+// The server can only replace the whole relationship array, so the array is
+// read, changed and written back while the client holds a lock on the key
+// (see LocksSk). Changes made with the relationship helpers, on any
+// connection, are serialized by the lock; an array written directly, such as
+// by SetKeyValueEx with relationships, doesn't take the lock, and a change
+// made that way during the update is overwritten.
+func (tsc *tsClient) AddRelationship(sk StoreKey, addr StoreAddress) (index int, exists bool, err error) {
+	err = tsc.updateRelationships(sk, func(relationships []StoreAddress, metadata map[string]string) []StoreAddress {
+		exists = true
+		index = len(relationships)
+		return append(relationships, addr)
+	})
+	return
+}
+
+// Empties the first relationship slot of `sk` that holds `addr`. The indexes
+// of the other relationships are not changed. See AddRelationship for how
+// concurrent changes are handled.
+func (tsc *tsClient) RemoveRelationship(sk StoreKey, addr StoreAddress) (removed bool, err error) {
+	if addr == 0 {
+		return
+	}
+
+	err = tsc.updateRelationships(sk, func(relationships []StoreAddress, metadata map[string]string) []StoreAddress {
+		n := slices.Index(relationships, addr)
+		if n < 0 {
+			return nil
+		}
+		removed = true
+		relationships[n] = 0
+		return relationships
+	})
+	return
+}
+
+// Empties relationship slot `index` of `sk`, returning the address it held,
+// or 0 if the slot was already empty or doesn't exist. The indexes of the
+// other relationships are not changed. See AddRelationship for how concurrent
+// changes are handled.
+func (tsc *tsClient) RemoveRelationshipAt(sk StoreKey, index int) (addr StoreAddress, err error) {
+	err = tsc.updateRelationships(sk, func(relationships []StoreAddress, metadata map[string]string) []StoreAddress {
+		if index < 0 || index >= len(relationships) || relationships[index] == 0 {
+			return nil
+		}
+		addr = relationships[index]
+		relationships[index] = 0
+		return relationships
+	})
+	return
+}
+
+// Reads the relationship array and metadata of `sk` with a key match.
+func (tsc *tsClient) keyRelationships(sk StoreKey) (relationships []StoreAddress, metadata map[string]string, exists bool, err error) {
+	err = tsc.GetMatchingKeysStream(sk, func(km *KeyMatch) bool {
+		if km.Key == sk.Path {
+			relationships = slices.Clone(km.Relationships)
+			metadata = km.Metadata
+			exists = true
+			return false
+		}
+		return true
+	})
+	return
+}
+
+// Locks `sk` and updates its relationship array with `update`, as
+// updateRelationshipsLocked does.
+func (tsc *tsClient) updateRelationships(sk StoreKey, update func(relationships []StoreAddress, metadata map[string]string) []StoreAddress) (err error) {
+	unlock, err := tsc.lockKey(sk)
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	return tsc.updateRelationshipsLocked(sk, update)
+}
+
+// Reads the relationship array and metadata of `sk`, passes them to
+// `update`, and writes back the array that `update` returns, with the empty
+// slots at the end removed. `update` isn't called if `sk` doesn't exist, and
+// returns nil to leave the array unchanged. The key's expiration is kept. The
+// caller must hold the lock on `sk`.
+func (tsc *tsClient) updateRelationshipsLocked(sk StoreKey, update func(relationships []StoreAddress, metadata map[string]string) []StoreAddress) (err error) {
+	relationships, metadata, exists, err := tsc.keyRelationships(sk)
+	if err != nil || !exists {
+		return
+	}
+
+	updated := update(relationships, metadata)
+	if updated == nil {
+		return
+	}
+	for len(updated) > 0 && updated[len(updated)-1] == 0 {
+		updated = updated[:len(updated)-1]
+	}
+	updated = slices.Clip(updated)
+	if len(updated) == 0 {
+		// the server ignores an empty relationship list, so one empty slot
+		// is left
+		updated = []StoreAddress{0}
+	}
+
+	// the write is a setex, which otherwise removes the expiration
+	ttl, err := tsc.GetKeyTtl(sk)
+	if err != nil {
+		return
+	}
+	var expire *time.Time
+	if ttlIsSet(ttl) {
+		expire = ttl
+	}
+
+	_, _, _, err = tsc.SetKeyValueEx(sk, nil, SetExNoValueUpdate|SetExMustExist, expire, updated)
+	return
+}
+
+// Stores `addr` in the relationship slot of `sk` named `name`, returning the
+// slot's index. A name that isn't defined on `sk` is given the slot after the
+// last slot in use or named, and recorded in the key's metadata under
+// RelationshipNamePrefix. Nothing is done if `sk` doesn't exist, and the
+// key's expiration is kept. See AddRelationship for how concurrent changes
+// are handled.
+func (tsc *tsClient) SetRelationshipByName(sk StoreKey, name string, addr StoreAddress) (index int, exists bool, err error) {
+	if name == "" {
+		err = fmt.Errorf("empty relationship name")
+		return
+	}
+
+	// the name is recorded under the lock too, so that two new names don't
+	// get the same slot
+	unlock, err := tsc.lockKey(sk)
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	var named bool
+	err = tsc.updateRelationshipsLocked(sk, func(relationships []StoreAddress, metadata map[string]string) []StoreAddress {
+		exists = true
+		names := relationshipNames(metadata)
+		if index, named = names[name]; !named {
+			index = len(relationships)
+			for _, n := range names {
+				index = max(index, n+1)
+			}
+		}
+
+		for len(relationships) <= index {
+			relationships = append(relationships, 0)
+		}
+		relationships[index] = addr
+		return relationships
+	})
+	if err != nil || !exists || named {
+		return
+	}
+
+	_, _, err = tsc.SetMetadataAttribute(sk, RelationshipNamePrefix+name, strconv.Itoa(index))
+	return
+}
+
+// Follows the relationship of `sk` named `name`, as GetRelationshipValue does
+// for an index. `hasLink` is false if the name isn't defined on `sk` or its
+// slot is empty.
+func (tsc *tsClient) GetRelationshipValueByName(sk StoreKey, name string) (hasLink bool, rv *RelationshipValue, err error) {
+	index, named, err := tsc.GetRelationshipIndex(sk, name)
+	if err != nil || !named {
+		return
+	}
+	return tsc.GetRelationshipValue(sk, index)
+}
+
+// Returns the index of the relationship slot of `sk` named `name`, for use
+// with the index-based relationship APIs.
+func (tsc *tsClient) GetRelationshipIndex(sk StoreKey, name string) (index int, named bool, err error) {
+	named, value, err := tsc.GetMetadataAttribute(sk, RelationshipNamePrefix+name)
+	if err != nil || !named {
+		return
+	}
+	if index, err = strconv.Atoi(value); err != nil {
+		named = false
+		err = fmt.Errorf("relationship name %s has invalid index %s", name, value)
+	}
+	return
+}
+
+// Returns the relationship names defined in key metadata and their indexes.
+// Attributes holding an invalid index are ignored.
+func relationshipNames(metadata map[string]string) map[string]int {
+	names := map[string]int{}
+	for attribute, value := range metadata {
+		if name, found := strings.CutPrefix(attribute, RelationshipNamePrefix); found {
+			if index, err := strconv.Atoi(value); err == nil && index >= 0 {
+				names[name] = index
+			}
+		}
+	}
+	return names
+}
+
+// Deletes a key and all of its child data, as DeleteKeyTree does, and cleans
+// up the relationships of other keys that link into the deleted subtree, so
+// that they aren't left dangling. The keys whose relationships changed are
+// returned in `referrers`, in key order.
+//
+// The server doesn't keep a reverse index of relationships, so the referrers
+// are found by scanning the keys matching opts.ReferrersPattern - the whole
+// store unless a pattern is given - and resolving their relationship
+// addresses before the delete. The delete and the cleanup are separate
+// commands; a relationship to the subtree made during the operation can be
+// missed. Each referrer is updated as AddRelationship does, under a lock on
+// the referrer, and keeps its expiration.
+func (tsc *tsClient) DeleteKeyTreeCascade(sk StoreKey, opts CascadeOptions) (removed bool, referrers []StoreKey, err error) {
+	pattern := opts.ReferrersPattern
+	if len(pattern.Tokens) == 0 {
+		pattern = MakeStoreKey("**")
+	}
+
+	candidates := map[TokenPath][]StoreAddress{}
+	var addrs []StoreAddress
+	err = tsc.GetMatchingKeysStream(pattern, func(km *KeyMatch) bool {
+		if isSameOrDescendant(km.Key, sk.Path) {
+			return true
+		}
+		for _, addr := range km.Relationships {
+			if addr != 0 {
+				candidates[km.Key] = km.Relationships
+				addrs = append(addrs, km.Relationships...)
+				break
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return
+	}
+
+	results, err := tsc.KeysFromAddresses(addrs)
+	if err != nil {
+		return
+	}
+	targets := map[StoreAddress]bool{}
+	for n, result := range results {
+		if result.KeyExists && isSameOrDescendant(result.Sk.Path, sk.Path) {
+			targets[addrs[n]] = true
+		}
+	}
+
+	if removed, err = tsc.DeleteKeyTree(sk); err != nil || len(targets) == 0 {
+		return
+	}
+
+	paths := make([]TokenPath, 0, len(candidates))
+	for path, relationships := range candidates {
+		if slices.ContainsFunc(relationships, func(addr StoreAddress) bool { return targets[addr] }) {
+			paths = append(paths, path)
+		}
+	}
+	sort.Slice(paths, func(i, j int) bool { return paths[i] < paths[j] })
+
+	referrers = []StoreKey{}
+	for _, path := range paths {
+		refSk := MakeStoreKeyFromPath(path)
+		changed := false
+		err = tsc.updateRelationships(refSk, func(relationships []StoreAddress, metadata map[string]string) []StoreAddress {
+			kept := relationships[:0]
+			for _, addr := range relationships {
+				if targets[addr] {
+					changed = true
+					if opts.RemoveSlots {
+						continue
+					}
+					addr = 0
+				}
+				kept = append(kept, addr)
+			}
+			if !changed {
+				return nil
+			}
+			return kept
+		})
+		if err != nil {
+			return
+		}
+		if changed {
+			referrers = append(referrers, refSk)
+		}
+	}
+	return
+}
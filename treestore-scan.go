@@ -0,0 +1,110 @@
+package treestore_client
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Invokes `fn` for each key matching `skPattern`, scanning with `workers`
+// concurrent connections, for sweeps of a large part of the store.
+//
+// The key space is partitioned by the segments at the first wildcard of
+// `skPattern`: each child there is a partition, streamed a page at a time by
+// the next free worker. Each worker has a connection of its own, which is
+// closed when the scan ends. A pattern without wildcards, or whose first
+// wildcard is a `**` that is followed by more segments, isn't partitioned and
+// is scanned by one worker.
+//
+// `fn` is invoked concurrently, from several workers, and keys are not
+// delivered in key order. When `fn` returns false, the workers stop after
+// the keys they are delivering. The first error stops the scan and is
+// returned.
+func (tsc *tsClient) ScanParallel(skPattern StoreKey, workers int, fn func(km *KeyMatch) bool) (err error) {
+	partitions, err := tsc.scanPartitions(skPattern)
+	if err != nil {
+		return
+	}
+	workers = max(1, min(workers, len(partitions)))
+
+	queue := make(chan []StoreKey, len(partitions))
+	for _, partition := range partitions {
+		queue <- partition
+	}
+	close(queue)
+
+	var stopped atomic.Bool
+	var errMu sync.Mutex
+	var wg sync.WaitGroup
+	for n := 0; n < workers; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			worker := tsc.dedicated()
+			defer worker.Close()
+
+			for partition := range queue {
+				for _, patternSk := range partition {
+					if stopped.Load() {
+						return
+					}
+					scanErr := worker.GetMatchingKeysStream(patternSk, func(km *KeyMatch) bool {
+						if stopped.Load() || !fn(km) {
+							stopped.Store(true)
+							return false
+						}
+						return true
+					})
+					if scanErr != nil {
+						errMu.Lock()
+						if err == nil {
+							err = scanErr
+						}
+						errMu.Unlock()
+						stopped.Store(true)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return
+}
+
+// Splits the keys matching `skPattern` into partitions, each a list of
+// patterns to stream in turn.
+func (tsc *tsClient) scanPartitions(skPattern StoreKey) (partitions [][]StoreKey, err error) {
+	wild := -1
+	for n, token := range skPattern.Tokens {
+		if strings.Contains(string(token), "*") {
+			wild = n
+			break
+		}
+	}
+
+	multiLevel := wild >= 0 && string(skPattern.Tokens[wild]) == "**"
+	if wild < 0 || (multiLevel && wild < len(skPattern.Tokens)-1) {
+		partitions = [][]StoreKey{{skPattern}}
+		return
+	}
+
+	parentSk := MakeStoreKeyFromTokenSegments(skPattern.Tokens[:wild]...)
+	levelPattern := string(skPattern.Tokens[wild])
+	if multiLevel {
+		levelPattern = "*"
+	}
+
+	partitions = [][]StoreKey{}
+	err = tsc.GetLevelKeysStream(parentSk, levelPattern, func(lk LevelKey) bool {
+		childSk := AppendStoreKeySegments(MakeStoreKeyFromPath(parentSk.Path), lk.Segment)
+		if multiLevel {
+			// `**` matches the child as well as its descendants
+			partitions = append(partitions, []StoreKey{childSk, AppendStoreKeySegmentStrings(MakeStoreKeyFromPath(childSk.Path), "**")})
+		} else {
+			partitions = append(partitions, []StoreKey{MakeStoreKeyFromTokenSegments(append(childSk.Tokens, skPattern.Tokens[wild+1:]...)...)})
+		}
+		return true
+	})
+	return
+}
@@ -0,0 +1,70 @@
+package treestore_client
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Scans the subtree at `rootSk`, including `rootSk` itself, and returns the
+// keys whose current value equals `value`, in key order, stopping after
+// `limit` keys (0 for no limit). Values are equal as they are for
+// SetKeyValueCAS: with the same type as well as the same content, so a
+// number must be given as the type it was stored as.
+//
+// The server has no value search, so the values are fetched a page at a time
+// with GetMatchingKeyValuesStream and compared by the client. This is meant
+// for debugging and ad-hoc queries; use an index for frequent lookups.
+func (tsc *tsClient) FindKeysByValue(rootSk StoreKey, value any, limit int) (keys []StoreKey, err error) {
+	keys = []StoreKey{}
+
+	var compareErr error
+	match := func(kvm *KeyValueMatch) bool {
+		var equal bool
+		if equal, compareErr = valuesEqual(kvm.CurrentValue, value); compareErr != nil {
+			return false
+		}
+		if equal {
+			keys = append(keys, MakeStoreKeyFromPath(kvm.Key))
+		}
+		return limit <= 0 || len(keys) < limit
+	}
+
+	var rootValue any
+	var valueExists bool
+	if rootValue, _, valueExists, err = tsc.GetKeyValue(rootSk); err != nil {
+		return
+	}
+	if valueExists && !match(&KeyValueMatch{Key: rootSk.Path, CurrentValue: rootValue}) {
+		err = compareErr
+		return
+	}
+
+	if err = tsc.GetMatchingKeyValuesStream(AppendStoreKeySegmentStrings(MakeStoreKeyFromPath(rootSk.Path), "**"), match); err == nil {
+		err = compareErr
+	}
+	return
+}
+
+// Invokes `fn` for each key matching `skPattern` whose path also matches the
+// regular expression `expr`, such as `^/users/[0-9]+/sessions$`. The path is
+// the key's StoreKey.Path, relative to the client's key prefix, with the
+// escapes of a token path. Iteration stops early when `fn` returns false.
+//
+// The server only matches simple wildcards, so the keys matching `skPattern`
+// are streamed a page at a time and the expression is applied by the client;
+// use the narrowest wildcard pattern that covers the expression, such as
+// /users/*/sessions rather than /**.
+func (tsc *tsClient) GetMatchingKeysRegexStream(skPattern StoreKey, expr string, fn func(km *KeyMatch) bool) (err error) {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		err = fmt.Errorf("invalid key expression: %w", err)
+		return
+	}
+
+	return tsc.GetMatchingKeysStream(skPattern, func(km *KeyMatch) bool {
+		if !re.MatchString(string(km.Key)) {
+			return true
+		}
+		return fn(km)
+	})
+}
@@ -0,0 +1,104 @@
+package treestore_client
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"math"
+	"sync"
+	"time"
+)
+
+type (
+	// A consistent, point-in-time view of a subtree, made by BeginSnapshot.
+	// Reads of the snapshot are not affected by writes made after it began.
+	// Call Close to release the server memory held by the snapshot.
+	Snapshot struct {
+		reader    *tsClient
+		root      *tsClient
+		tempSk    StoreKey
+		stopAlive func()
+		closeOnce sync.Once
+	}
+)
+
+// The staging key under which snapshot copies are held.
+var SnapshotsSk = MakeStoreKey("treestore-client", "snapshots")
+
+// how often an open snapshot's expiration is refreshed
+const snapshotKeepAliveInterval = 30 * time.Second
+
+// Begins a snapshot of the subtree at `sk`.
+//
+// The server doesn't have snapshot reads, so the subtree is exported - which
+// the server does under an exclusive lock, making the view consistent - and
+// imported into a private copy under SnapshotsSk, without value history. The
+// snapshot reads the copy, and so needs as much server memory as the subtree.
+//
+// The copy is staged, so it expires if the client goes away without closing
+// the snapshot. Use CleanupStaging on SnapshotsSk to remove copies that are
+// left behind.
+func (tsc *tsClient) BeginSnapshot(sk StoreKey) (snap *Snapshot, err error) {
+	root := tsc.unscoped()
+
+	node, err := tsc.exportHistoryNode(sk)
+	if err != nil {
+		return
+	}
+
+	tempSk, _, err := root.StageKeyJson(SnapshotsSk, map[string]any{}, JsonStageCleanupOnClose)
+	if err != nil {
+		return
+	}
+
+	if node != nil {
+		// only the current values are needed
+		snapshotNode(node, math.MaxInt64)
+		var exported []byte
+		if exported, err = json.Marshal(node); err != nil {
+			return
+		}
+		copySk := MakeStoreKeyFromPath(tempSk.Path + TokenPath(tsc.keyArg(sk)))
+		if err = root.ImportBase64(copySk, base64.StdEncoding.EncodeToString(exported)); err != nil {
+			root.AbortStagedKey(tempSk)
+			return
+		}
+	}
+
+	reader := *root
+	reader.prefix = MakeStoreKeyFromPath(tempSk.Path + tsc.prefix.Path)
+	reader.touchOnRead = 0
+
+	snap = &Snapshot{
+		reader:    &reader,
+		root:      root,
+		tempSk:    tempSk,
+		stopAlive: root.KeepStagedAlive(tempSk, snapshotKeepAliveInterval),
+	}
+	return
+}
+
+// Looks up the key in the snapshot and returns the value if it exists.
+func (snap *Snapshot) GetKeyValue(sk StoreKey) (value any, keyExists, valueExists bool, err error) {
+	return snap.reader.GetKeyValue(sk)
+}
+
+// Retrieves the child key tree and leaf values of the snapshot in the form of
+// json.
+func (snap *Snapshot) GetKeyAsJson(sk StoreKey, opt JsonOptions) (jsonData any, err error) {
+	return snap.reader.GetKeyAsJson(sk, opt)
+}
+
+// Finds the keys of the snapshot that match `skPattern`, with the same
+// paging as TSClient.GetMatchingKeys.
+func (snap *Snapshot) GetMatchingKeys(skPattern StoreKey, startAt, limit int) (keys []*KeyMatch, err error) {
+	return snap.reader.GetMatchingKeys(skPattern, startAt, limit)
+}
+
+// Ends the snapshot and deletes its copy of the subtree.
+func (snap *Snapshot) Close() (err error) {
+	snap.closeOnce.Do(func() {
+		snap.stopAlive()
+		_, err = snap.root.AbortStagedKey(snap.tempSk)
+	})
+	return
+}
@@ -0,0 +1,361 @@
+package treestore_client
+
+import (
+	"sync"
+	"time"
+)
+
+// the server assigns a one minute expiration to keys made by stagejson
+const stagedKeyLifetime = time.Minute
+
+// the number of staging children to fetch per nodes request
+const stagingPageSize = 1000
+
+// Tracks a staged key (as an absolute key) so that it is deleted when the
+// client is closed.
+func (tsc *tsClient) registerStaged(tempSk StoreKey) {
+	tsc.stagedMu.Lock()
+	defer tsc.stagedMu.Unlock()
+
+	if tsc.staged == nil {
+		tsc.staged = map[TokenPath]StoreKey{}
+	}
+	tsc.staged[tempSk.Path] = tempSk
+}
+
+// Stops tracking a staged key that has been committed or aborted.
+func (tsc *tsClient) unregisterStaged(tempSk StoreKey) {
+	tsc.stagedMu.Lock()
+	defer tsc.stagedMu.Unlock()
+	delete(tsc.staged, TokenPath(tsc.keyArg(tempSk)))
+}
+
+// Commits a key staged by StageKeyJson: moves `tempSk` to `destSk` with
+// MoveReferencedKey, maintaining the index keys `refs` and `unrefs`. Unlike
+// MoveReferencedKey, a nil `ttl` clears the staging expiration, so the
+// committed key is permanent; specify a time to set a new expiration.
+func (tsc *tsClient) CommitStagedKey(tempSk, destSk StoreKey, overwrite bool, ttl *time.Time, refs, unrefs []StoreKey) (exists, moved bool, err error) {
+	if ttl == nil {
+		ttl = &ZeroTime
+	}
+
+	if exists, moved, err = tsc.MoveReferencedKey(tempSk, destSk, overwrite, ttl, refs, unrefs); err != nil {
+		return
+	}
+	if moved {
+		tsc.unregisterStaged(tempSk)
+	}
+	return
+}
+
+// Deletes a key staged by StageKeyJson immediately, rather than waiting for it
+// to expire.
+func (tsc *tsClient) AbortStagedKey(tempSk StoreKey) (removed bool, err error) {
+	if removed, err = tsc.DeleteKeyTree(tempSk); err != nil {
+		return
+	}
+	tsc.unregisterStaged(tempSk)
+	return
+}
+
+// Stages `jsonData` under `stagingSk`, calls `verify` to check the staged key
+// with any reads it needs, and then either commits the key to `destSk` with
+// CommitStagedKey, replacing an existing key, or deletes it if `verify` returns
+// an error (which is returned). The commit is a single move, so readers of
+// `destSk` see either the prior document or the verified one.
+//
+// The staged key is also deleted if `verify` panics, and when the client is
+// closed if it is left behind.
+func (tsc *tsClient) StageKeyJsonVerified(stagingSk, destSk StoreKey, jsonData any, opts JsonOptions, verify func(tempSk StoreKey) error) (moved bool, err error) {
+	tempSk, _, err := tsc.StageKeyJson(stagingSk, jsonData, opts|JsonStageCleanupOnClose)
+	if err != nil {
+		return
+	}
+
+	finished := false
+	defer func() {
+		if !finished {
+			tsc.AbortStagedKey(tempSk)
+		}
+	}()
+
+	if err = verify(tempSk); err != nil {
+		return
+	}
+
+	_, moved, err = tsc.CommitStagedKey(tempSk, destSk, true, nil, nil, nil)
+	finished = moved
+	return
+}
+
+// Deletes the staged keys that were registered for cleanup. Keys that have
+// already been committed (moved) or have expired are simply not found.
+func (tsc *tsClient) cleanupRegisteredStaged() {
+	tsc.stagedMu.Lock()
+	staged := tsc.staged
+	tsc.staged = nil
+	tsc.stagedMu.Unlock()
+
+	// registered keys are absolute, regardless of the registering client's prefix
+	root := tsc.unscoped()
+	for _, tempSk := range staged {
+		if _, err := root.DeleteKeyTree(tempSk); err != nil {
+			tsc.l.Warnf("can't clean up staged key %s: %s", tempSk.Path, err.Error())
+		}
+	}
+}
+
+// Removes staged subtrees under `stagingSk` that were staged longer than
+// `olderThan` ago, or that no longer have an expiration (and so would never
+// be cleaned up by the server).
+//
+// The staging time is derived from the key expiration, which the server sets
+// to one minute after staging.
+func (tsc *tsClient) CleanupStaging(stagingSk StoreKey, olderThan time.Duration) (removed int, err error) {
+	cutoff := time.Now().Add(-olderThan)
+
+	var candidates []StoreKey
+	startAt := 0
+	for {
+		var keys []LevelKey
+		keys, err = tsc.GetLevelKeys(stagingSk, "*", startAt, stagingPageSize)
+		if err != nil {
+			return
+		}
+
+		for _, key := range keys {
+			tempSk := AppendStoreKeySegments(stagingSk, key.Segment)
+
+			var ttl *time.Time
+			if ttl, err = tsc.GetKeyTtl(tempSk); err != nil {
+				return
+			}
+			if ttl == nil {
+				continue // expired meanwhile
+			}
+
+			if ttl.UnixNano() <= 0 || ttl.Add(-stagedKeyLifetime).Before(cutoff) {
+				candidates = append(candidates, tempSk)
+			}
+		}
+
+		if len(keys) < stagingPageSize {
+			break
+		}
+		startAt += len(keys)
+	}
+
+	for _, tempSk := range candidates {
+		var deleted bool
+		if deleted, err = tsc.DeleteKeyTree(tempSk); err != nil {
+			return
+		}
+		if deleted {
+			removed++
+		}
+	}
+	return
+}
+
+// Refreshes the expiration of a staged key every `interval`, so that a long
+// running preparation job can keep filling the staged subtree without it
+// expiring. Each refresh sets the expiration to `interval` plus the normal
+// one minute staging lifetime from now.
+//
+// The refresh stops when the returned stop function is called, or when the
+// staged key no longer exists (because it was moved to its permanent location,
+// deleted or expired).
+func (tsc *tsClient) KeepStagedAlive(tempSk StoreKey, interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	exited := make(chan struct{})
+
+	go func() {
+		defer close(exited)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			expiration := time.Now().Add(interval + stagedKeyLifetime)
+			exists, err := tsc.SetKeyTtl(tempSk, &expiration)
+			if err != nil {
+				tsc.l.Warnf("can't refresh staged key %s: %s", tempSk.Path, err.Error())
+				continue
+			}
+			if !exists {
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	stop = func() {
+		once.Do(func() {
+			close(done)
+			<-exited
+		})
+	}
+	return
+}
+
+type (
+	// A fluent wrapper of the staged indexing workflow:
+	//
+	//   - The record is staged with StageKeyJson under a temporary key
+	//   - Child values, json and metadata are written incrementally
+	//   - The record is committed with MoveReferencedKey, atomically maintaining
+	//     the index (reference) keys, or aborted by deleting the temporary key
+	//
+	// Errors are deferred: once a step fails, later steps are skipped and the
+	// error is returned by Commit (or Err).
+	StagedRecordBuilder struct {
+		tsc       *tsClient
+		tempSk    StoreKey
+		address   StoreAddress
+		err       error
+		overwrite bool
+		ttl       *time.Time
+		refs      []StoreKey
+		unrefs    []StoreKey
+		stopAlive func()
+		finished  bool
+	}
+)
+
+// Stages `jsonData` under `stagingSk` and returns a builder to complete the
+// record and commit it.
+func (tsc *tsClient) StageRecord(stagingSk StoreKey, jsonData any, opts JsonOptions) (b *StagedRecordBuilder) {
+	b = &StagedRecordBuilder{
+		tsc: tsc,
+		ttl: &ZeroTime,
+	}
+	b.tempSk, b.address, b.err = tsc.StageKeyJson(stagingSk, jsonData, opts)
+	return
+}
+
+// Returns the temporary key of the staged record.
+func (b *StagedRecordBuilder) TempKey() StoreKey {
+	return b.tempSk
+}
+
+// Returns the address of the staged record.
+func (b *StagedRecordBuilder) Address() StoreAddress {
+	return b.address
+}
+
+// Returns the first error encountered by the builder, if any.
+func (b *StagedRecordBuilder) Err() error {
+	return b.err
+}
+
+func (b *StagedRecordBuilder) ok() bool {
+	if b.err == nil && b.finished {
+		b.err = ErrStagedRecordFinished
+	}
+	return b.err == nil
+}
+
+// Sets a value on a child of the staged record. An empty subpath sets the value
+// of the record key itself.
+func (b *StagedRecordBuilder) SetValue(subPath SubPath, value any) *StagedRecordBuilder {
+	if b.ok() {
+		_, _, b.err = b.tsc.SetKeyValue(JoinSubPath(b.tempSk, subPath), value)
+	}
+	return b
+}
+
+// Overlays json data on a child of the staged record.
+func (b *StagedRecordBuilder) MergeJson(subPath SubPath, jsonData any, opts JsonOptions) *StagedRecordBuilder {
+	if b.ok() {
+		_, b.err = b.tsc.MergeKeyJson(JoinSubPath(b.tempSk, subPath), jsonData, opts)
+	}
+	return b
+}
+
+// Sets a metadata attribute on the staged record or one of its children.
+func (b *StagedRecordBuilder) SetMetadata(subPath SubPath, attribute, value string) *StagedRecordBuilder {
+	if b.ok() {
+		_, _, b.err = b.tsc.SetMetadataAttribute(JoinSubPath(b.tempSk, subPath), attribute, value)
+	}
+	return b
+}
+
+// Adds index keys that will reference the record once it is committed.
+func (b *StagedRecordBuilder) Reference(refs ...StoreKey) *StagedRecordBuilder {
+	b.refs = append(b.refs, refs...)
+	return b
+}
+
+// Adds index keys that will stop referencing the destination when the record
+// is committed.
+func (b *StagedRecordBuilder) Unreference(unrefs ...StoreKey) *StagedRecordBuilder {
+	b.unrefs = append(b.unrefs, unrefs...)
+	return b
+}
+
+// Specifies the expiration of the committed record and its index keys. By
+// default, the staging expiration is removed upon commit. Specify nil to retain
+// the staging expiration.
+func (b *StagedRecordBuilder) Ttl(ttl *time.Time) *StagedRecordBuilder {
+	b.ttl = ttl
+	return b
+}
+
+// Specifies if Commit may overwrite an existing destination key.
+func (b *StagedRecordBuilder) Overwrite(overwrite bool) *StagedRecordBuilder {
+	b.overwrite = overwrite
+	return b
+}
+
+// Keeps the staged record from expiring while it is built. See KeepStagedAlive.
+func (b *StagedRecordBuilder) KeepAlive(interval time.Duration) *StagedRecordBuilder {
+	if b.ok() && b.stopAlive == nil {
+		b.stopAlive = b.tsc.KeepStagedAlive(b.tempSk, interval)
+	}
+	return b
+}
+
+func (b *StagedRecordBuilder) finish() {
+	if b.stopAlive != nil {
+		b.stopAlive()
+		b.stopAlive = nil
+	}
+	b.finished = true
+}
+
+// Moves the staged record to `destSk` with MoveReferencedKey, maintaining the
+// index keys. If an earlier step failed, the staged record is left to expire
+// and the error is returned.
+func (b *StagedRecordBuilder) Commit(destSk StoreKey) (exists, moved bool, err error) {
+	if !b.ok() {
+		err = b.err
+		return
+	}
+	defer b.finish()
+
+	exists, moved, err = b.tsc.MoveReferencedKey(b.tempSk, destSk, b.overwrite, b.ttl, b.refs, b.unrefs)
+	if moved {
+		b.tsc.unregisterStaged(b.tempSk)
+	}
+	b.err = err
+	return
+}
+
+// Discards the staged record immediately, rather than waiting for it to expire.
+func (b *StagedRecordBuilder) Abort() (err error) {
+	if b.finished {
+		return
+	}
+	defer b.finish()
+
+	if b.tempSk.Path != "" {
+		_, err = b.tsc.AbortStagedKey(b.tempSk)
+	}
+	return
+}
@@ -0,0 +1,232 @@
+package treestore_client
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+)
+
+type (
+	// The distribution of value sizes in bytes, estimated from a sample of up
+	// to valueSizeSamples values.
+	ValueSizeDistribution struct {
+		Count int64
+		P50   int
+		P95   int
+		Max   int
+	}
+
+	// The value sizes written and read under a tracked key prefix.
+	ValueSizeStats struct {
+		Prefix  StoreKey
+		Written ValueSizeDistribution
+		Read    ValueSizeDistribution
+	}
+
+	// The shape of a subtree, as measured by GetTreeStats.
+	TreeStats struct {
+		// The number of keys in the subtree, including its root key.
+		Keys int
+		// The number of keys that have a value.
+		Values int
+		// The total size of the current values, as stored by the server.
+		ValueBytes int64
+		// The number of levels below the root key; 0 when it has no children.
+		Depth int
+		// The number of keys at each level below the root key: LevelKeys[0]
+		// counts its children, LevelKeys[1] its grandchildren, and so on.
+		LevelKeys []int
+	}
+
+	// a reservoir sample of value sizes
+	sizeSample struct {
+		count   int64
+		max     int
+		samples []int
+	}
+
+	prefixSizeStats struct {
+		written sizeSample
+		read    sizeSample
+	}
+)
+
+// the number of value sizes kept per prefix and direction for estimating
+// percentiles
+const valueSizeSamples = 1024
+
+// Starts (or with `track` false, stops) collecting the sizes of values written
+// and read under `prefixSk`, which is relative to the client's key prefix.
+// Statistics are shared by the clients derived with With(). When prefixes are
+// nested, a value is counted under the longest one.
+func (tsc *tsClient) TrackValueSizes(prefixSk StoreKey, track bool) {
+	tsc.sizeStatsMu.Lock()
+	defer tsc.sizeStatsMu.Unlock()
+
+	prefix := TokenPath(tsc.keyArg(prefixSk))
+	if !track {
+		delete(tsc.sizeStats, prefix)
+		return
+	}
+
+	if tsc.sizeStats == nil {
+		tsc.sizeStats = map[TokenPath]*prefixSizeStats{}
+	}
+	if tsc.sizeStats[prefix] == nil {
+		tsc.sizeStats[prefix] = &prefixSizeStats{}
+	}
+}
+
+// Returns the value size statistics of each tracked prefix, ordered by prefix.
+func (tsc *tsClient) GetValueSizeStats() (stats []ValueSizeStats) {
+	tsc.sizeStatsMu.Lock()
+	defer tsc.sizeStatsMu.Unlock()
+
+	stats = make([]ValueSizeStats, 0, len(tsc.sizeStats))
+	for prefix, pss := range tsc.sizeStats {
+		stats = append(stats, ValueSizeStats{
+			Prefix:  tsc.responseKey(string(prefix)),
+			Written: pss.written.distribution(),
+			Read:    pss.read.distribution(),
+		})
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Prefix.Path < stats[j].Prefix.Path
+	})
+	return
+}
+
+// Clears the collected value sizes, keeping the tracked prefixes.
+func (tsc *tsClient) ResetValueSizeStats() {
+	tsc.sizeStatsMu.Lock()
+	defer tsc.sizeStatsMu.Unlock()
+
+	for prefix := range tsc.sizeStats {
+		tsc.sizeStats[prefix] = &prefixSizeStats{}
+	}
+}
+
+// Counts the size of a value sent to or received from the server, if the
+// absolute key path is under a tracked prefix. `val` is in command line form.
+func (tsc *tsClient) recordValueSize(tokenPath string, val string, written bool) {
+	tsc.sizeStatsMu.Lock()
+	defer tsc.sizeStatsMu.Unlock()
+
+	var pss *prefixSizeStats
+	longest := -1
+	for prefix, candidate := range tsc.sizeStats {
+		p := string(prefix)
+		if len(p) > longest && (tokenPath == p || strings.HasPrefix(tokenPath, p+"/") || p == "") {
+			pss = candidate
+			longest = len(p)
+		}
+	}
+	if pss == nil {
+		return
+	}
+
+	size := len(valueUnescape(val))
+	if written {
+		pss.written.add(size)
+	} else {
+		pss.read.add(size)
+	}
+}
+
+func (ss *sizeSample) add(size int) {
+	ss.count++
+	ss.max = max(ss.max, size)
+
+	if len(ss.samples) < valueSizeSamples {
+		ss.samples = append(ss.samples, size)
+	} else if n := rand.Int63n(ss.count); n < valueSizeSamples {
+		ss.samples[n] = size
+	}
+}
+
+func (ss *sizeSample) distribution() (vsd ValueSizeDistribution) {
+	vsd.Count = ss.count
+	vsd.Max = ss.max
+	if len(ss.samples) == 0 {
+		return
+	}
+
+	sorted := make([]int, len(ss.samples))
+	copy(sorted, ss.samples)
+	sort.Ints(sorted)
+
+	vsd.P50 = sorted[percentileIndex(len(sorted), 50)]
+	vsd.P95 = sorted[percentileIndex(len(sorted), 95)]
+	return
+}
+
+// The nearest-rank index of the percentile `p` in `n` sorted values.
+func percentileIndex(n, p int) int {
+	return max((n*p+99)/100-1, 0)
+}
+
+// Measures the subtree at `sk`: its key and value counts, the total size of
+// its values, its depth and the number of keys at each level. A key that
+// doesn't exist measures as an empty subtree.
+//
+// The server has no statistics command, so the keys are listed a page at a
+// time and measured by the client. Only the current values are transferred,
+// not history or the export of the subtree; the values aren't decoded. Keys
+// that change during the scan may be missed or counted twice.
+func (tsc *tsClient) GetTreeStats(sk StoreKey) (stats TreeStats, err error) {
+	stats.LevelKeys = []int{}
+	measure := func(key map[string]any) {
+		tokenPath, _ := key["key"].(string)
+		level := len(tsc.responseKey(tokenPath).Tokens) - len(sk.Tokens)
+		stats.Keys++
+		if level > 0 {
+			for len(stats.LevelKeys) < level {
+				stats.LevelKeys = append(stats.LevelKeys, 0)
+			}
+			stats.LevelKeys[level-1]++
+			stats.Depth = max(stats.Depth, level)
+		}
+		if responseBool(key["has_value"]) {
+			stats.Values++
+			valStr, _ := key["current_value"].(string)
+			stats.ValueBytes += int64(len(valueUnescape(valStr)))
+		}
+	}
+
+	if len(sk.Tokens) > 0 {
+		if err = tsc.scanKeyDetails(tsc.keyArg(sk), measure); err != nil {
+			return
+		}
+		if stats.Keys == 0 {
+			return
+		}
+	}
+	err = tsc.scanKeyDetails(tsc.keyArg(AppendStoreKeySegmentStrings(MakeStoreKeyFromPath(sk.Path), "**")), measure)
+	return
+}
+
+// Pages through the detailed listing of the keys matching `pattern`, an
+// absolute key path, passing each key's raw response to `fn`.
+func (tsc *tsClient) scanKeyDetails(pattern string, fn func(key map[string]any)) (err error) {
+	for start := 0; ; {
+		var response map[string]any
+		response, err = tsc.RawCommand("lsk", pattern, "--start", fmt.Sprintf("%d", start), "--limit", fmt.Sprintf("%d", streamPageSize), "--detailed")
+		if err != nil {
+			return
+		}
+
+		rawKeys, _ := response["keys"].([]any)
+		for _, rawKey := range rawKeys {
+			if key, is := rawKey.(map[string]any); is {
+				fn(key)
+			}
+		}
+
+		start += len(rawKeys)
+		if len(rawKeys) < streamPageSize {
+			return
+		}
+	}
+}
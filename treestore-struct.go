@@ -0,0 +1,421 @@
+package treestore_client
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+type (
+	// how a struct field maps to the tree store, from its `treestore` tag
+	structField struct {
+		index     int
+		name      string
+		omitEmpty bool
+		metadata  bool
+		flatten   bool
+	}
+
+	// a metadata attribute of a key within a struct's json tree
+	structMetadata struct {
+		subPath   SubPath
+		attribute string
+		value     string
+	}
+)
+
+var (
+	jsonMarshalerType   = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+)
+
+// Stores a struct at `sk`, with each field as a child key. Fields are mapped
+// with `treestore` tags, which work like `json` tags:
+//
+//	type Pet struct {
+//		Name    string   `treestore:"name"`
+//		Tags    []string `treestore:"tags,omitempty"`
+//		Owner   *Person  `treestore:"owner"`
+//		Color   string   `treestore:"color,metadata"`
+//		Ignored string   `treestore:"-"`
+//	}
+//
+// Untagged fields use the field name, and embedded structs without a tag name
+// have their fields stored alongside the outer struct's. Nested structs,
+// pointers, maps with string keys, slices and arrays become child key trees.
+// A field with the `metadata` option must be a string; it is stored as a
+// metadata attribute of the key holding the struct instead of as a child key.
+// Types that implement json.Marshaler are stored as they marshal.
+//
+// The struct is written with SetKeyJson, so existing children of `sk` are
+// replaced. The metadata attributes are written afterward, with one command
+// each.
+func (tsc *tsClient) SetKeyStruct(sk StoreKey, v any) (replaced bool, address StoreAddress, err error) {
+	var metadata []structMetadata
+	jsonData, err := structToJson(reflect.ValueOf(v), SubPath{}, &metadata)
+	if err != nil {
+		return
+	}
+
+	if replaced, address, err = tsc.SetKeyJson(sk, jsonData, 0); err != nil {
+		return
+	}
+
+	for _, md := range metadata {
+		if _, _, err = tsc.SetMetadataAttribute(JoinSubPath(sk, md.subPath), md.attribute, md.value); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Loads a struct stored by SetKeyStruct into `out`, which must be a pointer.
+// Keys without a matching field are ignored, and fields without a matching
+// key are left unchanged. `exists` is false, and `out` is unchanged, if `sk`
+// does not exist.
+func (tsc *tsClient) GetKeyStruct(sk StoreKey, out any) (exists bool, err error) {
+	rv := reflect.ValueOf(out)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		err = fmt.Errorf("GetKeyStruct requires a non-nil pointer, not %T", out)
+		return
+	}
+
+	jsonData, err := tsc.GetKeyAsJson(sk, 0)
+	if err != nil || jsonData == nil {
+		return
+	}
+	exists = true
+
+	getMetadata := func(subPath SubPath, attribute string) (value string, found bool, err error) {
+		found, value, err = tsc.GetMetadataAttribute(JoinSubPath(sk, subPath), attribute)
+		return
+	}
+	err = jsonToStruct(jsonData, rv.Elem(), SubPath{}, getMetadata)
+	return
+}
+
+// Fetches the json document at `sk` and unmarshals it into a value of type T
+// with encoding/json, so `json:"..."` struct tags and custom UnmarshalJSON
+// implementations are honored. `exists` is false, and `v` is the zero value,
+// if `sk` does not exist or holds a json null.
+func GetKeyJsonAs[T any](tsc JsonStore, sk StoreKey, opt JsonOptions) (v T, exists bool, err error) {
+	marshalled, err := tsc.GetKeyAsJsonBytes(sk, opt)
+	if err != nil {
+		return
+	}
+	if string(bytes.TrimSpace(marshalled)) == "null" {
+		return
+	}
+
+	if err = json.Unmarshal(marshalled, &v); err != nil {
+		return
+	}
+	exists = true
+	return
+}
+
+// Marshals `v` with encoding/json and stages it under `stagingSk`, as
+// StageKeyJson does. The staged record can be read back with GetKeyJsonAs.
+func StageKeyJsonAs[T any](tsc JsonStager, stagingSk StoreKey, v T, opts JsonOptions) (tempSk StoreKey, address StoreAddress, err error) {
+	marshalled, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	return tsc.StageKeyJsonBase64(stagingSk, base64.StdEncoding.EncodeToString(marshalled), opts)
+}
+
+// Parses the `treestore` tags of a struct type.
+func structFields(t reflect.Type) (fields []structField) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag, tagged := f.Tag.Lookup("treestore")
+		if tag == "-" {
+			continue
+		}
+
+		sf := structField{index: i, name: f.Name}
+		if tagged {
+			parts := strings.Split(tag, ",")
+			if parts[0] != "" {
+				sf.name = parts[0]
+			}
+			for _, opt := range parts[1:] {
+				switch opt {
+				case "omitempty":
+					sf.omitEmpty = true
+				case "metadata":
+					sf.metadata = true
+				}
+			}
+		}
+
+		ft := f.Type
+		if ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && ft.Kind() == reflect.Struct && (!tagged || strings.HasPrefix(tag, ",")) {
+			// like json, the exported fields of an embedded struct of an
+			// unexported type are promoted, unless it is a pointer, which
+			// couldn't be allocated
+			if !f.IsExported() && f.Type.Kind() == reflect.Pointer {
+				continue
+			}
+			sf.flatten = true
+		} else if !f.IsExported() {
+			continue
+		}
+
+		fields = append(fields, sf)
+	}
+	return
+}
+
+// Converts a Go value to generic json data, collecting the metadata fields.
+func structToJson(v reflect.Value, subPath SubPath, metadata *[]structMetadata) (jsonData any, err error) {
+	if !v.IsValid() {
+		return
+	}
+
+	if v.Type().Implements(jsonMarshalerType) {
+		if (v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface) && v.IsNil() {
+			return
+		}
+		return remarshalJson(v.Interface())
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return
+		}
+		return structToJson(v.Elem(), subPath, metadata)
+
+	case reflect.Struct:
+		obj := map[string]any{}
+		if err = structFieldsToJson(v, subPath, obj, metadata); err != nil {
+			return
+		}
+		jsonData = obj
+
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			err = fmt.Errorf("unsupported map key type %s", v.Type().Key())
+			return
+		}
+		if v.IsNil() {
+			return
+		}
+		obj := make(map[string]any, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			name := iter.Key().String()
+			if obj[name], err = structToJson(iter.Value(), appendSubPath(subPath, SubPathSegment(name)), metadata); err != nil {
+				return
+			}
+		}
+		jsonData = obj
+
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
+			// byte slices are stored as base64 text, as json does
+			return remarshalJson(v.Interface())
+		}
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return
+		}
+		arr := make([]any, v.Len())
+		for i := range arr {
+			if arr[i], err = structToJson(v.Index(i), appendSubPath(subPath, jsonArrayIndexSegment(i)), metadata); err != nil {
+				return
+			}
+		}
+		jsonData = arr
+
+	default:
+		return remarshalJson(v.Interface())
+	}
+	return
+}
+
+// Adds the fields of a struct to a json object.
+func structFieldsToJson(v reflect.Value, subPath SubPath, obj map[string]any, metadata *[]structMetadata) (err error) {
+	for _, sf := range structFields(v.Type()) {
+		fv := v.Field(sf.index)
+
+		if sf.flatten {
+			if fv.Kind() == reflect.Pointer {
+				if fv.IsNil() {
+					continue
+				}
+				fv = fv.Elem()
+			}
+			if err = structFieldsToJson(fv, subPath, obj, metadata); err != nil {
+				return
+			}
+			continue
+		}
+
+		if sf.omitEmpty && fv.IsZero() {
+			continue
+		}
+
+		if sf.metadata {
+			if fv.Kind() != reflect.String {
+				err = fmt.Errorf("metadata field %s must be a string", sf.name)
+				return
+			}
+			*metadata = append(*metadata, structMetadata{subPath: subPath, attribute: sf.name, value: fv.String()})
+			continue
+		}
+
+		if obj[sf.name], err = structToJson(fv, appendSubPath(subPath, SubPathSegment(sf.name)), metadata); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Stores generic json data into a Go value, loading the metadata fields with
+// `getMetadata`.
+func jsonToStruct(jsonData any, v reflect.Value, subPath SubPath, getMetadata func(subPath SubPath, attribute string) (string, bool, error)) (err error) {
+	if v.CanAddr() && v.Addr().Type().Implements(jsonUnmarshalerType) {
+		return unmarshalJsonInto(jsonData, v)
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer:
+		if jsonData == nil {
+			v.Set(reflect.Zero(v.Type()))
+			return
+		}
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return jsonToStruct(jsonData, v.Elem(), subPath, getMetadata)
+
+	case reflect.Struct:
+		obj, _ := jsonData.(map[string]any)
+		return jsonToStructFields(obj, v, subPath, getMetadata)
+
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			err = fmt.Errorf("unsupported map key type %s", v.Type().Key())
+			return
+		}
+		obj, isObj := jsonData.(map[string]any)
+		if !isObj {
+			return unmarshalJsonInto(jsonData, v)
+		}
+		m := reflect.MakeMapWithSize(v.Type(), len(obj))
+		for name, childData := range obj {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err = jsonToStruct(childData, elem, appendSubPath(subPath, SubPathSegment(name)), getMetadata); err != nil {
+				return
+			}
+			m.SetMapIndex(reflect.ValueOf(name).Convert(v.Type().Key()), elem)
+		}
+		v.Set(m)
+
+	case reflect.Slice:
+		arr, isArr := jsonData.([]any)
+		if !isArr {
+			return unmarshalJsonInto(jsonData, v)
+		}
+		s := reflect.MakeSlice(v.Type(), len(arr), len(arr))
+		for i, childData := range arr {
+			if err = jsonToStruct(childData, s.Index(i), appendSubPath(subPath, jsonArrayIndexSegment(i)), getMetadata); err != nil {
+				return
+			}
+		}
+		v.Set(s)
+
+	case reflect.Array:
+		arr, _ := jsonData.([]any)
+		for i := 0; i < v.Len() && i < len(arr); i++ {
+			if err = jsonToStruct(arr[i], v.Index(i), appendSubPath(subPath, jsonArrayIndexSegment(i)), getMetadata); err != nil {
+				return
+			}
+		}
+
+	default:
+		return unmarshalJsonInto(jsonData, v)
+	}
+	return
+}
+
+// Stores the members of a json object into the fields of a struct.
+func jsonToStructFields(obj map[string]any, v reflect.Value, subPath SubPath, getMetadata func(subPath SubPath, attribute string) (string, bool, error)) (err error) {
+	for _, sf := range structFields(v.Type()) {
+		fv := v.Field(sf.index)
+
+		if sf.flatten {
+			if fv.Kind() == reflect.Pointer {
+				if fv.IsNil() {
+					if !fv.CanSet() {
+						continue
+					}
+					fv.Set(reflect.New(fv.Type().Elem()))
+				}
+				fv = fv.Elem()
+			}
+			if err = jsonToStructFields(obj, fv, subPath, getMetadata); err != nil {
+				return
+			}
+			continue
+		}
+
+		if sf.metadata {
+			if fv.Kind() != reflect.String {
+				err = fmt.Errorf("metadata field %s must be a string", sf.name)
+				return
+			}
+			var value string
+			var found bool
+			if value, found, err = getMetadata(subPath, sf.name); err != nil {
+				return
+			}
+			if found {
+				fv.SetString(value)
+			}
+			continue
+		}
+
+		childData, found := obj[sf.name]
+		if !found {
+			continue
+		}
+		if err = jsonToStruct(childData, fv, appendSubPath(subPath, SubPathSegment(sf.name)), getMetadata); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Converts a value to generic json data through its json encoding.
+func remarshalJson(value any) (jsonData any, err error) {
+	marshalled, err := json.Marshal(value)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(marshalled, &jsonData)
+	return
+}
+
+// Stores generic json data into a Go value through its json encoding.
+func unmarshalJsonInto(jsonData any, v reflect.Value) (err error) {
+	marshalled, err := json.Marshal(jsonData)
+	if err != nil {
+		return
+	}
+	return json.Unmarshal(marshalled, v.Addr().Interface())
+}
+
+// Appends a segment to a copy of the subpath.
+func appendSubPath(subPath SubPath, seg SubPathSegment) SubPath {
+	extended := make(SubPath, len(subPath), len(subPath)+1)
+	copy(extended, subPath)
+	return append(extended, seg)
+}
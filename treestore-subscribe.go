@@ -0,0 +1,227 @@
+package treestore_client
+
+import (
+	"reflect"
+	"sync"
+	"time"
+)
+
+type (
+	KeyEventType int
+
+	// A change detected on a key that matches a subscription pattern.
+	KeyEvent struct {
+		Type  KeyEventType
+		Key   StoreKey
+		Value any
+	}
+
+	// Adjusts a subscription made by SubscribeEx.
+	SubscribeOptions struct {
+		// How often the matching keys are scanned for changes;
+		// DefaultSubscribePollInterval if zero.
+		PollInterval time.Duration
+	}
+
+	// An active subscription created by Subscribe. Events are delivered on
+	// the Events channel, which is closed after Close is called.
+	Subscription struct {
+		Events    <-chan KeyEvent
+		events    chan KeyEvent
+		tsc       *tsClient
+		skPattern StoreKey
+		interval  time.Duration
+		known     map[TokenPath]*subscribedKey
+		done      chan struct{}
+		closeOnce sync.Once
+		wg        sync.WaitGroup
+	}
+
+	subscribedKey struct {
+		sk       StoreKey
+		hasValue bool
+		value    any
+		ttl      *time.Time
+	}
+)
+
+const (
+	KeyEventCreated KeyEventType = iota + 1
+	KeyEventValueSet
+	KeyEventDeleted
+	KeyEventExpired
+)
+
+// The interval at which a subscription's dedicated connection scans for
+// changes, unless SubscribeOptions specifies another.
+const DefaultSubscribePollInterval = 100 * time.Millisecond
+
+func (t KeyEventType) String() string {
+	switch t {
+	case KeyEventCreated:
+		return "created"
+	case KeyEventValueSet:
+		return "value set"
+	case KeyEventDeleted:
+		return "deleted"
+	case KeyEventExpired:
+		return "expired"
+	}
+	return "unknown"
+}
+
+// Watches keys matching `skPattern` and delivers change events on a channel.
+//
+// The subscription uses its own connection to the server, so that watching
+// does not contend with the caller's commands. The server does not push
+// notifications; instead the matching keys are scanned every
+// DefaultSubscribePollInterval and compared to the prior scan. Consequently, changes
+// that are undone between two scans are not reported, and setting a key to
+// the value it already has is not reported.
+//
+// A key that disappears is reported as expired if its expiration (captured
+// when the key was created or its value last changed) has passed; otherwise
+// it is reported as deleted.
+func (tsc *tsClient) Subscribe(skPattern StoreKey) (sub *Subscription, err error) {
+	return tsc.SubscribeEx(skPattern, SubscribeOptions{})
+}
+
+// Watches keys matching `skPattern` as Subscribe does, with the scan interval
+// given in `opts`.
+func (tsc *tsClient) SubscribeEx(skPattern StoreKey, opts SubscribeOptions) (sub *Subscription, err error) {
+	interval := opts.PollInterval
+	if interval <= 0 {
+		interval = DefaultSubscribePollInterval
+	}
+
+	watcher := tsc.dedicated()
+
+	events := make(chan KeyEvent, 100)
+	sub = &Subscription{
+		Events:    events,
+		events:    events,
+		tsc:       watcher,
+		skPattern: skPattern,
+		interval:  interval,
+		known:     map[TokenPath]*subscribedKey{},
+		done:      make(chan struct{}),
+	}
+
+	// the initial scan establishes the baseline without raising events
+	if _, err = sub.scan(false); err != nil {
+		watcher.Close()
+		sub = nil
+		return
+	}
+
+	sub.wg.Add(1)
+	go sub.run()
+	return
+}
+
+// Stops the subscription, closes its dedicated connection and closes the
+// Events channel.
+func (sub *Subscription) Close() (err error) {
+	sub.closeOnce.Do(func() {
+		close(sub.done)
+		sub.wg.Wait()
+		err = sub.tsc.Close()
+		close(sub.events)
+	})
+	return
+}
+
+func (sub *Subscription) run() {
+	defer sub.wg.Done()
+
+	ticker := time.NewTicker(sub.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sub.done:
+			return
+		case <-ticker.C:
+		}
+
+		stopped, err := sub.scan(true)
+		if err != nil {
+			sub.tsc.l.Warnf("subscription scan of %s failed: %s", sub.skPattern.Path, err.Error())
+		}
+		if stopped {
+			return
+		}
+	}
+}
+
+// Reads all keys matching the subscription pattern, and compares them to the
+// prior scan. If `notify` is true, differences are sent as events. The scan
+// is only kept if it completes, so that a failed scan doesn't lose changes;
+// they are found by the next scan.
+func (sub *Subscription) scan(notify bool) (stopped bool, err error) {
+	current := make(map[TokenPath]*subscribedKey, len(sub.known))
+	var events []KeyEvent
+
+	// the stream resumes after the last key of each page, so keys added or
+	// removed during the scan don't shift other keys out of it
+	var ttlErr error
+	err = sub.tsc.GetMatchingKeysStream(sub.skPattern, func(km *KeyMatch) bool {
+		prior := sub.known[km.Key]
+
+		var eventType KeyEventType
+		if prior == nil {
+			eventType = KeyEventCreated
+		} else if km.HasValue != prior.hasValue || !reflect.DeepEqual(km.CurrentValue, prior.value) {
+			eventType = KeyEventValueSet
+		} else {
+			current[km.Key] = prior
+			return true
+		}
+
+		key := &subscribedKey{sk: MakeStoreKeyFromPath(km.Key), hasValue: km.HasValue, value: km.CurrentValue}
+		if key.ttl, ttlErr = sub.tsc.GetKeyTtl(key.sk); ttlErr != nil {
+			return false
+		}
+		current[km.Key] = key
+		events = append(events, KeyEvent{Type: eventType, Key: key.sk, Value: key.value})
+		return true
+	})
+	if err == nil {
+		err = ttlErr
+	}
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	for tokenPath, prior := range sub.known {
+		if _, exists := current[tokenPath]; exists {
+			continue
+		}
+
+		eventType := KeyEventDeleted
+		if prior.ttl != nil && prior.ttl.UnixNano() > 0 && !prior.ttl.After(now) {
+			eventType = KeyEventExpired
+		}
+		events = append(events, KeyEvent{Type: eventType, Key: prior.sk, Value: prior.value})
+	}
+
+	sub.known = current
+	if notify {
+		for _, event := range events {
+			if stopped = sub.send(event); stopped {
+				return
+			}
+		}
+	}
+	return
+}
+
+func (sub *Subscription) send(event KeyEvent) (stopped bool) {
+	select {
+	case sub.events <- event:
+	case <-sub.done:
+		stopped = true
+	}
+	return
+}
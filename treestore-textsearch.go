@@ -0,0 +1,82 @@
+package treestore_client
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+type (
+	// A record found by Search, with the number of distinct query words it
+	// contains.
+	SearchResult struct {
+		Sk    StoreKey
+		Value any
+		Hits  int
+	}
+)
+
+// Splits text into lowercase words, at every character that isn't a letter
+// or a digit.
+func TokenizeText(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(ch rune) bool {
+		return !unicode.IsLetter(ch) && !unicode.IsDigit(ch)
+	})
+}
+
+// Defines the full-text index `name` over the string values of the children
+// of `parentSk`, with a term for each word found by TokenizeText. Values that
+// aren't strings are not indexed. The index is a secondary index (see
+// DefineIndex), so it is an inverted index kept under IndexesSk and
+// maintained by the writes made through this client.
+func (ic *IndexedClient) DefineTextIndex(name string, parentSk StoreKey) (err error) {
+	return ic.DefineIndex(name, parentSk, func(value any) []string {
+		text, _ := value.(string)
+		return TokenizeText(text)
+	})
+}
+
+// Finds the records of the full-text index `name` that contain any of the
+// words of `query`, ranked by the number of distinct query words they
+// contain, then in key order. At most `limit` results are returned (0 for no
+// limit). Each query word is looked up with QueryIndex.
+func (ic *IndexedClient) Search(name, query string, limit int) (results []SearchResult, err error) {
+	words := map[string]bool{}
+	found := map[TokenPath]*SearchResult{}
+	for _, word := range TokenizeText(query) {
+		if words[word] {
+			continue
+		}
+		words[word] = true
+
+		var matches []IndexMatch
+		if matches, err = ic.QueryIndex(name, word); err != nil {
+			return
+		}
+		for _, match := range matches {
+			result := found[match.Sk.Path]
+			if result == nil {
+				result = &SearchResult{Sk: match.Sk}
+				found[match.Sk.Path] = result
+			}
+			result.Value = match.Value
+			result.Hits++
+		}
+	}
+
+	results = make([]SearchResult, 0, len(found))
+	for _, result := range found {
+		results = append(results, *result)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Hits != results[j].Hits {
+			return results[i].Hits > results[j].Hits
+		}
+		return results[i].Sk.Path < results[j].Sk.Path
+	})
+
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return
+}
@@ -4,10 +4,10 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/gob"
-	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math/big"
 	"strconv"
 	"strings"
 	"time"
@@ -15,11 +15,18 @@ import (
 	"github.com/jimsnab/go-treestore"
 )
 
+const escapeHexDigits = "0123456789ABCDEF"
+
 func bytesToEscapedValue(v []byte) string {
 	var sb strings.Builder
-	for _, by := range v {
-		if by < 32 || by == '\\' {
-			sb.WriteString(fmt.Sprintf("\\%02X", by))
+	sb.Grow(len(v))
+	for i, by := range v {
+		// a leading dash is escaped so the server doesn't take the value (such
+		// as -Inf or a negative number) for an option
+		if by < 32 || by == '\\' || (i == 0 && by == '-') {
+			sb.WriteByte('\\')
+			sb.WriteByte(escapeHexDigits[by>>4])
+			sb.WriteByte(escapeHexDigits[by&0xF])
 		} else {
 			sb.WriteByte(by)
 		}
@@ -43,6 +50,41 @@ func valueEscape(v any) string {
 	}
 }
 
+// The escapes of the first character of a metadata value. The server can't
+// take an argument that begins with a dash, so a leading dash is sent as
+// `\2D`; a value that already begins with one of the escapes has its leading
+// backslash sent as `\5C`, so that it reads back unchanged.
+const (
+	metadataDashEscape      = `\2D`
+	metadataBackslashEscape = `\5C`
+)
+
+// Escapes the first character of a metadata value when it is a dash, or when
+// the value begins with one of the escapes. The rest of the value is sent as
+// it is, and the server stores it as sent.
+func metadataEscape(v string) string {
+	switch {
+	case strings.HasPrefix(v, "-"):
+		return metadataDashEscape + v[1:]
+	case strings.HasPrefix(v, metadataDashEscape), strings.HasPrefix(v, metadataBackslashEscape):
+		return metadataBackslashEscape + v[1:]
+	}
+	return v
+}
+
+// Reverses metadataEscape. Only the two escapes at the start of the value are
+// decoded, so other metadata, such as that written by other clients, is
+// returned as stored, unless it happens to begin with `\2D` or `\5C`.
+func metadataUnescape(v string) string {
+	if rest, found := strings.CutPrefix(v, metadataDashEscape); found {
+		return "-" + rest
+	}
+	if rest, found := strings.CutPrefix(v, metadataBackslashEscape); found {
+		return `\` + rest
+	}
+	return v
+}
+
 func valueUnescape(v string) []byte {
 	unescaped := make([]byte, 0, len(v))
 
@@ -50,13 +92,12 @@ func valueUnescape(v string) []byte {
 	for pos < len(v) {
 		by := v[pos]
 		if by == '\\' && pos+2 < len(v) {
-			decoded, err := hex.DecodeString(string(v[pos+1 : pos+3]))
-			if err != nil {
-				unescaped = append(unescaped, by)
-				continue
+			hi, hiValid := unhex(v[pos+1])
+			lo, loValid := unhex(v[pos+2])
+			if hiValid && loValid {
+				by = hi<<4 | lo
+				pos += 2
 			}
-			by = decoded[0]
-			pos += 2
 		}
 		unescaped = append(unescaped, by)
 		pos++
@@ -65,6 +106,19 @@ func valueUnescape(v string) []byte {
 	return unescaped
 }
 
+// Converts a hex digit to its value.
+func unhex(ch byte) (value byte, valid bool) {
+	switch {
+	case ch >= '0' && ch <= '9':
+		return ch - '0', true
+	case ch >= 'a' && ch <= 'f':
+		return ch - 'a' + 10, true
+	case ch >= 'A' && ch <= 'F':
+		return ch - 'A' + 10, true
+	}
+	return
+}
+
 func nativeValueToCmdline(val any) (value, valueType string, err error) {
 	switch t := val.(type) {
 	case []byte:
@@ -124,7 +178,19 @@ func nativeValueToCmdline(val any) (value, valueType string, err error) {
 		value = bytesToEscapedValue(by)
 		valueType = "uint64"
 
-	case float32, float64, bool, complex64, complex128:
+	case float32:
+		// the shortest text that parses back to the same bits; NaN and
+		// infinities are written as NaN, +Inf and -Inf
+		value = bytesToEscapedValue([]byte(strconv.FormatFloat(float64(t), 'g', -1, 32)))
+		valueType = "float32"
+	case float64:
+		value = bytesToEscapedValue([]byte(strconv.FormatFloat(t, 'g', -1, 64)))
+		valueType = "float64"
+
+	case *big.Int, big.Int, *big.Float, big.Float:
+		value, valueType, err = bigValueToCmdline(t)
+
+	case bool, complex64, complex128:
 		str := fmt.Sprintf("%v", t)
 		value = bytesToEscapedValue([]byte(str))
 		valueType = fmt.Sprintf("%T", t)
@@ -150,7 +216,7 @@ func cmdlineToNativeValue(valStr, valueType string) (val any, err error) {
 			err = errors.New("invalid int value")
 			return
 		}
-		val = int(binary.BigEndian.Uint32(value))
+		val = int(int32(binary.BigEndian.Uint32(value)))
 		return
 	case "int8":
 		if len(value) != 1 {
@@ -224,7 +290,7 @@ func cmdlineToNativeValue(valStr, valueType string) (val any, err error) {
 		val = float32(f64)
 		return
 	case "float64":
-		val, err = strconv.ParseFloat(string(value), 32)
+		val, err = strconv.ParseFloat(string(value), 64)
 		if err != nil {
 			return
 		}
@@ -255,10 +321,16 @@ func cmdlineToNativeValue(valStr, valueType string) (val any, err error) {
 	case "":
 		val = value
 		return
+	case "nil":
+		val = nil
+		return
+	case bigIntValueType, bigFloatValueType:
+		val, err = parseBigValue(value, valueType)
+		return
 	}
 
-	if strings.HasPrefix(valueType, "json-") {
-		val = value
+	if typeName, isJson := strings.CutPrefix(valueType, "json-"); isJson {
+		val, err = decodeJsonValue(typeName, value)
 		return
 	}
 
@@ -266,30 +338,76 @@ func cmdlineToNativeValue(valStr, valueType string) (val any, err error) {
 	return
 }
 
+// Compares two values by their wire encoding, so that values that are stored
+// identically are equal.
+func valuesEqual(a, b any) (equal bool, err error) {
+	av, at, err := nativeValueToCmdline(a)
+	if err != nil {
+		return
+	}
+	bv, bt, err := nativeValueToCmdline(b)
+	if err != nil {
+		return
+	}
+
+	equal = (av == bv && at == bt)
+	return
+}
+
+// Compares two keys in the order the server iterates them: segment by
+// segment in byte order, with a parent ahead of its children.
+func compareKeyOrder(a, b TokenSet) int {
+	for index := 0; index < len(a) && index < len(b); index++ {
+		if cmp := bytes.Compare(a[index], b[index]); cmp != 0 {
+			return cmp
+		}
+	}
+	return len(a) - len(b)
+}
+
 // Simple wrapper of gob to binary-encode before storing as a treestore value.
-// panics on an error
+// panics on an error; see ValueEncodeErr
 func ValueEncode[T any](v T) []byte {
+	by, err := ValueEncodeErr(v)
+	if err != nil {
+		panic(err)
+	}
+	return by
+}
+
+// Simple wrapper of gob to binary-encode before storing as a treestore value.
+func ValueEncodeErr[T any](v T) (by []byte, err error) {
 	b := bytes.Buffer{}
 	e := gob.NewEncoder(&b)
 
-	err := e.Encode(&v)
+	if err = e.Encode(&v); err != nil {
+		return
+	}
+	by = b.Bytes()
+	return
+}
+
+// Simple wrapper of gob to binary-decode after retrieving a treestore value.
+// panics on an error; see ValueDecodeErr
+func ValueDecode[T any](v []byte) (result T) {
+	result, err := ValueDecodeErr[T](v)
 	if err != nil {
 		panic(err)
 	}
-	return b.Bytes()
+	return
 }
 
 // Simple wrapper of gob to binary-decode after retrieving a treestore value.
-// panics on an error
-func ValueDecode[T any](v []byte) (result T) {
+// A nil `v` decodes to the zero value.
+func ValueDecodeErr[T any](v []byte) (result T, err error) {
 	if v != nil {
 		b := bytes.Buffer{}
 		b.Write(v)
 		d := gob.NewDecoder(&b)
 
-		err := d.Decode(&result)
-		if err != nil {
-			panic(err)
+		if err = d.Decode(&result); err != nil {
+			var zero T
+			result = zero
 		}
 	}
 	return
@@ -324,6 +442,12 @@ func responseEpochNs(v any) *time.Time {
 	return &t
 }
 
+// Determines if a ttl returned by the server is an expiration; the server
+// reports 0 for no expiration and -1 for a missing key.
+func ttlIsSet(ttl *time.Time) bool {
+	return ttl != nil && ttl.UnixNano() > 0
+}
+
 var EscapeTokenString = treestore.EscapeTokenString
 var UnescapeTokenString = treestore.UnescapeTokenString
 var MakeTokenPath = treestore.MakeTokenPath
@@ -0,0 +1,73 @@
+package treestore_client
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// Go types registered with RegisterJsonValueType, by the type name recorded
+// with values stored in json form
+var (
+	jsonValueTypesMu sync.RWMutex
+	jsonValueTypes   = map[string]reflect.Type{}
+)
+
+// Registers the type of `sample` for decoding values in json form.
+//
+// Values of types without a native tree store encoding, such as structs, maps
+// and slices, are encoded as json, with a "json-" value type that names the Go
+// type. When the server returns a value with a json value type, it is decoded
+// into a new value of the registered type with that name, or into generic
+// json data (maps, slices, float64, and so on) if no type is registered.
+// Registering a pointer type, such as &Pet{}, decodes values of type *Pet as
+// pointers.
+//
+// N.B., the server keeps the json value type only for values stored in
+// process. A json value sent by a client is stored as plain bytes, and is
+// returned as []byte.
+//
+// The type name doesn't include the package path, so types with the same
+// name in different packages can't both be registered.
+func RegisterJsonValueType(sample any) {
+	t := reflect.TypeOf(sample)
+	if t == nil {
+		return
+	}
+
+	jsonValueTypesMu.Lock()
+	defer jsonValueTypesMu.Unlock()
+	jsonValueTypes[t.String()] = t
+}
+
+// Decodes a value stored in json form by nativeValueToCmdline.
+func decodeJsonValue(typeName string, marshalled []byte) (val any, err error) {
+	jsonValueTypesMu.RLock()
+	t := jsonValueTypes[typeName]
+	jsonValueTypesMu.RUnlock()
+
+	if t == nil {
+		if err = json.Unmarshal(marshalled, &val); err != nil {
+			err = fmt.Errorf("invalid json value of type %s: %w", typeName, err)
+		}
+		return
+	}
+
+	var target reflect.Value
+	if t.Kind() == reflect.Pointer {
+		target = reflect.New(t.Elem())
+		err = json.Unmarshal(marshalled, target.Interface())
+	} else {
+		target = reflect.New(t)
+		err = json.Unmarshal(marshalled, target.Interface())
+		target = target.Elem()
+	}
+	if err != nil {
+		err = fmt.Errorf("invalid json value of type %s: %w", typeName, err)
+		return
+	}
+
+	val = target.Interface()
+	return
+}
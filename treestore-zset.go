@@ -0,0 +1,263 @@
+package treestore_client
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+type (
+	// A member of a sorted set and its score.
+	ZMember struct {
+		Member string
+		Score  float64
+	}
+)
+
+// A sorted set at `sk` keeps two subtrees:
+//
+//	sk/ranks/<score><member>  one key per member, ordered by score
+//	sk/members/<member>       the member's score as its value, with
+//	                          relationship 0 linking to its ranks key
+//
+// The ranks segment starts with 16 hex digits that sort in score order, so the
+// server's key order is the rank order. (Raw bytes wouldn't survive the json
+// responses of the server, which are utf-8.)
+const (
+	zsetRanks   = "ranks"
+	zsetMembers = "members"
+)
+
+// Adds `member` to the sorted set at `sk` with `score`, or updates the score
+// of an existing member. `added` is true if the member is new.
+//
+// The server has no transactions, so the ranks key of a new score is added
+// before the old one is removed; a concurrent range can briefly see a member
+// twice. The update is made while the client holds a lock on the member (see
+// LocksSk), so that concurrent updates of a member through the sorted set
+// methods, on any connection, don't leave an unlinked ranks key behind.
+//
+// An expiration set on the member's key (sk/members/<member>) is kept when the
+// score changes, and given to the new ranks key as well.
+func (tsc *tsClient) ZAdd(sk StoreKey, member string, score float64) (added bool, err error) {
+	if math.IsNaN(score) {
+		err = errors.New("a sorted set score can't be NaN")
+		return
+	}
+
+	unlock, err := tsc.lockKey(AppendStoreKeySegmentStrings(sk, zsetMembers, member))
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	return tsc.zaddLocked(sk, member, score)
+}
+
+// Adds or updates a member as ZAdd does. The caller must hold the lock on the
+// member.
+func (tsc *tsClient) zaddLocked(sk StoreKey, member string, score float64) (added bool, err error) {
+	memberSk := AppendStoreKeySegmentStrings(sk, zsetMembers, member)
+	oldRankSk, _, found, err := tsc.zsetRank(memberSk)
+	if err != nil {
+		return
+	}
+
+	rankSk := JoinSubPath(AppendStoreKeySegmentStrings(sk, zsetRanks), SubPath{zsetRankSegment(score, member)})
+	if found && oldRankSk.Path == rankSk.Path {
+		return
+	}
+
+	// the member write is a setex, which otherwise removes the expiration
+	var expire *time.Time
+	if found {
+		var ttl *time.Time
+		if ttl, err = tsc.GetKeyTtl(memberSk); err != nil {
+			return
+		}
+		if ttlIsSet(ttl) {
+			expire = ttl
+		}
+	}
+
+	address, _, err := tsc.SetKey(rankSk)
+	if err != nil {
+		return
+	}
+	if expire != nil {
+		if _, err = tsc.SetKeyTtl(rankSk, expire); err != nil {
+			return
+		}
+	}
+	if _, _, _, err = tsc.SetKeyValueEx(memberSk, score, 0, expire, []StoreAddress{address}); err != nil {
+		return
+	}
+
+	if found {
+		_, err = tsc.DeleteKeyTree(oldRankSk)
+	}
+	added = !found
+	return
+}
+
+// Adds `delta` to the score of `member` in the sorted set at `sk`, adding the
+// member with a score of `delta` if it isn't in the set, and returns the new
+// score.
+//
+// The score is read and written back while the client holds the lock on the
+// member that ZAdd takes, so concurrent increments through the sorted set
+// methods aren't lost.
+func (tsc *tsClient) ZIncrBy(sk StoreKey, member string, delta float64) (score float64, err error) {
+	unlock, err := tsc.lockKey(AppendStoreKeySegmentStrings(sk, zsetMembers, member))
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	if score, _, err = tsc.ZScore(sk, member); err != nil {
+		return
+	}
+	score += delta
+	if math.IsNaN(score) {
+		err = errors.New("a sorted set score can't be NaN")
+		return
+	}
+	_, err = tsc.zaddLocked(sk, member, score)
+	return
+}
+
+// Returns the score of `member` in the sorted set at `sk`. `exists` is false
+// if the member isn't in the set.
+func (tsc *tsClient) ZScore(sk StoreKey, member string) (score float64, exists bool, err error) {
+	_, score, exists, err = tsc.zsetRank(AppendStoreKeySegmentStrings(sk, zsetMembers, member))
+	return
+}
+
+// Removes `member` from the sorted set at `sk`. `removed` is false if the
+// member wasn't in the set. The member is locked as ZAdd does.
+func (tsc *tsClient) ZRem(sk StoreKey, member string) (removed bool, err error) {
+	memberSk := AppendStoreKeySegmentStrings(sk, zsetMembers, member)
+	unlock, err := tsc.lockKey(memberSk)
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	rankSk, _, found, err := tsc.zsetRank(memberSk)
+	if err != nil || !found {
+		return
+	}
+
+	if _, err = tsc.DeleteKeyTree(rankSk); err != nil {
+		return
+	}
+	return tsc.DeleteKeyTree(memberSk)
+}
+
+// Returns the number of members in the sorted set at `sk`.
+func (tsc *tsClient) ZCard(sk StoreKey) (count int, err error) {
+	count, _, err = tsc.GetKeyChildrenCount(AppendStoreKeySegmentStrings(sk, zsetRanks))
+	return
+}
+
+// Returns the members of the sorted set at `sk` ranked `start` through `stop`,
+// inclusive, lowest score first. Negative ranks count from the highest score,
+// so -1 is the highest. Ranks beyond the set are clamped.
+func (tsc *tsClient) ZRange(sk StoreKey, start, stop int) (members []ZMember, err error) {
+	count, err := tsc.ZCard(sk)
+	if err != nil {
+		return
+	}
+
+	if start < 0 {
+		start = max(count+start, 0)
+	}
+	if stop < 0 {
+		stop = count + stop
+	}
+	stop = min(stop, count-1)
+
+	members = []ZMember{}
+	if start > stop {
+		return
+	}
+
+	keys, err := tsc.GetLevelKeys(AppendStoreKeySegmentStrings(sk, zsetRanks), "*", start, stop-start+1)
+	if err != nil {
+		return
+	}
+
+	members = make([]ZMember, 0, len(keys))
+	for _, lk := range keys {
+		if zm, valid := zsetMemberFromRank(lk.Segment); valid {
+			members = append(members, zm)
+		}
+	}
+	return
+}
+
+// Returns up to `n` members of the sorted set at `sk` with the highest scores,
+// highest first.
+func (tsc *tsClient) ZTop(sk StoreKey, n int) (members []ZMember, err error) {
+	if n <= 0 {
+		return []ZMember{}, nil
+	}
+
+	if members, err = tsc.ZRange(sk, -n, -1); err != nil {
+		return
+	}
+	for i, j := 0, len(members)-1; i < j; i, j = i+1, j-1 {
+		members[i], members[j] = members[j], members[i]
+	}
+	return
+}
+
+// Follows a member key to its ranks key, returning the exact score held in
+// the ranks segment.
+func (tsc *tsClient) zsetRank(memberSk StoreKey) (rankSk StoreKey, score float64, found bool, err error) {
+	hasLink, rv, err := tsc.GetRelationshipValue(memberSk, 0)
+	if err != nil || !hasLink || rv == nil || len(rv.Sk.Tokens) == 0 {
+		return
+	}
+
+	zm, valid := zsetMemberFromRank(rv.Sk.Tokens[len(rv.Sk.Tokens)-1])
+	if !valid {
+		return
+	}
+	return rv.Sk, zm.Score, true, nil
+}
+
+// Makes the ranks segment of a member. The float64 bits are adjusted so that
+// they sort in numeric order: negative numbers have all bits flipped, and
+// positive numbers have the sign bit set.
+func zsetRankSegment(score float64, member string) SubPathSegment {
+	bits := math.Float64bits(score)
+	if bits&(1<<63) != 0 {
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+
+	return SubPathSegment(fmt.Sprintf("%016X%s", bits, member))
+}
+
+// Parses a ranks segment made by zsetRankSegment.
+func zsetMemberFromRank(seg TokenSegment) (zm ZMember, valid bool) {
+	if len(seg) < 16 {
+		return
+	}
+
+	bits, err := strconv.ParseUint(string(seg[:16]), 16, 64)
+	if err != nil {
+		return
+	}
+	if bits&(1<<63) != 0 {
+		bits &^= 1 << 63
+	} else {
+		bits = ^bits
+	}
+
+	return ZMember{Member: string(seg[16:]), Score: math.Float64frombits(bits)}, true
+}